@@ -1,43 +1,854 @@
 package main
 
-import bufferpool "basis/util/bufferpool"
-import postinglist "basis/match/postinglist"
+import "fmt"
+import "log"
+import "os"
+import "path"
+import "sort"
+import "strconv"
+import "sync"
 import match "basis/match"
+import bitset "basis/match/bitset"
+import analysis "basis/index/analysis"
+import builder "basis/index/builder"
+import commit "basis/index/commit"
+import keystore "basis/index/keystore"
+import replication "basis/index/replication"
+import segment "basis/index/segment"
+import wal "basis/index/wal"
+import cache "basis/search/cache"
+import collector "basis/search/collector"
+import facet "basis/search/facet"
+import query "basis/search/query"
 
-const initialSize = 100
+// Docs that haven't been flushed to a segment yet are searched as a
+// segment of this name, rebuilt in memory on every change
+const memoryName = "memory"
 
+// The commit point Meta key the next DocId is kept under, so DocIds of
+// docs that were deleted before they were flushed aren't reused
+const nextDocKey = "next-doc"
+const walDir = "wal"
+
+const filterCacheSize = 64 << 20
+const resultCacheSize = 16 << 20
+
+type Options struct {
+	// Flush added docs to a segment once this many are in memory
+	FlushDocs int
+	WAL       wal.Options
+	// Splits text fields into terms, when they're added and when
+	// they're searched
+	Analyzer analysis.Analyzer
+}
+
+var DefaultOptions = Options{1000, wal.DefaultOptions, analysis.Default}
+
+// An index directory holding one sub-directory per segment. Added docs
+// are logged, then kept in memory until enough of them are flushed
+// into a new segment; deletes mark docs in the segment that holds
+// them. A flush commits the new segment and every segment's deletions
+// together (see basis/index/commit), so a crash leaves the last commit
+// to open, and replaying the log restores what came after it.
 type Index struct {
-	index map[string] *bufferpool.Reference
-	postingLists *bufferpool.BufferPool
+	lock    sync.RWMutex
+	options Options
+
+	dir      string
+	sources  []query.Source
+	segments map[string]*segment.Segment
+
+	log     *wal.Log
+	pending map[match.DocId]*builder.Document
+	memory  *segment.Segment
+	changed bool
+	// Which segment holds each doc
+	owners map[match.DocId]string
+	// DocIds of the docs added by key
+	keys *keystore.KeyStore
+
+	committed *commit.Point
+	// Segments with deletions since the last commit
+	dirty map[string]bool
+
+	generation  uint64
+	nextSegment int
+
+	filters  *cache.FilterCache
+	results  *cache.ResultCache
+	searcher *query.Cached
+
+	// Serves each commit to replicas
+	primary *replication.Primary
+}
+
+func newIndex(dir string, options Options) *Index {
+	filters := cache.NewFilterCache(filterCacheSize)
+	results := cache.NewResultCache(resultCacheSize, 0)
+	executor := query.NewExecutor([]query.Source{}, 0, filters)
+
+	return &Index{
+		sync.RWMutex{}, options, dir, []query.Source{}, make(map[string]*segment.Segment),
+		nil, make(map[match.DocId]*builder.Document), nil, false,
+		make(map[match.DocId]string), keystore.New(), &commit.Point{0, []commit.Segment{}, make(map[string]string)}, make(map[string]bool),
+		0, 0, filters, results, query.NewCached(executor, results),
+		replication.NewPrimary(dir),
+	}
+}
+
+func CreateIndex(dir string, options Options) (*Index, os.Error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	i := newIndex(dir, options)
+	if err := i.openLog(); err != nil {
+		return nil, err
+	}
+
+	return i, nil
+}
+
+// Must hold the write lock
+func (i *Index) openLog() (err os.Error) {
+	i.log, err = wal.Open(path.Join(i.dir, walDir), i.options.WAL, func(r *wal.Record) os.Error {
+		switch r.Op {
+		case wal.OpAdd:
+			return i.apply(r.Docs)
+		case wal.OpDelete:
+			_, err := i.delete(r.Doc)
+			return err
+		}
+
+		return os.NewError(fmt.Sprintf("unknown op %d in the log", r.Op))
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return i.refresh()
+}
+
+func segmentNumber(name string) int {
+	n := 0
+	fmt.Sscanf(name[len(commit.SegmentPrefix):], "%d", &n)
+
+	return n
+}
+
+// Opens the last commit. Whatever a flush that didn't finish left
+// behind is deleted first. An index from before commit points has its
+// segments committed as they are.
+func OpenIndex(dir string, options Options) (*Index, os.Error) {
+	committed, err := commit.Adopt(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	removed, err := commit.Recover(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range removed {
+		log.Println("removed", name, "left by an unfinished commit")
+	}
+
+	i := newIndex(dir, options)
+	i.committed = committed
+
+	if next, found := committed.Meta[nextDocKey]; found {
+		n, err := strconv.Atoui64(next)
+		if err != nil {
+			return nil, os.NewError(fmt.Sprintf("bad %s in the commit point: %s", nextDocKey, err))
+		}
+
+		if n > 0 {
+			i.keys.Reserve(match.DocId(n - 1))
+		}
+	}
+
+	for _, ref := range committed.Segments {
+		seg, err := commit.OpenSegment(dir, ref)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = i.addSegment(ref.Name, seg); err != nil {
+			return nil, err
+		}
+
+		if n := segmentNumber(ref.Name); n >= i.nextSegment {
+			i.nextSegment = n + 1
+		}
+	}
+
+	i.publish()
+
+	if committed.Generation > 0 {
+		if err = i.primary.Publish(committed); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = i.openLog(); err != nil {
+		return nil, err
+	}
+
+	return i, nil
+}
+
+// Must hold the write lock
+func (i *Index) addSegment(name string, seg *segment.Segment) os.Error {
+	i.sources = append(i.sources, query.Source{name, seg})
+	i.segments[name] = seg
+
+	for _, doc := range seg.Docs {
+		// Deleted docs' DocIds still can't be reused
+		i.keys.Reserve(doc)
+
+		if local, _ := localId(seg, doc); seg.IsDeleted(local) {
+			continue
+		}
+
+		// Later segments replace earlier copies of a doc
+		if owner, found := i.owners[doc]; found {
+			if _, err := i.deleteFrom(owner, doc); err != nil {
+				return err
+			}
+		}
+
+		i.owners[doc] = name
+
+		key, found := seg.Keys[doc]
+		if !found {
+			continue
+		}
+
+		// and the doc a key had before
+		if old, found := i.keys.Lookup(key); found && old != doc {
+			if _, err := i.delete(old); err != nil {
+				return err
+			}
+		}
+
+		i.keys.Set(key, doc)
+	}
+
+	return nil
+}
+
+// Must hold the write lock. Rebuild the memory segment if the pending
+// docs changed, then publish.
+func (i *Index) refresh() os.Error {
+	if !i.changed {
+		return nil
+	}
+
+	i.memory = nil
+	i.segments[memoryName] = nil, false
+
+	if len(i.pending) > 0 {
+		docs := make([]*builder.Document, 0, len(i.pending))
+		for _, doc := range i.pending {
+			docs = append(docs, doc)
+		}
+
+		seg, err := build(docs, i.options.Analyzer)
+		if err != nil {
+			return err
+		}
+
+		i.memory = seg
+		i.segments[memoryName] = seg
+	}
+
+	i.changed = false
+	i.publish()
+
+	return nil
+}
+
+func build(docs []*builder.Document, analyzer analysis.Analyzer) (*segment.Segment, os.Error) {
+	sort.Sort(byId(docs))
+
+	options := builder.DefaultOptions
+	options.Analyzer = analyzer
+
+	b := builder.New(options)
+	for _, doc := range docs {
+		if err := b.Add(doc); err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Finish()
+}
+
+// Must hold the write lock. Swap in an executor over the current
+// segments, which invalidates the cached results, and the cached
+// filters of segments that were flushed, merged away or rebuilt (as
+// the memory segment is, under the same name).
+func (i *Index) publish() {
+	i.generation++
+
+	sources := make([]query.Source, len(i.sources), len(i.sources)+1)
+	copy(sources, i.sources)
+
+	if i.memory != nil {
+		sources = append(sources, query.Source{memoryName, i.memory})
+	}
+
+	i.searcher.SetExecutor(i.searcher.Executor().Replace(sources, i.generation))
+}
+
+// The position of a doc (by the id it was added with) in a segment
+func localId(seg *segment.Segment, doc match.DocId) (match.DocId, bool) {
+	if seg.Remapped {
+		return seg.DocMap.ToNew(doc)
+	}
+
+	return doc, true
+}
+
+// Must hold the write lock
+func (i *Index) deleteFrom(name string, doc match.DocId) (bool, os.Error) {
+	if name == memoryName {
+		if _, found := i.pending[doc]; !found {
+			return false, nil
+		}
+
+		i.pending[doc] = nil, false
+		i.changed = true
+
+		return true, nil
+	}
+
+	seg := i.segments[name]
+
+	local, found := localId(seg, doc)
+	if !found {
+		return false, nil
+	}
+
+	deleted, err := seg.Delete(local)
+	if err != nil || !deleted {
+		return false, err
+	}
+
+	// Written by the next commit; until then the log has the delete
+	i.dirty[name] = true
+	return true, nil
+}
+
+// Index a batch of docs. Docs that are already in the index, by Id or
+// by Key, are replaced. Docs with a Key are given new DocIds.
+func (i *Index) Add(docs []*builder.Document) os.Error {
+	if len(docs) == 0 {
+		return nil
+	}
+
+	// Once, before taking the lock: the log and the memory segment
+	// keep the tokens, so rebuilds and replays don't analyze again
+	if err := builder.Analyze(docs, i.options.Analyzer); err != nil {
+		return err
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	keys := make(map[string]bool)
+	for _, doc := range docs {
+		if doc.Key == "" {
+			continue
+		}
+
+		if keys[doc.Key] {
+			return os.NewError(fmt.Sprintf("key %q is in the batch twice", doc.Key))
+		}
+
+		keys[doc.Key] = true
+		doc.Id = i.keys.Allocate()
+	}
+
+	sort.Sort(byId(docs))
+	for idx := 1; idx < len(docs); idx++ {
+		if docs[idx-1].Id == docs[idx].Id {
+			return os.NewError(fmt.Sprintf("doc %d is in the batch twice", docs[idx].Id))
+		}
+	}
+
+	// Logged before anything changes, so the docs survive a crash once
+	// the log has them
+	if _, err := i.log.Append(wal.Add(docs)); err != nil {
+		return err
+	}
+
+	if err := i.apply(docs); err != nil {
+		return err
+	}
+
+	if len(i.pending) >= i.options.FlushDocs {
+		return i.flush()
+	}
+
+	return i.refresh()
+}
+
+// Must hold the write lock. Put docs in memory, replacing older copies.
+func (i *Index) apply(docs []*builder.Document) os.Error {
+	for _, doc := range docs {
+		if owner, found := i.owners[doc.Id]; found {
+			if _, err := i.deleteFrom(owner, doc.Id); err != nil {
+				return err
+			}
+		}
+
+		if doc.Key != "" {
+			if old, found := i.keys.Lookup(doc.Key); found && old != doc.Id {
+				if _, err := i.delete(old); err != nil {
+					return err
+				}
+			}
+
+			i.keys.Set(doc.Key, doc.Id)
+		}
+
+		i.keys.Reserve(doc.Id)
+		i.owners[doc.Id] = memoryName
+		i.pending[doc.Id] = doc
+		i.changed = true
+	}
+
+	return nil
+}
+
+// Must hold the write lock. Write the docs in memory to a new segment,
+// commit it with every deletion, and checkpoint the log.
+func (i *Index) flush() os.Error {
+	if err := i.refresh(); err != nil {
+		return err
+	}
+
+	seq := i.log.Seq()
+	if len(i.pending) == 0 {
+		return i.commit(seq)
+	}
+
+	docs := make([]*builder.Document, 0, len(i.pending))
+	for _, doc := range i.pending {
+		docs = append(docs, doc)
+	}
+
+	seg, err := build(docs, i.options.Analyzer)
+	if err != nil {
+		return err
+	}
+
+	name := commit.SegmentName(i.nextSegment)
+	dir := path.Join(i.dir, name)
+
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if err = seg.Write(dir); err != nil {
+		return err
+	}
+
+	if err = commit.SyncDir(dir); err != nil {
+		return err
+	}
+
+	i.nextSegment++
+
+	// Takes the docs over from the memory segment
+	if err = i.addSegment(name, seg); err != nil {
+		return err
+	}
+
+	if err = i.refresh(); err != nil {
+		return err
+	}
+
+	return i.commit(seq)
+}
+
+// Must hold the write lock. Write the deletions of the dirty segments
+// to new files, then replace the commit point with one naming them and
+// any new segments. The log is checkpointed at seq once that's done.
+func (i *Index) commit(seq uint64) os.Error {
+	previous := make(map[string]string)
+	for _, ref := range i.committed.Segments {
+		previous[ref.Name] = ref.Deleted
+	}
+
+	meta := make(map[string]string)
+	for key, value := range i.committed.Meta {
+		meta[key] = value
+	}
+
+	meta[nextDocKey] = strconv.Uitoa64(uint64(i.keys.Next))
+
+	changed := len(i.committed.Segments) != len(i.sources) || meta[nextDocKey] != i.committed.Meta[nextDocKey]
+	next := &commit.Point{i.committed.Generation + 1, make([]commit.Segment, len(i.sources)), meta}
+
+	for idx, src := range i.sources {
+		ref := commit.Segment{src.Name, previous[src.Name]}
+
+		if i.dirty[src.Name] {
+			dir := path.Join(i.dir, src.Name)
+			ref.Deleted = commit.DeletedName(next.Generation)
+
+			if err := src.Segment.WriteDeletedTo(dir, ref.Deleted); err != nil {
+				return err
+			}
+
+			if err := commit.SyncDir(dir); err != nil {
+				return err
+			}
+
+			changed = true
+		}
+
+		next.Segments[idx] = ref
+	}
+
+	if changed {
+		if err := commit.Write(i.dir, next); err != nil {
+			return err
+		}
+
+		i.committed = next
+		i.dirty = make(map[string]bool)
+
+		// The deletions files the commit replaced
+		for _, ref := range next.Segments {
+			if old := previous[ref.Name]; old != "" && old != ref.Deleted {
+				os.Remove(path.Join(i.dir, ref.Name, old))
+			}
+		}
+
+		// Replicas keep their last commit until the next publish works
+		if err := i.primary.Publish(next); err != nil {
+			log.Println("couldn't publish commit", next.Generation, "to replicas:", err)
+		}
+	}
+
+	return i.log.Checkpoint(seq)
+}
+
+// Flush the docs in memory now
+func (i *Index) Flush() os.Error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	return i.flush()
 }
 
-func NewIndex() *Index {
-	return &Index{make(map[string] *bufferpool.Reference), bufferpool.New(1024*1024)}
+type byId []*builder.Document
+
+func (d byId) Len() int           { return len(d) }
+func (d byId) Less(i, j int) bool { return d[i].Id < d[j].Id }
+func (d byId) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// Returns false if the doc isn't in the index
+func (i *Index) Delete(doc match.DocId) (bool, os.Error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	return i.logDelete(doc)
+}
+
+func (i *Index) DeleteKey(key string) (bool, os.Error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	doc, found := i.keys.Lookup(key)
+	if !found {
+		return false, nil
+	}
+
+	return i.logDelete(doc)
+}
+
+// Must hold the write lock
+func (i *Index) logDelete(doc match.DocId) (bool, os.Error) {
+	if _, found := i.owners[doc]; !found {
+		return false, nil
+	}
+
+	if _, err := i.log.Append(wal.Delete(doc)); err != nil {
+		return false, err
+	}
+
+	deleted, err := i.delete(doc)
+	if err != nil {
+		return false, err
+	}
+
+	if i.changed {
+		return deleted, i.refresh()
+	}
+
+	i.publish()
+	return deleted, nil
 }
 
-func (i *Index) Lookup(word string) match.MatchIterator {
-	ref := i.index[word]
+// Must hold the write lock
+func (i *Index) delete(doc match.DocId) (bool, os.Error) {
+	owner, found := i.owners[doc]
+	if !found {
+		return false, nil
+	}
 
-	if ref == nil {
-		panic("word not found")
+	deleted, err := i.deleteFrom(owner, doc)
+	if err != nil {
+		return false, err
 	}
 
-	allocation := i.postingLists.Find(*ref)
-	pl := postinglist.FromBytes(allocation.Raw)
+	i.owners[doc] = "", false
+	if key, found := i.keys.Key(doc); found {
+		i.keys.Delete(key)
+	}
 
-	return postinglist.NewIter(pl)
+	return deleted, nil
 }
 
-func (i *Index) Replace(word string, pl *postinglist.PostingList) {
-	if i.index[word] != nil {
-		alloc := i.postingLists.Find(*i.index[word])
-		alloc.Free()
-		i.index[word] = nil
+type Hit struct {
+	Id     match.DocId
+	Key    string
+	Score  float64
+	Fields map[string]string
+
+	// For sorted searches, where the page after this hit starts
+	Cursor *collector.Cursor
+}
+
+// The segments an executor searched, by name
+func segmentsOf(executor *query.Executor) map[string]*segment.Segment {
+	segments := make(map[string]*segment.Segment)
+	for _, src := range executor.Sources() {
+		segments[src.Name] = src.Segment
 	}
 
-	size := uint64(pl.Size())
-	dst := i.postingLists.Alloc(size)
+	return segments
+}
+
+// Must hold the read lock. The hits must be from segments.
+func (i *Index) resolve(segments map[string]*segment.Segment, hits []query.Hit) ([]Hit, os.Error) {
+	resolved := make([]Hit, len(hits))
+
+	for idx, hit := range hits {
+		seg := segments[hit.Segment]
+
+		fields, err := seg.Document(hit.Doc)
+		if err != nil {
+			return nil, err
+		}
+
+		doc := seg.OriginalId(hit.Doc)
+		key, _ := i.keys.Key(doc)
+
+		resolved[idx] = Hit{doc, key, hit.Score, fields, nil}
+	}
+
+	return resolved, nil
+}
+
+func (i *Index) Search(q *query.Query) (hits []Hit, total int, err os.Error) {
+	// Deletes write to the segments' bitsets
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	results, err := i.searcher.Search(q, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if hits, err = i.resolve(i.segments, results.Hits); err != nil {
+		return nil, 0, err
+	}
+
+	return hits, results.Total, nil
+}
+
+// The first q.K hits in the order of fields' doc values, after the
+// cursor of the previous page's last hit if it's given. Sorted
+// searches bypass the result cache, and hits have no score.
+func (i *Index) SearchSorted(q *query.Query, fields []collector.SortField, after *collector.Cursor) ([]Hit, int, os.Error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	executor := i.searcher.Executor()
+
+	results, err := executor.Sorted(q, fields, q.K, after)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	hits := make([]query.Hit, len(results.Hits))
+	for idx, hit := range results.Hits {
+		hits[idx] = query.Hit{hit.Segment, hit.Doc, 0}
+	}
+
+	resolved, err := i.resolve(segmentsOf(executor), hits)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for idx, hit := range results.Hits {
+		resolved[idx].Cursor = hit.Cursor
+	}
+
+	return resolved, results.Total, nil
+}
+
+// The counts of each requested facet among q's matches (see
+// query.Executor.Facets)
+func (i *Index) Facets(q *query.Query, requests []query.FacetRequest, n int) (map[string][]facet.Count, os.Error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	return i.searcher.Executor().Facets(q, requests, n)
+}
+
+// Every match of a query, unscored, a segment at a time: only the
+// matches of the segment being read are held, as a bitset, and fields
+// are fetched a page at a time. The segments are the ones searched
+// when the export started; flushes and refreshes since don't change
+// what it returns.
+type Export struct {
+	index    *Index
+	executor *query.Executor
+	segments map[string]*segment.Segment
+	q        *query.Query
+
+	// The source after the one being read, and the matches in that
+	// one not returned yet
+	next    int
+	source  string
+	matches *bitset.BitSetIterator
+
+	Total int
+}
+
+// Counts matches without keeping them
+type discard struct{}
+
+func (discard) Add(match.DocId) os.Error {
+	return nil
+}
+
+// q.K is ignored. Exports bypass the result cache.
+func (i *Index) Export(q *query.Query) (*Export, os.Error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	executor := i.searcher.Executor()
+	e := &Export{i, executor, segmentsOf(executor), q, 0, "", nil, 0}
+
+	for idx := range executor.Sources() {
+		n, err := executor.Each(q, idx, discard{})
+		if err != nil {
+			return nil, err
+		}
+
+		e.Total += n
+	}
+
+	if err := e.advance(); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// Must hold the read lock. Reads the following sources until one has
+// matches left, or there are no more.
+func (e *Export) advance() os.Error {
+	sources := e.executor.Sources()
+
+	for (e.matches == nil || e.matches.Finished()) && e.next < len(sources) {
+		src := sources[e.next]
+		bits := bitset.New(uint(src.Segment.MaxId) + 1)
+
+		if _, err := e.executor.Each(e.q, e.next, bits); err != nil {
+			return err
+		}
+
+		e.next++
+		e.source, e.matches = src.Name, bitset.NewIter(bits)
+	}
+
+	return nil
+}
+
+// Up to max more hits, or none once the export is done
+func (e *Export) Next(max int) ([]Hit, os.Error) {
+	e.index.lock.RLock()
+	defer e.index.lock.RUnlock()
+
+	hits := []query.Hit{}
+	for len(hits) < max && !e.Done() {
+		hits = append(hits, query.Hit{e.source, e.matches.Current(), 0})
+		e.matches.Next()
+
+		if err := e.advance(); err != nil {
+			return nil, err
+		}
+	}
+
+	return e.index.resolve(e.segments, hits)
+}
+
+func (e *Export) Done() bool {
+	return e.matches == nil || e.matches.Finished()
+}
+
+type IndexStats struct {
+	Generation uint64
+	Segments   int
+	Docs       int
+	Deleted    int
+	// Docs in memory, waiting to be flushed
+	Pending int
+
+	Filters cache.FilterStats
+	Results cache.ResultStats
+}
+
+func (i *Index) Stats() IndexStats {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	stats := IndexStats{i.generation, len(i.sources), len(i.pending), 0, len(i.pending), i.filters.Stats(), i.results.Stats()}
+	for _, src := range i.sources {
+		stats.Docs += src.Segment.DocCount - src.Segment.DeletedCount
+		stats.Deleted += src.Segment.DeletedCount
+	}
+
+	return stats
+}
+
+func (i *Index) Close() os.Error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if err := i.flush(); err != nil {
+		return err
+	}
+
+	if err := i.log.Close(); err != nil {
+		return err
+	}
+
+	for _, src := range i.sources {
+		if err := src.Segment.Close(); err != nil {
+			return err
+		}
+	}
 
-	pl.ToBytes(dst.Raw)
-	i.index[word] = &dst.Ref
+	return nil
 }
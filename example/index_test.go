@@ -0,0 +1,641 @@
+package main
+
+import "fmt"
+import "http"
+import "io/ioutil"
+import "os"
+import "path"
+import "testing"
+import match "basis/match"
+import commit "basis/index/commit"
+import collector "basis/search/collector"
+import query "basis/search/query"
+
+func searchCount(t *testing.T, index *Index, text string) int {
+	q, err := (&SearchRequest{text, 0, "", nil, nil, "", nil, nil, nil, nil, nil, nil, nil, nil}).Query(index.options.Analyzer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, total, err := index.Search(q)
+	if err != nil {
+		t.Fatalf("Search(%s) = %s", text, err)
+	}
+
+	return total
+}
+
+func TestReplayLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basis-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := DefaultOptions
+	options.FlushDocs = 3
+
+	index, err := CreateIndex(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	add := func(key, text string) {
+		doc := &DocRequest{0, key, map[string]string{"body": text}, nil, nil, nil, nil, nil, nil, nil, nil}
+		docs, _ := documents([]*DocRequest{doc})
+
+		if err := index.Add(docs); err != nil {
+			t.Fatalf("Add(%s) = %s", key, err)
+		}
+	}
+
+	// The third add flushes a segment
+	add("a", "flushed")
+	add("b", "flushed")
+	add("c", "flushed")
+	add("d", "logged")
+	index.DeleteKey("a")
+
+	if stats := index.Stats(); stats.Segments != 1 || stats.Pending != 1 {
+		t.Errorf("Stats() = %d segments, %d pending, want 1 and 1", stats.Segments, stats.Pending)
+	}
+
+	// Reopen without closing, as after a crash
+	index, err = OpenIndex(dir, options)
+	if err != nil {
+		t.Fatalf("OpenIndex() = %s", err)
+	}
+
+	if flushed, logged := searchCount(t, index, "flushed"), searchCount(t, index, "logged"); flushed != 2 || logged != 1 {
+		t.Errorf("after replay found %d flushed and %d logged, want 2 and 1", flushed, logged)
+	}
+
+	if err = index.Close(); err != nil {
+		t.Fatalf("Close() = %s", err)
+	}
+
+	index, err = OpenIndex(dir, options)
+	if err != nil {
+		t.Fatalf("OpenIndex() = %s", err)
+	}
+	defer index.Close()
+
+	if stats := index.Stats(); stats.Segments != 2 || stats.Pending != 0 || stats.Docs != 3 {
+		t.Errorf("Stats() after close = %d segments, %d pending, %d docs, want 2, 0, 3", stats.Segments, stats.Pending, stats.Docs)
+	}
+}
+
+func TestUnfinishedCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basis-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	index, err := CreateIndex(dir, DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc := &DocRequest{0, "a", map[string]string{"body": "committed"}, nil, nil, nil, nil, nil, nil, nil, nil}
+	docs, _ := documents([]*DocRequest{doc})
+	if err = index.Add(docs); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = index.Close(); err != nil {
+		t.Fatalf("Close() = %s", err)
+	}
+
+	// What a flush leaves if it crashes before renaming the commit point
+	orphan := path.Join(dir, commit.SegmentName(7))
+	if err = os.MkdirAll(orphan, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(path.Join(dir, "COMMIT.tmp"), []byte("half"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	index, err = OpenIndex(dir, DefaultOptions)
+	if err != nil {
+		t.Fatalf("OpenIndex() = %s", err)
+	}
+	defer index.Close()
+
+	if n := searchCount(t, index, "committed"); n != 1 {
+		t.Errorf("found %d committed docs, want 1", n)
+	}
+
+	for _, name := range []string{orphan, path.Join(dir, "COMMIT.tmp")} {
+		if _, err = os.Stat(name); err == nil {
+			t.Errorf("%s wasn't removed", name)
+		}
+	}
+}
+
+// An index written before commit points: bare segment directories
+func TestOpenUncommitted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basis-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for n, text := range []string{"first", "second"} {
+		doc := &DocRequest{uint64(n + 1), "", map[string]string{"body": text}, nil, nil, nil, nil, nil, nil, nil, nil}
+		docs, _ := documents([]*DocRequest{doc})
+
+		seg, err := build(docs, DefaultOptions.Analyzer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		segDir := path.Join(dir, commit.SegmentName(n))
+		if err = os.MkdirAll(segDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = seg.Write(segDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for round := 0; round < 2; round++ {
+		index, err := OpenIndex(dir, DefaultOptions)
+		if err != nil {
+			t.Fatalf("OpenIndex() = %s", err)
+		}
+
+		if first, second := searchCount(t, index, "first"), searchCount(t, index, "second"); first != 1 || second != 1 {
+			t.Errorf("open %d found %d and %d docs, want 1 and 1", round, first, second)
+		}
+
+		if err = index.Close(); err != nil {
+			t.Fatalf("Close() = %s", err)
+		}
+	}
+}
+
+func TestFilterAfterAdd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basis-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	index, err := CreateIndex(dir, DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	ranges := []query.Range{query.Range{"year", 1990, 2010}}
+	count := func() int {
+		q, err := (&SearchRequest{"film", 0, "", nil, nil, "", ranges, nil, nil, nil, nil, nil, nil, nil}).Query(index.options.Analyzer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, total, err := index.Search(q)
+		if err != nil {
+			t.Fatalf("Search() = %s", err)
+		}
+
+		return total
+	}
+
+	for n, year := range []int64{2000, 2005} {
+		doc := &DocRequest{uint64(n + 1), "", map[string]string{"body": "film"}, nil, nil, map[string]int64{"year": year}, nil, nil, nil, nil, nil}
+		docs, _ := documents([]*DocRequest{doc})
+
+		if err := index.Add(docs); err != nil {
+			t.Fatalf("Add() = %s", err)
+		}
+
+		// Both docs are in the rebuilt memory segment
+		if total := count(); total != n+1 {
+			t.Errorf("after %d adds, found %d docs, want %d", n+1, total, n+1)
+		}
+	}
+}
+
+func TestExportAfterFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basis-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	index, err := CreateIndex(dir, DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	add := func(id uint64, text string) {
+		doc := &DocRequest{id, "", map[string]string{"body": text}, map[string]string{"body": text}, nil, nil, nil, nil, nil, nil, nil}
+		docs, _ := documents([]*DocRequest{doc})
+
+		if err := index.Add(docs); err != nil {
+			t.Fatalf("Add(%d) = %s", id, err)
+		}
+	}
+
+	add(1, "film one")
+	add(2, "film two")
+	add(3, "film three")
+
+	q, err := (&SearchRequest{"film", 0, "", nil, nil, "", nil, nil, nil, nil, nil, nil, nil, nil}).Query(index.options.Analyzer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	export, err := index.Export(q)
+	if err != nil {
+		t.Fatalf("Export() = %s", err)
+	}
+
+	seen := make(map[uint64]bool)
+	next := func() {
+		hits, err := export.Next(1)
+		if err != nil {
+			t.Fatalf("Next() = %s", err)
+		}
+
+		if len(hits) != 1 || hits[0].Fields["body"] == "" {
+			t.Fatalf("Next() = %v, want a hit with its fields", hits)
+		}
+
+		seen[uint64(hits[0].Id)] = true
+	}
+
+	// The memory segment is rebuilt, then flushed away
+	next()
+	add(4, "other")
+	next()
+	if err = index.Flush(); err != nil {
+		t.Fatalf("Flush() = %s", err)
+	}
+	next()
+
+	if !export.Done() || len(seen) != 3 || seen[4] {
+		t.Errorf("exported %v, want docs 1 to 3", seen)
+	}
+}
+
+func TestExportSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basis-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	index, err := CreateIndex(dir, DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	// Three matches, a segment with none, then two in memory
+	texts := []string{"film", "film", "film", "other", "film", "film"}
+	for idx, text := range texts {
+		doc := &DocRequest{uint64(idx + 1), "", map[string]string{"body": text}, nil, nil, nil, nil, nil, nil, nil, nil}
+		docs, _ := documents([]*DocRequest{doc})
+
+		if err := index.Add(docs); err != nil {
+			t.Fatalf("Add(%d) = %s", idx+1, err)
+		}
+
+		if idx == 2 || idx == 3 {
+			if err = index.Flush(); err != nil {
+				t.Fatalf("Flush() = %s", err)
+			}
+		}
+	}
+
+	q, err := (&SearchRequest{"film", 0, "", nil, nil, "", nil, nil, nil, nil, nil, nil, nil, nil}).Query(index.options.Analyzer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	export, err := index.Export(q)
+	if err != nil {
+		t.Fatalf("Export() = %s", err)
+	}
+
+	pages := []string{}
+	for !export.Done() {
+		hits, err := export.Next(2)
+		if err != nil {
+			t.Fatalf("Next() = %s", err)
+		}
+
+		pages = append(pages, fmt.Sprint(len(hits)))
+	}
+
+	if got := fmt.Sprint(pages); got != "[2 2 1]" || export.Total != 5 {
+		t.Errorf("export pages = %s of %d, want [2 2 1] of 5", got, export.Total)
+	}
+}
+
+func TestDocIdsNotReused(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basis-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	index, err := CreateIndex(dir, DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	add := func(key string) match.DocId {
+		doc := &DocRequest{0, key, map[string]string{"body": key}, nil, nil, nil, nil, nil, nil, nil, nil}
+		docs, _ := documents([]*DocRequest{doc})
+
+		if err := index.Add(docs); err != nil {
+			t.Fatalf("Add(%s) = %s", key, err)
+		}
+
+		id, _ := index.keys.Lookup(key)
+		return id
+	}
+
+	add("a")
+	add("b")
+	if err = index.Flush(); err != nil {
+		t.Fatalf("Flush() = %s", err)
+	}
+
+	// The last doc flushed, and one that never was
+	index.DeleteKey("b")
+	last := add("c")
+	index.DeleteKey("c")
+
+	if err = index.Close(); err != nil {
+		t.Fatalf("Close() = %s", err)
+	}
+
+	if index, err = OpenIndex(dir, DefaultOptions); err != nil {
+		t.Fatalf("OpenIndex() = %s", err)
+	}
+	defer index.Close()
+
+	if doc := add("d"); doc <= last {
+		t.Errorf("Add(d) after reopening gave DocId %d, want more than %d", doc, last)
+	}
+}
+
+func TestNumericFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basis-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	index, err := CreateIndex(dir, DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	requests := []*DocRequest{}
+	for n, day := range []string{"01", "02", "03", "04"} {
+		requests = append(requests, &DocRequest{
+			uint64(n), "", map[string]string{"body": "film"}, nil, nil, nil,
+			map[string]int64{"year": int64(1990 + 10*n)}, map[string]float64{"rating": float64(n) - 1.5},
+			map[string]string{"released": "2011-05-" + day + "T12:00:00Z"}, nil, nil,
+		})
+	}
+
+	docs, err := documents(requests)
+	if err != nil {
+		t.Fatalf("documents() = %s", err)
+	}
+
+	if err = index.Add(docs); err != nil {
+		t.Fatalf("Add() = %s", err)
+	}
+
+	filters := []struct {
+		filter NumericFilter
+		want   int
+	}{
+		{NumericFilter{"year", "int", "2000", "2020"}, 3},
+		{NumericFilter{"rating", "float", "-1", "0.5"}, 2},
+		{NumericFilter{"released", "time", "2011-05-02T00:00:00Z", "2011-05-03T12:00:00Z"}, 2},
+		{NumericFilter{"year", "float", "2000", "2020"}, 0},
+	}
+
+	for _, f := range filters {
+		q, err := (&SearchRequest{"film", 0, "", nil, nil, "", nil, []NumericFilter{f.filter}, nil, nil, nil, nil, nil, nil}).Query(index.options.Analyzer)
+		if err != nil {
+			t.Fatalf("Query(%v) = %s", f.filter, err)
+		}
+
+		if _, total, err := index.Search(q); err != nil || total != f.want {
+			t.Errorf("Search(%v) = %d, %v, want %d", f.filter, total, err, f.want)
+		}
+	}
+
+	if _, err = (&SearchRequest{"film", 0, "", nil, nil, "", nil, []NumericFilter{NumericFilter{"year", "int", "x", "1"}}, nil, nil, nil, nil, nil, nil}).Query(index.options.Analyzer); err == nil {
+		t.Errorf("Query() with a bad int = nil error")
+	}
+}
+
+func TestSortedSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basis-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	index, err := CreateIndex(dir, DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	add := func(id uint64, price int64) {
+		doc := &DocRequest{id, "", map[string]string{"body": "film"}, nil, nil, map[string]int64{"price": price}, nil, nil, nil, nil, nil}
+		docs, _ := documents([]*DocRequest{doc})
+
+		if err := index.Add(docs); err != nil {
+			t.Fatalf("Add(%d) = %s", id, err)
+		}
+	}
+
+	// Two in a segment, two in memory
+	add(1, 20)
+	add(2, 40)
+	if err = index.Flush(); err != nil {
+		t.Fatalf("Flush() = %s", err)
+	}
+	add(3, 30)
+	add(4, 10)
+
+	search := &SearchRequest{"film", 3, "", nil, nil, "", nil, nil, nil, []collector.SortField{collector.SortField{"price", true, collector.MissingLast}}, nil, nil, nil, nil}
+	q, err := search.Query(index.options.Analyzer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := search.run(index, q)
+	if err != nil {
+		t.Fatalf("run() = %s", err)
+	}
+
+	ids := []match.DocId{}
+	for _, hit := range reply.Hits {
+		ids = append(ids, hit.Id)
+	}
+
+	if got := fmt.Sprint(ids); got != "[2 3 1]" || reply.Total != 4 {
+		t.Errorf("sorted search = %s of %d, want [2 3 1] of 4", got, reply.Total)
+	}
+}
+
+func TestFacetSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	index, err := CreateIndex(dir, DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	add := func(id uint64, body, brand string, price int64) {
+		doc := &DocRequest{id, "", map[string]string{"body": body}, nil, map[string]string{"brand": brand}, map[string]int64{"price": price}, nil, nil, nil, nil, nil}
+		docs, _ := documents([]*DocRequest{doc})
+
+		if err := index.Add(docs); err != nil {
+			t.Fatalf("Add(%d) = %s", id, err)
+		}
+	}
+
+	// Counts add up across a segment and the memory buffer
+	add(1, "film", "acme", 5)
+	add(2, "film", "zeta", 20)
+	add(3, "book", "acme", 7)
+	if err = index.Flush(); err != nil {
+		t.Fatalf("Flush() = %s", err)
+	}
+	add(4, "film", "acme", 12)
+
+	search := &SearchRequest{"film", 0, "", nil, nil, "", nil, nil, nil, nil, nil, []string{"brand", "unknown"}, nil, nil}
+	q, err := search.Query(index.options.Analyzer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := search.run(index, q)
+	if err != nil {
+		t.Fatalf("run() = %s", err)
+	}
+
+	if got := fmt.Sprint(reply.Facets["brand"]); got != "[{acme 2} {zeta 1}]" {
+		t.Errorf("brand facet = %s, want [{acme 2} {zeta 1}]", got)
+	}
+
+	if got := reply.Facets["unknown"]; len(got) != 0 {
+		t.Errorf("unknown facet = %v, want none", got)
+	}
+
+	// Films up to 15 are 1 and 4, but the price facet leaves that
+	// filter out
+	r, err := http.NewRequest("GET", "/search?q=film&range=price:0:15&facets=brand&multiselect=price&"+
+		"facetrange=price:cheap:0:10&facetrange=price:dear:10:100", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.ParseForm(); err != nil {
+		t.Fatal(err)
+	}
+
+	if search, err = parseSearch(r); err != nil {
+		t.Fatalf("parseSearch() = %s", err)
+	}
+
+	if q, err = search.Query(index.options.Analyzer); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply, err = search.run(index, q); err != nil {
+		t.Fatalf("run() = %s", err)
+	}
+
+	if got := fmt.Sprint(reply.Facets["brand"]); got != "[{acme 2}]" || reply.Total != 2 {
+		t.Errorf("brand facet = %s of %d, want [{acme 2}] of 2", got, reply.Total)
+	}
+
+	if got := fmt.Sprint(reply.Facets["price"]); got != "[{cheap 1} {dear 2}]" {
+		t.Errorf("price facet = %s, want [{cheap 1} {dear 2}]", got)
+	}
+}
+
+func TestSortedPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	index, err := CreateIndex(dir, DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	// Brands tie across segments; two segments and the memory buffer
+	brands := []string{"b", "a", "c", "a", "b", "a", "c"}
+	for idx, brand := range brands {
+		doc := &DocRequest{uint64(idx + 1), "", map[string]string{"body": "film"}, nil, map[string]string{"brand": brand}, nil, nil, nil, nil, nil, nil}
+		docs, _ := documents([]*DocRequest{doc})
+
+		if err := index.Add(docs); err != nil {
+			t.Fatalf("Add(%d) = %s", idx+1, err)
+		}
+
+		if idx == 2 || idx == 4 {
+			if err = index.Flush(); err != nil {
+				t.Fatalf("Flush() = %s", err)
+			}
+		}
+	}
+
+	search := &SearchRequest{"film", 2, "", nil, nil, "", nil, nil, nil, []collector.SortField{collector.SortField{"brand", false, collector.MissingLast}}, nil, nil, nil, nil}
+	q, err := search.Query(index.options.Analyzer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := ""
+	for pages := 0; pages < 10; pages++ {
+		reply, err := search.run(index, q)
+		if err != nil {
+			t.Fatalf("run() = %s", err)
+		}
+
+		if len(reply.Hits) == 0 {
+			break
+		}
+
+		for _, hit := range reply.Hits {
+			got += brands[hit.Id-1]
+		}
+		got += " "
+
+		search.After = reply.Hits[len(reply.Hits)-1].Cursor
+	}
+
+	if got != "aa ab bc c " {
+		t.Errorf("pages of brands = %q, want every doc once in brand order", got)
+	}
+}
@@ -1,2 +1,248 @@
 package main
 
+import "fmt"
+import "http"
+import "io/ioutil"
+import "json"
+import "os"
+import "strconv"
+import "strings"
+import "time"
+import match "basis/match"
+import builder "basis/index/builder"
+import numeric "basis/index/numeric"
+
+// A doc as it's posted to /docs. Docs with a Key are given an Id, and
+// replace the doc that had the key before. Text fields are analyzed
+// and also stored, so they come back with results.
+type DocRequest struct {
+	Id         uint64
+	Key        string
+	Fields     map[string]string
+	Stored     map[string]string
+	Values     map[string]string
+	Attributes map[string]int64
+
+	// Numeric fields, for NumericFilters. Times are RFC 3339.
+	Ints   map[string]int64
+	Floats map[string]float64
+	Times  map[string]string
+
+	Lat, Lon *float64
+}
+
+// A value of a numeric field of type "int", "float" or "time" (RFC
+// 3339), encoded as the numeric package indexes it
+func encodeNumber(kind, value string) (uint64, os.Error) {
+	switch kind {
+	case "int":
+		n, err := strconv.Atoi64(value)
+		return numeric.Int(n), err
+	case "float":
+		f, err := strconv.Atof64(value)
+		return numeric.Float(f), err
+	case "time":
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return 0, err
+		}
+
+		return numeric.Time(t), nil
+	}
+
+	return 0, os.NewError("numeric types are int, float and time")
+}
+
+func (d *DocRequest) document() (*builder.Document, os.Error) {
+	if (d.Lat == nil) != (d.Lon == nil) {
+		return nil, os.NewError(fmt.Sprintf("doc %d needs both lat and lon", d.Id))
+	}
+
+	doc := &builder.Document{
+		match.DocId(d.Id), d.Key, nil, make(map[string]string), d.Attributes, make(map[string]uint64), d.Values,
+		make(map[string]string), d.Lat != nil, 0, 0,
+	}
+
+	for field, value := range d.Ints {
+		doc.Numbers[field] = numeric.Int(value)
+	}
+
+	for field, value := range d.Floats {
+		doc.Numbers[field] = numeric.Float(value)
+	}
+
+	for field, value := range d.Times {
+		encoded, err := encodeNumber("time", value)
+		if err != nil {
+			return nil, os.NewError(fmt.Sprintf("doc %d: %s: %s", d.Id, field, err))
+		}
+
+		doc.Numbers[field] = encoded
+	}
+
+	for field, text := range d.Fields {
+		doc.Text[field] = text
+		doc.Stored[field] = text
+	}
+
+	for field, value := range d.Stored {
+		doc.Stored[field] = value
+	}
+
+	if doc.HasLocation {
+		doc.Lat, doc.Lon = *d.Lat, *d.Lon
+	}
+
+	return doc, nil
+}
+
+// Accepts a single doc or an array of them
+func decodeDocs(body []byte) ([]*DocRequest, os.Error) {
+	requests := []*DocRequest{}
+
+	if trimmed := strings.TrimSpace(string(body)); strings.HasPrefix(trimmed, "[") {
+		err := json.Unmarshal(body, &requests)
+		return requests, err
+	}
+
+	request := &DocRequest{}
+	if err := json.Unmarshal(body, request); err != nil {
+		return nil, err
+	}
+
+	return append(requests, request), nil
+}
+
+func documents(requests []*DocRequest) ([]*builder.Document, os.Error) {
+	docs := make([]*builder.Document, len(requests))
+
+	for idx, request := range requests {
+		doc, err := request.document()
+		if err != nil {
+			return nil, err
+		}
+
+		docs[idx] = doc
+	}
+
+	return docs, nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, err.String(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
+
+// POST /docs indexes docs, DELETE /docs/{id} removes one
+func docsHandler(index *Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			addDocs(index, w, r)
+		case "DELETE":
+			deleteDoc(index, w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "use POST or DELETE")
+		}
+	}
+}
+
+func addDocs(index *Index, w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/docs" {
+		writeError(w, http.StatusNotFound, "POST to /docs")
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.String())
+		return
+	}
+
+	requests, err := decodeDocs(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.String())
+		return
+	}
+
+	docs, err := documents(requests)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.String())
+		return
+	}
+
+	if err = index.Add(docs); err != nil {
+		writeError(w, http.StatusInternalServerError, err.String())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"indexed": len(docs)})
+}
+
+func deleteDoc(index *Index, w http.ResponseWriter, r *http.Request) {
+	const prefix = "/docs/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeError(w, http.StatusNotFound, "DELETE /docs/{id}")
+		return
+	}
+
+	id, err := strconv.Atoui64(r.URL.Path[len(prefix):])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.String())
+		return
+	}
+
+	deleted, err := index.Delete(match.DocId(id))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.String())
+		return
+	}
+
+	if !deleted {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no doc %d", id))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"deleted": id})
+}
+
+// DELETE /keys/{key}
+func keysHandler(index *Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const prefix = "/keys/"
+		if r.Method != "DELETE" {
+			writeError(w, http.StatusMethodNotAllowed, "use DELETE")
+			return
+		}
+
+		key, err := http.URLUnescape(r.URL.Path[len(prefix):])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.String())
+			return
+		}
+
+		deleted, err := index.DeleteKey(key)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.String())
+			return
+		}
+
+		if !deleted {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("no doc with key %q", key))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{"deleted": key})
+	}
+}
@@ -1,38 +1,195 @@
 package main
 
 import "flag"
-import "gob"
+import "fmt"
+import "http"
+import "log"
+import "net"
 import "os"
+import "os/signal"
+import "sync"
+import "syscall"
+import analysis "basis/index/analysis"
+import replication "basis/index/replication"
+import wal "basis/index/wal"
 
-var indexPath *string = flag.String("index", "", "path to the index file")
+var indexPath *string = flag.String("index", "", "path to the index directory")
 var createIndex *bool = flag.Bool("create", false, "create a new index")
+var addr *string = flag.String("addr", ":8080", "address to serve HTTP on")
+var rpcAddr *string = flag.String("rpc", "", "address to serve RPC on (off if empty)")
+var flushDocs *int = flag.Int("flush", DefaultOptions.FlushDocs, "flush added docs to a segment once this many are in memory")
+var walSync *string = flag.String("wal-sync", "always", "when to fsync the log: always, interval or never")
+var walInterval *int64 = flag.Int64("wal-interval", 100, "milliseconds between log fsyncs, with -wal-sync=interval")
+var analysisURL *string = flag.String("analysis", "", "URL of an analysis service for text fields (words are split locally if empty, or if it can't be reached)")
 
-func loadIndex() *Index {
-	var index *Index = nil
+func loadIndex() (*Index, os.Error) {
+	if *indexPath == "" {
+		return nil, os.NewError("-index is required")
+	}
+
+	options := DefaultOptions
+	options.FlushDocs = *flushDocs
+	options.WAL.Interval = *walInterval * 1e6
+
+	if *analysisURL != "" {
+		options.Analyzer = analysis.NewRemote(*analysisURL, analysis.Default)
+	}
+
+	switch *walSync {
+	case "always":
+		options.WAL.Sync = wal.SyncAlways
+	case "interval":
+		options.WAL.Sync = wal.SyncInterval
+	case "never":
+		options.WAL.Sync = wal.SyncNever
+	default:
+		return nil, os.NewError("-wal-sync must be always, interval or never")
+	}
 
 	if *createIndex {
-		index = NewIndex()
-	} else {
-		indexReader, err := os.Open(*indexPath, 0, 0)
+		return CreateIndex(*indexPath, options)
+	}
 
-		if err != nil{
-			panic(err)
-		}
+	return OpenIndex(*indexPath, options)
+}
 
-		index = new(Index)
-		err = gob.NewDecoder(indexReader).Decode(&index)
+// Passes requests through a gate, so shutdown can wait for those in
+// flight. Once it's closed, requests on connections still kept alive
+// get a 503, and the connection is closed.
+type tracker struct {
+	handler  http.Handler
+	requests *gate
+}
 
-		if err != nil{
-			panic(err)
-		}
+func (t *tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !t.requests.enter() {
+		w.Header().Set("Connection", "close")
+		writeError(w, http.StatusServiceUnavailable, errShuttingDown.String())
+		return
 	}
+	defer t.requests.leave()
+
+	t.handler.ServeHTTP(w, r)
+}
+
+var errShuttingDown = os.NewError("shutting down")
+
+// Lets calls in until it's closed, then waits for the ones that got in
+type gate struct {
+	lock    sync.Mutex
+	closed  bool
+	running sync.WaitGroup
+}
+
+func newGate() *gate {
+	return &gate{sync.Mutex{}, false, sync.WaitGroup{}}
+}
+
+// Whether a call can start. If it can, it must leave when it's done.
+func (g *gate) enter() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.closed {
+		return false
+	}
+
+	g.running.Add(1)
+	return true
+}
+
+func (g *gate) leave() {
+	g.running.Done()
+}
 
-	return index
+// Turn new calls away and wait for the running ones
+func (g *gate) close() {
+	g.lock.Lock()
+	g.closed = true
+	g.lock.Unlock()
+
+	g.running.Wait()
+}
+
+func newServer(index *Index) *tracker {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/search", searchHandler(index))
+	mux.HandleFunc("/docs", docsHandler(index))
+	mux.HandleFunc("/docs/", docsHandler(index))
+	mux.HandleFunc("/keys/", keysHandler(index))
+	mux.HandleFunc("/stats", statsHandler(index))
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.Handle("/replication/", replication.NewHandler("/replication", index.primary))
+
+	return &tracker{mux, newGate()}
+}
+
+func waitForShutdown() {
+	for sig := range signal.Incoming {
+		if unix, ok := sig.(signal.UnixSignal); ok && (unix == syscall.SIGINT || unix == syscall.SIGTERM) {
+			return
+		}
+	}
 }
 
 func main() {
 	flag.Parse()
-	index := loadIndex()
 
-	index.Lookup("foo")
+	index, err := loadIndex()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	server := newServer(index)
+	go func() {
+		// Returns once the listener is closed
+		http.Serve(listener, server)
+	}()
+
+	log.Println("serving on", listener.Addr())
+
+	var rpcListener net.Listener
+	rpcCalls := newGate()
+	if *rpcAddr != "" {
+		rpcListener, err = net.Listen("tcp", *rpcAddr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		rpcServer, err := NewRPCServer(index, rpcCalls)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		go rpcServer.Accept(rpcListener)
+		log.Println("serving RPC on", rpcListener.Addr())
+	}
+
+	waitForShutdown()
+
+	// Stop taking new requests, then let the running ones finish
+	// before the segments are closed. Requests and calls on
+	// connections that stay open are turned away.
+	log.Println("shutting down")
+	listener.Close()
+	if rpcListener != nil {
+		rpcListener.Close()
+	}
+
+	server.requests.close()
+	rpcCalls.close()
+
+	if err = index.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,32 @@
+package main
+
+import "http"
+import "http/httptest"
+import "testing"
+
+func TestTrackerShutdown(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	server := &tracker{ok, newGate()}
+
+	r, err := http.NewRequest("GET", "/healthz", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("ServeHTTP() = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// A kept-alive connection's request, after shutdown started
+	server.requests.close()
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Connection") != "close" {
+		t.Errorf("ServeHTTP() after close = %d, want %d and the connection closed", w.Code, http.StatusServiceUnavailable)
+	}
+}
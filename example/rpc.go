@@ -0,0 +1,294 @@
+package main
+
+import "fmt"
+import "os"
+import "rpc"
+import "sync"
+import "time"
+import match "basis/match"
+import coordinator "basis/search/coordinator"
+import facet "basis/search/facet"
+import query "basis/search/query"
+
+// Exports that are open at once. Clients that stop reading one should
+// CloseExport it, or it's closed once it's been idle for exportTTL.
+const maxExports = 64
+
+// Nanoseconds an export can go unread before it's closed
+const exportTTL = 5 * 60 * 1e9
+
+// The RPC side of the server; see search.proto for the API
+type SearchService struct {
+	index *Index
+	calls *gate
+
+	lock       sync.Mutex
+	exports    map[uint64]*openExport
+	nextExport uint64
+	ttl        int64
+}
+
+type openExport struct {
+	export *Export
+	// When it was last opened or read, in nanoseconds
+	used int64
+}
+
+type SearchReply struct {
+	Total int
+	Hits  []Hit
+	// For each facet the request asks for, its most common values or
+	// the counts of its ranges
+	Facets map[string][]facet.Count
+}
+
+type IndexRequest struct {
+	Docs []*DocRequest
+}
+
+type IndexReply struct {
+	Indexed int
+}
+
+// By Key if it's set, otherwise by Id
+type DeleteRequest struct {
+	Id  uint64
+	Key string
+}
+
+type DeleteReply struct {
+	Deleted bool
+}
+
+type StatsRequest struct{}
+
+type ExportReply struct {
+	Id    uint64
+	Total int
+}
+
+type ExportPage struct {
+	Id  uint64
+	Max int
+}
+
+type ExportBatch struct {
+	Hits []Hit
+	Done bool
+}
+
+// Calls go through the gate, so closing it turns new ones away and
+// waits for those running
+func NewSearchService(index *Index, calls *gate) *SearchService {
+	return &SearchService{index, calls, sync.Mutex{}, make(map[uint64]*openExport), 0, exportTTL}
+}
+
+// An rpc server with the service registered, whose calls go through
+// the gate
+func NewRPCServer(index *Index, calls *gate) (*rpc.Server, os.Error) {
+	server := rpc.NewServer()
+	if err := server.Register(NewSearchService(index, calls)); err != nil {
+		return nil, err
+	}
+
+	// So a coordinator can search this index as one of its shards
+	if err := server.Register(coordinator.NewShardService(indexShard{index, calls})); err != nil {
+		return nil, err
+	}
+
+	return server, nil
+}
+
+type indexShard struct {
+	index *Index
+	calls *gate
+}
+
+func (s indexShard) Stats(q *query.Query) (*query.Stats, os.Error) {
+	if !s.calls.enter() {
+		return nil, errShuttingDown
+	}
+	defer s.calls.leave()
+
+	s.index.lock.RLock()
+	defer s.index.lock.RUnlock()
+
+	return s.index.searcher.Executor().Stats(q), nil
+}
+
+func (s indexShard) Search(q *query.Query, global *query.Stats) (*query.Results, os.Error) {
+	if !s.calls.enter() {
+		return nil, errShuttingDown
+	}
+	defer s.calls.leave()
+
+	s.index.lock.RLock()
+	defer s.index.lock.RUnlock()
+
+	// Global stats bypass the result cache anyway
+	return coordinator.Local{s.index.searcher.Executor()}.Search(q, global)
+}
+
+func (s *SearchService) Search(args *SearchRequest, reply *SearchReply) os.Error {
+	if !s.calls.enter() {
+		return errShuttingDown
+	}
+	defer s.calls.leave()
+
+	q, err := args.Query(s.index.options.Analyzer)
+	if err != nil {
+		return err
+	}
+
+	result, err := args.run(s.index, q)
+	if err != nil {
+		return err
+	}
+
+	*reply = *result
+	return nil
+}
+
+func (s *SearchService) Index(args *IndexRequest, reply *IndexReply) os.Error {
+	if !s.calls.enter() {
+		return errShuttingDown
+	}
+	defer s.calls.leave()
+
+	docs, err := documents(args.Docs)
+	if err != nil {
+		return err
+	}
+
+	if err = s.index.Add(docs); err != nil {
+		return err
+	}
+
+	reply.Indexed = len(docs)
+	return nil
+}
+
+func (s *SearchService) Delete(args *DeleteRequest, reply *DeleteReply) (err os.Error) {
+	if !s.calls.enter() {
+		return errShuttingDown
+	}
+	defer s.calls.leave()
+
+	if args.Key != "" {
+		reply.Deleted, err = s.index.DeleteKey(args.Key)
+	} else {
+		reply.Deleted, err = s.index.Delete(match.DocId(args.Id))
+	}
+
+	return
+}
+
+func (s *SearchService) Stats(args *StatsRequest, reply *IndexStats) os.Error {
+	if !s.calls.enter() {
+		return errShuttingDown
+	}
+	defer s.calls.leave()
+
+	*reply = s.index.Stats()
+	return nil
+}
+
+// Starts streaming every match of a search. Read the hits with
+// NextExport until Done.
+func (s *SearchService) OpenExport(args *SearchRequest, reply *ExportReply) os.Error {
+	if !s.calls.enter() {
+		return errShuttingDown
+	}
+	defer s.calls.leave()
+
+	q, err := args.Query(s.index.options.Analyzer)
+	if err != nil {
+		return err
+	}
+
+	export, err := s.index.Export(q)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Nanoseconds()
+	s.expire(now)
+
+	if len(s.exports) >= maxExports {
+		return os.NewError("too many open exports")
+	}
+
+	s.nextExport++
+	s.exports[s.nextExport] = &openExport{export, now}
+
+	reply.Id, reply.Total = s.nextExport, export.Total
+	return nil
+}
+
+// Closes exports that have been idle for longer than the TTL. The
+// lock must be held.
+func (s *SearchService) expire(now int64) {
+	for id, open := range s.exports {
+		if now-open.used > s.ttl {
+			s.exports[id] = nil, false
+		}
+	}
+}
+
+func (s *SearchService) export(id uint64) (*Export, os.Error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.expire(time.Nanoseconds())
+
+	open, found := s.exports[id]
+	if !found {
+		return nil, os.NewError(fmt.Sprintf("no export %d", id))
+	}
+
+	open.used = time.Nanoseconds()
+	return open.export, nil
+}
+
+func (s *SearchService) NextExport(args *ExportPage, reply *ExportBatch) os.Error {
+	if !s.calls.enter() {
+		return errShuttingDown
+	}
+	defer s.calls.leave()
+
+	if args.Max <= 0 || args.Max > maxK {
+		return os.NewError(fmt.Sprintf("max must be between 1 and %d", maxK))
+	}
+
+	export, err := s.export(args.Id)
+	if err != nil {
+		return err
+	}
+
+	if reply.Hits, err = export.Next(args.Max); err != nil {
+		return err
+	}
+
+	if reply.Done = export.Done(); reply.Done {
+		s.drop(args.Id)
+	}
+
+	return nil
+}
+
+func (s *SearchService) drop(id uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.exports[id] = nil, false
+}
+
+func (s *SearchService) CloseExport(args *ExportPage, reply *ExportBatch) os.Error {
+	s.drop(args.Id)
+	reply.Done = true
+
+	return nil
+}
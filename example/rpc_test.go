@@ -0,0 +1,220 @@
+package main
+
+import "io/ioutil"
+import "net"
+import "os"
+import "rpc"
+import "testing"
+import "time"
+
+func newTestClient(t *testing.T) (*rpc.Client, func()) {
+	dir, err := ioutil.TempDir("", "basis-rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := CreateIndex(dir, DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewRPCServer(index, newGate())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+
+	client := rpc.NewClient(clientConn)
+	return client, func() {
+		client.Close()
+		index.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSearchService(t *testing.T) {
+	client, done := newTestClient(t)
+	defer done()
+
+	docs := &IndexRequest{[]*DocRequest{}}
+	for id := uint64(1); id <= 25; id++ {
+		text := "common"
+		if id%5 == 0 {
+			text += " rare"
+		}
+
+		docs.Docs = append(docs.Docs, &DocRequest{id, "", map[string]string{"body": text}, nil, nil, nil, nil, nil, nil, nil, nil})
+	}
+
+	indexed := &IndexReply{}
+	if err := client.Call("SearchService.Index", docs, indexed); err != nil || indexed.Indexed != 25 {
+		t.Fatalf("Index = %d, %v, want 25", indexed.Indexed, err)
+	}
+
+	results := &SearchReply{}
+	if err := client.Call("SearchService.Search", &SearchRequest{"rare", 3, "", nil, nil, "", nil, nil, nil, nil, nil, nil, nil, nil}, results); err != nil {
+		t.Fatal(err)
+	}
+
+	if results.Total != 5 || len(results.Hits) != 3 {
+		t.Errorf("Search(rare) = %d hits of %d, want 3 of 5", len(results.Hits), results.Total)
+	}
+
+	deleted := &DeleteReply{}
+	if err := client.Call("SearchService.Delete", &DeleteRequest{5, ""}, deleted); err != nil || !deleted.Deleted {
+		t.Errorf("Delete(5) = %t, %v, want true", deleted.Deleted, err)
+	}
+
+	stats := &IndexStats{}
+	if err := client.Call("SearchService.Stats", &StatsRequest{}, stats); err != nil || stats.Docs != 24 {
+		t.Errorf("Stats().Docs = %d, %v, want 24", stats.Docs, err)
+	}
+
+	export := &ExportReply{}
+	if err := client.Call("SearchService.OpenExport", &SearchRequest{"common", 0, "", nil, nil, "", nil, nil, nil, nil, nil, nil, nil, nil}, export); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[uint64]bool)
+	for {
+		batch := &ExportBatch{}
+		if err := client.Call("SearchService.NextExport", &ExportPage{export.Id, 10}, batch); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, hit := range batch.Hits {
+			seen[uint64(hit.Id)] = true
+		}
+
+		if batch.Done {
+			break
+		}
+	}
+
+	if export.Total != 24 || len(seen) != 24 || seen[5] {
+		t.Errorf("Export(common) returned %d docs of %d, want 24 without doc 5", len(seen), export.Total)
+	}
+
+	if err := client.Call("SearchService.NextExport", &ExportPage{export.Id, 10}, &ExportBatch{}); err == nil {
+		t.Errorf("NextExport on a finished export succeeded")
+	}
+}
+
+func TestKeys(t *testing.T) {
+	client, done := newTestClient(t)
+	defer done()
+
+	for _, text := range []string{"first", "second"} {
+		doc := &DocRequest{0, "doc", map[string]string{"body": text}, nil, nil, nil, nil, nil, nil, nil, nil}
+		if err := client.Call("SearchService.Index", &IndexRequest{[]*DocRequest{doc}}, &IndexReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The second version replaced the first
+	for text, want := range map[string]int{"first": 0, "second": 1} {
+		results := &SearchReply{}
+		if err := client.Call("SearchService.Search", &SearchRequest{text, 0, "", nil, nil, "", nil, nil, nil, nil, nil, nil, nil, nil}, results); err != nil {
+			t.Fatal(err)
+		}
+
+		if results.Total != want {
+			t.Errorf("Search(%s) found %d, want %d", text, results.Total, want)
+		} else if want == 1 && results.Hits[0].Key != "doc" {
+			t.Errorf("Search(%s) hit key = %q, want doc", text, results.Hits[0].Key)
+		}
+	}
+
+	deleted := &DeleteReply{}
+	if err := client.Call("SearchService.Delete", &DeleteRequest{0, "doc"}, deleted); err != nil || !deleted.Deleted {
+		t.Errorf("Delete(doc) = %t, %v, want true", deleted.Deleted, err)
+	}
+}
+
+func TestExportExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basis-rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	index, err := CreateIndex(dir, DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	service := NewSearchService(index, newGate())
+	search := &SearchRequest{"common", 0, "", nil, nil, "", nil, nil, nil, nil, nil, nil, nil, nil}
+
+	first := &ExportReply{}
+	for n := 0; n < maxExports; n++ {
+		if err := service.OpenExport(search, first); err != nil {
+			t.Fatalf("OpenExport() %d = %s", n, err)
+		}
+	}
+
+	if err := service.OpenExport(search, &ExportReply{}); err == nil {
+		t.Fatalf("OpenExport() past %d open exports succeeded", maxExports)
+	}
+
+	// Abandoned exports make room once they've been idle for the TTL
+	service.ttl = 1
+	time.Sleep(1e6)
+
+	if err := service.OpenExport(search, &ExportReply{}); err != nil {
+		t.Fatalf("OpenExport() after the TTL = %s", err)
+	}
+
+	if err := service.NextExport(&ExportPage{first.Id, 10}, &ExportBatch{}); err == nil {
+		t.Errorf("NextExport() on an expired export succeeded")
+	}
+}
+
+func TestServiceShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basis-rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	index, err := CreateIndex(dir, DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	calls := newGate()
+	service := NewSearchService(index, calls)
+
+	// A call that's running holds up the close
+	if !calls.enter() {
+		t.Fatalf("enter() on an open gate = false")
+	}
+
+	closed := make(chan bool)
+	go func() {
+		calls.close()
+		closed <- true
+	}()
+
+	stats := &IndexStats{}
+	for service.Stats(&StatsRequest{}, stats) == nil {
+		time.Sleep(1e6)
+	}
+
+	select {
+	case <-closed:
+		t.Fatalf("close() returned with a call running")
+	default:
+	}
+
+	calls.leave()
+	<-closed
+
+	if err = service.Stats(&StatsRequest{}, stats); err != errShuttingDown {
+		t.Errorf("Stats() after close = %v, want %s", err, errShuttingDown)
+	}
+}
@@ -1,2 +1,433 @@
 package main
 
+import "fmt"
+import "http"
+import "json"
+import "os"
+import "strconv"
+import "strings"
+import analysis "basis/index/analysis"
+import collector "basis/search/collector"
+import facet "basis/search/facet"
+import query "basis/search/query"
+
+// Bare terms in q search this field, unless Fields are given
+const defaultField = "body"
+const defaultK = 10
+const maxK = 1000
+
+// Values returned per facet
+const facetSize = 10
+
+// A search, as it arrives over HTTP or RPC
+type SearchRequest struct {
+	// Terms, either bare or field:term
+	Q string
+	// How many hits to return (0 for the default)
+	K int
+	// "all" (the default) or "any"
+	Mode string
+
+	// Fields that bare terms are looked for in (the default field if
+	// empty). A term matches if any of them has it.
+	Fields []string
+	// Scales scores in a field (1 if it's missing)
+	Boosts map[string]float64
+	// How a doc's scores in each field combine: "sum" (the default)
+	// or "best"
+	Combine string
+
+	Ranges  []query.Range
+	Numeric []NumericFilter
+	Box     *query.Box
+
+	// Orders hits by these doc values instead of by score
+	Sort []collector.SortField
+	// For sorted searches, the Cursor of the last hit of the previous
+	// page
+	After *collector.Cursor
+	// Doc value fields to count the most common values of, over every
+	// match
+	Facets []string
+	// Numeric doc value fields to count the matches in ranges of
+	RangeFacets []RangeFacet
+	// Facet fields counted with the search's own filters on them left
+	// out, so each value shows how many results picking it would add
+	MultiSelect []string
+}
+
+// Counts of the matches with Field in each of Ranges, in order
+type RangeFacet struct {
+	Field  string
+	Ranges []facet.Range
+}
+
+// Docs with a numeric field in [Min, Max]. Type is the type the field
+// was added with: "int", "float" or "time" (RFC 3339).
+type NumericFilter struct {
+	Field, Type string
+	Min, Max    string
+}
+
+// The query, with its text split into terms by analyzer
+func (s *SearchRequest) Query(analyzer analysis.Analyzer) (*query.Query, os.Error) {
+	q := &query.Query{nil, query.MatchAll, nil, s.Fields, s.Boosts, query.SumFields, s.Ranges, nil, s.Box, s.K}
+
+	for _, f := range s.Numeric {
+		min, err := encodeNumber(f.Type, f.Min)
+		if err != nil {
+			return nil, os.NewError(fmt.Sprintf("%s: %s", f.Field, err))
+		}
+
+		max, err := encodeNumber(f.Type, f.Max)
+		if err != nil {
+			return nil, os.NewError(fmt.Sprintf("%s: %s", f.Field, err))
+		}
+
+		q.Numeric = append(q.Numeric, query.NumericRange{f.Field, min, max})
+	}
+
+	var err os.Error
+	if len(s.Fields) == 0 {
+		q.Terms, err = query.Parse(s.Q, defaultField, analyzer)
+	} else {
+		q.Terms, q.Words, err = query.ParseWords(s.Q, analyzer)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if q.K == 0 {
+		q.K = defaultK
+	} else if q.K < 0 || q.K > maxK {
+		return nil, os.NewError(fmt.Sprintf("k must be between 1 and %d", maxK))
+	}
+
+	switch s.Mode {
+	case "", "all":
+	case "any":
+		q.Mode = query.MatchAny
+	default:
+		return nil, os.NewError("mode must be all or any")
+	}
+
+	switch s.Combine {
+	case "", "sum":
+	case "best":
+		q.Combine = query.BestField
+	default:
+		return nil, os.NewError("combine must be sum or best")
+	}
+
+	if len(q.Terms) == 0 && len(q.Words) == 0 && len(q.Ranges) == 0 && len(q.Numeric) == 0 && q.Box == nil {
+		return nil, os.NewError("nothing to search for")
+	}
+
+	return q, nil
+}
+
+// Reads a search from the request's parameters:
+//   q        terms, either bare or field:term
+//   k        how many hits to return
+//   mode     "all" (the default) or "any"
+//   fields   fields for bare terms, each with an optional boost:
+//            title^2,body
+//   combine  "sum" (the default) or "best"
+//   range    attribute:min:max, may be repeated
+//   int      field:min..max, may be repeated, as may
+//   float    field:min..max and
+//   time     field:min..max, with RFC 3339 times
+//   box      minLat,minLon,maxLat,maxLon
+//   sort     doc value fields to order hits by, each descending if it
+//            starts with -: brand,-price. Docs without a value go last.
+//   after    for sort, the "after" of the previous page's response
+//   facets   doc value fields to count values of: brand,year
+//   facetrange
+//            field:name:min:max, counts matches with field in
+//            [min, max). May be repeated; a field's ranges are
+//            counted in the order they're given.
+//   multiselect
+//            facet fields to count with the search's filters on them
+//            left out: brand,price
+func parseSearch(r *http.Request) (*SearchRequest, os.Error) {
+	s := &SearchRequest{
+		r.FormValue("q"), 0, r.FormValue("mode"), []string{}, make(map[string]float64), r.FormValue("combine"),
+		[]query.Range{}, []NumericFilter{}, nil, []collector.SortField{}, nil, []string{}, []RangeFacet{}, []string{},
+	}
+
+	if k := r.FormValue("k"); k != "" {
+		n, err := strconv.Atoi(k)
+		if err != nil {
+			return nil, err
+		}
+
+		s.K = n
+	}
+
+	if param := r.FormValue("fields"); param != "" {
+		for _, field := range strings.Split(param, ",", -1) {
+			if idx := strings.Index(field, "^"); idx >= 0 {
+				boost, err := strconv.Atof64(field[idx+1:])
+				if err != nil {
+					return nil, err
+				}
+
+				field = field[:idx]
+				s.Boosts[field] = boost
+			}
+
+			s.Fields = append(s.Fields, field)
+		}
+	}
+
+	for _, param := range r.Form["range"] {
+		parts := strings.Split(param, ":", -1)
+		if len(parts) != 3 {
+			return nil, os.NewError("range must be attribute:min:max")
+		}
+
+		min, err := strconv.Atoi64(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		max, err := strconv.Atoi64(parts[2])
+		if err != nil {
+			return nil, err
+		}
+
+		s.Ranges = append(s.Ranges, query.Range{parts[0], min, max})
+	}
+
+	for _, kind := range []string{"int", "float", "time"} {
+		for _, param := range r.Form[kind] {
+			// Times have colons of their own
+			colon, dots := strings.Index(param, ":"), strings.Index(param, "..")
+			if colon < 0 || dots < colon {
+				return nil, os.NewError(kind + " must be field:min..max")
+			}
+
+			s.Numeric = append(s.Numeric, NumericFilter{param[:colon], kind, param[colon+1 : dots], param[dots+2:]})
+		}
+	}
+
+	if param := r.FormValue("box"); param != "" {
+		parts := strings.Split(param, ",", -1)
+		if len(parts) != 4 {
+			return nil, os.NewError("box must be minLat,minLon,maxLat,maxLon")
+		}
+
+		coords := make([]float64, 4)
+		for idx, part := range parts {
+			coord, err := strconv.Atof64(part)
+			if err != nil {
+				return nil, err
+			}
+
+			coords[idx] = coord
+		}
+
+		s.Box = &query.Box{coords[0], coords[1], coords[2], coords[3]}
+	}
+
+	if param := r.FormValue("sort"); param != "" {
+		for _, field := range strings.Split(param, ",", -1) {
+			descending := strings.HasPrefix(field, "-")
+			if descending {
+				field = field[1:]
+			}
+
+			s.Sort = append(s.Sort, collector.SortField{field, descending, collector.MissingLast})
+		}
+	}
+
+	if param := r.FormValue("after"); param != "" {
+		s.After = new(collector.Cursor)
+		if err := json.Unmarshal([]byte(param), s.After); err != nil {
+			return nil, os.NewError("after must be the cursor of a previous page: " + err.String())
+		}
+	}
+
+	if param := r.FormValue("facets"); param != "" {
+		s.Facets = strings.Split(param, ",", -1)
+	}
+
+	ranges := make(map[string]int)
+	for _, param := range r.Form["facetrange"] {
+		parts := strings.Split(param, ":", -1)
+		if len(parts) != 4 {
+			return nil, os.NewError("facetrange must be field:name:min:max")
+		}
+
+		min, err := strconv.Atoi64(parts[2])
+		if err != nil {
+			return nil, err
+		}
+
+		max, err := strconv.Atoi64(parts[3])
+		if err != nil {
+			return nil, err
+		}
+
+		idx, found := ranges[parts[0]]
+		if !found {
+			idx = len(s.RangeFacets)
+			ranges[parts[0]] = idx
+			s.RangeFacets = append(s.RangeFacets, RangeFacet{parts[0], []facet.Range{}})
+		}
+
+		s.RangeFacets[idx].Ranges = append(s.RangeFacets[idx].Ranges, facet.Range{parts[1], min, max})
+	}
+
+	if param := r.FormValue("multiselect"); param != "" {
+		s.MultiSelect = strings.Split(param, ",", -1)
+	}
+
+	return s, nil
+}
+
+// The facets the search asks for
+func (s *SearchRequest) facets() []query.FacetRequest {
+	multiSelect := make(map[string]bool)
+	for _, field := range s.MultiSelect {
+		multiSelect[field] = true
+	}
+
+	requests := []query.FacetRequest{}
+	for _, field := range s.Facets {
+		requests = append(requests, query.FacetRequest{field, nil, multiSelect[field]})
+	}
+
+	for _, f := range s.RangeFacets {
+		requests = append(requests, query.FacetRequest{f.Field, f.Ranges, multiSelect[f.Field]})
+	}
+
+	return requests
+}
+
+// The hits for q, which is the search's query: the best by score, or
+// the first by the search's sort fields. Facets are counted if the
+// search asks for any.
+func (s *SearchRequest) run(index *Index, q *query.Query) (*SearchReply, os.Error) {
+	reply := &SearchReply{}
+
+	var err os.Error
+	if len(s.Sort) > 0 {
+		reply.Hits, reply.Total, err = index.SearchSorted(q, s.Sort, s.After)
+	} else {
+		reply.Hits, reply.Total, err = index.Search(q)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if requests := s.facets(); len(requests) > 0 {
+		if reply.Facets, err = index.Facets(q, requests, facetSize); err != nil {
+			return nil, err
+		}
+	}
+
+	return reply, nil
+}
+
+// GET /search
+func searchHandler(index *Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeError(w, http.StatusMethodNotAllowed, "use GET")
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			writeError(w, http.StatusBadRequest, err.String())
+			return
+		}
+
+		search, err := parseSearch(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.String())
+			return
+		}
+
+		q, err := search.Query(index.options.Analyzer)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.String())
+			return
+		}
+
+		reply, err := search.run(index, q)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.String())
+			return
+		}
+
+		results := make([]interface{}, len(reply.Hits))
+		for idx, hit := range reply.Hits {
+			results[idx] = map[string]interface{}{
+				"id":     hit.Id,
+				"key":    hit.Key,
+				"score":  hit.Score,
+				"fields": hit.Fields,
+			}
+		}
+
+		body := map[string]interface{}{"total": reply.Total, "hits": results}
+		if n := len(reply.Hits); n > 0 && reply.Hits[n-1].Cursor != nil {
+			body["after"] = reply.Hits[n-1].Cursor
+		}
+
+		if reply.Facets != nil {
+			body["facets"] = reply.Facets
+		}
+
+		writeJSON(w, http.StatusOK, body)
+	}
+}
+
+// GET /stats
+func statsHandler(index *Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := index.Stats()
+
+		body := map[string]interface{}{
+			"generation": stats.Generation,
+			"segments":   stats.Segments,
+			"docs":       stats.Docs,
+			"deleted":    stats.Deleted,
+			"pending":    stats.Pending,
+			"filterCache": map[string]interface{}{
+				"hits":    stats.Filters.Hits,
+				"misses":  stats.Filters.Misses,
+				"entries": stats.Filters.Entries,
+				"bytes":   stats.Filters.Bytes,
+			},
+			"resultCache": map[string]interface{}{
+				"hits":    stats.Results.Hits,
+				"misses":  stats.Results.Misses,
+				"entries": stats.Results.Entries,
+				"bytes":   stats.Results.Bytes,
+			},
+		}
+
+		// Texts the analysis service failed, analyzed locally instead
+		if remote, ok := index.options.Analyzer.(*analysis.Remote); ok {
+			fallbacks, err := remote.Fallbacks()
+
+			analysisStats := map[string]interface{}{"fallbacks": fallbacks}
+			if err != nil {
+				analysisStats["lastError"] = err.String()
+			}
+
+			body["analysis"] = analysisStats
+		}
+
+		writeJSON(w, http.StatusOK, body)
+	}
+}
+
+// GET /healthz
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
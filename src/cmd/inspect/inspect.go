@@ -0,0 +1,321 @@
+// Prints what's in an index, for debugging.
+//
+//   basis-inspect [-top N] [-prefix P] DIR
+//   basis-inspect -term TERM [-blocks] DIR
+//   basis-inspect -gaps FILE [-prefix P] DIR
+//
+// DIR is an index directory (its committed segments are read) or a
+// single segment directory. By default each segment is summarized: its
+// docs, deletions, terms, attributes and geo cells, then its N longest
+// posting lists with their stats, encoded sizes and skip layouts.
+//
+// -term dumps every posting of TERM in each segment, or with -blocks
+// every block, skips included. -gaps writes histograms of the gaps
+// between consecutive docs (by segment, and overall) to FILE as JSON,
+// or to stdout if FILE is -. -prefix only looks at the terms starting
+// with P, such as a field ("title:").
+package main
+
+import "bufio"
+import "flag"
+import "fmt"
+import "json"
+import "math"
+import "os"
+import "path"
+import "sort"
+import match "basis/match"
+import postinglist "basis/match/postinglist"
+import attribute "basis/index/attribute"
+import commit "basis/index/commit"
+import segment "basis/index/segment"
+
+var top *int = flag.Int("top", 10, "longest posting lists to show per segment")
+var prefix *string = flag.String("prefix", "", "only look at terms with this prefix")
+var term *string = flag.String("term", "", "dump the postings of this term")
+var blocks *bool = flag.Bool("blocks", false, "with -term, dump every block")
+var gapsPath *string = flag.String("gaps", "", "write gap size histograms as JSON to this file (- for stdout)")
+
+func fail(err os.Error) {
+	fmt.Fprintln(os.Stderr, "basis-inspect:", err)
+	os.Exit(1)
+}
+
+type source struct {
+	name string
+	seg  *segment.Segment
+}
+
+// A segment directory, or every committed segment of an index
+func openIndex(dir string) ([]source, os.Error) {
+	if _, err := os.Stat(path.Join(dir, segment.InfoFile)); err == nil {
+		seg, err := segment.Open(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		return []source{source{path.Base(dir), seg}}, nil
+	}
+
+	refs, err := commit.Segments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := []source{}
+	for _, ref := range refs {
+		seg, err := commit.OpenSegment(dir, ref)
+		if err != nil {
+			return nil, os.NewError(fmt.Sprintf("%s: %s", ref.Name, err))
+		}
+
+		sources = append(sources, source{ref.Name, seg})
+	}
+
+	return sources, nil
+}
+
+// Visit the terms with the prefix, in order
+func terms(seg *segment.Segment, visit func(string, *postinglist.PostingList)) {
+	seg.Terms.Prefix(*prefix, visit)
+}
+
+type list struct {
+	term string
+	docs int
+}
+
+type byDocs []list
+
+func (l byDocs) Len() int { return len(l) }
+func (l byDocs) Less(i, j int) bool {
+	if l[i].docs != l[j].docs {
+		return l[i].docs > l[j].docs
+	}
+
+	return l[i].term < l[j].term
+}
+func (l byDocs) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+
+func attributeValues(tree *attribute.Tree) (values, postings int) {
+	tree.Walk(math.MinInt64, math.MaxInt64, func(key int64, pl *postinglist.PostingList) {
+		values++
+		postings += pl.Stats().DocCount
+	})
+
+	return
+}
+
+func summarize(src source) os.Error {
+	seg := src.seg
+
+	fmt.Printf("%s: %d docs (max id %d), %d deleted, %d terms, %d geo cells", src.name, seg.DocCount, seg.MaxId, seg.DeletedCount, seg.Terms.Len(), len(seg.Geo.Cells))
+	if seg.Remapped {
+		fmt.Printf(", remapped")
+	}
+	fmt.Println()
+
+	names := []string{}
+	for name := range seg.Attributes {
+		names = append(names, name)
+	}
+	sort.SortStrings(names)
+
+	for _, name := range names {
+		values, postings := attributeValues(seg.Attributes[name])
+		fmt.Printf("  attribute %s: %d values, %d postings\n", name, values, postings)
+	}
+
+	lists := []list{}
+	terms(seg, func(term string, pl *postinglist.PostingList) {
+		lists = append(lists, list{term, pl.Stats().DocCount})
+	})
+
+	sort.Sort(byDocs(lists))
+	if len(lists) > *top {
+		lists = lists[:*top]
+	}
+
+	for _, l := range lists {
+		pl, _ := seg.Terms.Lookup(l.term)
+
+		layout, err := pl.Layout()
+		if err != nil {
+			return os.NewError(fmt.Sprintf("%s %s: %s", src.name, l.term, err))
+		}
+
+		stats := pl.Stats()
+		fmt.Printf("  %s: %d docs, max %d; %d bytes (%d data, %d skip table), %.2f bytes/doc; %d skips (%d linked), %d table skips\n",
+			l.term, stats.DocCount, stats.MaxId, pl.Size(), layout.RawBytes, layout.TableBytes,
+			float64(pl.Size())/float64(stats.DocCount), layout.Skips, layout.LinkedSkips, layout.TableSkips)
+	}
+
+	return nil
+}
+
+func dump(src source, term string) os.Error {
+	seg := src.seg
+
+	pl, found := seg.Terms.Lookup(term)
+	if !found {
+		fmt.Printf("%s: no %s\n", src.name, term)
+		return nil
+	}
+
+	fmt.Printf("%s: %s, %d docs\n", src.name, term, pl.Stats().DocCount)
+
+	if *blocks {
+		fmt.Print(pl.String())
+		return nil
+	}
+
+	return pl.Docs(func(doc match.DocId) {
+		line := fmt.Sprintf("  %d", doc)
+		if seg.Remapped {
+			line += fmt.Sprintf(" (added as %d)", seg.OriginalId(doc))
+		}
+
+		if seg.IsDeleted(doc) {
+			line += " deleted"
+		}
+
+		fmt.Println(line)
+	})
+}
+
+// Gaps are bucketed by bit length: bucket b holds gaps in
+// [2^(b-1), 2^b), and bucket 0 holds gaps of 0
+type histogram struct {
+	lists   int
+	gaps    int
+	buckets [65]int
+}
+
+func bucket(gap uint64) int {
+	b := 0
+	for ; gap > 0; gap >>= 1 {
+		b++
+	}
+
+	return b
+}
+
+// Gaps as they're encoded, so each list's first is from 0
+func (h *histogram) add(pl *postinglist.PostingList) os.Error {
+	h.lists++
+	last := match.DocId(0)
+
+	return pl.Docs(func(doc match.DocId) {
+		h.gaps++
+		h.buckets[bucket(uint64(doc-last))]++
+		last = doc
+	})
+}
+
+func (h *histogram) json() map[string]interface{} {
+	buckets := []interface{}{}
+
+	for b, count := range h.buckets {
+		if count == 0 {
+			continue
+		}
+
+		min, max := uint64(0), uint64(0)
+		if b > 0 {
+			min = uint64(1) << uint(b-1)
+			max = min<<1 - 1
+		}
+
+		buckets = append(buckets, map[string]interface{}{"min": min, "max": max, "count": count})
+	}
+
+	return map[string]interface{}{"lists": h.lists, "gaps": h.gaps, "buckets": buckets}
+}
+
+func writeGaps(name string, sources []source) os.Error {
+	all := new(histogram)
+	bySegment := make(map[string]interface{})
+
+	for _, src := range sources {
+		h := new(histogram)
+
+		var err os.Error
+		terms(src.seg, func(term string, pl *postinglist.PostingList) {
+			if err != nil {
+				return
+			}
+
+			if err = h.add(pl); err == nil {
+				err = all.add(pl)
+			}
+
+			if err != nil {
+				err = os.NewError(fmt.Sprintf("%s %s: %s", src.name, term, err))
+			}
+		})
+
+		if err != nil {
+			return err
+		}
+
+		bySegment[src.name] = h.json()
+	}
+
+	encoded, err := json.Marshal(map[string]interface{}{"segments": bySegment, "all": all.json()})
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if name != "-" {
+		if out, err = os.Open(name, os.O_WRONLY|os.O_CREAT|os.O_TRUNC, 0644); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	w := bufio.NewWriter(out)
+	w.Write(encoded)
+	w.WriteString("\n")
+
+	return w.Flush()
+}
+
+func main() {
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: basis-inspect [-top N] [-prefix P] [-term TERM [-blocks]] [-gaps FILE] DIR")
+		os.Exit(2)
+	}
+
+	sources, err := openIndex(flag.Arg(0))
+	if err != nil {
+		fail(err)
+	}
+
+	switch {
+	case *gapsPath != "":
+		err = writeGaps(*gapsPath, sources)
+	case *term != "":
+		for _, src := range sources {
+			if err = dump(src, *term); err != nil {
+				break
+			}
+		}
+	default:
+		for _, src := range sources {
+			if err = summarize(src); err != nil {
+				break
+			}
+		}
+	}
+
+	for _, src := range sources {
+		src.seg.Close()
+	}
+
+	if err != nil {
+		fail(err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import "bufio"
+import "csv"
+import "fmt"
+import "io"
+import "json"
+import "os"
+import "strings"
+
+// Reads records one at a time, returning os.EOF after the last
+type records interface {
+	Read() (map[string]interface{}, os.Error)
+}
+
+// One JSON object per line. Blank lines are skipped.
+type jsonRecords struct {
+	r    *bufio.Reader
+	line int
+}
+
+func (j *jsonRecords) Read() (map[string]interface{}, os.Error) {
+	for {
+		line, err := j.r.ReadString('\n')
+		if err == os.EOF && line != "" {
+			err = nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		j.line++
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		record := make(map[string]interface{})
+		if err = json.Unmarshal([]byte(line), &record); err != nil {
+			return nil, os.NewError(fmt.Sprintf("line %d: %s", j.line, err))
+		}
+
+		return record, nil
+	}
+
+	panic("can't get here")
+}
+
+// A header row names the fields
+type csvRecords struct {
+	r      *csv.Reader
+	header []string
+}
+
+func newCSVRecords(r io.Reader) (*csvRecords, os.Error) {
+	c := &csvRecords{csv.NewReader(r), nil}
+
+	header, err := c.r.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	c.header = header
+	return c, nil
+}
+
+func (c *csvRecords) Read() (map[string]interface{}, os.Error) {
+	row, err := c.r.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	record := make(map[string]interface{})
+	for idx, value := range row {
+		if idx < len(c.header) {
+			record[c.header[idx]] = value
+		}
+	}
+
+	return record, nil
+}
+
+// Counts the bytes read through it, for throughput
+type counter struct {
+	r io.Reader
+	n int64
+}
+
+func (c *counter) Read(p []byte) (int, os.Error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+
+	return n, err
+}
+
+func openRecords(format string, r io.Reader) (records, os.Error) {
+	switch format {
+	case "jsonl":
+		return &jsonRecords{bufio.NewReader(r), 0}, nil
+	case "csv":
+		return newCSVRecords(r)
+	}
+
+	return nil, os.NewError("format must be jsonl or csv")
+}
@@ -0,0 +1,255 @@
+// Builds an index directory from documents in a file.
+//
+//   basis-load -mapping FILE [-format jsonl|csv] [-batch N] -out DIR INPUT
+//
+// INPUT (- for stdin) holds one JSON object per line, or CSV with a
+// header row. The mapping file says which fields are text, attributes
+// and so on (see Mapping). Every batch of N records becomes a segment,
+// committed (see basis/index/commit) along with the number of records
+// loaded so far, so after an interruption the same command picks up
+// after the last committed batch. The result opens like any index
+// directory; a doc that's loaded twice, by id, is only found in the
+// later segment.
+package main
+
+import "flag"
+import "fmt"
+import "io"
+import "os"
+import "path"
+import "runtime"
+import "sort"
+import "strconv"
+import "strings"
+import "time"
+import builder "basis/index/builder"
+import commit "basis/index/commit"
+
+// Commit point meta keys
+const recordsKey = "load.records"
+const inputKey = "load.input"
+
+var mappingPath *string = flag.String("mapping", "", "mapping file (JSON)")
+var format *string = flag.String("format", "", "jsonl or csv (by default, csv for .csv inputs and jsonl otherwise)")
+var batchSize *int = flag.Int("batch", 10000, "records per segment")
+var outDir *string = flag.String("out", "", "index directory to load into")
+var skipInterval *uint = flag.Uint("skip", builder.DefaultOptions.SkipInterval, "postings between skips")
+
+func fail(err os.Error) {
+	fmt.Fprintln(os.Stderr, "basis-load:", err)
+	os.Exit(1)
+}
+
+type byId []*builder.Document
+
+func (d byId) Len() int           { return len(d) }
+func (d byId) Less(i, j int) bool { return d[i].Id < d[j].Id }
+func (d byId) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// The number after commit.SegmentPrefix in the name of every segment so far,
+// plus one
+func nextSegment(p *commit.Point) int {
+	next := 0
+
+	for _, s := range p.Segments {
+		n := -1
+		if strings.HasPrefix(s.Name, commit.SegmentPrefix) {
+			fmt.Sscanf(s.Name[len(commit.SegmentPrefix):], "%d", &n)
+		}
+
+		if n >= next {
+			next = n + 1
+		}
+	}
+
+	return next
+}
+
+// Write docs to a new segment and commit it, with records as the
+// count loaded
+func commitBatch(dir string, p *commit.Point, docs []*builder.Document, records uint64) (*commit.Point, os.Error) {
+	sort.Sort(byId(docs))
+
+	options := builder.DefaultOptions
+	options.SkipInterval = *skipInterval
+
+	b := builder.New(options)
+	for idx, doc := range docs {
+		if idx > 0 && docs[idx-1].Id == doc.Id {
+			return nil, os.NewError(fmt.Sprintf("doc %d is in the batch twice", doc.Id))
+		}
+
+		if err := b.Add(doc); err != nil {
+			return nil, err
+		}
+	}
+
+	seg, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+	defer seg.Close()
+
+	name := commit.SegmentName(nextSegment(p))
+	segDir := path.Join(dir, name)
+
+	if err = os.MkdirAll(segDir, 0755); err != nil {
+		return nil, err
+	}
+
+	if err = seg.Write(segDir); err != nil {
+		return nil, err
+	}
+
+	if err = commit.SyncDir(segDir); err != nil {
+		return nil, err
+	}
+
+	next := &commit.Point{p.Generation + 1, make([]commit.Segment, len(p.Segments), len(p.Segments)+1), make(map[string]string)}
+	copy(next.Segments, p.Segments)
+	next.Segments = append(next.Segments, commit.Segment{name, ""})
+
+	for key, value := range p.Meta {
+		next.Meta[key] = value
+	}
+	next.Meta[recordsKey] = strconv.Uitoa64(records)
+
+	if err = commit.Write(dir, next); err != nil {
+		return nil, err
+	}
+
+	return next, nil
+}
+
+type progress struct {
+	start    int64
+	input    *counter
+	records  uint64
+	peakHeap uint64
+}
+
+func (p *progress) report(what string) {
+	runtime.UpdateMemStats()
+	if heap := runtime.MemStats.HeapAlloc; heap > p.peakHeap {
+		p.peakHeap = heap
+	}
+
+	seconds := float64(time.Nanoseconds()-p.start) / 1e9
+	fmt.Printf("%s: %d records loaded in %.1fs, %.0f records/s, %.2f MB/s, heap %.1f MB (peak %.1f MB)\n",
+		what, p.records, seconds, float64(p.records)/seconds, float64(p.input.n)/seconds/(1<<20),
+		float64(runtime.MemStats.HeapAlloc)/(1<<20), float64(p.peakHeap)/(1<<20))
+}
+
+func main() {
+	flag.Parse()
+
+	if *mappingPath == "" || *outDir == "" || *batchSize <= 0 || flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: basis-load -mapping FILE [-format jsonl|csv] [-batch N] -out DIR INPUT")
+		os.Exit(2)
+	}
+
+	mapping, err := readMapping(*mappingPath)
+	if err != nil {
+		fail(err)
+	}
+
+	inputName := flag.Arg(0)
+	if *format == "" {
+		*format = "jsonl"
+		if strings.HasSuffix(strings.ToLower(inputName), ".csv") {
+			*format = "csv"
+		}
+	}
+
+	if err = os.MkdirAll(*outDir, 0755); err != nil {
+		fail(err)
+	}
+
+	// Keep the segments of a directory from before commit points, then
+	// drop whatever an interrupted batch left
+	p, err := commit.Adopt(*outDir)
+	if err != nil {
+		fail(err)
+	}
+
+	if _, err = commit.Recover(*outDir); err != nil {
+		fail(err)
+	}
+
+	done := uint64(0)
+	if loaded, found := p.Meta[recordsKey]; found {
+		if done, err = strconv.Atoui64(loaded); err != nil {
+			fail(err)
+		}
+
+		if p.Meta[inputKey] != inputName {
+			fmt.Fprintf(os.Stderr, "basis-load: warning: resuming a load of %s\n", p.Meta[inputKey])
+		}
+	}
+	p.Meta[inputKey] = inputName
+
+	var in io.Reader = os.Stdin
+	if inputName != "-" {
+		f, err := os.Open(inputName, os.O_RDONLY, 0)
+		if err != nil {
+			fail(err)
+		}
+		defer f.Close()
+
+		in = f
+	}
+
+	progress := &progress{time.Nanoseconds(), &counter{in, 0}, 0, 0}
+
+	input, err := openRecords(*format, progress.input)
+	if err != nil {
+		fail(err)
+	}
+
+	// Skip what the last commit has
+	for n := uint64(0); n < done; n++ {
+		if _, err = input.Read(); err != nil {
+			fail(os.NewError(fmt.Sprintf("the index has %d records but the input ran out after %d", done, n)))
+		}
+	}
+
+	if done > 0 {
+		fmt.Printf("resuming after record %d\n", done)
+	}
+
+	n := done
+	for batch := 1; ; batch++ {
+		docs := []*builder.Document{}
+
+		for len(docs) < *batchSize {
+			record, err := input.Read()
+			if err == os.EOF {
+				break
+			} else if err != nil {
+				fail(err)
+			}
+
+			doc, err := mapping.document(record, n)
+			if err != nil {
+				fail(os.NewError(fmt.Sprintf("record %d: %s", n, err)))
+			}
+
+			docs = append(docs, doc)
+			n++
+		}
+
+		if len(docs) == 0 {
+			break
+		}
+
+		if p, err = commitBatch(*outDir, p, docs, n); err != nil {
+			fail(err)
+		}
+
+		progress.records += uint64(len(docs))
+		progress.report(fmt.Sprintf("batch %d", batch))
+	}
+
+	progress.report("done")
+	fmt.Printf("%d records in the index, generation %d\n", n, p.Generation)
+}
@@ -0,0 +1,268 @@
+package main
+
+import "fmt"
+import "io/ioutil"
+import "json"
+import "math"
+import "os"
+import "strconv"
+import "strings"
+import "time"
+import match "basis/match"
+import builder "basis/index/builder"
+import numeric "basis/index/numeric"
+
+// Which input fields go where. A mapping file is this as JSON:
+//
+//   {
+//     "id": "id",
+//     "key": "sku",
+//     "text": ["title", "body"],
+//     "stored": ["url"],
+//     "values": ["brand"],
+//     "attributes": {
+//       "price": {"type": "float", "scale": 100},
+//       "stock": {"type": "int"},
+//       "published": {"type": "time", "layout": "2006-01-02"}
+//     },
+//     "numbers": {
+//       "weight": {"type": "float"},
+//       "updated": {"type": "time"}
+//     },
+//     "geo": {"lat": "latitude", "lon": "longitude"}
+//   }
+//
+// Every part is optional. Records without an id field are numbered in
+// input order, from 0.
+type Mapping struct {
+	Id  string
+	Key string
+
+	// Analyzed and stored
+	Text []string
+	// Stored only
+	Stored []string
+	// Sorted-string doc values
+	Values []string
+
+	Attributes map[string]Attribute
+	// Numeric fields (see numeric), typed like attributes
+	Numbers map[string]Attribute
+	Geo     *Geo
+}
+
+// Attributes are int64s. Floats are multiplied by Scale (1 if it's
+// unset) and rounded; times become Unix seconds, parsed with Layout
+// (RFC 3339 if it's unset) unless they're already numbers. Numeric
+// fields keep floats as they are, so they ignore Scale.
+type Attribute struct {
+	Type   string
+	Scale  float64
+	Layout string
+}
+
+type Geo struct {
+	Lat, Lon string
+}
+
+func readMapping(name string) (*Mapping, os.Error) {
+	raw, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(Mapping)
+	if err = json.Unmarshal(raw, m); err != nil {
+		return nil, err
+	}
+
+	for field, a := range m.Attributes {
+		switch a.Type {
+		case "int", "float", "time":
+		default:
+			return nil, os.NewError(fmt.Sprintf("attribute %s: type must be int, float or time", field))
+		}
+	}
+
+	for field, a := range m.Numbers {
+		switch a.Type {
+		case "int", "float", "time":
+		default:
+			return nil, os.NewError(fmt.Sprintf("number %s: type must be int, float or time", field))
+		}
+	}
+
+	if m.Geo != nil && (m.Geo.Lat == "" || m.Geo.Lon == "") {
+		return nil, os.NewError("geo needs both lat and lon fields")
+	}
+
+	return m, nil
+}
+
+// JSON gives strings, numbers and bools; CSV only strings
+func toString(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+
+	return fmt.Sprint(value)
+}
+
+func toFloat(value interface{}) (float64, os.Error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case string:
+		return strconv.Atof64(strings.TrimSpace(v))
+	}
+
+	return 0, os.NewError(fmt.Sprintf("%v isn't a number", value))
+}
+
+func (a Attribute) convert(value interface{}) (int64, os.Error) {
+	if s, ok := value.(string); ok && a.Type == "time" {
+		layout := a.Layout
+		if layout == "" {
+			layout = time.RFC3339
+		}
+
+		t, err := time.Parse(layout, strings.TrimSpace(s))
+		if err != nil {
+			return 0, err
+		}
+
+		return t.Seconds(), nil
+	}
+
+	f, err := toFloat(value)
+	if err != nil {
+		return 0, err
+	}
+
+	if a.Type == "float" && a.Scale != 0 {
+		f *= a.Scale
+	}
+
+	if math.IsNaN(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, os.NewError(fmt.Sprintf("%v is out of range", value))
+	}
+
+	if a.Type == "int" && f != math.Floor(f) {
+		return 0, os.NewError(fmt.Sprintf("%v isn't an integer", value))
+	}
+
+	return int64(math.Floor(f + 0.5)), nil
+}
+
+// A value for a numeric field, encoded as the numeric package indexes it
+func (a Attribute) encode(value interface{}) (uint64, os.Error) {
+	if a.Type != "float" {
+		n, err := a.convert(value)
+		return numeric.Int(n), err
+	}
+
+	f, err := toFloat(value)
+	if err != nil {
+		return 0, err
+	}
+
+	if math.IsNaN(f) {
+		return 0, os.NewError(fmt.Sprintf("%v isn't a number", value))
+	}
+
+	return numeric.Float(f), nil
+}
+
+// The doc for record n (counting from 0) of the input
+func (m *Mapping) document(record map[string]interface{}, n uint64) (*builder.Document, os.Error) {
+	doc := &builder.Document{
+		match.DocId(n), "", nil, make(map[string]string), make(map[string]int64), make(map[string]uint64),
+		make(map[string]string), make(map[string]string), false, 0, 0,
+	}
+
+	if m.Id != "" {
+		value, found := record[m.Id]
+		if !found {
+			return nil, os.NewError(fmt.Sprintf("no %s field", m.Id))
+		}
+
+		id, err := strconv.Atoui64(strings.TrimSpace(toString(value)))
+		if err != nil {
+			return nil, os.NewError(fmt.Sprintf("%s: %s", m.Id, err))
+		}
+
+		doc.Id = match.DocId(id)
+	}
+
+	if value, found := record[m.Key]; found && m.Key != "" {
+		doc.Key = toString(value)
+	}
+
+	for _, field := range m.Text {
+		if value, found := record[field]; found {
+			text := toString(value)
+			doc.Text[field] = text
+			doc.Stored[field] = text
+		}
+	}
+
+	for _, field := range m.Stored {
+		if value, found := record[field]; found {
+			doc.Stored[field] = toString(value)
+		}
+	}
+
+	for _, field := range m.Values {
+		if value, found := record[field]; found {
+			doc.Values[field] = toString(value)
+		}
+	}
+
+	for field, a := range m.Attributes {
+		value, found := record[field]
+		if !found || toString(value) == "" {
+			continue
+		}
+
+		converted, err := a.convert(value)
+		if err != nil {
+			return nil, os.NewError(fmt.Sprintf("%s: %s", field, err))
+		}
+
+		doc.Attributes[field] = converted
+	}
+
+	for field, a := range m.Numbers {
+		value, found := record[field]
+		if !found || toString(value) == "" {
+			continue
+		}
+
+		encoded, err := a.encode(value)
+		if err != nil {
+			return nil, os.NewError(fmt.Sprintf("%s: %s", field, err))
+		}
+
+		doc.Numbers[field] = encoded
+	}
+
+	if m.Geo != nil {
+		lat, hasLat := record[m.Geo.Lat]
+		lon, hasLon := record[m.Geo.Lon]
+
+		if hasLat && hasLon {
+			var err os.Error
+			if doc.Lat, err = toFloat(lat); err != nil {
+				return nil, os.NewError(fmt.Sprintf("%s: %s", m.Geo.Lat, err))
+			}
+
+			if doc.Lon, err = toFloat(lon); err != nil {
+				return nil, os.NewError(fmt.Sprintf("%s: %s", m.Geo.Lon, err))
+			}
+
+			doc.HasLocation = true
+		}
+	}
+
+	return doc, nil
+}
@@ -0,0 +1,61 @@
+// Cleans up an index directory after a crash.
+//
+//   basis-recover [-n] DIR
+//
+// DIR's commit point names the segments (and the deletions file of
+// each) that make up the index. Everything else a commit leaves behind
+// when it doesn't finish, or when a later one replaces it, is deleted:
+// unlisted segment directories, stale deletions files and temporary
+// files. Nothing else in DIR is touched, and a directory without a
+// commit point is left as it is.
+package main
+
+import "flag"
+import "fmt"
+import "os"
+import commit "basis/index/commit"
+
+var dryRun *bool = flag.Bool("n", false, "only print what would be deleted")
+
+func fail(err os.Error) {
+	fmt.Fprintln(os.Stderr, "basis-recover:", err)
+	os.Exit(1)
+}
+
+func main() {
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: basis-recover [-n] DIR")
+		os.Exit(2)
+	}
+
+	dir := flag.Arg(0)
+
+	p, err := commit.Read(dir)
+	if err != nil {
+		fail(err)
+	}
+
+	fmt.Printf("generation %d, %d segments\n", p.Generation, len(p.Segments))
+
+	verb := "deleted"
+
+	orphans := []string{}
+	if *dryRun {
+		verb = "would delete"
+		if p.Generation > 0 {
+			orphans, err = commit.Orphans(dir, p)
+		}
+	} else {
+		orphans, err = commit.Recover(dir)
+	}
+
+	if err != nil {
+		fail(err)
+	}
+
+	for _, orphan := range orphans {
+		fmt.Println(verb, orphan)
+	}
+}
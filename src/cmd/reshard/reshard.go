@@ -0,0 +1,130 @@
+// Splits an index into more shards.
+//
+//   basis-reshard -table TABLE -shards N -out DIR SHARD...
+//
+// TABLE is the routing.Table that places every doc of the SHARD
+// directories (given in shard order). Each segment of each shard (the
+// committed ones, if the shard has a commit point) is split by the
+// keys of its docs, so DIR ends up holding shard-0 ... shard-N-1, each
+// with its pieces as segment-0, segment-1 ... and a commit point, plus
+// the new table. Deleted docs are dropped.
+package main
+
+import "flag"
+import "fmt"
+import "os"
+import "path"
+import commit "basis/index/commit"
+import routing "basis/index/routing"
+
+var tablePath *string = flag.String("table", "", "routing table of the shards being split")
+var shards *int = flag.Int("shards", 0, "number of shards to split into")
+var outDir *string = flag.String("out", "", "directory for the new shards")
+var skipInterval *uint = flag.Uint("skip", 32, "postings between skips in the new lists")
+
+func fail(err os.Error) {
+	fmt.Fprintln(os.Stderr, "basis-reshard:", err)
+	os.Exit(1)
+}
+
+func readTable(name string) (*routing.Table, os.Error) {
+	f, err := os.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return routing.ReadTable(f)
+}
+
+func writeTable(name string, t *routing.Table) os.Error {
+	f, err := os.Open(name, os.O_WRONLY|os.O_CREAT|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return t.Write(f)
+}
+
+func main() {
+	flag.Parse()
+
+	if *tablePath == "" || *outDir == "" || *shards <= 0 || flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: basis-reshard -table TABLE -shards N -out DIR SHARD...")
+		os.Exit(2)
+	}
+
+	from, err := readTable(*tablePath)
+	if err != nil {
+		fail(err)
+	}
+
+	if from.Shards != flag.NArg() {
+		fail(os.NewError(fmt.Sprintf("the table has %d shards but %d were given", from.Shards, flag.NArg())))
+	}
+
+	to := routing.NewTable(*shards)
+	pieces := make([][]commit.Segment, *shards)
+
+	for shard, dir := range flag.Args() {
+		segs, err := commit.Segments(dir)
+		if err != nil {
+			fail(err)
+		}
+
+		for _, ref := range segs {
+			seg, err := commit.OpenSegment(dir, ref)
+			if err != nil {
+				fail(err)
+			}
+
+			split, err := routing.Split(seg, shard, from, to, *skipInterval)
+			if err != nil {
+				fail(err)
+			}
+
+			for target, piece := range split {
+				if piece == nil {
+					continue
+				}
+
+				name := commit.SegmentName(len(pieces[target]))
+				pieceDir := path.Join(*outDir, fmt.Sprintf("shard-%d", target), name)
+				if err = os.MkdirAll(pieceDir, 0755); err != nil {
+					fail(err)
+				}
+
+				if err = piece.Write(pieceDir); err != nil {
+					fail(err)
+				}
+
+				if err = commit.SyncDir(pieceDir); err != nil {
+					fail(err)
+				}
+
+				pieces[target] = append(pieces[target], commit.Segment{name, ""})
+			}
+
+			seg.Close()
+			fmt.Printf("split %s\n", path.Join(dir, ref.Name))
+		}
+	}
+
+	for target, segs := range pieces {
+		shardDir := path.Join(*outDir, fmt.Sprintf("shard-%d", target))
+		if err = os.MkdirAll(shardDir, 0755); err != nil {
+			fail(err)
+		}
+
+		if err = commit.Write(shardDir, &commit.Point{1, segs, nil}); err != nil {
+			fail(err)
+		}
+	}
+
+	if err = writeTable(path.Join(*outDir, "table"), to); err != nil {
+		fail(err)
+	}
+
+	fmt.Printf("%d docs in %d shards\n", to.Len(), *shards)
+}
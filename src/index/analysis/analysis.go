@@ -0,0 +1,68 @@
+// Turns text into terms. The same analyzer has to be used when a field
+// is indexed and when it's queried, or the terms won't line up.
+package analysis
+
+import "os"
+import "strings"
+import "unicode"
+
+// A term and where it came from
+type Token struct {
+	Text string
+	// The token's place in the sequence (0, 1, 2 ...). Analyzers that
+	// drop or inject tokens may leave gaps or repeat positions.
+	Position int
+	// Byte offsets of the original text, [Start, End)
+	Start, End int
+}
+
+type Analyzer interface {
+	Analyze(text string) ([]Token, os.Error)
+}
+
+// Splits text into runs of letters, digits and combining marks, and
+// lowercases them. Everything else separates words.
+type Words struct{}
+
+func isWord(c int) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || unicode.Is(unicode.Mn, c)
+}
+
+func (Words) Analyze(text string) ([]Token, os.Error) {
+	tokens := []Token{}
+	start := -1
+
+	for idx, c := range text {
+		switch {
+		case isWord(c) && start < 0:
+			start = idx
+		case !isWord(c) && start >= 0:
+			tokens = append(tokens, Token{strings.ToLower(text[start:idx]), len(tokens), start, idx})
+			start = -1
+		}
+	}
+
+	if start >= 0 {
+		tokens = append(tokens, Token{strings.ToLower(text[start:]), len(tokens), start, len(text)})
+	}
+
+	return tokens, nil
+}
+
+// Used when nothing else is asked for
+var Default Analyzer = Words{}
+
+// Just the text of each token
+func Terms(a Analyzer, text string) ([]string, os.Error) {
+	tokens, err := a.Analyze(text)
+	if err != nil {
+		return nil, err
+	}
+
+	terms := make([]string, len(tokens))
+	for idx, token := range tokens {
+		terms[idx] = token.Text
+	}
+
+	return terms, nil
+}
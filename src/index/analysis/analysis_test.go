@@ -0,0 +1,50 @@
+package analysis
+
+import "testing"
+
+type wordsTest struct {
+	in     string
+	tokens []Token
+}
+
+var wordsTests = []wordsTest{
+	{"", []Token{}},
+	{"  ,. ", []Token{}},
+	{"Hello", []Token{{"hello", 0, 0, 5}}},
+	{"Hello, World!", []Token{{"hello", 0, 0, 5}, {"world", 1, 7, 12}}},
+	{"route-66 x", []Token{{"route", 0, 0, 5}, {"66", 1, 6, 8}, {"x", 2, 9, 10}}},
+	{"Ünïcode ΣΊΣΥΦΟΣ", []Token{{"ünïcode", 0, 0, 9}, {"σίσυφοσ", 1, 10, 24}}},
+	{"été", []Token{{"été", 0, 0, 6}}},
+}
+
+func TestWords(t *testing.T) {
+	for _, wt := range wordsTests {
+		tokens, err := Words{}.Analyze(wt.in)
+		if err != nil {
+			t.Fatalf("Analyze(%q): %s", wt.in, err)
+		}
+
+		if len(tokens) != len(wt.tokens) {
+			t.Errorf("Analyze(%q) = %v, want %v", wt.in, tokens, wt.tokens)
+			continue
+		}
+
+		for idx, token := range tokens {
+			want := wt.tokens[idx]
+			if !same(token, want) {
+				t.Errorf("Analyze(%q)[%d] = %v, want %v", wt.in, idx, token, want)
+			}
+		}
+	}
+}
+
+func TestTerms(t *testing.T) {
+	terms, err := Terms(Default, "The QUICK fox")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(terms) != 3 || terms[0] != "the" || terms[1] != "quick" || terms[2] != "fox" {
+		t.Errorf("Terms = %v", terms)
+	}
+}
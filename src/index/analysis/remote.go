@@ -0,0 +1,228 @@
+package analysis
+
+import "bytes"
+import "fmt"
+import "http"
+import "io/ioutil"
+import "json"
+import "os"
+import "sync"
+import "time"
+
+// Analyzers that can do many texts at once, such as Remote
+type BatchAnalyzer interface {
+	Analyzer
+	AnalyzeAll(texts []string) ([][]Token, os.Error)
+}
+
+// The tokens of each text, in one go if a can batch
+func All(a Analyzer, texts []string) ([][]Token, os.Error) {
+	if batcher, ok := a.(BatchAnalyzer); ok {
+		return batcher.AnalyzeAll(texts)
+	}
+
+	all := make([][]Token, len(texts))
+	for idx, text := range texts {
+		tokens, err := a.Analyze(text)
+		if err != nil {
+			return nil, err
+		}
+
+		all[idx] = tokens
+	}
+
+	return all, nil
+}
+
+var ErrTimeout = os.NewError("analysis service timed out")
+
+// What's posted to the service, as JSON
+type RemoteRequest struct {
+	Texts []string
+}
+
+// What the service answers with: the tokens of each text, in order
+type RemoteResponse struct {
+	Tokens [][]Token
+}
+
+// Sends text to an analysis service at URL, which gets a RemoteRequest
+// and answers with a RemoteResponse. Failed requests (network errors,
+// timeouts and 5xx responses) are retried; if they keep failing, or
+// the service answers with nonsense, the texts are given to Fallback,
+// which Fallbacks counts. The fallback should produce the same terms as the service does, or
+// docs analyzed by it won't match queries analyzed by the service (and
+// the other way around).
+type Remote struct {
+	URL    string
+	Client *http.Client
+
+	// Texts per request
+	BatchSize int
+	// Per attempt, in nanoseconds (0 waits forever)
+	Timeout int64
+	// Attempts after the first one, and the wait before the first
+	// retry (which doubles for each one after)
+	Retries int
+	Backoff int64
+
+	// nil to fail instead
+	Fallback Analyzer
+
+	// Batches given to the fallback, and why the last one was
+	lock      sync.Mutex
+	fallbacks uint64
+	lastErr   os.Error
+}
+
+func NewRemote(url string, fallback Analyzer) *Remote {
+	return &Remote{url, http.DefaultClient, 100, 1e9, 2, 50e6, fallback, sync.Mutex{}, 0, nil}
+}
+
+// How many batches the service failed and the fallback analyzed, and
+// the error that sent the last one there
+func (r *Remote) Fallbacks() (uint64, os.Error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.fallbacks, r.lastErr
+}
+
+func (r *Remote) Analyze(text string) ([]Token, os.Error) {
+	all, err := r.AnalyzeAll([]string{text})
+	if err != nil {
+		return nil, err
+	}
+
+	return all[0], nil
+}
+
+func (r *Remote) AnalyzeAll(texts []string) ([][]Token, os.Error) {
+	all := make([][]Token, 0, len(texts))
+
+	size := r.BatchSize
+	if size <= 0 {
+		size = len(texts)
+	}
+
+	for start := 0; start < len(texts); start += size {
+		end := start + size
+		if end > len(texts) {
+			end = len(texts)
+		}
+
+		batch, err := r.batch(texts[start:end])
+		if err != nil && r.Fallback != nil {
+			r.lock.Lock()
+			r.fallbacks++
+			r.lastErr = err
+			r.lock.Unlock()
+
+			batch, err = All(r.Fallback, texts[start:end])
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		all = append(all, batch...)
+	}
+
+	return all, nil
+}
+
+// One batch, with retries
+func (r *Remote) batch(texts []string) ([][]Token, os.Error) {
+	body, err := json.Marshal(&RemoteRequest{texts})
+	if err != nil {
+		return nil, err
+	}
+
+	wait := r.Backoff
+	for attempt := 0; ; attempt++ {
+		raw, err, retry := r.post(body)
+		if err == nil {
+			return decodeResponse(raw, texts)
+		}
+
+		if !retry || attempt >= r.Retries {
+			return nil, err
+		}
+
+		time.Sleep(wait)
+		wait *= 2
+	}
+
+	panic("unreachable")
+}
+
+type reply struct {
+	raw   []byte
+	err   os.Error
+	retry bool
+}
+
+// Posts one request, returning the response body. The error says
+// whether it's worth trying again.
+func (r *Remote) post(body []byte) ([]byte, os.Error, bool) {
+	// Buffered, so a request that outlives the timeout can still
+	// finish
+	replies := make(chan reply, 1)
+
+	go func() {
+		resp, err := r.Client.Post(r.URL, "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			replies <- reply{nil, err, true}
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			err = os.NewError(fmt.Sprintf("POST %s: %s", r.URL, resp.Status))
+			replies <- reply{nil, err, resp.StatusCode >= 500}
+			return
+		}
+
+		raw, err := ioutil.ReadAll(resp.Body)
+		replies <- reply{raw, err, true}
+	}()
+
+	// Never fires if there's no timeout
+	var deadline <-chan int64
+	if r.Timeout > 0 {
+		deadline = time.After(r.Timeout)
+	}
+
+	select {
+	case rep := <-replies:
+		return rep.raw, rep.err, rep.retry
+	case <-deadline:
+	}
+
+	return nil, ErrTimeout, true
+}
+
+func decodeResponse(raw []byte, texts []string) ([][]Token, os.Error) {
+	resp := new(RemoteResponse)
+	if err := json.Unmarshal(raw, resp); err != nil {
+		return nil, err
+	}
+
+	if len(resp.Tokens) != len(texts) {
+		return nil, os.NewError(fmt.Sprintf("analysis service sent tokens for %d texts, not %d", len(resp.Tokens), len(texts)))
+	}
+
+	for idx, tokens := range resp.Tokens {
+		for _, token := range tokens {
+			if token.Start < 0 || token.Start > token.End || token.End > len(texts[idx]) {
+				return nil, os.NewError(fmt.Sprintf("analysis service sent offsets [%d, %d) for a text of %d bytes", token.Start, token.End, len(texts[idx])))
+			}
+		}
+
+		if tokens == nil {
+			resp.Tokens[idx] = []Token{}
+		}
+	}
+
+	return resp.Tokens, nil
+}
@@ -0,0 +1,149 @@
+package analysis
+
+import "http"
+import "http/httptest"
+import "json"
+import "os"
+import "sync"
+import "testing"
+import "time"
+
+// A stand-in analysis service that splits words. The first failures
+// requests get a 503, and every request waits delay first.
+type service struct {
+	lock     sync.Mutex
+	requests int
+	failures int
+	delay    int64
+}
+
+func (s *service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	s.requests++
+	fail := s.requests <= s.failures
+	s.lock.Unlock()
+
+	time.Sleep(s.delay)
+
+	if fail {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	req := new(RemoteRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.String(), http.StatusBadRequest)
+		return
+	}
+
+	all, _ := All(Words{}, req.Texts)
+	json.NewEncoder(w).Encode(&RemoteResponse{all})
+}
+
+func testRemote(s *service) (*Remote, *httptest.Server) {
+	server := httptest.NewServer(s)
+
+	r := NewRemote(server.URL, nil)
+	r.BatchSize = 2
+	r.Timeout = 500e6
+	r.Backoff = 1e6
+
+	return r, server
+}
+
+func same(a, b Token) bool {
+	return a.Text == b.Text && a.Position == b.Position && a.Start == b.Start && a.End == b.End
+}
+
+func TestRemoteBatches(t *testing.T) {
+	s := &service{}
+	r, server := testRemote(s)
+	defer server.Close()
+
+	texts := []string{"One", "two Three", "", "four", "Five six"}
+	all, err := r.AnalyzeAll(texts)
+	if err != nil {
+		t.Fatalf("AnalyzeAll() = %s", err)
+	}
+
+	if s.requests != 3 {
+		t.Errorf("%d requests, want 3", s.requests)
+	}
+
+	want, _ := All(Words{}, texts)
+	if len(all) != len(want) {
+		t.Fatalf("AnalyzeAll() gave tokens for %d texts, want %d", len(all), len(want))
+	}
+
+	for idx, tokens := range all {
+		if len(tokens) != len(want[idx]) {
+			t.Errorf("text %d: %v, want %v", idx, tokens, want[idx])
+			continue
+		}
+
+		for n, token := range tokens {
+			if !same(token, want[idx][n]) {
+				t.Errorf("text %d: %v, want %v", idx, tokens, want[idx])
+			}
+		}
+	}
+}
+
+func TestRemoteRetries(t *testing.T) {
+	s := &service{failures: 2}
+	r, server := testRemote(s)
+	defer server.Close()
+
+	tokens, err := r.Analyze("retried")
+	if err != nil {
+		t.Fatalf("Analyze() = %s", err)
+	}
+
+	if len(tokens) != 1 || tokens[0].Text != "retried" || s.requests != 3 {
+		t.Errorf("Analyze() = %v after %d requests, want 1 token after 3", tokens, s.requests)
+	}
+
+	s.requests, s.failures = 0, 3
+	if _, err = r.Analyze("retried"); err == nil {
+		t.Errorf("Analyze() should fail once the retries run out")
+	}
+}
+
+type marked struct{}
+
+func (marked) Analyze(text string) ([]Token, os.Error) {
+	return []Token{{"local", 0, 0, len(text)}}, nil
+}
+
+func TestRemoteFallback(t *testing.T) {
+	s := &service{delay: 100e6}
+	r, server := testRemote(s)
+	defer server.Close()
+
+	r.Timeout = 10e6
+	r.Retries = 0
+
+	if _, err := r.Analyze("slow"); err != ErrTimeout {
+		t.Errorf("Analyze() = %v, want ErrTimeout", err)
+	}
+
+	// Without a fallback, failures aren't counted
+	if n, err := r.Fallbacks(); n != 0 || err != nil {
+		t.Errorf("Fallbacks() = %d, %v, want none", n, err)
+	}
+
+	r.Fallback = marked{}
+	tokens, err := r.Analyze("slow")
+	if err != nil || len(tokens) != 1 || tokens[0].Text != "local" {
+		t.Errorf("Analyze() = %v, %v, want the fallback's tokens", tokens, err)
+	}
+
+	// Three texts make two batches of two
+	if _, err = r.AnalyzeAll([]string{"a", "b", "c"}); err != nil {
+		t.Errorf("AnalyzeAll() = %s", err)
+	}
+
+	if n, err := r.Fallbacks(); n != 3 || err != ErrTimeout {
+		t.Errorf("Fallbacks() = %d, %v, want 3 and ErrTimeout", n, err)
+	}
+}
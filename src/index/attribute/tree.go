@@ -0,0 +1,259 @@
+package attribute
+
+import "fmt"
+import "gob"
+import "io"
+import "os"
+import match "basis/match"
+import postinglist "basis/match/postinglist"
+
+const fanout = 64
+
+// A bulk-loaded B+ tree from attribute values to posting lists. The
+// nodes are kept in a flat array (children are indexes into Nodes) so
+// the tree can be stored with gob.
+type Tree struct {
+	Nodes []Node
+	Root  int
+	First int
+}
+
+type Node struct {
+	// For leaves, the key of each list. For internal nodes, the
+	// smallest key under each child.
+	Keys []int64
+
+	Children []int
+
+	// Leaves only: serialized posting lists, and the next leaf (-1 at
+	// the end)
+	Lists [][]byte
+	Next  int
+}
+
+func (n *Node) leaf() bool {
+	return len(n.Children) == 0
+}
+
+// Build a tree from keys in ascending order and their posting lists
+func Build(keys []int64, lists []*postinglist.PostingList) (*Tree, os.Error) {
+	if len(keys) != len(lists) {
+		return nil, os.NewError("need exactly one posting list per key")
+	}
+
+	t := &Tree{[]Node{}, -1, -1}
+	if len(keys) == 0 {
+		return t, nil
+	}
+
+	// Pack the leaves
+	level := []int{}
+	for start := 0; start < len(keys); start += fanout {
+		end := start + fanout
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		leaf := Node{make([]int64, end-start), nil, make([][]byte, end-start), -1}
+		for idx := start; idx < end; idx++ {
+			if idx > 0 && keys[idx-1] >= keys[idx] {
+				return nil, os.NewError("keys must be unique and ascending")
+			}
+
+			leaf.Keys[idx-start] = keys[idx]
+			leaf.Lists[idx-start] = make([]byte, lists[idx].Size())
+			lists[idx].ToBytes(leaf.Lists[idx-start])
+		}
+
+		if len(level) > 0 {
+			t.Nodes[level[len(level)-1]].Next = len(t.Nodes)
+		}
+
+		level = append(level, len(t.Nodes))
+		t.Nodes = append(t.Nodes, leaf)
+	}
+
+	t.First = level[0]
+
+	// Then build internal levels until there's a single root
+	for len(level) > 1 {
+		parents := []int{}
+
+		for start := 0; start < len(level); start += fanout {
+			end := start + fanout
+			if end > len(level) {
+				end = len(level)
+			}
+
+			node := Node{[]int64{}, []int{}, nil, -1}
+			for _, child := range level[start:end] {
+				node.Keys = append(node.Keys, t.Nodes[child].Keys[0])
+				node.Children = append(node.Children, child)
+			}
+
+			parents = append(parents, len(t.Nodes))
+			t.Nodes = append(t.Nodes, node)
+		}
+
+		level = parents
+	}
+
+	t.Root = level[0]
+
+	return t, nil
+}
+
+// Find the leaf that would hold key, and the position of the first
+// key in it that's >= key
+func (t *Tree) find(key int64) (leaf, pos int) {
+	node := t.Root
+
+	for !t.Nodes[node].leaf() {
+		n := &t.Nodes[node]
+
+		child := 0
+		for child+1 < len(n.Keys) && n.Keys[child+1] <= key {
+			child++
+		}
+
+		node = n.Children[child]
+	}
+
+	n := &t.Nodes[node]
+	for pos = 0; pos < len(n.Keys) && n.Keys[pos] < key; pos++ {
+	}
+
+	return node, pos
+}
+
+func (t *Tree) Lookup(key int64) (*postinglist.PostingList, bool) {
+	if t.Root < 0 {
+		return nil, false
+	}
+
+	leaf, pos := t.find(key)
+	n := &t.Nodes[leaf]
+
+	if pos == len(n.Keys) || n.Keys[pos] != key {
+		return nil, false
+	}
+
+	// Checked when the tree was read
+	return postinglist.MustFromBytes(n.Lists[pos]), true
+}
+
+// Visit every key in [lo, hi] in ascending order
+func (t *Tree) Walk(lo, hi int64, visit func(int64, *postinglist.PostingList)) {
+	if t.Root < 0 {
+		return
+	}
+
+	leaf, pos := t.find(lo)
+
+	for leaf >= 0 {
+		n := &t.Nodes[leaf]
+
+		for ; pos < len(n.Keys); pos++ {
+			if n.Keys[pos] > hi {
+				return
+			}
+
+			visit(n.Keys[pos], postinglist.MustFromBytes(n.Lists[pos]))
+		}
+
+		leaf, pos = n.Next, 0
+	}
+}
+
+// Iterators over every posting list with a key in [lo, hi], ready to
+// be unioned with match.Merge
+func (t *Tree) Range(lo, hi int64) []match.MatchIterator {
+	iters := []match.MatchIterator{}
+
+	t.Walk(lo, hi, func(key int64, pl *postinglist.PostingList) {
+		iters = append(iters, postinglist.NewIter(pl))
+	})
+
+	return iters
+}
+
+func (t *Tree) Write(w io.Writer) os.Error {
+	return gob.NewEncoder(w).Encode(t)
+}
+
+func ReadTree(r io.Reader) (*Tree, os.Error) {
+	t := new(Tree)
+	if err := gob.NewDecoder(r).Decode(t); err != nil {
+		return nil, err
+	}
+
+	if err := t.Check(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Check that every node reference is in range (and, as Build lays
+// nodes out, points forwards to leaves and backwards to children, so
+// there are no cycles) and every list is framed, so lookups can't fail
+func (t *Tree) Check() os.Error {
+	if t.Root < -1 || t.Root >= len(t.Nodes) || t.First < -1 || t.First >= len(t.Nodes) {
+		return os.NewError("root or first leaf is out of range")
+	}
+
+	if (t.Root < 0) != (t.First < 0) || (t.First >= 0 && !t.Nodes[t.First].leaf()) {
+		return os.NewError("first leaf isn't a leaf")
+	}
+
+	for idx := range t.Nodes {
+		n := &t.Nodes[idx]
+
+		if n.leaf() {
+			if len(n.Lists) != len(n.Keys) {
+				return os.NewError(fmt.Sprintf("leaf %d has %d lists for %d keys", idx, len(n.Lists), len(n.Keys)))
+			}
+
+			if n.Next != -1 && (n.Next <= idx || n.Next >= len(t.Nodes) || !t.Nodes[n.Next].leaf()) {
+				return os.NewError(fmt.Sprintf("leaf %d has a bad next leaf", idx))
+			}
+
+			for pos, list := range n.Lists {
+				if _, err := postinglist.FromBytes(list); err != nil {
+					return os.NewError(fmt.Sprintf("key %d: %s", n.Keys[pos], err))
+				}
+			}
+
+			continue
+		}
+
+		if len(n.Keys) == 0 || len(n.Children) != len(n.Keys) {
+			return os.NewError(fmt.Sprintf("node %d has %d children for %d keys", idx, len(n.Children), len(n.Keys)))
+		}
+
+		for _, child := range n.Children {
+			if child < 0 || child >= idx {
+				return os.NewError(fmt.Sprintf("node %d has a bad child", idx))
+			}
+		}
+	}
+
+	return nil
+}
+
+// Check every list in full (see postinglist.Verify)
+func (t *Tree) Verify() os.Error {
+	if err := t.Check(); err != nil {
+		return err
+	}
+
+	for _, n := range t.Nodes {
+		for pos, list := range n.Lists {
+			if err := postinglist.MustFromBytes(list).Verify(); err != nil {
+				return os.NewError(fmt.Sprintf("key %d: %s", n.Keys[pos], err))
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package attribute
+
+import "bytes"
+import "testing"
+import match "basis/match"
+import postinglist "basis/match/postinglist"
+
+// Enough keys for three levels. Key k holds the single doc k + 1000.
+const keyCount = fanout*fanout + 10
+
+func buildTree(t *testing.T, count int) *Tree {
+	keys := make([]int64, count)
+	lists := make([]*postinglist.PostingList, count)
+
+	for idx := range keys {
+		keys[idx] = int64(idx*2 - count)
+
+		pl, err := postinglist.Build([]match.DocId{match.DocId(idx + 1000)}, 4, postinglist.SkipLayoutLevels)
+		if err != nil {
+			t.Fatalf("Build() = %s", err)
+		}
+
+		lists[idx] = pl
+	}
+
+	tree, err := Build(keys, lists)
+	if err != nil {
+		t.Fatalf("Build() = %s", err)
+	}
+
+	return tree
+}
+
+func TestLookup(t *testing.T) {
+	tree := buildTree(t, keyCount)
+
+	if tree.Nodes[tree.Root].leaf() || tree.Nodes[tree.Nodes[tree.Root].Children[0]].leaf() {
+		t.Fatalf("expected a tree three levels deep")
+	}
+
+	for _, idx := range []int{0, 1, fanout - 1, fanout, keyCount - 1} {
+		key := int64(idx*2 - keyCount)
+
+		pl, found := tree.Lookup(key)
+		if !found {
+			t.Errorf("Lookup(%d) not found", key)
+			continue
+		}
+
+		if it := postinglist.NewIter(pl); it.Current() != match.DocId(idx+1000) {
+			t.Errorf("Lookup(%d) holds doc %d, want %d", key, it.Current(), idx+1000)
+		}
+	}
+
+	// Between keys, and off either end
+	for _, key := range []int64{1 - keyCount, -keyCount - 1, keyCount} {
+		if _, found := tree.Lookup(key); found {
+			t.Errorf("Lookup(%d) found, want nothing", key)
+		}
+	}
+
+	if _, found := buildTree(t, 0).Lookup(0); found {
+		t.Errorf("Lookup() in an empty tree found, want nothing")
+	}
+}
+
+func TestWalk(t *testing.T) {
+	tree := buildTree(t, keyCount)
+
+	// Across a leaf boundary, from between two keys
+	lo, hi := int64(2*fanout-keyCount-5), int64(2*fanout-keyCount+20)
+	keys := []int64{}
+	tree.Walk(lo, hi, func(key int64, pl *postinglist.PostingList) {
+		keys = append(keys, key)
+	})
+
+	if len(keys) != 13 {
+		t.Fatalf("Walk(%d, %d) visited %d keys, want 13", lo, hi, len(keys))
+	}
+
+	for idx, key := range keys {
+		if want := lo + 1 + int64(idx*2); key != want {
+			t.Errorf("key %d = %d, want %d", idx, key, want)
+		}
+	}
+
+	count := 0
+	tree.Walk(-keyCount*4, keyCount*4, func(key int64, pl *postinglist.PostingList) {
+		count++
+	})
+
+	if count != keyCount {
+		t.Errorf("Walk() of everything visited %d keys, want %d", count, keyCount)
+	}
+
+	if iters := tree.Range(lo, hi); len(iters) != 13 {
+		t.Errorf("len(Range(%d, %d)) = %d, want 13", lo, hi, len(iters))
+	}
+
+	if iters := tree.Range(hi, lo); len(iters) != 0 {
+		t.Errorf("len(Range(%d, %d)) = %d, want 0", hi, lo, len(iters))
+	}
+
+	if iters := buildTree(t, 0).Range(-10, 10); len(iters) != 0 {
+		t.Errorf("len(Range()) of an empty tree = %d, want 0", len(iters))
+	}
+}
+
+func TestBuildRejects(t *testing.T) {
+	pl, _ := postinglist.Build([]match.DocId{1}, 4, postinglist.SkipLayoutLevels)
+
+	if _, err := Build([]int64{1, 2}, []*postinglist.PostingList{pl}); err == nil {
+		t.Errorf("Build() with a list missing = nil, want an error")
+	}
+
+	if _, err := Build([]int64{1, 1}, []*postinglist.PostingList{pl, pl}); err == nil {
+		t.Errorf("Build() with a repeated key = nil, want an error")
+	}
+}
+
+func TestReadTree(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	if err := buildTree(t, keyCount).Write(buf); err != nil {
+		t.Fatalf("Write() = %s", err)
+	}
+
+	tree, err := ReadTree(buf)
+	if err != nil {
+		t.Fatalf("ReadTree() = %s", err)
+	}
+
+	if err = tree.Verify(); err != nil {
+		t.Errorf("Verify() = %s", err)
+	}
+
+	if _, found := tree.Lookup(int64(2 - keyCount)); !found {
+		t.Errorf("Lookup() after reading not found")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	corrupt := map[string]func(tree *Tree){
+		"the root out of range":   func(tree *Tree) { tree.Root = len(tree.Nodes) },
+		"the first leaf internal": func(tree *Tree) { tree.First = tree.Root },
+		"a list missing":          func(tree *Tree) { tree.Nodes[0].Lists = tree.Nodes[0].Lists[1:] },
+		"a backwards next leaf":   func(tree *Tree) { tree.Nodes[1].Next = 0 },
+		"a cycle":                 func(tree *Tree) { tree.Nodes[tree.Root].Children[0] = tree.Root },
+		"a bad list":              func(tree *Tree) { tree.Nodes[0].Lists[0] = []byte{1, 2, 3} },
+	}
+
+	for name, damage := range corrupt {
+		tree := buildTree(t, keyCount)
+		damage(tree)
+
+		if err := tree.Check(); err == nil {
+			t.Errorf("Check() with %s = nil, want an error", name)
+		}
+	}
+}
@@ -0,0 +1,490 @@
+package builder
+
+import "bufio"
+import "io/ioutil"
+import "os"
+import match "basis/match"
+import postinglist "basis/match/postinglist"
+import analysis "basis/index/analysis"
+import attribute "basis/index/attribute"
+import docmap "basis/index/docmap"
+import geo "basis/index/geo"
+import numeric "basis/index/numeric"
+import segment "basis/index/segment"
+import store "basis/index/store"
+
+type Document struct {
+	Id match.DocId
+	// The doc's external key, if it has one (see keystore)
+	Key string
+
+	// field -> tokens
+	Fields map[string][]string
+	// field -> text, which the builder's analyzer turns into more
+	// tokens
+	Text map[string]string
+
+	// Attributes are indexed for range queries and also kept as
+	// numeric doc values
+	Attributes map[string]int64
+	// Values encoded by numeric.Int, Float or Time, indexed at
+	// several precisions for range queries over posting lists
+	Numbers map[string]uint64
+
+	// Sorted-string doc values, for sorting and faceting
+	Values map[string]string
+
+	// Returned with results
+	Stored map[string]string
+
+	HasLocation bool
+	Lat, Lon    float64
+}
+
+type Options struct {
+	// Spill sorted runs to disk once roughly this many bytes of
+	// postings are buffered. Stored fields are written straight to a
+	// temp file, but doc values stay in memory, so they're bounded by
+	// how many docs are added to one builder.
+	MemoryBudget uint64
+	// Where runs and stored fields are spilled ("" for the system
+	// default)
+	TempDir string
+	// Postings between skips in the final posting lists
+	SkipInterval uint
+
+	// If set, documents are renumbered by descending rank (a static
+	// score such as popularity) and the segment keeps the old -> new
+	// mapping. Docs missing from the map rank 0.
+	Ranks map[match.DocId]float64
+
+	// Splits Document.Text into tokens (analysis.Default if nil)
+	Analyzer analysis.Analyzer
+}
+
+var DefaultOptions = Options{64 << 20, "", 32, nil, nil}
+
+// Rough cost of a buffered key on top of its bytes (map entry, slice
+// header)
+const keyOverhead = 64
+
+// Inverts a stream of documents into a segment. Documents must be
+// added in ascending DocId order.
+type Builder struct {
+	options Options
+
+	postings map[string][]match.DocId
+	used     uint64
+	runs     []string
+
+	docCount int
+	maxId    match.DocId
+
+	// Every doc added, and the keys of those that have them
+	docs []match.DocId
+	keys map[match.DocId]string
+
+	// Stored fields, written to a temp file as docs are added. The
+	// segment Finish returns reads them from there.
+	stored       *os.File
+	storedBuffer *bufio.Writer
+	storedWriter *store.StoredWriter
+	values       *store.DocValues
+	sortedDocs   map[string][]match.DocId
+	sortedValues map[string][]string
+}
+
+func New(options Options) *Builder {
+	return &Builder{
+		options, make(map[string][]match.DocId), 0, []string{}, 0, 0, []match.DocId{}, make(map[match.DocId]string),
+		nil, nil, nil, store.NewDocValues(),
+		make(map[string][]match.DocId), make(map[string][]string),
+	}
+}
+
+func (b *Builder) analyzer() analysis.Analyzer {
+	if b.options.Analyzer == nil {
+		return analysis.Default
+	}
+
+	return b.options.Analyzer
+}
+
+func addNumeric(columns map[string]*store.NumericColumn, name string, doc match.DocId, value int64) os.Error {
+	column, found := columns[name]
+	if !found {
+		column = store.NewNumericColumn()
+		columns[name] = column
+	}
+
+	return column.Add(doc, value)
+}
+
+func (b *Builder) addValues(doc *Document, lengths map[string]int64) os.Error {
+	for name, value := range doc.Attributes {
+		if err := addNumeric(b.values.Numeric, name, doc.Id, value); err != nil {
+			return err
+		}
+	}
+
+	for field, length := range lengths {
+		if err := addNumeric(b.values.Lengths, field, doc.Id, length); err != nil {
+			return err
+		}
+	}
+
+	if doc.HasLocation {
+		if err := b.values.AddPoint(doc.Id, doc.Lat, doc.Lon); err != nil {
+			return err
+		}
+	}
+
+	for name, value := range doc.Values {
+		b.sortedDocs[name] = append(b.sortedDocs[name], doc.Id)
+		b.sortedValues[name] = append(b.sortedValues[name], value)
+	}
+
+	return nil
+}
+
+func (b *Builder) store(doc *Document) os.Error {
+	if b.storedWriter == nil {
+		f, err := ioutil.TempFile(b.options.TempDir, "basis-stored")
+		if err != nil {
+			return err
+		}
+
+		b.stored, b.storedBuffer = f, bufio.NewWriter(f)
+		b.storedWriter = store.NewStoredWriter(b.storedBuffer)
+	}
+
+	return b.storedWriter.Add(doc.Id, doc.Stored)
+}
+
+// Finish the stored fields and hand their file to seg
+func (b *Builder) finishStored(seg *segment.Segment) os.Error {
+	if err := b.storedWriter.Close(); err != nil {
+		return err
+	}
+
+	if err := b.storedBuffer.Flush(); err != nil {
+		return err
+	}
+
+	size, err := b.stored.Seek(0, 2)
+	if err != nil {
+		return err
+	}
+
+	if err = seg.SetStored(b.stored, size); err != nil {
+		return err
+	}
+
+	// The segment's handle keeps the contents until it's closed
+	os.Remove(b.stored.Name())
+	b.stored = nil
+
+	return nil
+}
+
+func (b *Builder) post(key string, doc match.DocId) {
+	docs, found := b.postings[key]
+
+	if !found {
+		b.used += uint64(len(key)) + keyOverhead
+	} else if docs[len(docs)-1] == doc {
+		// Repeated token
+		return
+	}
+
+	b.postings[key] = append(docs, doc)
+	b.used += 8
+}
+
+// The tokens of each doc's text, by field. All the text goes at once,
+// which is one batch of requests for a remote analyzer.
+func analyze(docs []*Document, a analysis.Analyzer) ([]map[string][]string, os.Error) {
+	fields, texts := []string{}, []string{}
+	for _, doc := range docs {
+		for field, text := range doc.Text {
+			fields = append(fields, field)
+			texts = append(texts, text)
+		}
+	}
+
+	all := [][]analysis.Token{}
+	if len(texts) > 0 {
+		var err os.Error
+		if all, err = analysis.All(a, texts); err != nil {
+			return nil, err
+		}
+	}
+
+	analyzed := make([]map[string][]string, len(docs))
+	next := 0
+
+	for idx, doc := range docs {
+		analyzed[idx] = make(map[string][]string)
+
+		for n := 0; n < len(doc.Text); n++ {
+			terms := make([]string, len(all[next]))
+			for n, token := range all[next] {
+				terms[n] = token.Text
+			}
+
+			analyzed[idx][fields[next]] = terms
+			next++
+		}
+	}
+
+	return analyzed, nil
+}
+
+// Analyze the text of docs with a (or analysis.Default if it's nil)
+// and move the tokens to their Fields, so building the docs, however
+// many times, doesn't analyze them again. The text of every doc is
+// analyzed together. If analysis fails the docs are left alone.
+func Analyze(docs []*Document, a analysis.Analyzer) os.Error {
+	if a == nil {
+		a = analysis.Default
+	}
+
+	all, err := analyze(docs, a)
+	if err != nil {
+		return err
+	}
+
+	for idx, doc := range docs {
+		if len(all[idx]) == 0 {
+			continue
+		}
+
+		if doc.Fields == nil {
+			doc.Fields = make(map[string][]string)
+		}
+
+		for field, terms := range all[idx] {
+			doc.Fields[field] = append(doc.Fields[field], terms...)
+		}
+
+		doc.Text = nil
+	}
+
+	return nil
+}
+
+func (b *Builder) Add(doc *Document) os.Error {
+	if b.docCount > 0 && doc.Id <= b.maxId {
+		return os.NewError("documents must be added in ascending DocId order")
+	}
+
+	// Analyze and store the doc before posting anything, so a doc that
+	// fails leaves no trace in the postings
+	all, err := analyze([]*Document{doc}, b.analyzer())
+	if err != nil {
+		return err
+	}
+
+	if doc.Stored != nil {
+		if err = b.store(doc); err != nil {
+			return err
+		}
+	}
+
+	analyzed := all[0]
+	lengths := make(map[string]int64)
+	for _, tokenized := range []map[string][]string{doc.Fields, analyzed} {
+		for field, tokens := range tokenized {
+			lengths[field] += int64(len(tokens))
+		}
+	}
+
+	// Docs are in order, so these can't fail
+	if err = b.addValues(doc, lengths); err != nil {
+		return err
+	}
+
+	for _, tokenized := range []map[string][]string{doc.Fields, analyzed} {
+		for field, tokens := range tokenized {
+			for _, token := range tokens {
+				b.post(termKey(field, token), doc.Id)
+			}
+		}
+	}
+
+	for name, value := range doc.Attributes {
+		b.post(attributeKey(name, value), doc.Id)
+	}
+
+	for name, value := range doc.Numbers {
+		for _, token := range numeric.Tokens(value) {
+			b.post(termKey(name, token), doc.Id)
+		}
+	}
+
+	if doc.HasLocation {
+		b.post(geoKey(doc.Lat, doc.Lon), doc.Id)
+	}
+
+	b.docCount++
+	b.maxId = doc.Id
+
+	b.docs = append(b.docs, doc.Id)
+	if doc.Key != "" {
+		b.keys[doc.Id] = doc.Key
+	}
+
+	if b.used >= b.options.MemoryBudget {
+		return b.spill()
+	}
+
+	return nil
+}
+
+// Write the buffered postings out as a sorted run
+func (b *Builder) spill() os.Error {
+	name, err := writeRun(b.options.TempDir, newMemorySource(b.postings))
+	if err != nil {
+		return err
+	}
+
+	b.runs = append(b.runs, name)
+	b.postings = make(map[string][]match.DocId)
+	b.used = 0
+
+	return nil
+}
+
+func (b *Builder) cleanup() {
+	for _, name := range b.runs {
+		os.Remove(name)
+	}
+
+	b.runs = []string{}
+
+	if b.stored != nil {
+		b.stored.Close()
+		os.Remove(b.stored.Name())
+		b.stored = nil
+	}
+}
+
+type sortedLists struct {
+	keys  []int64
+	lists []*postinglist.PostingList
+}
+
+// Merge the buffered postings and any spilled runs into a segment.
+// The builder can't be used afterwards.
+func (b *Builder) Finish() (*segment.Segment, os.Error) {
+	defer b.cleanup()
+
+	sources := []source{}
+	defer func() {
+		for _, src := range sources {
+			src.close()
+		}
+	}()
+
+	for _, name := range b.runs {
+		run, err := openRun(name)
+		if err != nil {
+			return nil, err
+		}
+
+		sources = append(sources, run)
+	}
+	sources = append(sources, newMemorySource(b.postings))
+	b.postings = nil
+
+	seg := segment.New()
+	seg.DocCount = b.docCount
+	seg.MaxId = b.maxId
+	seg.Docs = b.docs
+	seg.Keys = b.keys
+
+	// An empty segment has nothing to renumber, and no last doc to
+	// give MaxId
+	var remap *docmap.DocMap
+	if b.options.Ranks != nil && b.docCount > 0 {
+		remap = docmap.ByRank(b.docs, func(doc match.DocId) float64 {
+			return b.options.Ranks[doc]
+		})
+
+		seg.MaxId = match.DocId(b.docCount - 1)
+		seg.Remapped = true
+		seg.DocMap = remap
+	}
+
+	attributes := make(map[string]*sortedLists)
+	cells := []uint64{}
+	cellLists := []*postinglist.PostingList{}
+
+	err := merge(sources, func(key string, docs []match.DocId) os.Error {
+		if remap != nil {
+			docs = remap.Docs(docs)
+		}
+
+		pl, err := postinglist.Build(docs, b.options.SkipInterval, postinglist.SkipLayoutLevels)
+		if err != nil {
+			return err
+		}
+
+		switch key[0] {
+		case keyTerm:
+			return seg.Terms.Add(key[1:], pl)
+		case keyAttribute:
+			name, value := parseAttributeKey(key)
+
+			lists, found := attributes[name]
+			if !found {
+				lists = &sortedLists{}
+				attributes[name] = lists
+			}
+
+			lists.keys = append(lists.keys, value)
+			lists.lists = append(lists.lists, pl)
+		case keyGeo:
+			cells = append(cells, parseGeoKey(key))
+			cellLists = append(cellLists, pl)
+		default:
+			return os.NewError("unknown key type")
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for name, lists := range attributes {
+		tree, err := attribute.Build(lists.keys, lists.lists)
+		if err != nil {
+			return nil, err
+		}
+
+		seg.Attributes[name] = tree
+	}
+
+	if seg.Geo, err = geo.Build(cells, cellLists); err != nil {
+		return nil, err
+	}
+
+	for name, docs := range b.sortedDocs {
+		b.values.Sorted[name] = store.NewSortedColumn(docs, b.sortedValues[name])
+	}
+
+	seg.Values = b.values
+	if remap != nil {
+		seg.Values = b.values.Remap(remap)
+	}
+
+	if b.storedWriter != nil {
+		if err = b.finishStored(seg); err != nil {
+			return nil, err
+		}
+	}
+
+	return seg, nil
+}
@@ -0,0 +1,339 @@
+package builder
+
+import "io/ioutil"
+import "os"
+import "path"
+import "strconv"
+import "testing"
+import match "basis/match"
+import postinglist "basis/match/postinglist"
+import analysis "basis/index/analysis"
+import segment "basis/index/segment"
+
+func parity(i int) string {
+	if i%2 == 0 {
+		return "even"
+	}
+
+	return "odd"
+}
+
+func build(t *testing.T, dir string, ranks map[match.DocId]float64) *segment.Segment {
+	b := New(Options{200, dir, 4, ranks, nil})
+
+	for i := 1; i <= 500; i++ {
+		doc := &Document{
+			Id:          match.DocId(i * 2),
+			Fields:      map[string][]string{"body": []string{"all", parity(i)}},
+			Attributes:  map[string]int64{"price": int64(i%10 - 5)},
+			HasLocation: true,
+			Lat:         float64(i % 90),
+			Lon:         float64(-i % 180),
+		}
+
+		if err := b.Add(doc); err != nil {
+			t.Fatalf("Add(%d) = %s", doc.Id, err)
+		}
+	}
+
+	if len(b.runs) < 2 {
+		t.Errorf("len(runs) = %d, expected the builder to spill", len(b.runs))
+	}
+
+	seg, err := b.Finish()
+	if err != nil {
+		t.Fatalf("Finish() = %s", err)
+	}
+
+	return seg
+}
+
+func TestBuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basis-builder")
+	if err != nil {
+		t.Fatalf("TempDir() = %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = build(t, dir, nil).Write(dir); err != nil {
+		t.Fatalf("Write() = %s", err)
+	}
+
+	seg, err := segment.Open(dir)
+	if err != nil {
+		t.Fatalf("Open() = %s", err)
+	}
+
+	terms := map[string]int{"body:all": 500, "body:even": 250, "body:odd": 250}
+	for term, count := range terms {
+		pl, found := seg.Terms.Lookup(term)
+		if !found {
+			t.Errorf("Lookup(%s) not found", term)
+		} else if pl.Stats().DocCount != count {
+			t.Errorf("Lookup(%s) has %d docs, want %d", term, pl.Stats().DocCount, count)
+		}
+	}
+
+	prices := 0
+	seg.Attributes["price"].Walk(-5, -3, func(key int64, pl *postinglist.PostingList) {
+		prices += pl.Stats().DocCount
+	})
+
+	if prices != 150 {
+		t.Errorf("%d docs priced in [-5, -3], want 150", prices)
+	}
+
+	located := 0
+	for _, it := range seg.Geo.Within(10, -20, 20, -10, seg.Values.Point) {
+		for ; !it.Finished(); it.Next() {
+			located++
+		}
+	}
+
+	if located != 33 {
+		t.Errorf("%d docs within box, want 33", located)
+	}
+}
+
+func TestBuildRanked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basis-builder")
+	if err != nil {
+		t.Fatalf("TempDir() = %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Reverse the order of the docs
+	ranks := make(map[match.DocId]float64)
+	for i := 1; i <= 500; i++ {
+		ranks[match.DocId(i*2)] = float64(i)
+	}
+
+	seg := build(t, dir, ranks)
+
+	if old, _ := seg.DocMap.ToOld(0); old != 1000 {
+		t.Errorf("ToOld(0) = %d, want 1000", old)
+	}
+
+	if doc, _ := seg.DocMap.ToNew(2); doc != 499 {
+		t.Errorf("ToNew(2) = %d, want 499", doc)
+	}
+
+	pl, _ := seg.Terms.Lookup("body:even")
+	it := postinglist.NewIter(pl)
+
+	if it.Current() != 0 || pl.MaxId != 498 {
+		t.Errorf("body:even covers [%d, %d], want [0, 498]", it.Current(), pl.MaxId)
+	}
+}
+
+func TestBuildRankedEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basis-builder")
+	if err != nil {
+		t.Fatalf("TempDir() = %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := New(Options{200, dir, 4, make(map[match.DocId]float64), nil})
+
+	seg, err := b.Finish()
+	if err != nil {
+		t.Fatalf("Finish() = %s", err)
+	}
+
+	if seg.DocCount != 0 || seg.MaxId != 0 || seg.Remapped {
+		t.Errorf("empty segment has %d docs up to %d (remapped %v), want none", seg.DocCount, seg.MaxId, seg.Remapped)
+	}
+
+	if err = seg.Write(dir); err != nil {
+		t.Fatalf("Write() = %s", err)
+	}
+
+	if _, err = segment.Open(dir); err != nil {
+		t.Errorf("Open() = %s", err)
+	}
+}
+
+func TestStoredAndValues(t *testing.T) {
+	b := New(DefaultOptions)
+
+	for i := 1; i <= 2000; i++ {
+		doc := &Document{
+			Id:         match.DocId(i),
+			Attributes: map[string]int64{"price": int64(i % 7)},
+			Values:     map[string]string{"colour": parity(i)},
+			Stored:     map[string]string{"title": strconv.Itoa(i)},
+		}
+
+		if err := b.Add(doc); err != nil {
+			t.Fatalf("Add(%d) = %s", doc.Id, err)
+		}
+	}
+
+	seg, err := b.Finish()
+	if err != nil {
+		t.Fatalf("Finish() = %s", err)
+	}
+
+	for _, doc := range []match.DocId{1, 999, 2000} {
+		fields, err := seg.Document(doc)
+		if err != nil || fields["title"] != strconv.Itoa(int(doc)) {
+			t.Errorf("Document(%d) = %v, %v", doc, fields, err)
+		}
+	}
+
+	if price, _ := seg.Values.Numeric["price"].Get(20); price != 6 {
+		t.Errorf("price of 20 = %d, want 6", price)
+	}
+
+	colours := seg.Values.Sorted["colour"]
+	if colour, _ := colours.Get(7); colour != "odd" || colours.Cardinality() != 2 {
+		t.Errorf("colour of 7 = %s of %d values", colour, colours.Cardinality())
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basis-builder")
+	if err != nil {
+		t.Fatalf("TempDir() = %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = build(t, dir, nil).Write(dir); err != nil {
+		t.Fatalf("Write() = %s", err)
+	}
+
+	if err = segment.Verify(dir); err != nil {
+		t.Fatalf("Verify() = %s", err)
+	}
+
+	for _, name := range []string{segment.InfoFile, segment.TermsFile, segment.AttributesFile, segment.GeoFile} {
+		raw, err := ioutil.ReadFile(path.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Flip a bit in the middle, then put the file back
+		raw[len(raw)/2] ^= 0x10
+		if err = ioutil.WriteFile(path.Join(dir, name), raw, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = segment.Open(dir); err == nil {
+			t.Errorf("Open() with a corrupt %s file = nil error", name)
+		}
+
+		if err = segment.Verify(dir); err == nil {
+			t.Errorf("Verify() with a corrupt %s file = nil error", name)
+		}
+
+		raw[len(raw)/2] ^= 0x10
+		if err = ioutil.WriteFile(path.Join(dir, name), raw, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type failing struct{}
+
+func (failing) Analyze(text string) ([]analysis.Token, os.Error) {
+	return nil, os.NewError("analysis failed")
+}
+
+func TestAnalyze(t *testing.T) {
+	b := New(DefaultOptions)
+
+	doc := &Document{Id: 1, Text: map[string]string{"title": "Hello, hello World"}}
+	if err := b.Add(doc); err != nil {
+		t.Fatalf("Add() = %s", err)
+	}
+
+	seg, err := b.Finish()
+	if err != nil {
+		t.Fatalf("Finish() = %s", err)
+	}
+
+	for _, term := range []string{"title:hello", "title:world"} {
+		if pl, found := seg.Terms.Lookup(term); !found || pl.Stats().DocCount != 1 {
+			t.Errorf("Lookup(%s) should find doc 1", term)
+		}
+	}
+
+	options := DefaultOptions
+	options.Analyzer = failing{}
+	b = New(options)
+
+	doc = &Document{Id: 1, Fields: map[string][]string{"body": []string{"kept"}}, Text: map[string]string{"title": "x"}}
+	if err = b.Add(doc); err == nil {
+		t.Errorf("Add() should fail when analysis does")
+	}
+
+	if len(b.postings) != 0 {
+		t.Errorf("a failed Add() left %d postings", len(b.postings))
+	}
+}
+
+// Counts the batches it's given
+type counting struct {
+	batches int
+}
+
+func (c *counting) Analyze(text string) ([]analysis.Token, os.Error) {
+	return analysis.Default.Analyze(text)
+}
+
+func (c *counting) AnalyzeAll(texts []string) ([][]analysis.Token, os.Error) {
+	c.batches++
+	return analysis.All(analysis.Default, texts)
+}
+
+func TestAnalyzeDocs(t *testing.T) {
+	docs := []*Document{
+		&Document{Id: 1, Fields: map[string][]string{"title": []string{"tagged"}}, Text: map[string]string{"title": "Red fish"}},
+		&Document{Id: 2, Text: map[string]string{"title": "Blue fish", "body": "two"}},
+		&Document{Id: 3},
+	}
+
+	a := &counting{}
+	if err := Analyze(docs, a); err != nil {
+		t.Fatalf("Analyze() = %s", err)
+	}
+
+	if a.batches != 1 {
+		t.Errorf("Analyze() sent %d batches, want 1", a.batches)
+	}
+
+	options := DefaultOptions
+	options.Analyzer = a
+
+	b := New(options)
+	for _, doc := range docs {
+		if doc.Text != nil {
+			t.Errorf("doc %d still has text", doc.Id)
+		}
+
+		if err := b.Add(doc); err != nil {
+			t.Fatalf("Add(%d) = %s", doc.Id, err)
+		}
+	}
+
+	seg, err := b.Finish()
+	if err != nil {
+		t.Fatalf("Finish() = %s", err)
+	}
+
+	if a.batches != 1 {
+		t.Errorf("building analyzed %d more batches", a.batches-1)
+	}
+
+	counts := map[string]int{"title:tagged": 1, "title:red": 1, "title:fish": 2, "title:blue": 1, "body:two": 1}
+	for term, count := range counts {
+		if pl, found := seg.Terms.Lookup(term); !found || pl.Stats().DocCount != count {
+			t.Errorf("Lookup(%s) should find %d docs", term, count)
+		}
+	}
+
+	docs = []*Document{&Document{Id: 1, Text: map[string]string{"title": "x"}}}
+	if err = Analyze(docs, failing{}); err == nil || docs[0].Text == nil {
+		t.Errorf("a failed Analyze() = %v, and should leave the text", err)
+	}
+}
@@ -0,0 +1,62 @@
+package builder
+
+import geo "basis/index/geo"
+import text "basis/index/text"
+
+// Every posting the builder buffers is keyed by a string, so terms,
+// attribute values and geo cells can share the same sorted runs. The
+// first byte says which kind of key it is, and the rest sorts in the
+// same order as the underlying value.
+const (
+	keyTerm      = 't'
+	keyAttribute = 'a'
+	keyGeo       = 'g'
+)
+
+func putUInt64(dst []byte, num uint64) {
+	for idx := 7; idx >= 0; idx-- {
+		dst[idx] = byte(num)
+		num >>= 8
+	}
+}
+
+func getUInt64(src []byte) uint64 {
+	num := uint64(0)
+	for _, b := range src[:8] {
+		num = num<<8 | uint64(b)
+	}
+
+	return num
+}
+
+func termKey(field, token string) string {
+	return string(keyTerm) + text.FieldTerm(field, token)
+}
+
+// Flipping the sign bit makes negative values sort first
+func attributeKey(name string, value int64) string {
+	raw := make([]byte, len(name)+10)
+	raw[0] = keyAttribute
+	copy(raw[1:], name)
+	raw[len(name)+1] = 0
+	putUInt64(raw[len(name)+2:], uint64(value)^(1<<63))
+
+	return string(raw)
+}
+
+func geoKey(lat, lon float64) string {
+	raw := make([]byte, 9)
+	raw[0] = keyGeo
+	putUInt64(raw[1:], geo.Cell(lat, lon))
+
+	return string(raw)
+}
+
+func parseAttributeKey(key string) (name string, value int64) {
+	end := len(key) - 9
+	return key[1:end], int64(getUInt64([]byte(key[end+1:])) ^ (1 << 63))
+}
+
+func parseGeoKey(key string) uint64 {
+	return getUInt64([]byte(key[1:]))
+}
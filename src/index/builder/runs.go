@@ -0,0 +1,217 @@
+package builder
+
+import "bufio"
+import "container/heap"
+import "gob"
+import "io/ioutil"
+import "os"
+import "sort"
+import match "basis/match"
+
+// The postings for one key, in ascending doc order
+type posting struct {
+	Key  string
+	Docs []match.DocId
+}
+
+type postings []*posting
+
+func (p postings) Len() int           { return len(p) }
+func (p postings) Less(i, j int) bool { return p[i].Key < p[j].Key }
+func (p postings) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// A stream of postings in key order
+type source interface {
+	// nil once the source is exhausted
+	head() *posting
+	next() os.Error
+	close()
+}
+
+type memorySource struct {
+	postings postings
+	pos      int
+}
+
+func newMemorySource(buffered map[string][]match.DocId) *memorySource {
+	p := make(postings, 0, len(buffered))
+	for key, docs := range buffered {
+		p = append(p, &posting{key, docs})
+	}
+
+	sort.Sort(p)
+	return &memorySource{p, 0}
+}
+
+func (m *memorySource) head() *posting {
+	if m.pos >= len(m.postings) {
+		return nil
+	}
+
+	return m.postings[m.pos]
+}
+
+func (m *memorySource) next() os.Error {
+	m.pos++
+	return nil
+}
+
+func (m *memorySource) close() {}
+
+// A sorted run spilled to a temp file as a stream of gobs
+type runSource struct {
+	file    *os.File
+	dec     *gob.Decoder
+	current *posting
+}
+
+func writeRun(dir string, m *memorySource) (name string, err os.Error) {
+	f, err := ioutil.TempFile(dir, "basis-run")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	enc := gob.NewEncoder(w)
+
+	for p := m.head(); p != nil; p = m.head() {
+		if err = enc.Encode(p); err != nil {
+			os.Remove(f.Name())
+			return "", err
+		}
+
+		m.next()
+	}
+
+	if err = w.Flush(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+func openRun(name string) (*runSource, os.Error) {
+	f, err := os.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &runSource{f, gob.NewDecoder(bufio.NewReader(f)), nil}
+	if err = r.next(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *runSource) head() *posting {
+	return r.current
+}
+
+func (r *runSource) next() os.Error {
+	p := new(posting)
+	err := r.dec.Decode(p)
+
+	if err == os.EOF {
+		r.current = nil
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	r.current = p
+	return nil
+}
+
+func (r *runSource) close() {
+	r.file.Close()
+}
+
+// Sources ordered by their head key. Ties go to the earlier source,
+// which holds the earlier (smaller) docs.
+type sourceHeap struct {
+	sources []source
+	order   []int
+}
+
+func (h *sourceHeap) Len() int {
+	return len(h.sources)
+}
+
+func (h *sourceHeap) Less(i, j int) bool {
+	a, b := h.sources[i].head().Key, h.sources[j].head().Key
+	return a < b || (a == b && h.order[i] < h.order[j])
+}
+
+func (h *sourceHeap) Swap(i, j int) {
+	h.sources[i], h.sources[j] = h.sources[j], h.sources[i]
+	h.order[i], h.order[j] = h.order[j], h.order[i]
+}
+
+func (h *sourceHeap) Push(x interface{}) {
+	e := x.(heapEntry)
+	h.sources = append(h.sources, e.src)
+	h.order = append(h.order, e.order)
+}
+
+func (h *sourceHeap) Pop() interface{} {
+	last := len(h.sources) - 1
+	e := heapEntry{h.sources[last], h.order[last]}
+
+	h.sources = h.sources[:last]
+	h.order = h.order[:last]
+
+	return e
+}
+
+type heapEntry struct {
+	src   source
+	order int
+}
+
+// k-way merge the sources, concatenating the docs for each key
+func merge(sources []source, visit func(key string, docs []match.DocId) os.Error) os.Error {
+	h := &sourceHeap{}
+	for idx, src := range sources {
+		if src.head() != nil {
+			heap.Push(h, heapEntry{src, idx})
+		}
+	}
+
+	var current *posting
+	for h.Len() > 0 {
+		e := heap.Pop(h).(heapEntry)
+		p := e.src.head()
+
+		if current != nil && current.Key != p.Key {
+			if err := visit(current.Key, current.Docs); err != nil {
+				return err
+			}
+
+			current = nil
+		}
+
+		if current == nil {
+			current = &posting{p.Key, p.Docs}
+		} else {
+			current.Docs = append(current.Docs, p.Docs...)
+		}
+
+		if err := e.src.next(); err != nil {
+			return err
+		}
+
+		if e.src.head() != nil {
+			heap.Push(h, e)
+		}
+	}
+
+	if current != nil {
+		return visit(current.Key, current.Docs)
+	}
+
+	return nil
+}
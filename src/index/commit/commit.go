@@ -0,0 +1,316 @@
+package commit
+
+import "fmt"
+import "gob"
+import "os"
+import "path"
+import "sort"
+import "strconv"
+import "strings"
+import segment "basis/index/segment"
+
+// The commit point of an index directory. It's only ever replaced by
+// rename, once everything it lists is on disk, so the directory always
+// holds a complete index: the one named here.
+const File = "COMMIT"
+
+const tmpSuffix = ".tmp"
+
+// Segment directories are named with this and a number. Recovery only
+// ever deletes directories named like this.
+const SegmentPrefix = "segment-"
+
+func SegmentName(n int) string {
+	return fmt.Sprintf("%s%d", SegmentPrefix, n)
+}
+
+// The number a segment directory was named with, if it was
+func segmentNumber(name string) (int, bool) {
+	if !strings.HasPrefix(name, SegmentPrefix) {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(name[len(SegmentPrefix):])
+	return n, err == nil
+}
+
+// Numbered segments in the order they were written (segment-2 before
+// segment-10), then any others by name
+type segmentNames []string
+
+func (s segmentNames) Len() int { return len(s) }
+func (s segmentNames) Less(i, j int) bool {
+	a, aNumbered := segmentNumber(s[i])
+	b, bNumbered := segmentNumber(s[j])
+
+	if aNumbered != bNumbered {
+		return aNumbered
+	} else if aNumbered && a != b {
+		return a < b
+	}
+
+	return s[i] < s[j]
+}
+func (s segmentNames) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+type Segment struct {
+	Name string
+	// The segment's deletions file, if it isn't segment.DeletedFile
+	Deleted string
+}
+
+type Point struct {
+	Generation uint64
+	Segments   []Segment
+
+	// Whatever the writer wants committed along with the segments,
+	// such as how far through its input it got
+	Meta map[string]string
+}
+
+// The deletions file for a segment's deletions as of a generation
+func DeletedName(generation uint64) string {
+	return fmt.Sprintf("%s-%d", segment.DeletedFile, generation)
+}
+
+// The last commit, or an empty one if there hasn't been one
+func Read(dir string) (*Point, os.Error) {
+	f, err := os.Open(path.Join(dir, File), os.O_RDONLY, 0)
+	if err != nil {
+		if _, statErr := os.Stat(path.Join(dir, File)); statErr != nil {
+			return &Point{0, []Segment{}, make(map[string]string)}, nil
+		}
+
+		return nil, err
+	}
+	defer f.Close()
+
+	p := new(Point)
+	if err = gob.NewDecoder(f).Decode(p); err != nil {
+		return nil, err
+	}
+
+	if p.Meta == nil {
+		p.Meta = make(map[string]string)
+	}
+
+	return p, nil
+}
+
+// Commit p. Everything it lists must already be synced (see SyncDir).
+func Write(dir string, p *Point) os.Error {
+	tmp := path.Join(dir, File+tmpSuffix)
+
+	f, err := os.Open(tmp, os.O_WRONLY|os.O_CREAT|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err = gob.NewEncoder(f).Encode(p); err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err = os.Rename(tmp, path.Join(dir, File)); err != nil {
+		return err
+	}
+
+	// Make the rename itself durable
+	return syncFile(dir)
+}
+
+func syncFile(name string) os.Error {
+	f, err := os.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
+
+func list(dir string) ([]string, os.Error) {
+	d, err := os.Open(dir, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	return d.Readdirnames(-1)
+}
+
+// fsync every file in dir, then dir itself
+func SyncDir(dir string) os.Error {
+	names, err := list(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err = syncFile(path.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+
+	return syncFile(dir)
+}
+
+// The segments of dir's commit, or if it has none (a directory of
+// segments written some other way) every segment directory in it, in
+// the order segmentNames gives
+func Segments(dir string) ([]Segment, os.Error) {
+	p, err := Read(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Generation > 0 {
+		return p.Segments, nil
+	}
+
+	names, err := list(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(segmentNames(names))
+
+	segs := []Segment{}
+	for _, name := range names {
+		if _, err := os.Stat(path.Join(dir, name, segment.InfoFile)); err == nil {
+			segs = append(segs, Segment{name, ""})
+		}
+	}
+
+	return segs, nil
+}
+
+// Open one of a commit's segments, with its committed deletions
+func OpenSegment(dir string, s Segment) (*segment.Segment, os.Error) {
+	segDir := path.Join(dir, s.Name)
+
+	seg, err := segment.Open(segDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Deleted != "" && s.Deleted != segment.DeletedFile {
+		if err = seg.ReadDeleted(segDir, s.Deleted); err != nil {
+			seg.Close()
+			return nil, err
+		}
+	}
+
+	return seg, nil
+}
+
+// Whether a file in the segment's directory is part of the commit.
+// Deletions files other than the named one, and temporary files, aren't.
+func (s Segment) Uses(name string) bool {
+	if strings.HasSuffix(name, tmpSuffix) {
+		return false
+	}
+
+	return !strings.HasPrefix(name, segment.DeletedFile+"-") || name == s.Deleted
+}
+
+// The paths in dir that the commit doesn't use: segment directories
+// it doesn't list, their deletions files it doesn't name, and
+// temporary files. Only names the index writes itself are considered,
+// so anything else kept in dir is left alone.
+func Orphans(dir string, p *Point) ([]string, os.Error) {
+	names, err := list(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	live := make(map[string]Segment)
+	for _, s := range p.Segments {
+		live[s.Name] = s
+	}
+
+	orphans := []string{}
+	for _, name := range names {
+		s, found := live[name]
+
+		if strings.HasSuffix(name, tmpSuffix) || !found && strings.HasPrefix(name, SegmentPrefix) {
+			orphans = append(orphans, path.Join(dir, name))
+			continue
+		}
+
+		if !found {
+			continue
+		}
+
+		files, err := list(path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			if !s.Uses(file) {
+				orphans = append(orphans, path.Join(dir, name, file))
+			}
+		}
+	}
+
+	return orphans, nil
+}
+
+// Delete the orphans left by commits that didn't finish (or by commits
+// that replaced what they used), returning what was deleted. Without a
+// commit point nothing is known to be unused, so nothing is deleted
+// (see Adopt).
+func Recover(dir string) ([]string, os.Error) {
+	p, err := Read(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Generation == 0 {
+		return []string{}, nil
+	}
+
+	orphans, err := Orphans(dir, p)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, orphan := range orphans {
+		if err = os.RemoveAll(orphan); err != nil {
+			return nil, err
+		}
+	}
+
+	return orphans, nil
+}
+
+// The last commit. A directory of segments written before there were
+// commit points has none, so its segments (see Segments) are committed
+// as they are first, to be kept by Recover.
+func Adopt(dir string) (*Point, os.Error) {
+	p, err := Read(dir)
+	if err != nil || p.Generation > 0 {
+		return p, err
+	}
+
+	segs, err := Segments(dir)
+	if err != nil || len(segs) == 0 {
+		return p, err
+	}
+
+	adopted := &Point{1, segs, p.Meta}
+	if err = Write(dir, adopted); err != nil {
+		return nil, err
+	}
+
+	return adopted, nil
+}
@@ -0,0 +1,208 @@
+package commit
+
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path"
+import "sort"
+import "testing"
+import match "basis/match"
+import builder "basis/index/builder"
+import segment "basis/index/segment"
+
+func writeSegment(t *testing.T, dir, name string, from, to int) *segment.Segment {
+	b := builder.New(builder.DefaultOptions)
+
+	for i := from; i < to; i++ {
+		doc := &builder.Document{
+			Id:     match.DocId(i),
+			Fields: map[string][]string{"body": []string{"all"}},
+			Stored: map[string]string{"n": fmt.Sprint(i)},
+		}
+
+		if err := b.Add(doc); err != nil {
+			t.Fatalf("Add(%d) = %s", i, err)
+		}
+	}
+
+	seg, err := b.Finish()
+	if err != nil {
+		t.Fatalf("Finish() = %s", err)
+	}
+
+	segDir := path.Join(dir, name)
+	if err = os.MkdirAll(segDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = seg.Write(segDir); err != nil {
+		t.Fatalf("Write() = %s", err)
+	}
+
+	if err = SyncDir(segDir); err != nil {
+		t.Fatalf("SyncDir() = %s", err)
+	}
+
+	return seg
+}
+
+func TestRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basis-commit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if p, err := Read(dir); err != nil || p.Generation != 0 || len(p.Segments) != 0 {
+		t.Fatalf("Read() of a new directory = %v, %v, want an empty commit", p, err)
+	}
+
+	first := writeSegment(t, dir, "segment-0", 0, 10)
+	first.Delete(2)
+	if err = first.WriteDeletedTo(path.Join(dir, "segment-0"), DeletedName(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = Write(dir, &Point{1, []Segment{Segment{"segment-0", DeletedName(1)}}, nil}); err != nil {
+		t.Fatalf("Write() = %s", err)
+	}
+
+	// A commit that crashes before its rename: a new segment, new
+	// deletions and a half written commit point
+	writeSegment(t, dir, "segment-1", 10, 20)
+	first.Delete(3)
+	if err = first.WriteDeletedTo(path.Join(dir, "segment-0"), DeletedName(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(path.Join(dir, File+tmpSuffix), []byte("junk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.MkdirAll(path.Join(dir, "wal"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := Read(dir)
+	if err != nil || p.Generation != 1 || len(p.Segments) != 1 {
+		t.Fatalf("Read() = %v, %v, want generation 1", p, err)
+	}
+
+	seg, err := OpenSegment(dir, p.Segments[0])
+	if err != nil {
+		t.Fatalf("OpenSegment() = %s", err)
+	}
+
+	if !seg.IsDeleted(2) || seg.IsDeleted(3) {
+		t.Errorf("OpenSegment() deletions = %d docs, want only the committed doc 2", seg.DeletedCount)
+	}
+	seg.Close()
+
+	removed, err := Recover(dir)
+	if err != nil {
+		t.Fatalf("Recover() = %s", err)
+	}
+
+	want := []string{
+		path.Join(dir, File+tmpSuffix),
+		path.Join(dir, "segment-0", DeletedName(2)),
+		path.Join(dir, "segment-1"),
+	}
+
+	sort.SortStrings(removed)
+	if fmt.Sprint(removed) != fmt.Sprint(want) {
+		t.Errorf("Recover() removed %v, want %v", removed, want)
+	}
+
+	for _, name := range []string{File, "wal", path.Join("segment-0", DeletedName(1)), path.Join("segment-0", segment.InfoFile)} {
+		if _, err = os.Stat(path.Join(dir, name)); err != nil {
+			t.Errorf("Recover() removed %s", name)
+		}
+	}
+}
+
+// A directory from before commit points: bare segment directories, with
+// their deletions in segment.DeletedFile, and other things alongside
+func TestAdopt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basis-commit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := writeSegment(t, dir, SegmentName(0), 0, 10)
+	first.Delete(4)
+	if err = first.WriteDeleted(path.Join(dir, SegmentName(0))); err != nil {
+		t.Fatal(err)
+	}
+	writeSegment(t, dir, SegmentName(1), 10, 20)
+
+	for _, name := range []string{"wal", "backup"} {
+		if err = os.MkdirAll(path.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if removed, err := Recover(dir); err != nil || len(removed) != 0 {
+		t.Fatalf("Recover() without a commit = %v, %v, want nothing removed", removed, err)
+	}
+
+	p, err := Adopt(dir)
+	if err != nil {
+		t.Fatalf("Adopt() = %s", err)
+	}
+
+	if p.Generation != 1 || len(p.Segments) != 2 || p.Segments[0].Name != SegmentName(0) || p.Segments[1].Name != SegmentName(1) {
+		t.Fatalf("Adopt() = %v, want both segments at generation 1", p)
+	}
+
+	if removed, err := Recover(dir); err != nil || len(removed) != 0 {
+		t.Errorf("Recover() after Adopt() = %v, %v, want nothing removed", removed, err)
+	}
+
+	for _, name := range []string{"wal", "backup", SegmentName(0), SegmentName(1)} {
+		if _, err = os.Stat(path.Join(dir, name)); err != nil {
+			t.Errorf("%s was removed", name)
+		}
+	}
+
+	seg, err := OpenSegment(dir, p.Segments[0])
+	if err != nil {
+		t.Fatalf("OpenSegment() = %s", err)
+	}
+	defer seg.Close()
+
+	if !seg.IsDeleted(4) {
+		t.Errorf("the adopted segment lost its deletions")
+	}
+
+	if again, err := Adopt(dir); err != nil || again.Generation != 1 {
+		t.Errorf("Adopt() of a committed directory = %v, %v, want the commit unchanged", again, err)
+	}
+}
+
+func TestSegmentsOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basis-commit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"segment-10", "imported", SegmentName(2), "segment-x", SegmentName(1)} {
+		writeSegment(t, dir, name, 0, 1)
+	}
+
+	segs, err := Segments(dir)
+	if err != nil {
+		t.Fatalf("Segments() = %s", err)
+	}
+
+	names := []string{}
+	for _, s := range segs {
+		names = append(names, s.Name)
+	}
+
+	if got := fmt.Sprint(names); got != "[segment-1 segment-2 segment-10 imported segment-x]" {
+		t.Errorf("Segments() = %s, want [segment-1 segment-2 segment-10 imported segment-x]", got)
+	}
+}
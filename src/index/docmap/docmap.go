@@ -0,0 +1,203 @@
+package docmap
+
+import "gob"
+import "io"
+import "os"
+import "sort"
+import match "basis/match"
+import bitset "basis/match/bitset"
+import postinglist "basis/match/postinglist"
+
+// A renumbering of documents. Documents are given new DocIds in order
+// of descending rank, so the best documents come first in every
+// posting list and a query can stop early once it has enough hits.
+type DocMap struct {
+	// Old ids in ascending order, and the new id of each
+	Old []match.DocId
+	New []match.DocId
+
+	// ByNew[new - Base] is the old id
+	ByNew []match.DocId
+	// The first new id
+	Base match.DocId
+}
+
+type ranked struct {
+	docs  []match.DocId
+	ranks []float64
+}
+
+func (r *ranked) Len() int {
+	return len(r.docs)
+}
+
+// Highest rank first, ties broken by the old id
+func (r *ranked) Less(i, j int) bool {
+	if r.ranks[i] != r.ranks[j] {
+		return r.ranks[i] > r.ranks[j]
+	}
+
+	return r.docs[i] < r.docs[j]
+}
+
+func (r *ranked) Swap(i, j int) {
+	r.docs[i], r.docs[j] = r.docs[j], r.docs[i]
+	r.ranks[i], r.ranks[j] = r.ranks[j], r.ranks[i]
+}
+
+// Number docs (in ascending order) by descending rank, starting at 0
+func ByRank(docs []match.DocId, rank func(match.DocId) float64) *DocMap {
+	r := &ranked{make([]match.DocId, len(docs)), make([]float64, len(docs))}
+	for idx, doc := range docs {
+		r.docs[idx] = doc
+		r.ranks[idx] = rank(doc)
+	}
+
+	sort.Sort(r)
+
+	m := &DocMap{make([]match.DocId, len(docs)), make([]match.DocId, len(docs)), r.docs, 0}
+	copy(m.Old, docs)
+
+	for doc, old := range m.ByNew {
+		idx, _ := m.find(old)
+		m.New[idx] = match.DocId(doc)
+	}
+
+	return m
+}
+
+// Number docs (in ascending order) from base, keeping their order
+func Sequential(docs []match.DocId, base match.DocId) *DocMap {
+	m := &DocMap{make([]match.DocId, len(docs)), make([]match.DocId, len(docs)), make([]match.DocId, len(docs)), base}
+	copy(m.Old, docs)
+	copy(m.ByNew, docs)
+
+	for idx := range m.New {
+		m.New[idx] = base + match.DocId(idx)
+	}
+
+	return m
+}
+
+type pairs struct {
+	old, new []match.DocId
+}
+
+func (p *pairs) Len() int           { return len(p.old) }
+func (p *pairs) Less(i, j int) bool { return p.old[i] < p.old[j] }
+func (p *pairs) Swap(i, j int) {
+	p.old[i], p.old[j] = p.old[j], p.old[i]
+	p.new[i], p.new[j] = p.new[j], p.new[i]
+}
+
+// Apply first then second. Docs that second drops are dropped.
+func Compose(first, second *DocMap) *DocMap {
+	p := &pairs{[]match.DocId{}, []match.DocId{}}
+
+	for idx, old := range first.Old {
+		if doc, found := second.ToNew(first.New[idx]); found {
+			p.old = append(p.old, old)
+			p.new = append(p.new, doc)
+		}
+	}
+
+	sort.Sort(p)
+
+	m := &DocMap{p.old, p.new, make([]match.DocId, len(second.ByNew)), second.Base}
+	for idx, doc := range m.New {
+		m.ByNew[doc-m.Base] = m.Old[idx]
+	}
+
+	return m
+}
+
+func (m *DocMap) find(old match.DocId) (int, bool) {
+	idx := sort.Search(len(m.Old), func(i int) bool { return m.Old[i] >= old })
+	return idx, idx < len(m.Old) && m.Old[idx] == old
+}
+
+func (m *DocMap) Len() int {
+	return len(m.Old)
+}
+
+func (m *DocMap) ToNew(old match.DocId) (match.DocId, bool) {
+	idx, found := m.find(old)
+	if !found {
+		return 0, false
+	}
+
+	return m.New[idx], true
+}
+
+func (m *DocMap) ToOld(doc match.DocId) (match.DocId, bool) {
+	if doc < m.Base || uint64(doc-m.Base) >= uint64(len(m.ByNew)) {
+		return 0, false
+	}
+
+	return m.ByNew[doc-m.Base], true
+}
+
+// The largest new id
+func (m *DocMap) MaxId() match.DocId {
+	return m.Base + match.DocId(len(m.ByNew)) - 1
+}
+
+type docIds []match.DocId
+
+func (d docIds) Len() int           { return len(d) }
+func (d docIds) Less(i, j int) bool { return d[i] < d[j] }
+func (d docIds) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// Renumber docs, returning them in ascending order. Docs that aren't
+// in the map are dropped.
+func (m *DocMap) Docs(docs []match.DocId) []match.DocId {
+	mapped := make(docIds, 0, len(docs))
+
+	for _, doc := range docs {
+		if doc, found := m.ToNew(doc); found {
+			mapped = append(mapped, doc)
+		}
+	}
+
+	sort.Sort(mapped)
+	return mapped
+}
+
+func (m *DocMap) List(pl *postinglist.PostingList, skipInterval uint) (*postinglist.PostingList, os.Error) {
+	docs := []match.DocId{}
+	if err := pl.Docs(func(doc match.DocId) { docs = append(docs, doc) }); err != nil {
+		return nil, err
+	}
+
+	return postinglist.Build(m.Docs(docs), skipInterval, postinglist.SkipLayoutLevels)
+}
+
+// Renumber the docs in b. Docs that aren't in the map are dropped.
+func (m *DocMap) BitSet(b *bitset.BitSet) (*bitset.BitSet, os.Error) {
+	remapped := bitset.New(uint(m.MaxId()) + 1)
+
+	for idx, old := range m.Old {
+		if !b.Contains(old) {
+			continue
+		}
+
+		if err := remapped.Add(m.New[idx]); err != nil {
+			return nil, err
+		}
+	}
+
+	return remapped, nil
+}
+
+func (m *DocMap) Write(w io.Writer) os.Error {
+	return gob.NewEncoder(w).Encode(m)
+}
+
+func ReadDocMap(r io.Reader) (*DocMap, os.Error) {
+	m := new(DocMap)
+	if err := gob.NewDecoder(r).Decode(m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
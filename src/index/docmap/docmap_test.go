@@ -0,0 +1,121 @@
+package docmap
+
+import "bytes"
+import "testing"
+import match "basis/match"
+import bitset "basis/match/bitset"
+import postinglist "basis/match/postinglist"
+
+var docs = []match.DocId{2, 4, 6, 8}
+
+// 6 ranks highest, and 2 and 8 tie
+func rank(doc match.DocId) float64 {
+	return map[match.DocId]float64{2: 1, 4: 2, 6: 3, 8: 1}[doc]
+}
+
+// Check m maps exactly the old ids in want to their new ids
+func check(t *testing.T, name string, m *DocMap, want map[match.DocId]match.DocId) {
+	if m.Len() != len(want) {
+		t.Errorf("%s: Len() = %d, want %d", name, m.Len(), len(want))
+	}
+
+	for old, new := range want {
+		if doc, found := m.ToNew(old); !found || doc != new {
+			t.Errorf("%s: ToNew(%d) = %d, %v, want %d", name, old, doc, found, new)
+		}
+
+		if doc, found := m.ToOld(new); !found || doc != old {
+			t.Errorf("%s: ToOld(%d) = %d, %v, want %d", name, new, doc, found, old)
+		}
+	}
+}
+
+func TestByRank(t *testing.T) {
+	m := ByRank(docs, rank)
+	check(t, "ByRank", m, map[match.DocId]match.DocId{6: 0, 4: 1, 2: 2, 8: 3})
+
+	if m.MaxId() != 3 {
+		t.Errorf("MaxId() = %d, want 3", m.MaxId())
+	}
+
+	if _, found := m.ToNew(5); found {
+		t.Errorf("ToNew(5) found, want nothing")
+	}
+
+	if _, found := m.ToOld(4); found {
+		t.Errorf("ToOld(4) found, want nothing")
+	}
+}
+
+func TestSequential(t *testing.T) {
+	m := Sequential(docs, 10)
+	check(t, "Sequential", m, map[match.DocId]match.DocId{2: 10, 4: 11, 6: 12, 8: 13})
+
+	if _, found := m.ToOld(9); found {
+		t.Errorf("ToOld(9) found, want nothing")
+	}
+}
+
+func TestCompose(t *testing.T) {
+	// Drop 4 (new id 1) on the way through
+	second := Sequential([]match.DocId{0, 2, 3}, 20)
+	m := Compose(ByRank(docs, rank), second)
+
+	check(t, "Compose", m, map[match.DocId]match.DocId{6: 20, 2: 21, 8: 22})
+
+	if _, found := m.ToNew(4); found {
+		t.Errorf("ToNew(4) found, want it dropped")
+	}
+}
+
+func TestRenumber(t *testing.T) {
+	m := ByRank(docs, rank)
+
+	mapped := m.Docs([]match.DocId{8, 3, 6})
+	if len(mapped) != 2 || mapped[0] != 0 || mapped[1] != 3 {
+		t.Errorf("Docs() = %v, want [0 3]", mapped)
+	}
+
+	pl, _ := postinglist.Build([]match.DocId{2, 4, 5}, 4, postinglist.SkipLayoutLevels)
+	remapped, err := m.List(pl, 4)
+	if err != nil {
+		t.Fatalf("List() = %s", err)
+	}
+
+	listed := []match.DocId{}
+	remapped.Docs(func(doc match.DocId) { listed = append(listed, doc) })
+
+	if len(listed) != 2 || listed[0] != 1 || listed[1] != 2 {
+		t.Errorf("List() = %v, want [1 2]", listed)
+	}
+
+	b := bitset.New(10)
+	b.Add(4)
+	b.Add(8)
+	b.Add(9)
+
+	renumbered, err := m.BitSet(b)
+	if err != nil {
+		t.Fatalf("BitSet() = %s", err)
+	}
+
+	for doc := match.DocId(0); doc <= m.MaxId(); doc++ {
+		if want := doc == 1 || doc == 3; renumbered.Contains(doc) != want {
+			t.Errorf("BitSet().Contains(%d) = %v, want %v", doc, !want, want)
+		}
+	}
+}
+
+func TestReadDocMap(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	if err := Sequential(docs, 10).Write(buf); err != nil {
+		t.Fatalf("Write() = %s", err)
+	}
+
+	m, err := ReadDocMap(buf)
+	if err != nil {
+		t.Fatalf("ReadDocMap() = %s", err)
+	}
+
+	check(t, "ReadDocMap", m, map[match.DocId]match.DocId{2: 10, 4: 11, 6: 12, 8: 13})
+}
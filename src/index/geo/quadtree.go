@@ -0,0 +1,252 @@
+package geo
+
+import "fmt"
+import "gob"
+import "io"
+import "os"
+import "sort"
+import match "basis/match"
+import postinglist "basis/match/postinglist"
+
+// Points are bucketed into the cells of a quad tree Depth levels deep.
+// A cell id interleaves the bits of the cell's row and column (a
+// z-order curve), so every quad tree node covers a contiguous range
+// of cell ids and the tree never has to be stored explicitly.
+const Depth = 16
+
+// Queries stop descending at this level. The docs of cells a box only
+// partly covers are checked against their points.
+const queryDepth = 12
+
+// Where a doc is, or false if its point wasn't kept
+type Points func(doc match.DocId) (lat, lon float64, found bool)
+
+type Index struct {
+	Cells []uint64
+	Lists [][]byte
+}
+
+func scale(value, min, max float64) uint64 {
+	cells := float64(uint64(1) << Depth)
+	pos := (value - min) / (max - min) * cells
+
+	if pos < 0 {
+		return 0
+	} else if pos >= cells {
+		return uint64(cells) - 1
+	}
+
+	return uint64(pos)
+}
+
+func interleave(row, col uint64) uint64 {
+	cell := uint64(0)
+
+	for bit := uint(0); bit < Depth; bit++ {
+		cell |= (row >> bit & 1) << (2*bit + 1)
+		cell |= (col >> bit & 1) << (2 * bit)
+	}
+
+	return cell
+}
+
+// The leaf cell holding a point
+func Cell(lat, lon float64) uint64 {
+	return interleave(scale(lat, -90, 90), scale(lon, -180, 180))
+}
+
+// Build an index from cells in ascending order and their posting lists
+func Build(cells []uint64, lists []*postinglist.PostingList) (*Index, os.Error) {
+	if len(cells) != len(lists) {
+		return nil, os.NewError("need exactly one posting list per cell")
+	}
+
+	g := &Index{make([]uint64, len(cells)), make([][]byte, len(cells))}
+
+	for idx, cell := range cells {
+		if idx > 0 && cells[idx-1] >= cell {
+			return nil, os.NewError("cells must be unique and ascending")
+		}
+
+		g.Cells[idx] = cell
+		g.Lists[idx] = make([]byte, lists[idx].Size())
+		lists[idx].ToBytes(g.Lists[idx])
+	}
+
+	return g, nil
+}
+
+type box struct {
+	minLat, minLon, maxLat, maxLon float64
+}
+
+func (b box) contains(o box) bool {
+	return b.minLat <= o.minLat && o.maxLat <= b.maxLat && b.minLon <= o.minLon && o.maxLon <= b.maxLon
+}
+
+func (b box) intersects(o box) bool {
+	return b.minLat <= o.maxLat && o.minLat <= b.maxLat && b.minLon <= o.maxLon && o.minLon <= b.maxLon
+}
+
+func (b box) containsPoint(lat, lon float64) bool {
+	return b.minLat <= lat && lat <= b.maxLat && b.minLon <= lon && lon <= b.maxLon
+}
+
+// Skips the docs of a cell's list that aren't in a box. Docs without
+// a point are kept.
+type checked struct {
+	*postinglist.PostingListIterator
+
+	query  box
+	points Points
+}
+
+func newChecked(it *postinglist.PostingListIterator, query box, points Points) *checked {
+	c := &checked{it, query, points}
+	c.skip()
+
+	return c
+}
+
+func (c *checked) skip() {
+	for !c.Finished() {
+		lat, lon, found := c.points(c.Current())
+		if !found || c.query.containsPoint(lat, lon) {
+			return
+		}
+
+		c.PostingListIterator.Next()
+	}
+}
+
+func (c *checked) Next() (match.DocId, bool) {
+	c.PostingListIterator.Next()
+	c.skip()
+
+	return c.Current(), c.Finished()
+}
+
+func (c *checked) Seek(target match.DocId) (match.DocId, bool) {
+	if c.Current() < target {
+		c.PostingListIterator.Seek(target)
+		c.skip()
+	}
+
+	return c.Current(), c.Finished()
+}
+
+// Collect the lists in the half-open range of cell ids [lo, hi),
+// checking their docs against the query if the range isn't inside it
+func (g *Index) cellRange(lo, hi uint64, query box, points Points, iters []match.MatchIterator) []match.MatchIterator {
+	idx := sort.Search(len(g.Cells), func(i int) bool { return g.Cells[i] >= lo })
+
+	for ; idx < len(g.Cells) && g.Cells[idx] < hi; idx++ {
+		it := postinglist.NewIter(g.List(idx))
+		if points != nil {
+			iters = append(iters, newChecked(it, query, points))
+		} else {
+			iters = append(iters, it)
+		}
+	}
+
+	return iters
+}
+
+func (g *Index) search(query, node box, points Points, prefix uint64, level uint, iters []match.MatchIterator) []match.MatchIterator {
+	if !query.intersects(node) {
+		return iters
+	}
+
+	shift := 2 * (Depth - level)
+	if query.contains(node) {
+		return g.cellRange(prefix<<shift, (prefix+1)<<shift, query, nil, iters)
+	} else if level == queryDepth {
+		return g.cellRange(prefix<<shift, (prefix+1)<<shift, query, points, iters)
+	}
+
+	midLat := (node.minLat + node.maxLat) / 2
+	midLon := (node.minLon + node.maxLon) / 2
+
+	// Children in z-order: the low bit is the column, the high bit the row
+	children := []box{
+		box{node.minLat, node.minLon, midLat, midLon},
+		box{node.minLat, midLon, midLat, node.maxLon},
+		box{midLat, node.minLon, node.maxLat, midLon},
+		box{midLat, midLon, node.maxLat, node.maxLon},
+	}
+
+	for idx, child := range children {
+		iters = g.search(query, child, points, prefix<<2|uint64(idx), level+1, iters)
+	}
+
+	return iters
+}
+
+// Iterators over the docs in a bounding box, ready to be unioned with
+// match.Merge. Docs in cells the box only partly covers are checked
+// with points; if points is nil, or a doc has none, they're all taken,
+// so results near the edge of the box are approximate.
+func (g *Index) Within(minLat, minLon, maxLat, maxLon float64, points Points) []match.MatchIterator {
+	query := box{minLat, minLon, maxLat, maxLon}
+	world := box{-90, -180, 90, 180}
+
+	return g.search(query, world, points, 0, 0, []match.MatchIterator{})
+}
+
+func (g *Index) Write(w io.Writer) os.Error {
+	return gob.NewEncoder(w).Encode(g)
+}
+
+func ReadIndex(r io.Reader) (*Index, os.Error) {
+	g := new(Index)
+	if err := gob.NewDecoder(r).Decode(g); err != nil {
+		return nil, err
+	}
+
+	if err := g.Check(); err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// The list of the idx'th cell
+func (g *Index) List(idx int) *postinglist.PostingList {
+	// Checked when the index was read
+	return postinglist.MustFromBytes(g.Lists[idx])
+}
+
+// Check that the cells are sorted and every list is framed, so
+// searches can't fail
+func (g *Index) Check() os.Error {
+	if len(g.Lists) != len(g.Cells) {
+		return os.NewError(fmt.Sprintf("%d lists for %d cells", len(g.Lists), len(g.Cells)))
+	}
+
+	for idx, cell := range g.Cells {
+		if idx > 0 && g.Cells[idx-1] >= cell {
+			return os.NewError(fmt.Sprintf("cell %d is out of order", cell))
+		}
+
+		if _, err := postinglist.FromBytes(g.Lists[idx]); err != nil {
+			return os.NewError(fmt.Sprintf("cell %d: %s", cell, err))
+		}
+	}
+
+	return nil
+}
+
+// Check every list in full (see postinglist.Verify)
+func (g *Index) Verify() os.Error {
+	if err := g.Check(); err != nil {
+		return err
+	}
+
+	for idx, cell := range g.Cells {
+		if err := g.List(idx).Verify(); err != nil {
+			return os.NewError(fmt.Sprintf("cell %d: %s", cell, err))
+		}
+	}
+
+	return nil
+}
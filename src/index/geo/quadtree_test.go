@@ -0,0 +1,171 @@
+package geo
+
+import "bytes"
+import "sort"
+import "testing"
+import match "basis/match"
+import postinglist "basis/match/postinglist"
+
+type point struct {
+	lat, lon float64
+}
+
+// Near the edge of the box (10, 10, 20, 20), 2 and 5 are just outside
+// it but share a cell with 1
+var points = map[match.DocId]point{
+	1: point{10.01, 10.01},
+	2: point{9.99, 10.01},
+	3: point{15, 15},
+	4: point{30, 30},
+	5: point{9.995, 10.01},
+}
+
+type cellIds []uint64
+
+func (c cellIds) Len() int           { return len(c) }
+func (c cellIds) Less(i, j int) bool { return c[i] < c[j] }
+func (c cellIds) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+func buildIndex(t *testing.T) *Index {
+	docs := make(map[uint64][]match.DocId)
+	for doc := match.DocId(1); doc <= 5; doc++ {
+		cell := Cell(points[doc].lat, points[doc].lon)
+		docs[cell] = append(docs[cell], doc)
+	}
+
+	cells := cellIds{}
+	for cell := range docs {
+		cells = append(cells, cell)
+	}
+	sort.Sort(cells)
+
+	lists := []*postinglist.PostingList{}
+	for _, cell := range cells {
+		pl, err := postinglist.Build(docs[cell], 4, postinglist.SkipLayoutLevels)
+		if err != nil {
+			t.Fatalf("Build(%v) = %s", docs[cell], err)
+		}
+
+		lists = append(lists, pl)
+	}
+
+	g, err := Build(cells, lists)
+	if err != nil {
+		t.Fatalf("Build() = %s", err)
+	}
+
+	return g
+}
+
+// Every doc the iterators match, in order
+func collect(iters []match.MatchIterator) []match.DocId {
+	found := make(map[match.DocId]bool)
+	for _, it := range iters {
+		for ; !it.Finished(); it.Next() {
+			found[it.Current()] = true
+		}
+	}
+
+	docs := []match.DocId{}
+	for doc := match.DocId(1); doc <= 5; doc++ {
+		if found[doc] {
+			docs = append(docs, doc)
+		}
+	}
+
+	return docs
+}
+
+func equal(a, b []match.DocId) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestWithin(t *testing.T) {
+	g := buildIndex(t)
+
+	// 5 has no point, so it can't be checked
+	lookup := func(doc match.DocId) (float64, float64, bool) {
+		if doc == 5 {
+			return 0, 0, false
+		}
+
+		return points[doc].lat, points[doc].lon, true
+	}
+
+	want := []match.DocId{1, 3, 5}
+	if docs := collect(g.Within(10, 10, 20, 20, lookup)); !equal(docs, want) {
+		t.Errorf("Within() = %v, want %v", docs, want)
+	}
+
+	// Without points, the whole edge cell is taken
+	want = []match.DocId{1, 2, 3, 5}
+	if docs := collect(g.Within(10, 10, 20, 20, nil)); !equal(docs, want) {
+		t.Errorf("Within(nil) = %v, want %v", docs, want)
+	}
+
+	if docs := collect(g.Within(-50, -50, -40, -40, lookup)); len(docs) != 0 {
+		t.Errorf("Within() of an empty box = %v, want none", docs)
+	}
+}
+
+func TestBuildRejects(t *testing.T) {
+	pl, _ := postinglist.Build([]match.DocId{1}, 4, postinglist.SkipLayoutLevels)
+
+	if _, err := Build([]uint64{1, 2}, []*postinglist.PostingList{pl}); err == nil {
+		t.Errorf("Build() with a list missing = nil, want an error")
+	}
+
+	if _, err := Build([]uint64{2, 1}, []*postinglist.PostingList{pl, pl}); err == nil {
+		t.Errorf("Build() out of order = nil, want an error")
+	}
+}
+
+func TestReadIndex(t *testing.T) {
+	g := buildIndex(t)
+
+	buf := bytes.NewBuffer(nil)
+	if err := g.Write(buf); err != nil {
+		t.Fatalf("Write() = %s", err)
+	}
+
+	read, err := ReadIndex(buf)
+	if err != nil {
+		t.Fatalf("ReadIndex() = %s", err)
+	}
+
+	if err = read.Verify(); err != nil {
+		t.Errorf("Verify() = %s", err)
+	}
+
+	want := collect(g.Within(10, 10, 20, 20, nil))
+	if docs := collect(read.Within(10, 10, 20, 20, nil)); !equal(docs, want) {
+		t.Errorf("Within() after reading = %v, want %v", docs, want)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	corrupt := map[string]func(g *Index){
+		"a list missing": func(g *Index) { g.Lists = g.Lists[1:] },
+		"out of order":   func(g *Index) { g.Cells[0], g.Cells[1] = g.Cells[1], g.Cells[0] },
+		"a bad list":     func(g *Index) { g.Lists[0] = []byte{1, 2, 3} },
+	}
+
+	for name, damage := range corrupt {
+		g := buildIndex(t)
+		damage(g)
+
+		if err := g.Check(); err == nil {
+			t.Errorf("Check() with %s = nil, want an error", name)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package keystore
+
+import match "basis/match"
+
+// Maps external string keys to DocIds and back. DocIds are handed out
+// in increasing order, so docs can be indexed in the order they're
+// assigned. Changing a doc gives it a new DocId (the old one should be
+// deleted), so a DocId always names one version of one doc.
+type KeyStore struct {
+	Next match.DocId
+	Keys map[string]match.DocId
+
+	docs map[match.DocId]string
+}
+
+func New() *KeyStore {
+	return &KeyStore{0, make(map[string]match.DocId), make(map[match.DocId]string)}
+}
+
+func (k *KeyStore) Lookup(key string) (match.DocId, bool) {
+	doc, found := k.Keys[key]
+	return doc, found
+}
+
+func (k *KeyStore) Key(doc match.DocId) (string, bool) {
+	key, found := k.docs[doc]
+	return key, found
+}
+
+func (k *KeyStore) Len() int {
+	return len(k.Keys)
+}
+
+// A new DocId, not tied to any key yet
+func (k *KeyStore) Allocate() match.DocId {
+	doc := k.Next
+	k.Next++
+
+	return doc
+}
+
+// Remove a key, returning the DocId it had
+func (k *KeyStore) Delete(key string) (match.DocId, bool) {
+	doc, found := k.Keys[key]
+	if !found {
+		return 0, false
+	}
+
+	k.Keys[key] = 0, false
+	k.docs[doc] = "", false
+
+	return doc, true
+}
+
+// Record a key's DocId, as when reloading keys from segments. DocIds
+// assigned afterwards are larger than doc.
+func (k *KeyStore) Set(key string, doc match.DocId) {
+	k.Delete(key)
+	k.set(key, doc)
+	k.Reserve(doc)
+}
+
+func (k *KeyStore) set(key string, doc match.DocId) {
+	k.Keys[key] = doc
+	k.docs[doc] = key
+}
+
+// Make sure DocIds assigned from now on are larger than doc, which was
+// assigned some other way
+func (k *KeyStore) Reserve(doc match.DocId) {
+	if doc >= k.Next {
+		k.Next = doc + 1
+	}
+}
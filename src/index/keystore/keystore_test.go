@@ -0,0 +1,40 @@
+package keystore
+
+import "testing"
+
+func TestKeys(t *testing.T) {
+	k := New()
+	k.Reserve(9)
+
+	a := k.Allocate()
+	if a != 10 {
+		t.Errorf("Allocate() = %d, want 10", a)
+	}
+
+	k.Set("a", a)
+	k.Set("b", 20)
+
+	// A new version of a
+	again := k.Allocate()
+	if again != 21 {
+		t.Errorf("Allocate() after Set(b, 20) = %d, want 21", again)
+	}
+
+	k.Set("a", again)
+
+	if _, found := k.Key(a); found {
+		t.Errorf("Key(%d) still found after a was given %d", a, again)
+	}
+
+	if doc, found := k.Lookup("a"); !found || doc != again {
+		t.Errorf("Lookup(a) = %d, want %d", doc, again)
+	}
+
+	if doc, found := k.Delete("b"); !found || doc != 20 || k.Len() != 1 {
+		t.Errorf("Delete(b) = %d, %t, want 20, true", doc, found)
+	}
+
+	if doc := k.Allocate(); doc != 22 {
+		t.Errorf("Allocate() after Delete(b) = %d, want 22", doc)
+	}
+}
@@ -0,0 +1,135 @@
+// Numeric fields indexed as terms, so a range query can be answered
+// from posting lists without a B+ tree (see attribute). Each value is
+// indexed at several precisions: as itself, and with its low Step,
+// 2*Step ... bits cut off. A range is covered by a few of these
+// prefixes, coarse ones for its middle and finer ones at its ends, so
+// it expands to a small number of terms whatever its width.
+//
+// Values are encoded as uint64s that sort in the same order as the
+// numbers they stand for.
+package numeric
+
+import "fmt"
+import "math"
+import "time"
+
+// Bits cut off for each coarser precision. Smaller steps mean more
+// terms per value but fewer per range.
+const Step = 4
+
+// Flipping the sign bit makes negative values sort first
+func Int(value int64) uint64 {
+	return uint64(value) ^ (1 << 63)
+}
+
+func ToInt(encoded uint64) int64 {
+	return int64(encoded ^ (1 << 63))
+}
+
+// Positive floats sort like their bits once the sign bit is set;
+// negative ones sort backwards, so all their bits are flipped
+func Float(value float64) uint64 {
+	bits := math.Float64bits(value)
+	if bits>>63 == 1 {
+		return ^bits
+	}
+
+	return bits | 1<<63
+}
+
+func ToFloat(encoded uint64) float64 {
+	if encoded>>63 == 1 {
+		return math.Float64frombits(encoded &^ (1 << 63))
+	}
+
+	return math.Float64frombits(^encoded)
+}
+
+// To the second
+func Time(t *time.Time) uint64 {
+	return Int(t.Seconds())
+}
+
+// The value's bits above shift. Tokens start with # so they can't be
+// mistaken for words.
+func token(shift uint, prefix uint64) string {
+	return fmt.Sprintf("#%d/%x", shift, prefix)
+}
+
+func tokens(encoded uint64, step uint) []string {
+	all := []string{}
+	for shift := uint(0); shift < 64; shift += step {
+		all = append(all, token(shift, encoded>>shift))
+	}
+
+	return all
+}
+
+// The tokens to index a value with
+func Tokens(encoded uint64) []string {
+	return tokens(encoded, Step)
+}
+
+// Calls visit with the prefixes that together cover [min, max] exactly
+// once: every prefix from lo to hi at shift
+func split(min, max uint64, step uint, visit func(shift uint, lo, hi uint64)) {
+	for shift := uint(0); ; shift += step {
+		// Values that share a prefix one precision up, and the bits
+		// of this precision
+		diff := uint64(1) << (shift + step)
+		mask := (uint64(1)<<step - 1) << shift
+
+		hasLower := min&mask != 0
+		hasUpper := max&mask != mask
+
+		nextMin, nextMax := min&^mask, max&^mask
+		if hasLower {
+			nextMin = (min + diff) &^ mask
+		}
+
+		if hasUpper {
+			nextMax = (max - diff) &^ mask
+		}
+
+		// Done once the coarser precision can't cover anything more
+		// (or the bounds wrapped around)
+		if shift+step >= 64 || nextMin > nextMax || nextMin < min || nextMax > max {
+			visit(shift, min>>shift, max>>shift)
+			return
+		}
+
+		if hasLower {
+			visit(shift, min>>shift, (min|mask)>>shift)
+		}
+
+		if hasUpper {
+			visit(shift, (max&^mask)>>shift, max>>shift)
+		}
+
+		min, max = nextMin, nextMax
+	}
+}
+
+func rangeTokens(min, max uint64, step uint) []string {
+	all := []string{}
+	if min > max {
+		return all
+	}
+
+	split(min, max, step, func(shift uint, lo, hi uint64) {
+		for prefix := lo; ; prefix++ {
+			all = append(all, token(shift, prefix))
+			if prefix == hi {
+				break
+			}
+		}
+	})
+
+	return all
+}
+
+// The tokens whose docs, unioned, are the docs with a value in
+// [min, max]
+func RangeTokens(min, max uint64) []string {
+	return rangeTokens(min, max, Step)
+}
@@ -0,0 +1,105 @@
+package numeric
+
+import "math"
+import "rand"
+import "sort"
+import "testing"
+
+func TestInt(t *testing.T) {
+	values := []int64{math.MinInt64, -1 << 40, -2, -1, 0, 1, 2, 1 << 40, math.MaxInt64}
+
+	for idx, value := range values {
+		if ToInt(Int(value)) != value {
+			t.Errorf("ToInt(Int(%d)) = %d", value, ToInt(Int(value)))
+		}
+
+		if idx > 0 && Int(values[idx-1]) >= Int(value) {
+			t.Errorf("Int(%d) sorts after Int(%d)", values[idx-1], value)
+		}
+	}
+}
+
+func TestFloat(t *testing.T) {
+	values := []float64{math.Inf(-1), -1e300, -2.5, -1, -1e-300, 0, 1e-300, 1, 2.5, 1e300, math.Inf(1)}
+
+	for idx, value := range values {
+		if ToFloat(Float(value)) != value {
+			t.Errorf("ToFloat(Float(%g)) = %g", value, ToFloat(Float(value)))
+		}
+
+		if idx > 0 && Float(values[idx-1]) >= Float(value) {
+			t.Errorf("Float(%g) sorts after Float(%g)", values[idx-1], value)
+		}
+	}
+}
+
+// Whether value is in the range rangeTokens gave
+func covered(value uint64, step uint, inRange map[string]bool) bool {
+	hits := 0
+	for _, token := range tokens(value, step) {
+		if inRange[token] {
+			hits++
+		}
+	}
+
+	// No value should be counted twice
+	return hits == 1
+}
+
+func checkRange(t *testing.T, values []uint64, min, max uint64, step uint) {
+	inRange := make(map[string]bool)
+	for _, token := range rangeTokens(min, max, step) {
+		if inRange[token] {
+			t.Fatalf("[%d, %d] step %d: %s given twice", min, max, step, token)
+		}
+
+		inRange[token] = true
+	}
+
+	// Every precision can add up to 2^step - 1 tokens at each end
+	if limit := 2 * (64/int(step) + 1) * (1<<step - 1); len(inRange) > limit {
+		t.Errorf("[%d, %d] step %d: %d tokens, more than %d", min, max, step, len(inRange), limit)
+	}
+
+	for _, value := range values {
+		if want := value >= min && value <= max; covered(value, step, inRange) != want {
+			t.Errorf("[%d, %d] step %d: %d covered = %v", min, max, step, value, !want)
+		}
+	}
+}
+
+type uint64s []uint64
+
+func (u uint64s) Len() int           { return len(u) }
+func (u uint64s) Less(i, j int) bool { return u[i] < u[j] }
+func (u uint64s) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+
+func TestRange(t *testing.T) {
+	values := uint64s{0, 1, 2, 15, 16, 17, 255, 256, math.MaxUint64 - 1, math.MaxUint64}
+	for i := 0; i < 100; i++ {
+		values = append(values, uint64(rand.Int63())<<1|uint64(rand.Intn(2)))
+		values = append(values, uint64(rand.Intn(1000)))
+	}
+	sort.Sort(values)
+
+	for _, step := range []uint{1, 3, 4, 8} {
+		checkRange(t, values, 0, math.MaxUint64, step)
+		checkRange(t, values, 5, 5, step)
+		checkRange(t, values, 16, 255, step)
+		checkRange(t, values, math.MaxUint64-1, math.MaxUint64, step)
+
+		for i := 0; i < 20; i++ {
+			a, b := values[rand.Intn(len(values))], values[rand.Intn(len(values))]
+			if a > b {
+				a, b = b, a
+			}
+
+			checkRange(t, values, a, b, step)
+			checkRange(t, values, a+1, b, step)
+		}
+	}
+
+	if len(RangeTokens(10, 9)) != 0 {
+		t.Errorf("an empty range should have no tokens")
+	}
+}
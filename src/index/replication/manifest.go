@@ -0,0 +1,143 @@
+package replication
+
+import "fmt"
+import "hash/crc32"
+import "io"
+import "os"
+import "path"
+import "sort"
+import "strings"
+import commit "basis/index/commit"
+
+type File struct {
+	Name     string
+	Size     int64
+	Checksum uint32
+}
+
+type Segment struct {
+	Name  string
+	Files []File
+}
+
+// The segments that make up one generation of an index, with a
+// checksum of every file
+type Manifest struct {
+	Generation uint64
+	Segments   []Segment
+	// Written to a replica's generation directory once it's fetched,
+	// which makes the directory an index directory
+	Commit *commit.Point
+}
+
+// Files are checksummed with CRC-32C, as segments checksum their own
+// files
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func checksum(r io.Reader) (uint32, int64, os.Error) {
+	h := crc32.New(castagnoli)
+
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return h.Sum32(), size, nil
+}
+
+func checksumFile(name string) (uint32, int64, os.Error) {
+	f, err := os.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	return checksum(f)
+}
+
+func listDir(dir string) ([]string, os.Error) {
+	f, err := os.Open(dir, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SortStrings(names)
+	return names, nil
+}
+
+// Checksum every file of a commit's segments in dir
+func Snapshot(dir string, p *commit.Point) (*Manifest, os.Error) {
+	m := &Manifest{p.Generation, make([]Segment, len(p.Segments)), p}
+
+	for idx, ref := range p.Segments {
+		name := ref.Name
+
+		names, err := listDir(path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		seg := Segment{name, []File{}}
+		for _, fileName := range names {
+			if !ref.Uses(fileName) {
+				continue
+			}
+
+			sum, size, err := checksumFile(path.Join(dir, name, fileName))
+			if err != nil {
+				return nil, err
+			}
+
+			seg.Files = append(seg.Files, File{fileName, size, sum})
+		}
+
+		m.Segments[idx] = seg
+	}
+
+	return m, nil
+}
+
+func (m *Manifest) file(segment, name string) (File, bool) {
+	for _, seg := range m.Segments {
+		if seg.Name != segment {
+			continue
+		}
+
+		for _, f := range seg.Files {
+			if f.Name == name {
+				return f, true
+			}
+		}
+	}
+
+	return File{}, false
+}
+
+// A segment or file name that's safe to join to a directory
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// Manifests come from the source, so every name is checked before a
+// replica makes a path of it
+func (m *Manifest) check() os.Error {
+	for _, seg := range m.Segments {
+		if !validName(seg.Name) {
+			return os.NewError(fmt.Sprintf("the manifest has a bad segment name %q", seg.Name))
+		}
+
+		for _, f := range seg.Files {
+			if !validName(f.Name) {
+				return os.NewError(fmt.Sprintf("the manifest has a bad file name %q in %s", f.Name, seg.Name))
+			}
+		}
+	}
+
+	return nil
+}
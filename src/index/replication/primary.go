@@ -0,0 +1,164 @@
+package replication
+
+import "fmt"
+import "gob"
+import "http"
+import "io"
+import "os"
+import "path"
+import "strings"
+import "sync"
+import commit "basis/index/commit"
+
+// Where a replica gets an index from
+type Source interface {
+	Manifest() (*Manifest, os.Error)
+	Open(segment, name string) (io.ReadCloser, os.Error)
+}
+
+var ErrNotPublished = os.NewError("nothing has been published")
+
+// Serves the segments of an index directory. The index publishes each
+// commit once it's written.
+type Primary struct {
+	dir string
+
+	lock     sync.RWMutex
+	manifest *Manifest
+}
+
+func NewPrimary(dir string) *Primary {
+	return &Primary{dir, sync.RWMutex{}, nil}
+}
+
+func (p *Primary) Publish(point *commit.Point) os.Error {
+	m, err := Snapshot(p.dir, point)
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.manifest = m
+	return nil
+}
+
+func (p *Primary) Manifest() (*Manifest, os.Error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	if p.manifest == nil {
+		return nil, ErrNotPublished
+	}
+
+	return p.manifest, nil
+}
+
+// Only files in the current manifest can be opened. Committed files
+// don't change, but one can be removed once a later commit replaces
+// it, in which case the replica fails and tries again later.
+func (p *Primary) Open(segment, name string) (io.ReadCloser, os.Error) {
+	m, err := p.Manifest()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, found := m.file(segment, name); !found {
+		return nil, os.NewError(fmt.Sprintf("%s/%s isn't published", segment, name))
+	}
+
+	f, err := os.Open(path.Join(p.dir, segment, name), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Serves a source over HTTP:
+//   GET prefix/manifest               the manifest, as a gob
+//   GET prefix/files/{segment}/{name} a file
+type handler struct {
+	prefix string
+	source Source
+}
+
+func NewHandler(prefix string, source Source) http.Handler {
+	return &handler{prefix, source}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" || !strings.HasPrefix(r.URL.Path, h.prefix) {
+		http.NotFound(w, r)
+		return
+	}
+
+	request := r.URL.Path[len(h.prefix):]
+	if request == "/manifest" {
+		m, err := h.source.Manifest()
+		if err != nil {
+			http.Error(w, err.String(), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		gob.NewEncoder(w).Encode(m)
+		return
+	}
+
+	parts := strings.Split(request, "/", -1)
+	if len(parts) != 4 || parts[0] != "" || parts[1] != "files" {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := h.source.Open(parts[2], parts[3])
+	if err != nil {
+		http.Error(w, err.String(), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	io.Copy(w, f)
+}
+
+// A source served by NewHandler at url (which includes the prefix)
+type HTTPSource struct {
+	URL    string
+	Client *http.Client
+}
+
+func (s *HTTPSource) get(url string) (io.ReadCloser, os.Error) {
+	resp, err := s.Client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, os.NewError(fmt.Sprintf("GET %s: %s", url, resp.Status))
+	}
+
+	return resp.Body, nil
+}
+
+func (s *HTTPSource) Manifest() (*Manifest, os.Error) {
+	body, err := s.get(s.URL + "/manifest")
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	m := new(Manifest)
+	if err = gob.NewDecoder(body).Decode(m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (s *HTTPSource) Open(segment, name string) (io.ReadCloser, os.Error) {
+	return s.get(s.URL + "/files/" + segment + "/" + name)
+}
@@ -0,0 +1,279 @@
+package replication
+
+import "fmt"
+import "gob"
+import "hash/crc32"
+import "io"
+import "io/ioutil"
+import "os"
+import "path"
+import "strings"
+import "sync"
+import commit "basis/index/commit"
+
+// Names the generation directory a replica is serving
+const CurrentFile = "CURRENT"
+const manifestFile = "manifest"
+
+// A copy of an index, kept up to date from a source. Each generation
+// goes in its own directory, and CURRENT is switched to it (by rename)
+// only once every file has been fetched, checked and synced, so a
+// replica always has a complete generation to serve, after a crash
+// too.
+type Replica struct {
+	dir    string
+	source Source
+
+	// Held through a Sync, so only one runs at a time
+	syncing sync.Mutex
+
+	// Guards current, which a Sync switches while others read it
+	lock    sync.Mutex
+	current *Manifest
+}
+
+func generationDir(generation uint64) string {
+	return fmt.Sprintf("gen-%d", generation)
+}
+
+func OpenReplica(dir string, source Source) (*Replica, os.Error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	r := &Replica{dir, source, sync.Mutex{}, sync.Mutex{}, nil}
+
+	current, err := ioutil.ReadFile(path.Join(dir, CurrentFile))
+	if err != nil {
+		// Nothing synced yet
+		return r, nil
+	}
+
+	f, err := os.Open(path.Join(dir, strings.TrimSpace(string(current)), manifestFile), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r.current = new(Manifest)
+	if err = gob.NewDecoder(f).Decode(r.current); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// The manifest of the generation being served, or nil
+func (r *Replica) manifest() *Manifest {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.current
+}
+
+// The generation being served, or false if there isn't one yet
+func (r *Replica) Generation() (uint64, bool) {
+	current := r.manifest()
+	if current == nil {
+		return 0, false
+	}
+
+	return current.Generation, true
+}
+
+// The directory holding the current generation's segments
+func (r *Replica) Dir() string {
+	return r.dirOf(r.manifest())
+}
+
+func (r *Replica) dirOf(m *Manifest) string {
+	if m == nil {
+		return ""
+	}
+
+	return path.Join(r.dir, generationDir(m.Generation))
+}
+
+func (r *Replica) Segments() []string {
+	names := []string{}
+	if current := r.manifest(); current != nil {
+		for _, seg := range current.Segments {
+			names = append(names, seg.Name)
+		}
+	}
+
+	return names
+}
+
+// Fetch the source's generation if it's newer, and switch to it.
+// Returns whether the replica switched.
+func (r *Replica) Sync() (bool, os.Error) {
+	r.syncing.Lock()
+	defer r.syncing.Unlock()
+
+	m, err := r.source.Manifest()
+	if err != nil {
+		return false, err
+	}
+
+	current := r.manifest()
+	if current != nil && m.Generation <= current.Generation {
+		return false, nil
+	}
+
+	if err = m.check(); err != nil {
+		return false, err
+	}
+
+	dir := path.Join(r.dir, generationDir(m.Generation))
+
+	// Left over from a sync that failed
+	if err = os.RemoveAll(dir); err != nil {
+		return false, err
+	}
+
+	if err = r.fetch(current, m, dir); err != nil {
+		os.RemoveAll(dir)
+		return false, err
+	}
+
+	old := r.dirOf(current)
+	if err = r.switchTo(m); err != nil {
+		os.RemoveAll(dir)
+		return false, err
+	}
+
+	// Anything still reading the old generation keeps its open files
+	if old != "" {
+		os.RemoveAll(old)
+	}
+
+	return true, nil
+}
+
+// Fetch m into dir, linking files that haven't changed since current.
+// Everything, directories included, is synced before it returns.
+func (r *Replica) fetch(current, m *Manifest, dir string) os.Error {
+	for _, seg := range m.Segments {
+		segDir := path.Join(dir, seg.Name)
+		if err := os.MkdirAll(segDir, 0755); err != nil {
+			return err
+		}
+
+		for _, f := range seg.Files {
+			if r.reuse(current, seg.Name, f, path.Join(segDir, f.Name)) {
+				continue
+			}
+
+			if err := r.download(seg.Name, f, path.Join(segDir, f.Name)); err != nil {
+				return err
+			}
+		}
+
+		if err := commit.SyncDir(segDir); err != nil {
+			return err
+		}
+	}
+
+	if m.Commit != nil {
+		if err := commit.Write(dir, m.Commit); err != nil {
+			return err
+		}
+	}
+
+	err := writeSynced(path.Join(dir, manifestFile), func(w io.Writer) os.Error {
+		return gob.NewEncoder(w).Encode(m)
+	})
+	if err != nil {
+		return err
+	}
+
+	// The segment directories' entries, and the generation's own
+	if err = commit.SyncDir(dir); err != nil {
+		return err
+	}
+
+	return commit.SyncDir(r.dir)
+}
+
+// Link an unchanged file from the current generation
+func (r *Replica) reuse(current *Manifest, segment string, f File, dst string) bool {
+	if current == nil {
+		return false
+	}
+
+	have, found := current.file(segment, f.Name)
+	if !found || have.Size != f.Size || have.Checksum != f.Checksum {
+		return false
+	}
+
+	return os.Link(path.Join(r.dirOf(current), segment, f.Name), dst) == nil
+}
+
+func (r *Replica) download(segment string, f File, dst string) os.Error {
+	src, err := r.source.Open(segment, f.Name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	return writeSynced(dst, func(w io.Writer) os.Error {
+		h := crc32.New(castagnoli)
+
+		size, err := io.Copy(io.MultiWriter(w, h), src)
+		if err != nil {
+			return err
+		}
+
+		if size != f.Size || h.Sum32() != f.Checksum {
+			return os.NewError(fmt.Sprintf("%s/%s doesn't match its checksum", segment, f.Name))
+		}
+
+		return nil
+	})
+}
+
+// Write a file and fsync it
+func writeSynced(name string, write func(io.Writer) os.Error) os.Error {
+	f, err := os.Open(name, os.O_WRONLY|os.O_CREAT|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err = write(f); err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func (r *Replica) switchTo(m *Manifest) os.Error {
+	tmp := path.Join(r.dir, CurrentFile+".tmp")
+
+	err := writeSynced(tmp, func(w io.Writer) os.Error {
+		_, err := io.WriteString(w, generationDir(m.Generation)+"\n")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp, path.Join(r.dir, CurrentFile)); err != nil {
+		return err
+	}
+
+	// Or a crash could bring the old generation back
+	if err = commit.SyncDir(r.dir); err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	r.current = m
+	r.lock.Unlock()
+
+	return nil
+}
@@ -0,0 +1,261 @@
+package replication
+
+import "bytes"
+import "fmt"
+import "http"
+import "http/httptest"
+import "io"
+import "io/ioutil"
+import "os"
+import "path"
+import "testing"
+import match "basis/match"
+import builder "basis/index/builder"
+import commit "basis/index/commit"
+import segment "basis/index/segment"
+
+func writeSegment(t *testing.T, dir, name string, from, to int) *segment.Segment {
+	b := builder.New(builder.DefaultOptions)
+
+	for i := from; i < to; i++ {
+		doc := &builder.Document{
+			Id:     match.DocId(i),
+			Fields: map[string][]string{"body": []string{"all"}},
+			Stored: map[string]string{"n": fmt.Sprint(i)},
+		}
+
+		if err := b.Add(doc); err != nil {
+			t.Fatalf("Add(%d) = %s", i, err)
+		}
+	}
+
+	seg, err := b.Finish()
+	if err != nil {
+		t.Fatalf("Finish() = %s", err)
+	}
+
+	segDir := path.Join(dir, name)
+	if err = os.MkdirAll(segDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = seg.Write(segDir); err != nil {
+		t.Fatalf("Write() = %s", err)
+	}
+
+	return seg
+}
+
+// Flips a byte of every file it serves
+type corrupt struct {
+	Source
+}
+
+func (c corrupt) Open(segment, name string) (io.ReadCloser, os.Error) {
+	f, err := c.Source.Open(segment, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	raw, err := ioutil.ReadAll(f)
+	if len(raw) > 0 {
+		raw[0] ^= 0xFF
+	}
+
+	return ioutil.NopCloser(bytes.NewBuffer(raw)), err
+}
+
+func TestReplicate(t *testing.T) {
+	root, err := ioutil.TempDir("", "basis-replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	primaryDir, replicaDir := path.Join(root, "primary"), path.Join(root, "replica")
+	first := writeSegment(t, primaryDir, "segment-0", 0, 10)
+	writeSegment(t, primaryDir, "segment-1", 10, 20)
+
+	primary := NewPrimary(primaryDir)
+	point := &commit.Point{1, []commit.Segment{commit.Segment{"segment-0", ""}, commit.Segment{"segment-1", ""}}, nil}
+	if err = primary.Publish(point); err != nil {
+		t.Fatalf("Publish() = %s", err)
+	}
+
+	server := httptest.NewServer(NewHandler("/replication", primary))
+	defer server.Close()
+
+	replica, err := OpenReplica(replicaDir, &HTTPSource{server.URL + "/replication", http.DefaultClient})
+	if err != nil {
+		t.Fatalf("OpenReplica() = %s", err)
+	}
+
+	if switched, err := replica.Sync(); !switched || err != nil {
+		t.Fatalf("Sync() = %t, %v, want true", switched, err)
+	}
+
+	seg, err := segment.Open(path.Join(replica.Dir(), "segment-1"))
+	if err != nil {
+		t.Fatalf("Open(segment-1) = %s", err)
+	}
+
+	if fields, _ := seg.Document(15); fields["n"] != "15" {
+		t.Errorf("Document(15) = %v, want n=15", fields)
+	}
+	seg.Close()
+
+	// Ship a deletion
+	first.Delete(3)
+	if err = first.WriteDeletedTo(path.Join(primaryDir, "segment-0"), commit.DeletedName(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	point = &commit.Point{2, []commit.Segment{commit.Segment{"segment-0", commit.DeletedName(2)}, commit.Segment{"segment-1", ""}}, nil}
+	if err = primary.Publish(point); err != nil {
+		t.Fatalf("Publish() = %s", err)
+	}
+
+	// A replica that gets bad bytes stays on its generation
+	bad, _ := OpenReplica(replicaDir, corrupt{primary})
+	if switched, err := bad.Sync(); switched || err == nil {
+		t.Errorf("Sync() of corrupt files = %t, %v, want an error", switched, err)
+	}
+
+	if generation, _ := bad.Generation(); generation != 1 {
+		t.Errorf("Generation() after a failed sync = %d, want 1", generation)
+	}
+
+	if switched, err := replica.Sync(); !switched || err != nil {
+		t.Fatalf("Sync() = %t, %v, want true", switched, err)
+	}
+
+	// A reopened replica picks up where it was
+	reopened, err := OpenReplica(replicaDir, primary)
+	if err != nil {
+		t.Fatalf("OpenReplica() = %s", err)
+	}
+
+	if generation, _ := reopened.Generation(); generation != 2 || reopened.Dir() != path.Join(replicaDir, "gen-2") {
+		t.Errorf("reopened replica is at %d (%s), want 2", generation, reopened.Dir())
+	}
+
+	// The generation directory opens as the committed index
+	point, err = commit.Read(reopened.Dir())
+	if err != nil || point.Generation != 2 {
+		t.Fatalf("Read() of the replica's commit = %v, %v, want generation 2", point, err)
+	}
+
+	seg, err = commit.OpenSegment(reopened.Dir(), point.Segments[0])
+	if err != nil {
+		t.Fatalf("OpenSegment(segment-0) = %s", err)
+	}
+
+	if !seg.IsDeleted(3) || seg.IsDeleted(4) {
+		t.Errorf("replicated deletions = %d docs, want doc 3", seg.DeletedCount)
+	}
+	seg.Close()
+
+	if _, err = os.Stat(path.Join(replicaDir, "gen-1")); err == nil {
+		t.Errorf("gen-1 wasn't removed after the switch")
+	}
+
+	if switched, err := reopened.Sync(); switched || err != nil {
+		t.Errorf("Sync() with nothing new = %t, %v, want false", switched, err)
+	}
+}
+
+// Serves a fixed manifest, and the same bytes for every file
+type static struct {
+	manifest *Manifest
+}
+
+func (s static) Manifest() (*Manifest, os.Error) {
+	return s.manifest, nil
+}
+
+func (s static) Open(segment, name string) (io.ReadCloser, os.Error) {
+	return ioutil.NopCloser(bytes.NewBufferString("")), nil
+}
+
+func TestBadNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basis-replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	empty := []File{File{"terms", 0, 0}}
+	manifests := []*Manifest{
+		&Manifest{1, []Segment{Segment{"../escaped", empty}}, nil},
+		&Manifest{1, []Segment{Segment{"..", empty}}, nil},
+		&Manifest{1, []Segment{Segment{"segment-0", []File{File{"../../escaped", 0, 0}}}}, nil},
+		&Manifest{1, []Segment{Segment{"segment-0", []File{File{"sub/file", 0, 0}}}}, nil},
+	}
+
+	for _, m := range manifests {
+		r, err := OpenReplica(path.Join(dir, "replica"), static{m})
+		if err != nil {
+			t.Fatalf("OpenReplica() = %s", err)
+		}
+
+		if switched, err := r.Sync(); err == nil || switched {
+			t.Errorf("Sync() of %+v = %v, %v, want an error", m.Segments, switched, err)
+		}
+
+		if _, err = os.Stat(path.Join(dir, "replica", "escaped")); err == nil {
+			t.Errorf("Sync() of %+v wrote outside the replica", m.Segments)
+		}
+	}
+}
+
+// A new generation of the same empty segment on every call
+type growing struct {
+	static
+	generation uint64
+}
+
+func (g *growing) Manifest() (*Manifest, os.Error) {
+	g.generation++
+	return &Manifest{g.generation, []Segment{Segment{"segment-0", []File{File{"terms", 0, 0}}}}, nil}, nil
+}
+
+func TestSyncWhileReading(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basis-replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := OpenReplica(dir, &growing{})
+	if err != nil {
+		t.Fatalf("OpenReplica() = %s", err)
+	}
+
+	done := make(chan bool)
+	go func() {
+		for n := 0; n < 20; n++ {
+			if _, err := r.Sync(); err != nil {
+				t.Errorf("Sync() = %s", err)
+			}
+		}
+
+		done <- true
+	}()
+
+	// Run with -race to check the reads against the switches
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+			if _, found := r.Generation(); found && r.Dir() == "" {
+				t.Fatalf("Dir() is empty with a generation being served")
+			}
+		}
+	}
+
+	if generation, _ := r.Generation(); generation != 20 {
+		t.Errorf("Generation() = %d, want 20", generation)
+	}
+}
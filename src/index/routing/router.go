@@ -0,0 +1,42 @@
+package routing
+
+// Jump consistent hash (Lamping and Veach): the bucket in [0, buckets)
+// for a key. Growing from n to n+1 buckets moves only 1/(n+1) of the
+// keys, all of them into the new bucket.
+func Jump(key uint64, buckets int) int {
+	b, j := int64(-1), int64(0)
+
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+
+	return int(b)
+}
+
+const (
+	fnvOffset = 14695981039346656037
+	fnvPrime  = 1099511628211
+)
+
+// 64 bit FNV-1a
+func hash(key string) uint64 {
+	h := uint64(fnvOffset)
+
+	for idx := 0; idx < len(key); idx++ {
+		h ^= uint64(key[idx])
+		h *= fnvPrime
+	}
+
+	return h
+}
+
+// Picks the shard that owns each external doc key
+type Router struct {
+	Shards int
+}
+
+func (r Router) Route(key string) int {
+	return Jump(hash(key), r.Shards)
+}
@@ -0,0 +1,102 @@
+package routing
+
+import "fmt"
+import "testing"
+import match "basis/match"
+import postinglist "basis/match/postinglist"
+import builder "basis/index/builder"
+
+func TestJump(t *testing.T) {
+	counts := make([]int, 10)
+
+	for key := uint64(0); key < 10000; key++ {
+		before := Jump(key, 10)
+		after := Jump(key, 11)
+
+		if after != before && after != 10 {
+			t.Fatalf("Jump(%d) moved from %d to %d, want 10", key, before, after)
+		}
+
+		counts[before]++
+	}
+
+	for bucket, count := range counts {
+		if count < 800 || count > 1200 {
+			t.Errorf("bucket %d got %d of 10000 keys", bucket, count)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	from := NewTable(1)
+	b := builder.New(builder.DefaultOptions)
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("doc-%d", i)
+		loc := from.Assign(key)
+
+		doc := &builder.Document{
+			Id:     loc.Doc,
+			Fields: map[string][]string{"body": []string{"all", key}},
+			Stored: map[string]string{"key": key},
+		}
+
+		if err := b.Add(doc); err != nil {
+			t.Fatalf("Add(%s) = %s", key, err)
+		}
+	}
+
+	seg, err := b.Finish()
+	if err != nil {
+		t.Fatalf("Finish() = %s", err)
+	}
+
+	seg.Delete(7)
+
+	to := NewTable(3)
+	pieces, err := Split(seg, 0, from, to, 32)
+	if err != nil {
+		t.Fatalf("Split() = %s", err)
+	}
+
+	if to.Len() != 99 {
+		t.Errorf("Split() placed %d keys, want 99", to.Len())
+	}
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("doc-%d", i)
+
+		loc, found := to.Locate(key)
+		if i == 7 {
+			if found {
+				t.Errorf("deleted %s was placed at %v", key, loc)
+			}
+
+			continue
+		}
+
+		if !found || loc.Shard != to.Route(key) {
+			t.Fatalf("%s placed at %v, want shard %d", key, loc, to.Route(key))
+		}
+
+		fields, err := pieces[loc.Shard].Document(loc.Doc)
+		if err != nil || fields["key"] != key {
+			t.Errorf("Document(%v) = %v, %v, want key %s", loc, fields, err, key)
+		}
+
+		pl, found := pieces[loc.Shard].Terms.Lookup("body:" + key)
+		if !found || postinglist.NewIter(pl).Current() != loc.Doc {
+			t.Errorf("body:%s doesn't point at %v", key, loc)
+		}
+	}
+
+	total := 0
+	for _, piece := range pieces {
+		pl, _ := piece.Terms.Lookup("body:all")
+		pl.Docs(func(match.DocId) { total++ })
+	}
+
+	if total != 99 {
+		t.Errorf("pieces hold %d docs, want 99", total)
+	}
+}
@@ -0,0 +1,66 @@
+package routing
+
+import "fmt"
+import "os"
+import "sort"
+import match "basis/match"
+import docmap "basis/index/docmap"
+import segment "basis/index/segment"
+
+type docIds []match.DocId
+
+func (d docIds) Len() int           { return len(d) }
+func (d docIds) Less(i, j int) bool { return d[i] < d[j] }
+func (d docIds) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// Split a segment of the given shard (whose docs are in from) into one
+// piece per shard of to, routing each live doc by its key. Pieces get
+// fresh DocIds from to, which records where every doc went. Shards
+// that get no docs get a nil piece.
+func Split(seg *segment.Segment, shard int, from, to *Table, skipInterval uint) ([]*segment.Segment, os.Error) {
+	docs := make([]docIds, to.Shards)
+	keys := make(map[match.DocId]string)
+
+	for _, original := range seg.Docs {
+		doc := original
+		if seg.Remapped {
+			doc, _ = seg.DocMap.ToNew(original)
+		}
+
+		if seg.IsDeleted(doc) {
+			continue
+		}
+
+		key, found := from.Key(Location{shard, original})
+		if !found {
+			return nil, os.NewError(fmt.Sprintf("doc %d of shard %d has no key", original, shard))
+		}
+
+		target := to.Route(key)
+		docs[target] = append(docs[target], doc)
+		keys[doc] = key
+	}
+
+	pieces := make([]*segment.Segment, to.Shards)
+	for target, targetDocs := range docs {
+		if len(targetDocs) == 0 {
+			continue
+		}
+
+		sort.Sort(targetDocs)
+		m := docmap.Sequential(targetDocs, to.Next[target])
+
+		piece, err := seg.Renumber(m, skipInterval)
+		if err != nil {
+			return nil, err
+		}
+
+		for idx, doc := range m.Old {
+			to.Set(keys[doc], Location{target, m.New[idx]})
+		}
+
+		pieces[target] = piece
+	}
+
+	return pieces, nil
+}
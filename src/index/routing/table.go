@@ -0,0 +1,99 @@
+package routing
+
+import "gob"
+import "io"
+import "os"
+import match "basis/match"
+
+// Where a doc lives
+type Location struct {
+	Shard int
+	Doc   match.DocId
+}
+
+// Maps external doc keys to the shard and DocId holding them. Each
+// shard allocates its DocIds in increasing order.
+type Table struct {
+	Router
+	Next      []match.DocId
+	Locations map[string]Location
+
+	keys map[Location]string
+}
+
+func NewTable(shards int) *Table {
+	return &Table{Router{shards}, make([]match.DocId, shards), make(map[string]Location), make(map[Location]string)}
+}
+
+func (t *Table) Locate(key string) (Location, bool) {
+	loc, found := t.Locations[key]
+	return loc, found
+}
+
+func (t *Table) Key(loc Location) (string, bool) {
+	key, found := t.keys[loc]
+	return key, found
+}
+
+// The key's location, routing it and allocating a DocId if it's new
+func (t *Table) Assign(key string) Location {
+	if loc, found := t.Locations[key]; found {
+		return loc
+	}
+
+	shard := t.Route(key)
+	loc := Location{shard, t.Next[shard]}
+	t.Next[shard]++
+
+	t.Set(key, loc)
+	return loc
+}
+
+// Record where a key lives, moving it if it was elsewhere
+func (t *Table) Set(key string, loc Location) {
+	t.Remove(key)
+
+	t.Locations[key] = loc
+	t.keys[loc] = key
+
+	if loc.Doc >= t.Next[loc.Shard] {
+		t.Next[loc.Shard] = loc.Doc + 1
+	}
+}
+
+func (t *Table) Remove(key string) {
+	if loc, found := t.Locations[key]; found {
+		t.Locations[key] = Location{}, false
+		t.keys[loc] = "", false
+	}
+}
+
+func (t *Table) Len() int {
+	return len(t.Locations)
+}
+
+func (t *Table) Write(w io.Writer) os.Error {
+	return gob.NewEncoder(w).Encode(t)
+}
+
+func ReadTable(r io.Reader) (*Table, os.Error) {
+	t := new(Table)
+	if err := gob.NewDecoder(r).Decode(t); err != nil {
+		return nil, err
+	}
+
+	if len(t.Next) != t.Shards {
+		return nil, os.NewError("table doesn't match its shard count")
+	}
+
+	if t.Locations == nil {
+		t.Locations = make(map[string]Location)
+	}
+
+	t.keys = make(map[Location]string)
+	for key, loc := range t.Locations {
+		t.keys[loc] = key
+	}
+
+	return t, nil
+}
@@ -0,0 +1,637 @@
+package segment
+
+import "bytes"
+import "fmt"
+import "gob"
+import "hash/crc32"
+import "io"
+import "io/ioutil"
+import "math"
+import "os"
+import "path"
+import match "basis/match"
+import bitset "basis/match/bitset"
+import postinglist "basis/match/postinglist"
+import attribute "basis/index/attribute"
+import docmap "basis/index/docmap"
+import store "basis/index/store"
+import geo "basis/index/geo"
+import text "basis/index/text"
+
+// File names within a segment directory
+const (
+	InfoFile       = "info"
+	TermsFile      = "terms"
+	AttributesFile = "attributes"
+	GeoFile        = "geo"
+	DocMapFile     = "docmap"
+	StoredFile     = "stored"
+	DocValuesFile  = "docvalues"
+	DeletedFile    = "deleted"
+	DocsFile       = "docs"
+	KeysFile       = "keys"
+)
+
+type Info struct {
+	DocCount int
+	MaxId    match.DocId
+
+	// Whether DocIds were renumbered (and a DocMap is stored)
+	Remapped  bool
+	HasStored bool
+
+	// Whether every file ends with a CRC32C of the rest. Segments
+	// written before checksums were added don't.
+	Checksummed bool
+}
+
+// A sealed, read-only chunk of the index
+type Segment struct {
+	Info
+
+	Terms      *text.Dictionary
+	Attributes map[string]*attribute.Tree
+	Geo        *geo.Index
+
+	// The DocIds every doc was added with, ascending
+	Docs []match.DocId
+	// External keys (see keystore) of the docs that have them, by the
+	// DocIds they were added with
+	Keys map[match.DocId]string
+
+	// Original DocId -> DocId in this segment, if Remapped
+	DocMap *docmap.DocMap
+
+	// Stored fields are keyed by the original DocIds
+	Stored *store.Stored
+	Values *store.DocValues
+
+	// Deleted docs, or nil if there aren't any. Deletions are the only
+	// change a sealed segment allows.
+	Deleted      *bitset.BitSet
+	DeletedCount int
+
+	storedFile *os.File
+}
+
+func New() *Segment {
+	return &Segment{Info{}, text.NewDictionary(), make(map[string]*attribute.Tree), &geo.Index{}, []match.DocId{}, make(map[match.DocId]string), nil, nil, store.NewDocValues(), nil, 0, nil}
+}
+
+func (s *Segment) Attribute(name string) (*attribute.Tree, bool) {
+	t, found := s.Attributes[name]
+	return t, found
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+const checksumSize = 4
+
+// Every file is written with a CRC32C trailer
+func writeFile(dir, name string, write func(io.Writer) os.Error) os.Error {
+	f, err := os.Open(path.Join(dir, name), os.O_WRONLY|os.O_CREAT|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := crc32.New(castagnoli)
+	if err = write(io.MultiWriter(f, h)); err != nil {
+		return err
+	}
+
+	trailer := make([]byte, checksumSize)
+	putChecksum(trailer, h.Sum32())
+
+	_, err = f.Write(trailer)
+	return err
+}
+
+func putChecksum(dst []byte, sum uint32) {
+	dst[0], dst[1], dst[2], dst[3] = byte(sum>>24), byte(sum>>16), byte(sum>>8), byte(sum)
+}
+
+func getChecksum(src []byte) uint32 {
+	return uint32(src[0])<<24 | uint32(src[1])<<16 | uint32(src[2])<<8 | uint32(src[3])
+}
+
+// The contents of a file without its trailer, checked against it
+func checkedContents(name string, raw []byte) ([]byte, os.Error) {
+	if len(raw) < checksumSize {
+		return nil, os.NewError(fmt.Sprintf("%s is too short for its checksum", name))
+	}
+
+	body, trailer := raw[:len(raw)-checksumSize], raw[len(raw)-checksumSize:]
+	if crc32.Checksum(body, castagnoli) != getChecksum(trailer) {
+		return nil, os.NewError(fmt.Sprintf("%s doesn't match its checksum", name))
+	}
+
+	return body, nil
+}
+
+// Files of segments without checksums are read whole
+func readFile(dir, name string, checked bool, read func(io.Reader) os.Error) os.Error {
+	raw, err := ioutil.ReadFile(path.Join(dir, name))
+	if err != nil {
+		return err
+	}
+
+	if checked {
+		if raw, err = checkedContents(name, raw); err != nil {
+			return err
+		}
+	}
+
+	return read(bytes.NewBuffer(raw))
+}
+
+func encode(value interface{}) func(io.Writer) os.Error {
+	return func(w io.Writer) os.Error {
+		return gob.NewEncoder(w).Encode(value)
+	}
+}
+
+func decode(value interface{}) func(io.Reader) os.Error {
+	return func(r io.Reader) os.Error {
+		return gob.NewDecoder(r).Decode(value)
+	}
+}
+
+// Write the segment into dir, which must already exist
+func (s *Segment) Write(dir string) os.Error {
+	s.HasStored = s.Stored != nil
+	s.Checksummed = true
+
+	if err := writeFile(dir, InfoFile, encode(&s.Info)); err != nil {
+		return err
+	}
+
+	if err := writeFile(dir, TermsFile, func(w io.Writer) os.Error { return s.Terms.Write(w) }); err != nil {
+		return err
+	}
+
+	if err := writeFile(dir, AttributesFile, encode(s.Attributes)); err != nil {
+		return err
+	}
+
+	if err := writeFile(dir, GeoFile, func(w io.Writer) os.Error { return s.Geo.Write(w) }); err != nil {
+		return err
+	}
+
+	if err := writeFile(dir, DocsFile, encode(s.Docs)); err != nil {
+		return err
+	}
+
+	if err := writeFile(dir, KeysFile, encode(s.Keys)); err != nil {
+		return err
+	}
+
+	if err := writeFile(dir, DocValuesFile, func(w io.Writer) os.Error { return s.Values.Write(w) }); err != nil {
+		return err
+	}
+
+	if s.Stored != nil {
+		err := writeFile(dir, StoredFile, func(w io.Writer) os.Error {
+			_, err := s.Stored.WriteTo(w)
+			return err
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.Remapped {
+		err := writeFile(dir, DocMapFile, func(w io.Writer) os.Error { return s.DocMap.Write(w) })
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.WriteDeleted(dir)
+}
+
+// Mark a doc deleted. Returns false if it already was.
+func (s *Segment) Delete(doc match.DocId) (bool, os.Error) {
+	if doc > s.MaxId {
+		return false, os.NewError("doc isn't in this segment")
+	}
+
+	if s.Deleted == nil {
+		s.Deleted = bitset.New(uint(s.MaxId) + 1)
+	}
+
+	if s.Deleted.Contains(doc) {
+		return false, nil
+	}
+
+	if err := s.Deleted.Add(doc); err != nil {
+		return false, err
+	}
+
+	s.DeletedCount++
+	return true, nil
+}
+
+func (s *Segment) IsDeleted(doc match.DocId) bool {
+	return s.Deleted != nil && s.Deleted.Contains(doc)
+}
+
+// Deletions are stored as a list of docs, and can be rewritten without
+// touching the rest of the segment
+func (s *Segment) WriteDeleted(dir string) os.Error {
+	return s.WriteDeletedTo(dir, DeletedFile)
+}
+
+// Write the deletions to a file other than DeletedFile, so a new set
+// can be written without overwriting the old
+func (s *Segment) WriteDeletedTo(dir, name string) os.Error {
+	docs := []match.DocId{}
+
+	if s.Deleted != nil {
+		for it := bitset.NewIter(s.Deleted); !it.Finished(); it.Next() {
+			docs = append(docs, it.Current())
+		}
+	}
+
+	return writeFile(dir, name, encode(docs))
+}
+
+// Replace the deletions with those in a file written by WriteDeletedTo
+func (s *Segment) ReadDeleted(dir, name string) os.Error {
+	s.Deleted = nil
+	s.DeletedCount = 0
+
+	return s.readDeleted(dir, name)
+}
+
+func (s *Segment) readDeleted(dir, name string) os.Error {
+	docs := []match.DocId{}
+	if err := readFile(dir, name, s.Checksummed, decode(&docs)); err != nil {
+		return err
+	}
+
+	for _, doc := range docs {
+		if _, err := s.Delete(doc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The DocId a doc was added with
+func (s *Segment) OriginalId(doc match.DocId) match.DocId {
+	if s.Remapped {
+		if old, found := s.DocMap.ToOld(doc); found {
+			return old
+		}
+	}
+
+	return doc
+}
+
+func Open(dir string) (*Segment, os.Error) {
+	s := &Segment{}
+
+	// Decoding ignores the trailer, which is checked once Info says
+	// it's there
+	if err := readFile(dir, InfoFile, false, decode(&s.Info)); err != nil {
+		return nil, err
+	}
+
+	if s.Checksummed {
+		if err := readFile(dir, InfoFile, true, decode(&Info{})); err != nil {
+			return nil, err
+		}
+	}
+
+	err := readFile(dir, TermsFile, s.Checksummed, func(r io.Reader) (err os.Error) {
+		s.Terms, err = text.ReadDictionary(r)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := readFile(dir, AttributesFile, s.Checksummed, decode(&s.Attributes)); err != nil {
+		return nil, err
+	}
+
+	for name, tree := range s.Attributes {
+		if err := tree.Check(); err != nil {
+			return nil, os.NewError(fmt.Sprintf("attribute %s: %s", name, err))
+		}
+	}
+
+	err = readFile(dir, GeoFile, s.Checksummed, func(r io.Reader) (err os.Error) {
+		s.Geo, err = geo.ReadIndex(r)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Remapped {
+		err = readFile(dir, DocMapFile, s.Checksummed, func(r io.Reader) (err os.Error) {
+			s.DocMap, err = docmap.ReadDocMap(r)
+			return
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = readFile(dir, DocsFile, s.Checksummed, decode(&s.Docs)); err != nil {
+		return nil, err
+	}
+
+	s.Keys = make(map[match.DocId]string)
+	if err = readFile(dir, KeysFile, s.Checksummed, decode(&s.Keys)); err != nil {
+		return nil, err
+	}
+
+	err = readFile(dir, DocValuesFile, s.Checksummed, func(r io.Reader) (err os.Error) {
+		s.Values, err = store.ReadDocValues(r)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.readDeleted(dir, DeletedFile); err != nil {
+		return nil, err
+	}
+
+	if s.HasStored {
+		if err = s.openStored(path.Join(dir, StoredFile)); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Stored fields are read on demand, so the file stays open. Its
+// checksum is only checked by Verify.
+func (s *Segment) openStored(name string) os.Error {
+	f, err := os.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	size, err := f.Seek(0, 2)
+	if err == nil && s.Checksummed {
+		if size < checksumSize {
+			err = os.NewError("stored fields are too short for their checksum")
+		}
+
+		size -= checksumSize
+	}
+
+	if err == nil {
+		s.Stored, err = store.OpenStored(f, size)
+	}
+
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.storedFile = f
+	return nil
+}
+
+// Read stored fields from f, which is closed with the segment
+func (s *Segment) SetStored(f *os.File, size int64) os.Error {
+	stored, err := store.OpenStored(f, size)
+	if err != nil {
+		return err
+	}
+
+	s.Stored, s.storedFile = stored, f
+	return nil
+}
+
+func (s *Segment) Close() os.Error {
+	if s.storedFile == nil {
+		return nil
+	}
+
+	return s.storedFile.Close()
+}
+
+// The stored fields of a doc in this segment
+func (s *Segment) Document(doc match.DocId) (map[string]string, os.Error) {
+	if s.Stored == nil {
+		return nil, nil
+	}
+
+	if s.Remapped {
+		old, found := s.DocMap.ToOld(doc)
+		if !found {
+			return nil, nil
+		}
+
+		doc = old
+	}
+
+	return s.Stored.Document(doc)
+}
+
+// Rewrite every posting list with the DocIds from m. Docs that aren't
+// in m are dropped, along with any lists left empty; the rest stay
+// deleted if they were. If the segment was already remapped, m maps
+// from its current DocIds.
+func (s *Segment) Remap(m *docmap.DocMap, skipInterval uint) (*Segment, os.Error) {
+	if m.Len() == 0 {
+		return nil, os.NewError("can't remap to an empty segment")
+	}
+
+	remapped := New()
+	remapped.DocCount = m.Len()
+	remapped.MaxId = m.MaxId()
+	remapped.Remapped = true
+	remapped.DocMap = m
+	if s.Remapped {
+		// Stored fields stay keyed by the original DocIds
+		remapped.DocMap = docmap.Compose(s.DocMap, m)
+	}
+
+	remapped.Docs = remapped.DocMap.Old
+	for _, doc := range remapped.Docs {
+		if key, found := s.Keys[doc]; found {
+			remapped.Keys[doc] = key
+		}
+	}
+	remapped.Stored = s.Stored
+	remapped.Values = s.Values.Remap(m)
+
+	if s.Deleted != nil {
+		deleted, err := m.BitSet(s.Deleted)
+		if err != nil {
+			return nil, err
+		}
+
+		for it := bitset.NewIter(deleted); !it.Finished(); it.Next() {
+			remapped.DeletedCount++
+		}
+
+		if remapped.DeletedCount > 0 {
+			remapped.Deleted = deleted
+		}
+	}
+
+	for idx := 0; idx < s.Terms.Len(); idx++ {
+		pl, err := m.List(s.Terms.List(idx), skipInterval)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(pl.Raw) == 0 {
+			continue
+		}
+
+		if err = remapped.Terms.Add(s.Terms.Term(idx), pl); err != nil {
+			return nil, err
+		}
+	}
+
+	for name, tree := range s.Attributes {
+		keys := []int64{}
+		lists := []*postinglist.PostingList{}
+		var err os.Error
+
+		tree.Walk(math.MinInt64, math.MaxInt64, func(key int64, pl *postinglist.PostingList) {
+			if err != nil {
+				return
+			}
+
+			if pl, err = m.List(pl, skipInterval); err == nil && len(pl.Raw) > 0 {
+				keys = append(keys, key)
+				lists = append(lists, pl)
+			}
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		if remapped.Attributes[name], err = attribute.Build(keys, lists); err != nil {
+			return nil, err
+		}
+	}
+
+	cells := []uint64{}
+	lists := []*postinglist.PostingList{}
+	for idx, cell := range s.Geo.Cells {
+		pl, err := m.List(s.Geo.List(idx), skipInterval)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(pl.Raw) > 0 {
+			cells = append(cells, cell)
+			lists = append(lists, pl)
+		}
+	}
+
+	var err os.Error
+	if remapped.Geo, err = geo.Build(cells, lists); err != nil {
+		return nil, err
+	}
+
+	return remapped, nil
+}
+
+// Like Remap, but the new DocIds replace the old ones everywhere,
+// stored fields included, so the result keeps no DocMap.
+func (s *Segment) Renumber(m *docmap.DocMap, skipInterval uint) (*Segment, os.Error) {
+	renumbered, err := s.Remap(m, skipInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	renumbered.Remapped = false
+	renumbered.DocMap = nil
+	renumbered.Docs = make([]match.DocId, m.Len())
+	renumbered.Keys = make(map[match.DocId]string)
+
+	for idx := range renumbered.Docs {
+		doc := m.Base + match.DocId(idx)
+		renumbered.Docs[idx] = doc
+
+		old, _ := m.ToOld(doc)
+		if key, found := s.Keys[s.OriginalId(old)]; found {
+			renumbered.Keys[doc] = key
+		}
+	}
+
+	if s.Stored == nil {
+		return renumbered, nil
+	}
+
+	buf := new(bytes.Buffer)
+	w := store.NewStoredWriter(buf)
+
+	for _, doc := range renumbered.Docs {
+		old, _ := m.ToOld(doc)
+
+		fields, err := s.Document(old)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = w.Add(doc, fields); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+
+	raw := buf.Bytes()
+	if renumbered.Stored, err = store.OpenStored(store.Memory(raw), int64(len(raw))); err != nil {
+		return nil, err
+	}
+
+	return renumbered, nil
+}
+
+// Check a segment directory in full: every file against its checksum,
+// the stored fields included, then every posting list
+func Verify(dir string) os.Error {
+	s, err := Open(dir)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if s.HasStored && s.Checksummed {
+		if err = readFile(dir, StoredFile, true, func(io.Reader) os.Error { return nil }); err != nil {
+			return err
+		}
+	}
+
+	return s.Verify()
+}
+
+// Check every posting list of the segment (see postinglist.Verify)
+func (s *Segment) Verify() os.Error {
+	if err := s.Terms.Verify(); err != nil {
+		return os.NewError("terms: " + err.String())
+	}
+
+	for name, tree := range s.Attributes {
+		if err := tree.Verify(); err != nil {
+			return os.NewError(fmt.Sprintf("attribute %s: %s", name, err))
+		}
+	}
+
+	if err := s.Geo.Verify(); err != nil {
+		return os.NewError("geo: " + err.String())
+	}
+
+	return nil
+}
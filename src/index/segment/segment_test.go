@@ -0,0 +1,56 @@
+package segment
+
+import "fmt"
+import "testing"
+import match "basis/match"
+import docmap "basis/index/docmap"
+
+func deletedDocs(s *Segment) string {
+	deleted := []match.DocId{}
+	for doc := match.DocId(0); doc <= s.MaxId; doc++ {
+		if s.IsDeleted(doc) {
+			deleted = append(deleted, doc)
+		}
+	}
+
+	return fmt.Sprint(deleted, s.DeletedCount)
+}
+
+func TestRemapDeleted(t *testing.T) {
+	s := New()
+	s.Docs = []match.DocId{0, 1, 2, 3}
+	s.DocCount, s.MaxId = 4, 3
+
+	for _, doc := range []match.DocId{1, 3} {
+		if _, err := s.Delete(doc); err != nil {
+			t.Fatalf("Delete(%d) = %s", doc, err)
+		}
+	}
+
+	// Reversed, and without doc 3
+	m := docmap.ByRank([]match.DocId{0, 1, 2}, func(doc match.DocId) float64 { return float64(doc) })
+
+	remapped, err := s.Remap(m, 16)
+	if err != nil {
+		t.Fatalf("Remap() = %s", err)
+	}
+
+	if got := deletedDocs(remapped); got != "[1] 1" {
+		t.Errorf("deleted after Remap = %s, want [1] 1", got)
+	}
+
+	// None of the deleted docs are left
+	remapped, err = s.Remap(docmap.Sequential([]match.DocId{0, 2}, 10), 16)
+	if err != nil {
+		t.Fatalf("Remap() = %s", err)
+	}
+
+	if remapped.Deleted != nil || remapped.DeletedCount != 0 {
+		t.Errorf("Remap() without deleted docs kept %d deletions", remapped.DeletedCount)
+	}
+
+	if _, err = remapped.Delete(11); err != nil || !remapped.IsDeleted(11) {
+		t.Errorf("Delete(11) after Remap = %v", err)
+	}
+}
+
@@ -0,0 +1,238 @@
+package store
+
+import "gob"
+import "io"
+import "math"
+import "os"
+import "sort"
+import match "basis/match"
+import docmap "basis/index/docmap"
+
+// Doc values are columns of one value per doc, for scoring, sorting
+// and faceting without touching the stored fields. Docs are kept in
+// ascending order alongside their values.
+type NumericColumn struct {
+	Docs   []match.DocId
+	Values []int64
+}
+
+// String values are stored as ordinals into a sorted table of the
+// distinct values, so comparing two docs compares two ints.
+type SortedColumn struct {
+	Terms []string
+	Docs  []match.DocId
+	Ords  []int
+}
+
+type DocValues struct {
+	Numeric map[string]*NumericColumn
+	Sorted  map[string]*SortedColumn
+
+	// How many tokens each doc has in each text field, for length
+	// norms. Segments written before these were kept have none.
+	Lengths map[string]*NumericColumn
+
+	// Where each located doc is, as the bits of its float64 latitude
+	// and longitude, so box filters can check points exactly.
+	// Segments written before these were kept have none.
+	Lat, Lon *NumericColumn
+}
+
+func NewDocValues() *DocValues {
+	return &DocValues{make(map[string]*NumericColumn), make(map[string]*SortedColumn), make(map[string]*NumericColumn), NewNumericColumn(), NewNumericColumn()}
+}
+
+// Docs must be added in ascending order
+func (d *DocValues) AddPoint(doc match.DocId, lat, lon float64) os.Error {
+	if err := d.Lat.Add(doc, int64(math.Float64bits(lat))); err != nil {
+		return err
+	}
+
+	return d.Lon.Add(doc, int64(math.Float64bits(lon)))
+}
+
+// Where doc is, or false if it has no location recorded
+func (d *DocValues) Point(doc match.DocId) (lat, lon float64, found bool) {
+	latBits, found := d.Lat.Get(doc)
+	if !found {
+		return 0, 0, false
+	}
+
+	lonBits, _ := d.Lon.Get(doc)
+	return math.Float64frombits(uint64(latBits)), math.Float64frombits(uint64(lonBits)), true
+}
+
+func NewNumericColumn() *NumericColumn {
+	return &NumericColumn{[]match.DocId{}, []int64{}}
+}
+
+func findDoc(docs []match.DocId, doc match.DocId) (int, bool) {
+	idx := sort.Search(len(docs), func(i int) bool { return docs[i] >= doc })
+	return idx, idx < len(docs) && docs[idx] == doc
+}
+
+// Docs must be added in ascending order
+func (c *NumericColumn) Add(doc match.DocId, value int64) os.Error {
+	if n := len(c.Docs); n > 0 && c.Docs[n-1] >= doc {
+		return os.NewError("doc values must be added in ascending DocId order")
+	}
+
+	c.Docs = append(c.Docs, doc)
+	c.Values = append(c.Values, value)
+
+	return nil
+}
+
+func (c *NumericColumn) Get(doc match.DocId) (int64, bool) {
+	idx, found := findDoc(c.Docs, doc)
+	if !found {
+		return 0, false
+	}
+
+	return c.Values[idx], true
+}
+
+type numericPairs NumericColumn
+
+func (p *numericPairs) Len() int           { return len(p.Docs) }
+func (p *numericPairs) Less(i, j int) bool { return p.Docs[i] < p.Docs[j] }
+func (p *numericPairs) Swap(i, j int) {
+	p.Docs[i], p.Docs[j] = p.Docs[j], p.Docs[i]
+	p.Values[i], p.Values[j] = p.Values[j], p.Values[i]
+}
+
+// Build a sorted column from (doc, value) pairs with docs ascending
+func NewSortedColumn(docs []match.DocId, values []string) *SortedColumn {
+	sorted := make([]string, len(values))
+	copy(sorted, values)
+	sort.SortStrings(sorted)
+
+	terms := []string{}
+	for idx, term := range sorted {
+		if idx == 0 || sorted[idx-1] != term {
+			terms = append(terms, term)
+		}
+	}
+
+	c := &SortedColumn{terms, make([]match.DocId, len(docs)), make([]int, len(docs))}
+	copy(c.Docs, docs)
+
+	for idx, value := range values {
+		c.Ords[idx] = sort.SearchStrings(terms, value)
+	}
+
+	return c
+}
+
+// The ordinal of doc's value
+func (c *SortedColumn) Ord(doc match.DocId) (int, bool) {
+	idx, found := findDoc(c.Docs, doc)
+	if !found {
+		return 0, false
+	}
+
+	return c.Ords[idx], true
+}
+
+func (c *SortedColumn) Get(doc match.DocId) (string, bool) {
+	ord, found := c.Ord(doc)
+	if !found {
+		return "", false
+	}
+
+	return c.Terms[ord], true
+}
+
+// The number of distinct values
+func (c *SortedColumn) Cardinality() int {
+	return len(c.Terms)
+}
+
+func (c *SortedColumn) Term(ord int) string {
+	return c.Terms[ord]
+}
+
+type sortedPairs SortedColumn
+
+func (p *sortedPairs) Len() int           { return len(p.Docs) }
+func (p *sortedPairs) Less(i, j int) bool { return p.Docs[i] < p.Docs[j] }
+func (p *sortedPairs) Swap(i, j int) {
+	p.Docs[i], p.Docs[j] = p.Docs[j], p.Docs[i]
+	p.Ords[i], p.Ords[j] = p.Ords[j], p.Ords[i]
+}
+
+func (c *NumericColumn) remap(m *docmap.DocMap) *NumericColumn {
+	column := NewNumericColumn()
+
+	for idx, doc := range c.Docs {
+		if doc, found := m.ToNew(doc); found {
+			column.Docs = append(column.Docs, doc)
+			column.Values = append(column.Values, c.Values[idx])
+		}
+	}
+
+	sort.Sort((*numericPairs)(column))
+	return column
+}
+
+// Renumber every column with m, dropping docs that aren't in it
+func (d *DocValues) Remap(m *docmap.DocMap) *DocValues {
+	remapped := NewDocValues()
+
+	for name, c := range d.Numeric {
+		remapped.Numeric[name] = c.remap(m)
+	}
+
+	for name, c := range d.Lengths {
+		remapped.Lengths[name] = c.remap(m)
+	}
+
+	remapped.Lat, remapped.Lon = d.Lat.remap(m), d.Lon.remap(m)
+
+	for name, c := range d.Sorted {
+		column := &SortedColumn{c.Terms, []match.DocId{}, []int{}}
+
+		for idx, doc := range c.Docs {
+			if doc, found := m.ToNew(doc); found {
+				column.Docs = append(column.Docs, doc)
+				column.Ords = append(column.Ords, c.Ords[idx])
+			}
+		}
+
+		sort.Sort((*sortedPairs)(column))
+		remapped.Sorted[name] = column
+	}
+
+	return remapped
+}
+
+func (d *DocValues) Write(w io.Writer) os.Error {
+	return gob.NewEncoder(w).Encode(d)
+}
+
+func ReadDocValues(r io.Reader) (*DocValues, os.Error) {
+	d := new(DocValues)
+	if err := gob.NewDecoder(r).Decode(d); err != nil {
+		return nil, err
+	}
+
+	// Older segments have no lengths or points, and gob leaves out
+	// empty maps
+	if d.Numeric == nil {
+		d.Numeric = make(map[string]*NumericColumn)
+	}
+
+	if d.Sorted == nil {
+		d.Sorted = make(map[string]*SortedColumn)
+	}
+
+	if d.Lengths == nil {
+		d.Lengths = make(map[string]*NumericColumn)
+	}
+
+	if d.Lat == nil || d.Lon == nil {
+		d.Lat, d.Lon = NewNumericColumn(), NewNumericColumn()
+	}
+
+	return d, nil
+}
@@ -0,0 +1,205 @@
+package store
+
+import "bytes"
+import "strconv"
+import "strings"
+import "testing"
+import match "basis/match"
+import docmap "basis/index/docmap"
+
+// Every third doc up to 3000, with enough text to fill several blocks
+func writeStored(t *testing.T) []byte {
+	buf := bytes.NewBuffer(nil)
+	w := NewStoredWriter(buf)
+
+	for doc := match.DocId(3); doc <= 3000; doc += 3 {
+		fields := map[string]string{"id": strconv.Itoa(int(doc)), "body": strings.Repeat("word ", int(doc%50))}
+		if err := w.Add(doc, fields); err != nil {
+			t.Fatalf("Add(%d) = %s", doc, err)
+		}
+	}
+
+	if err := w.Add(3000, nil); err == nil {
+		t.Errorf("Add() out of order = nil, want an error")
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() = %s", err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestStored(t *testing.T) {
+	raw := writeStored(t)
+
+	s, err := OpenStored(Memory(raw), int64(len(raw)))
+	if err != nil {
+		t.Fatalf("OpenStored() = %s", err)
+	}
+
+	if len(s.index.First) < 3 {
+		t.Fatalf("%d blocks, want several", len(s.index.First))
+	}
+
+	// Out of order, so blocks are read again after others
+	for _, doc := range []match.DocId{2997, 3, 1500, 6, s.index.First[1], s.index.First[1] - 3, 3000} {
+		fields, err := s.Document(doc)
+		if err != nil {
+			t.Errorf("Document(%d) = %s", doc, err)
+		} else if fields["id"] != strconv.Itoa(int(doc)) || len(fields["body"]) != 5*int(doc%50) {
+			t.Errorf("Document(%d) = %v", doc, fields)
+		}
+	}
+
+	// Before the first doc, between docs and after the last
+	for _, doc := range []match.DocId{0, 1, 1501, 3003} {
+		if fields, err := s.Document(doc); fields != nil || err != nil {
+			t.Errorf("Document(%d) = %v, %v, want nothing", doc, fields, err)
+		}
+	}
+
+	copied := bytes.NewBuffer(nil)
+	if n, err := s.WriteTo(copied); err != nil || n != int64(len(raw)) || !bytes.Equal(copied.Bytes(), raw) {
+		t.Errorf("WriteTo() = %d, %v, want a copy of %d bytes", n, err, len(raw))
+	}
+}
+
+func TestCorruptStored(t *testing.T) {
+	raw := writeStored(t)
+
+	if _, err := OpenStored(Memory(raw[:4]), 4); err == nil {
+		t.Errorf("OpenStored() of 4 bytes = nil, want an error")
+	}
+
+	// Point the index past the end
+	bad := make([]byte, len(raw))
+	copy(bad, raw)
+	putUInt64(bad[len(bad)-8:], uint64(len(bad)))
+
+	if _, err := OpenStored(Memory(bad), int64(len(bad))); err == nil {
+		t.Errorf("OpenStored() with the index out of range = nil, want an error")
+	}
+
+	// Point the index at the middle of a block
+	copy(bad, raw)
+	putUInt64(bad[len(bad)-8:], 10)
+
+	if _, err := OpenStored(Memory(bad), int64(len(bad))); err == nil {
+		t.Errorf("OpenStored() with a corrupt index = nil, want an error")
+	}
+
+	// Wipe the start of the first block
+	copy(bad, raw)
+	for idx := 0; idx < 64; idx++ {
+		bad[idx] = 0xff
+	}
+
+	s, err := OpenStored(Memory(bad), int64(len(bad)))
+	if err != nil {
+		t.Fatalf("OpenStored() = %s", err)
+	}
+
+	if _, err = s.Document(3); err == nil {
+		t.Errorf("Document() in a corrupt block = nil, want an error")
+	}
+
+	if fields, err := s.Document(2997); err != nil || fields["id"] != "2997" {
+		t.Errorf("Document(2997) past the corrupt block = %v, %v", fields, err)
+	}
+}
+
+func buildValues(t *testing.T) *DocValues {
+	d := NewDocValues()
+
+	for doc := match.DocId(1); doc <= 5; doc++ {
+		if err := d.AddPoint(doc, float64(doc), -float64(doc)); err != nil {
+			t.Fatalf("AddPoint(%d) = %s", doc, err)
+		}
+	}
+
+	d.Numeric["price"] = &NumericColumn{[]match.DocId{1, 2, 4}, []int64{10, 20, 40}}
+	d.Lengths["body"] = &NumericColumn{[]match.DocId{2, 3}, []int64{7, 8}}
+	d.Sorted["colour"] = NewSortedColumn([]match.DocId{1, 3, 5}, []string{"red", "blue", "red"})
+
+	return d
+}
+
+func TestRemap(t *testing.T) {
+	// Reverse the docs and drop 3
+	m := docmap.ByRank([]match.DocId{1, 2, 4, 5}, func(doc match.DocId) float64 { return float64(doc) })
+	d := buildValues(t).Remap(m)
+
+	prices := map[match.DocId]int64{3: 10, 2: 20, 1: 40}
+	for doc, want := range prices {
+		if price, found := d.Numeric["price"].Get(doc); !found || price != want {
+			t.Errorf("price of %d = %d, %v, want %d", doc, price, found, want)
+		}
+	}
+
+	if length, found := d.Lengths["body"].Get(2); !found || length != 7 {
+		t.Errorf("length of 2 = %d, %v, want 7", length, found)
+	}
+
+	if d.Lengths["body"].Docs[0] != 2 || len(d.Lengths["body"].Docs) != 1 {
+		t.Errorf("lengths kept docs %v, want [2]", d.Lengths["body"].Docs)
+	}
+
+	colours := d.Sorted["colour"]
+	if len(colours.Docs) != 2 || colours.Docs[0] != 0 || colours.Docs[1] != 3 {
+		t.Errorf("colours kept docs %v, want [0 3]", colours.Docs)
+	}
+
+	if colour, _ := colours.Get(3); colour != "red" || colours.Cardinality() != 2 {
+		t.Errorf("colour of 3 = %s of %d values, want red of 2", colour, colours.Cardinality())
+	}
+
+	if lat, lon, found := d.Point(0); !found || lat != 5 || lon != -5 {
+		t.Errorf("Point(0) = %v, %v, %v, want 5, -5", lat, lon, found)
+	}
+
+	if _, _, found := d.Point(4); found {
+		t.Errorf("Point(4) found, want nothing")
+	}
+}
+
+func TestReadDocValues(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	if err := buildValues(t).Write(buf); err != nil {
+		t.Fatalf("Write() = %s", err)
+	}
+
+	d, err := ReadDocValues(buf)
+	if err != nil {
+		t.Fatalf("ReadDocValues() = %s", err)
+	}
+
+	if colour, _ := d.Sorted["colour"].Get(3); colour != "blue" {
+		t.Errorf("colour of 3 = %s, want blue", colour)
+	}
+
+	if lat, _, found := d.Point(2); !found || lat != 2 {
+		t.Errorf("Point(2) = %v, %v, want 2", lat, found)
+	}
+
+	// Gob leaves every empty map out
+	buf.Reset()
+	if err = NewDocValues().Write(buf); err != nil {
+		t.Fatalf("Write() = %s", err)
+	}
+
+	if d, err = ReadDocValues(buf); err != nil {
+		t.Fatalf("ReadDocValues() = %s", err)
+	}
+
+	if d.Numeric == nil || d.Sorted == nil || d.Lengths == nil || d.Lat == nil || d.Lon == nil {
+		t.Fatalf("ReadDocValues() left columns nil: %v", d)
+	}
+
+	d.Numeric["price"] = NewNumericColumn()
+	d.Sorted["colour"] = NewSortedColumn([]match.DocId{}, []string{})
+
+	if err = d.AddPoint(1, 0, 0); err != nil {
+		t.Errorf("AddPoint() = %s", err)
+	}
+}
@@ -0,0 +1,258 @@
+package store
+
+import "bytes"
+import "compress/flate"
+import "gob"
+import "io"
+import "os"
+import "sort"
+import "sync"
+import match "basis/match"
+
+// Stored fields are gob encoded, packed into blocks of roughly
+// BlockSize bytes and compressed. The file is the blocks back to back,
+// then a gob encoded blockIndex, then the offset of the index (8
+// bytes, big endian), so a doc can be found with two reads.
+const BlockSize = 16 * 1024
+
+type StoredDoc struct {
+	Id     match.DocId
+	Fields map[string]string
+}
+
+type blockIndex struct {
+	// The first doc in each block, and where each block starts. There's
+	// an extra offset for the end of the last block.
+	First   []match.DocId
+	Offsets []uint64
+}
+
+type StoredWriter struct {
+	w       io.Writer
+	written uint64
+
+	block     []StoredDoc
+	blockSize int
+	index     blockIndex
+
+	last  match.DocId
+	count int
+}
+
+func NewStoredWriter(w io.Writer) *StoredWriter {
+	return &StoredWriter{w, 0, []StoredDoc{}, 0, blockIndex{[]match.DocId{}, []uint64{}}, 0, 0}
+}
+
+// Add a doc's fields. Docs must be added in ascending DocId order.
+func (s *StoredWriter) Add(doc match.DocId, fields map[string]string) os.Error {
+	if s.count > 0 && doc <= s.last {
+		return os.NewError("stored docs must be added in ascending DocId order")
+	}
+
+	s.block = append(s.block, StoredDoc{doc, fields})
+	s.last = doc
+	s.count++
+
+	for name, value := range fields {
+		s.blockSize += len(name) + len(value)
+	}
+
+	if s.blockSize >= BlockSize {
+		return s.flush()
+	}
+
+	return nil
+}
+
+func (s *StoredWriter) write(raw []byte) os.Error {
+	n, err := s.w.Write(raw)
+	s.written += uint64(n)
+
+	return err
+}
+
+func (s *StoredWriter) flush() os.Error {
+	if len(s.block) == 0 {
+		return nil
+	}
+
+	compressed := new(bytes.Buffer)
+	fw := flate.NewWriter(compressed, flate.BestSpeed)
+
+	if err := gob.NewEncoder(fw).Encode(s.block); err != nil {
+		return err
+	}
+
+	if err := fw.Close(); err != nil {
+		return err
+	}
+
+	s.index.First = append(s.index.First, s.block[0].Id)
+	s.index.Offsets = append(s.index.Offsets, s.written)
+
+	s.block = []StoredDoc{}
+	s.blockSize = 0
+
+	return s.write(compressed.Bytes())
+}
+
+// Flush the last block and write the index
+func (s *StoredWriter) Close() os.Error {
+	if err := s.flush(); err != nil {
+		return err
+	}
+
+	indexStart := s.written
+	s.index.Offsets = append(s.index.Offsets, indexStart)
+
+	encoded := new(bytes.Buffer)
+	if err := gob.NewEncoder(encoded).Encode(&s.index); err != nil {
+		return err
+	}
+
+	if err := s.write(encoded.Bytes()); err != nil {
+		return err
+	}
+
+	tail := make([]byte, 8)
+	putUInt64(tail, indexStart)
+
+	return s.write(tail)
+}
+
+func putUInt64(dst []byte, num uint64) {
+	for idx := 7; idx >= 0; idx-- {
+		dst[idx] = byte(num)
+		num >>= 8
+	}
+}
+
+func getUInt64(src []byte) uint64 {
+	num := uint64(0)
+	for _, b := range src[:8] {
+		num = num<<8 | uint64(b)
+	}
+
+	return num
+}
+
+// Random access to stored docs
+type Stored struct {
+	r     io.ReaderAt
+	size  int64
+	index blockIndex
+
+	// The last block read. Searches share it, so it's guarded by lock.
+	lock      sync.Mutex
+	cached    int
+	cachedDoc []StoredDoc
+}
+
+func OpenStored(r io.ReaderAt, size int64) (*Stored, os.Error) {
+	if size < 8 {
+		return nil, os.NewError("stored fields are truncated")
+	}
+
+	tail := make([]byte, 8)
+	if _, err := r.ReadAt(tail, size-8); err != nil {
+		return nil, err
+	}
+
+	indexStart := int64(getUInt64(tail))
+	if indexStart > size-8 {
+		return nil, os.NewError("stored fields index is out of range")
+	}
+
+	s := &Stored{r, size, blockIndex{}, sync.Mutex{}, -1, nil}
+	err := gob.NewDecoder(io.NewSectionReader(r, indexStart, size-8-indexStart)).Decode(&s.index)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(s.index.Offsets) != len(s.index.First)+1 {
+		return nil, os.NewError("stored fields index is corrupt")
+	}
+
+	for idx, offset := range s.index.Offsets {
+		if offset > uint64(indexStart) || (idx > 0 && offset < s.index.Offsets[idx-1]) {
+			return nil, os.NewError("stored fields index is corrupt")
+		}
+	}
+
+	return s, nil
+}
+
+// A ReaderAt over bytes in memory
+type Memory []byte
+
+func (m Memory) ReadAt(p []byte, off int64) (int, os.Error) {
+	if off >= int64(len(m)) {
+		return 0, os.EOF
+	}
+
+	n := copy(p, m[off:])
+	if n < len(p) {
+		return n, os.EOF
+	}
+
+	return n, nil
+}
+
+func (s *Stored) readBlock(block int) ([]StoredDoc, os.Error) {
+	s.lock.Lock()
+	if block == s.cached {
+		docs := s.cachedDoc
+		s.lock.Unlock()
+
+		return docs, nil
+	}
+	s.lock.Unlock()
+
+	start, end := s.index.Offsets[block], s.index.Offsets[block+1]
+	raw := make([]byte, end-start)
+
+	if _, err := s.r.ReadAt(raw, int64(start)); err != nil {
+		return nil, err
+	}
+
+	fr := flate.NewReader(bytes.NewBuffer(raw))
+	defer fr.Close()
+
+	docs := []StoredDoc{}
+	if err := gob.NewDecoder(fr).Decode(&docs); err != nil {
+		return nil, err
+	}
+
+	// Decoded without the lock; the docs are never modified once
+	// they're cached
+	s.lock.Lock()
+	s.cached, s.cachedDoc = block, docs
+	s.lock.Unlock()
+
+	return docs, nil
+}
+
+// The stored fields for doc, or nil if it has none
+func (s *Stored) Document(doc match.DocId) (map[string]string, os.Error) {
+	block := sort.Search(len(s.index.First), func(i int) bool { return s.index.First[i] > doc }) - 1
+	if block < 0 {
+		return nil, nil
+	}
+
+	docs, err := s.readBlock(block)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := sort.Search(len(docs), func(i int) bool { return docs[i].Id >= doc })
+	if idx == len(docs) || docs[idx].Id != doc {
+		return nil, nil
+	}
+
+	return docs[idx].Fields, nil
+}
+
+// Copy the raw stored fields file
+func (s *Stored) WriteTo(w io.Writer) (int64, os.Error) {
+	return io.Copy(w, io.NewSectionReader(s.r, 0, s.size))
+}
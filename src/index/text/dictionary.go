@@ -0,0 +1,169 @@
+package text
+
+import "fmt"
+import "gob"
+import "io"
+import "os"
+import "sort"
+import "strings"
+import postinglist "basis/match/postinglist"
+
+// A sorted term dictionary. The serialized posting lists are stored
+// back to back in Data, and Offsets[i] is where the list for Terms[i]
+// starts.
+type Dictionary struct {
+	Terms   []string
+	Offsets []uint64
+	Data    []byte
+}
+
+func NewDictionary() *Dictionary {
+	return &Dictionary{[]string{}, []uint64{}, []byte{}}
+}
+
+// Terms qualified by the field they were found in (title:foo)
+func FieldTerm(field, token string) string {
+	return field + ":" + token
+}
+
+// The field and token of a FieldTerm. Terms without a field give "".
+func SplitFieldTerm(term string) (field, token string) {
+	idx := strings.Index(term, ":")
+	if idx < 0 {
+		return "", term
+	}
+
+	return term[:idx], term[idx+1:]
+}
+
+// Add the posting list for a term. Terms must be added in sorted
+// order.
+func (d *Dictionary) Add(term string, pl *postinglist.PostingList) os.Error {
+	if n := len(d.Terms); n > 0 && d.Terms[n-1] >= term {
+		return os.NewError("terms must be added in sorted order")
+	}
+
+	start := len(d.Data)
+	size := pl.Size()
+
+	if start+size > cap(d.Data) {
+		grown := make([]byte, start, 2*cap(d.Data)+size)
+		copy(grown, d.Data)
+		d.Data = grown
+	}
+
+	d.Data = d.Data[:start+size]
+	pl.ToBytes(d.Data[start:])
+
+	d.Terms = append(d.Terms, term)
+	d.Offsets = append(d.Offsets, uint64(start))
+
+	return nil
+}
+
+func (d *Dictionary) Len() int {
+	return len(d.Terms)
+}
+
+func (d *Dictionary) Term(idx int) string {
+	return d.Terms[idx]
+}
+
+func (d *Dictionary) List(idx int) *postinglist.PostingList {
+	end := uint64(len(d.Data))
+	if idx+1 < len(d.Offsets) {
+		end = d.Offsets[idx+1]
+	}
+
+	// Checked when the dictionary was read
+	return postinglist.MustFromBytes(d.Data[d.Offsets[idx]:end])
+}
+
+func (d *Dictionary) find(term string) (int, bool) {
+	idx := sort.SearchStrings(d.Terms, term)
+	return idx, idx < len(d.Terms) && d.Terms[idx] == term
+}
+
+func (d *Dictionary) Lookup(term string) (*postinglist.PostingList, bool) {
+	idx, found := d.find(term)
+	if !found {
+		return nil, false
+	}
+
+	return d.List(idx), true
+}
+
+// Visit every term starting with prefix, in order
+func (d *Dictionary) Prefix(prefix string, visit func(string, *postinglist.PostingList)) {
+	idx, _ := d.find(prefix)
+
+	for ; idx < len(d.Terms); idx++ {
+		term := d.Terms[idx]
+		if len(term) < len(prefix) || term[:len(prefix)] != prefix {
+			return
+		}
+
+		visit(term, d.List(idx))
+	}
+}
+
+func (d *Dictionary) Write(w io.Writer) os.Error {
+	return gob.NewEncoder(w).Encode(d)
+}
+
+func ReadDictionary(r io.Reader) (*Dictionary, os.Error) {
+	d := new(Dictionary)
+	if err := gob.NewDecoder(r).Decode(d); err != nil {
+		return nil, err
+	}
+
+	if err := d.Check(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Check that the terms are sorted and every list is framed inside
+// Data, so lookups can't fail
+func (d *Dictionary) Check() os.Error {
+	if len(d.Offsets) != len(d.Terms) {
+		return os.NewError(fmt.Sprintf("%d offsets for %d terms", len(d.Offsets), len(d.Terms)))
+	}
+
+	for idx, term := range d.Terms {
+		if idx > 0 && d.Terms[idx-1] >= term {
+			return os.NewError(fmt.Sprintf("term %q is out of order", term))
+		}
+
+		end := uint64(len(d.Data))
+		if idx+1 < len(d.Offsets) {
+			end = d.Offsets[idx+1]
+		}
+
+		if d.Offsets[idx] > end || end > uint64(len(d.Data)) {
+			return os.NewError(fmt.Sprintf("term %q has a bad offset", term))
+		}
+
+		if _, err := postinglist.FromBytes(d.Data[d.Offsets[idx]:end]); err != nil {
+			return os.NewError(fmt.Sprintf("term %q: %s", term, err))
+		}
+	}
+
+	return nil
+}
+
+// Check every list in full (see postinglist.Verify)
+func (d *Dictionary) Verify() os.Error {
+	if err := d.Check(); err != nil {
+		return err
+	}
+
+	for idx, term := range d.Terms {
+		if err := d.List(idx).Verify(); err != nil {
+			return os.NewError(fmt.Sprintf("term %q: %s", term, err))
+		}
+	}
+
+	return nil
+}
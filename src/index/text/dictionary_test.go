@@ -0,0 +1,127 @@
+package text
+
+import "bytes"
+import "testing"
+import match "basis/match"
+import postinglist "basis/match/postinglist"
+
+var terms = []string{"body:apple", "body:apricot", "body:banana", "title:apple"}
+
+func buildDictionary(t *testing.T) *Dictionary {
+	d := NewDictionary()
+
+	for idx, term := range terms {
+		docs := []match.DocId{}
+		for doc := 1; doc <= 100*(idx+1); doc += idx + 1 {
+			docs = append(docs, match.DocId(doc))
+		}
+
+		pl, err := postinglist.Build(docs, 4, postinglist.SkipLayoutLevels)
+		if err != nil {
+			t.Fatalf("Build() = %s", err)
+		}
+
+		if err = d.Add(term, pl); err != nil {
+			t.Fatalf("Add(%s) = %s", term, err)
+		}
+	}
+
+	return d
+}
+
+func TestLookup(t *testing.T) {
+	d := buildDictionary(t)
+
+	for _, term := range terms {
+		pl, found := d.Lookup(term)
+		if !found {
+			t.Errorf("Lookup(%s) not found", term)
+		} else if pl.Stats().DocCount != 100 {
+			t.Errorf("Lookup(%s) has %d docs, want 100", term, pl.Stats().DocCount)
+		}
+	}
+
+	for _, term := range []string{"body:", "body:cherry", "apple"} {
+		if _, found := d.Lookup(term); found {
+			t.Errorf("Lookup(%s) found, want nothing", term)
+		}
+	}
+
+	if err := d.Add("title:zucchini", postinglist.New(10, 4)); err != nil {
+		t.Errorf("Add() of an empty list = %s", err)
+	}
+
+	if err := d.Add("title:cherry", postinglist.New(10, 4)); err == nil {
+		t.Errorf("Add() out of order = nil, want an error")
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	d := buildDictionary(t)
+
+	found := []string{}
+	d.Prefix("body:ap", func(term string, pl *postinglist.PostingList) {
+		found = append(found, term)
+	})
+
+	if len(found) != 2 || found[0] != "body:apple" || found[1] != "body:apricot" {
+		t.Errorf("Prefix(body:ap) = %v, want [body:apple body:apricot]", found)
+	}
+
+	count := 0
+	d.Prefix("", func(term string, pl *postinglist.PostingList) { count++ })
+
+	if count != len(terms) {
+		t.Errorf("Prefix() visited %d terms, want %d", count, len(terms))
+	}
+}
+
+func TestSplitFieldTerm(t *testing.T) {
+	if field, token := SplitFieldTerm(FieldTerm("title", "a:b")); field != "title" || token != "a:b" {
+		t.Errorf("SplitFieldTerm() = %s, %s, want title, a:b", field, token)
+	}
+
+	if field, token := SplitFieldTerm("plain"); field != "" || token != "plain" {
+		t.Errorf("SplitFieldTerm(plain) = %s, %s, want \"\", plain", field, token)
+	}
+}
+
+func TestReadDictionary(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	if err := buildDictionary(t).Write(buf); err != nil {
+		t.Fatalf("Write() = %s", err)
+	}
+
+	d, err := ReadDictionary(buf)
+	if err != nil {
+		t.Fatalf("ReadDictionary() = %s", err)
+	}
+
+	if err = d.Verify(); err != nil {
+		t.Errorf("Verify() = %s", err)
+	}
+
+	if pl, found := d.Lookup("title:apple"); !found || pl.Stats().DocCount != 100 {
+		t.Errorf("Lookup() after reading = %v, %v, want 100 docs", pl, found)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	corrupt := map[string]func(d *Dictionary){
+		"an offset missing": func(d *Dictionary) { d.Offsets = d.Offsets[1:] },
+		"out of order":      func(d *Dictionary) { d.Terms[0], d.Terms[1] = d.Terms[1], d.Terms[0] },
+		"offsets backwards": func(d *Dictionary) { d.Offsets[1], d.Offsets[2] = d.Offsets[2], d.Offsets[1] },
+		"an offset too far": func(d *Dictionary) { d.Offsets[3] = uint64(len(d.Data) + 1) },
+		"data cut short":    func(d *Dictionary) { d.Data = d.Data[:len(d.Data)-1] },
+		"a bad list":        func(d *Dictionary) { d.Data = append(d.Data[:d.Offsets[3]], 1, 2, 3) },
+	}
+
+	for name, damage := range corrupt {
+		d := buildDictionary(t)
+		damage(d)
+
+		if err := d.Check(); err == nil {
+			t.Errorf("Check() with %s = nil, want an error", name)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package wal
+
+import "bytes"
+import "gob"
+import "hash/crc32"
+import "io"
+import "os"
+import match "basis/match"
+import builder "basis/index/builder"
+
+const (
+	OpAdd = iota + 1
+	OpDelete
+)
+
+type Record struct {
+	// Assigned by Append, increasing from 1
+	Seq uint64
+	Op  int
+
+	// For OpAdd
+	Docs []*builder.Document
+	// For OpDelete
+	Doc match.DocId
+}
+
+func Add(docs []*builder.Document) *Record {
+	return &Record{0, OpAdd, docs, 0}
+}
+
+func Delete(doc match.DocId) *Record {
+	return &Record{0, OpDelete, nil, doc}
+}
+
+// Each record is framed as length (4 bytes), CRC32 of the payload (4
+// bytes), then the payload: the record as a gob.
+const headerSize = 8
+
+// Anything claiming to be bigger is garbage
+const maxRecordSize = 1 << 30
+
+var errTorn = os.NewError("torn or corrupt record")
+
+func putUInt32(dst []byte, num uint32) {
+	for idx := 0; idx < 4; idx++ {
+		dst[idx] = byte(num >> (8 * uint(idx)))
+	}
+}
+
+func getUInt32(src []byte) uint32 {
+	num := uint32(0)
+	for idx := 0; idx < 4; idx++ {
+		num |= uint32(src[idx]) << (8 * uint(idx))
+	}
+
+	return num
+}
+
+func (r *Record) encode() ([]byte, os.Error) {
+	payload := new(bytes.Buffer)
+	if err := gob.NewEncoder(payload).Encode(r); err != nil {
+		return nil, err
+	}
+
+	framed := make([]byte, headerSize+payload.Len())
+	putUInt32(framed, uint32(payload.Len()))
+	putUInt32(framed[4:], crc32.ChecksumIEEE(payload.Bytes()))
+	copy(framed[headerSize:], payload.Bytes())
+
+	return framed, nil
+}
+
+// Returns os.EOF at a clean end, or errTorn if the record is cut off or
+// doesn't match its checksum
+func readRecord(r io.Reader) (*Record, int64, os.Error) {
+	header := make([]byte, headerSize)
+
+	n, err := io.ReadFull(r, header)
+	if err == os.EOF && n == 0 {
+		return nil, 0, os.EOF
+	} else if err != nil {
+		return nil, 0, errTorn
+	}
+
+	size := getUInt32(header)
+	if size > maxRecordSize {
+		return nil, 0, errTorn
+	}
+
+	payload := make([]byte, size)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return nil, 0, errTorn
+	}
+
+	if crc32.ChecksumIEEE(payload) != getUInt32(header[4:]) {
+		return nil, 0, errTorn
+	}
+
+	record := new(Record)
+	if err = gob.NewDecoder(bytes.NewBuffer(payload)).Decode(record); err != nil {
+		return nil, 0, errTorn
+	}
+
+	return record, int64(headerSize + len(payload)), nil
+}
@@ -0,0 +1,417 @@
+package wal
+
+import "bufio"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path"
+import "sort"
+import "strings"
+import "sync"
+import "time"
+
+// When appended records are fsynced
+const (
+	// Before Append returns. Nothing acknowledged is lost.
+	SyncAlways = iota
+	// Every Options.Interval. A crash loses at most that much.
+	SyncInterval
+	// When the OS gets round to it
+	SyncNever
+)
+
+type Options struct {
+	Sync int
+	// Nanoseconds between syncs, for SyncInterval
+	Interval int64
+}
+
+var DefaultOptions = Options{SyncAlways, 0}
+
+const checkpointFile = "checkpoint"
+const filePrefix = "wal-"
+
+// An append-only log of updates, kept until they're checkpointed
+// (flushed into a segment). The log is a series of files, each named
+// by the sequence number of its first record; a checkpoint starts a
+// new file and deletes the files it covers.
+type Log struct {
+	dir     string
+	options Options
+
+	lock       sync.Mutex
+	file       logFile
+	files      []uint64
+	seq        uint64
+	checkpoint uint64
+	dirty      bool
+
+	// The length of the current file up to its last whole record
+	size int64
+	// Once set, every append fails with it
+	failed os.Error
+
+	done chan bool
+}
+
+// The current file; an *os.File outside of tests
+type logFile interface {
+	Write([]byte) (int, os.Error)
+	Truncate(int64) os.Error
+	Sync() os.Error
+	Close() os.Error
+}
+
+func fileName(first uint64) string {
+	return fmt.Sprintf("%s%020d", filePrefix, first)
+}
+
+type seqs []uint64
+
+func (s seqs) Len() int           { return len(s) }
+func (s seqs) Less(i, j int) bool { return s[i] < s[j] }
+func (s seqs) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// The first sequence numbers of the log files in dir
+func listFiles(dir string) ([]uint64, os.Error) {
+	f, err := os.Open(dir, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	files := seqs{}
+	for _, name := range names {
+		var first uint64
+		if strings.HasPrefix(name, filePrefix) {
+			if _, err := fmt.Sscanf(name[len(filePrefix):], "%d", &first); err == nil {
+				files = append(files, first)
+			}
+		}
+	}
+
+	sort.Sort(files)
+	return files, nil
+}
+
+// Open the log in dir, calling replay with every record since the last
+// checkpoint, in order. A torn record at the end of the log (from a
+// crash mid-append) is cut off; one anywhere else is an error.
+func Open(dir string, options Options, replay func(*Record) os.Error) (*Log, os.Error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	l := &Log{dir, options, sync.Mutex{}, nil, nil, 0, 0, false, 0, nil, make(chan bool)}
+
+	if raw, err := ioutil.ReadFile(path.Join(dir, checkpointFile)); err == nil {
+		if _, err = fmt.Sscanf(string(raw), "%d", &l.checkpoint); err != nil {
+			return nil, err
+		}
+	}
+
+	files, err := listFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l.seq = l.checkpoint
+	for idx, first := range files {
+		if first > l.seq+1 {
+			return nil, os.NewError(fmt.Sprintf("log is missing records %d to %d", l.seq+1, first-1))
+		}
+
+		if err = l.replayFile(first, idx == len(files)-1, replay); err != nil {
+			return nil, err
+		}
+	}
+
+	l.files = files
+	if err = l.roll(); err != nil {
+		return nil, err
+	}
+
+	if options.Sync == SyncInterval {
+		go l.syncEvery(options.Interval)
+	}
+
+	return l, nil
+}
+
+func (l *Log) replayFile(first uint64, last bool, replay func(*Record) os.Error) os.Error {
+	name := path.Join(l.dir, fileName(first))
+
+	f, err := os.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	offset := int64(0)
+
+	for {
+		record, size, err := readRecord(r)
+		if err == os.EOF {
+			return nil
+		} else if err == errTorn && last {
+			return l.truncate(name, offset)
+		} else if err != nil {
+			return os.NewError(fmt.Sprintf("%s at byte %d: %s", name, offset, err))
+		}
+
+		offset += size
+
+		if record.Seq <= l.seq {
+			// Covered by the checkpoint
+			continue
+		}
+
+		if record.Seq != l.seq+1 {
+			return os.NewError(fmt.Sprintf("%s: record %d follows %d", name, record.Seq, l.seq))
+		}
+
+		l.seq = record.Seq
+		if err = replay(record); err != nil {
+			return err
+		}
+	}
+
+	panic("can't get here")
+}
+
+// Cut off a torn record, durably, so later appends don't follow it
+func (l *Log) truncate(name string, size int64) os.Error {
+	if err := os.Truncate(name, size); err != nil {
+		return err
+	}
+
+	if err := syncFile(name); err != nil {
+		return err
+	}
+
+	return syncFile(l.dir)
+}
+
+// Must hold the lock. Start a new file for the records after l.seq.
+func (l *Log) roll() os.Error {
+	if l.file != nil {
+		if err := l.sync(); err != nil {
+			return err
+		}
+
+		if err := l.file.Close(); err != nil {
+			return err
+		}
+	}
+
+	first := l.seq + 1
+	f, err := os.Open(path.Join(l.dir, fileName(first)), os.O_WRONLY|os.O_CREAT|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	if len(l.files) == 0 || l.files[len(l.files)-1] != first {
+		// The new file's directory entry must be durable before any
+		// record in it is
+		if err = syncFile(l.dir); err != nil {
+			f.Close()
+			return err
+		}
+
+		l.files = append(l.files, first)
+	}
+
+	if l.size, err = f.Seek(0, 2); err != nil {
+		f.Close()
+		return err
+	}
+
+	l.file = f
+	return nil
+}
+
+// Log a record, returning its sequence number. A record that fails to
+// write is cut off again, so the log stays readable; if that fails
+// too, or a sync fails after the record is written, the log is failed
+// and refuses every later append, since what's on disk is unknown.
+func (l *Log) Append(r *Record) (uint64, os.Error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.failed != nil {
+		return 0, l.failed
+	}
+
+	r.Seq = l.seq + 1
+	framed, err := r.encode()
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err = l.file.Write(framed); err != nil {
+		if truncErr := l.file.Truncate(l.size); truncErr != nil {
+			l.failed = os.NewError(fmt.Sprintf("log failed: can't cut off a partial record: %s", truncErr))
+		}
+
+		return 0, err
+	}
+
+	l.size += int64(len(framed))
+	l.seq = r.Seq
+	l.dirty = true
+
+	if l.options.Sync == SyncAlways {
+		if err = l.sync(); err != nil {
+			return 0, err
+		}
+	}
+
+	return r.Seq, nil
+}
+
+// The last record appended
+func (l *Log) Seq() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.seq
+}
+
+// Must hold the lock
+func (l *Log) sync() os.Error {
+	if l.failed != nil {
+		return l.failed
+	}
+
+	if !l.dirty {
+		return nil
+	}
+
+	if err := l.file.Sync(); err != nil {
+		l.failed = os.NewError(fmt.Sprintf("log failed: sync: %s", err))
+		return l.failed
+	}
+
+	l.dirty = false
+	return nil
+}
+
+func (l *Log) Sync() os.Error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.sync()
+}
+
+func (l *Log) syncEvery(interval int64) {
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-time.After(interval):
+			l.Sync()
+		}
+	}
+}
+
+// Records up to seq are safely in a segment, so they needn't be
+// replayed. The files holding only those records are deleted.
+func (l *Log) Checkpoint(seq uint64) os.Error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if seq > l.seq {
+		return os.NewError("can't checkpoint past the end of the log")
+	}
+
+	if seq <= l.checkpoint {
+		return nil
+	}
+
+	if err := l.roll(); err != nil {
+		return err
+	}
+
+	// Write the new checkpoint before deleting anything it covers
+	tmp := path.Join(l.dir, checkpointFile+".tmp")
+	if err := writeSynced(tmp, fmt.Sprintf("%d\n", seq)); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path.Join(l.dir, checkpointFile)); err != nil {
+		return err
+	}
+
+	if err := syncFile(l.dir); err != nil {
+		return err
+	}
+
+	l.checkpoint = seq
+
+	// A file is covered once the next one starts at or before seq + 1
+	kept := []uint64{}
+	for idx, first := range l.files {
+		if idx+1 < len(l.files) && l.files[idx+1] <= seq+1 {
+			if err := os.Remove(path.Join(l.dir, fileName(first))); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		kept = append(kept, first)
+	}
+
+	l.files = kept
+	return nil
+}
+
+// Fsync a file or directory
+func syncFile(name string) os.Error {
+	f, err := os.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
+
+func writeSynced(name, contents string) os.Error {
+	f, err := os.Open(name, os.O_WRONLY|os.O_CREAT|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.WriteString(contents); err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func (l *Log) Close() os.Error {
+	if l.options.Sync == SyncInterval {
+		l.done <- true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	err := l.sync()
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
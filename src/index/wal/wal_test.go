@@ -0,0 +1,146 @@
+package wal
+
+import "io/ioutil"
+import "os"
+import "path"
+import "testing"
+import match "basis/match"
+import builder "basis/index/builder"
+
+func replayAll(t *testing.T, dir string) (*Log, []*Record) {
+	records := []*Record{}
+
+	l, err := Open(dir, DefaultOptions, func(r *Record) os.Error {
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Open() = %s", err)
+	}
+
+	return l, records
+}
+
+func doc(id int) *builder.Document {
+	return &builder.Document{Id: match.DocId(id), Fields: map[string][]string{"body": []string{"word"}}}
+}
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basis-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, records := replayAll(t, dir)
+	if len(records) != 0 {
+		t.Errorf("new log replayed %d records", len(records))
+	}
+
+	l.Append(Add([]*builder.Document{doc(1), doc(2)}))
+	l.Append(Delete(1))
+	l.Close()
+
+	// A crash in the middle of an append
+	f, _ := os.Open(path.Join(dir, fileName(1)), os.O_WRONLY|os.O_APPEND, 0)
+	f.Write([]byte{200, 0, 0, 0, 1, 2})
+	f.Close()
+
+	l, records = replayAll(t, dir)
+	if len(records) != 2 || records[0].Op != OpAdd || len(records[0].Docs) != 2 || records[1].Doc != 1 {
+		t.Fatalf("Open() replayed %v, want the add and the delete", records)
+	}
+
+	if seq, _ := l.Append(Add([]*builder.Document{doc(3)})); seq != 3 {
+		t.Errorf("Append() after replay = %d, want 3", seq)
+	}
+
+	if err = l.Checkpoint(3); err != nil {
+		t.Fatalf("Checkpoint() = %s", err)
+	}
+
+	l.Append(Delete(2))
+	l.Close()
+
+	l, records = replayAll(t, dir)
+	defer l.Close()
+
+	if len(records) != 1 || records[0].Seq != 4 || records[0].Op != OpDelete {
+		t.Errorf("Open() after checkpoint replayed %v, want just record 4", records)
+	}
+
+	if files, _ := listFiles(dir); len(files) != 2 || files[0] != 4 {
+		t.Errorf("log files after checkpoint start at %v, want [4 5]", files)
+	}
+}
+
+// Writes half of what it's given, then fails, the first time; syncs
+// fail once failSync is set
+type faulty struct {
+	*os.File
+	short, failSync bool
+}
+
+func (f *faulty) Write(p []byte) (int, os.Error) {
+	if f.short {
+		f.short = false
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, os.NewError("no space left on device")
+	}
+
+	return f.File.Write(p)
+}
+
+func (f *faulty) Sync() os.Error {
+	if f.failSync {
+		return os.NewError("sync failed")
+	}
+
+	return f.File.Sync()
+}
+
+func TestFailedAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basis-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, _ := replayAll(t, dir)
+	l.Append(Delete(1))
+
+	f := &faulty{l.file.(*os.File), true, false}
+	l.file = f
+
+	if _, err = l.Append(Delete(2)); err == nil {
+		t.Fatalf("Append() with a short write succeeded")
+	}
+
+	// The partial record is cut off, so the next one follows the first
+	if seq, err := l.Append(Delete(3)); err != nil || seq != 2 {
+		t.Fatalf("Append() after a short write = %d, %v, want 2", seq, err)
+	}
+
+	f.failSync = true
+	if _, err = l.Append(Delete(4)); err == nil {
+		t.Fatalf("Append() with a failed sync succeeded")
+	}
+
+	if _, err = l.Append(Delete(5)); err == nil {
+		t.Errorf("Append() after a failed sync succeeded")
+	}
+	l.Close()
+
+	l, records := replayAll(t, dir)
+	defer l.Close()
+
+	docs := []match.DocId{}
+	for _, record := range records {
+		docs = append(docs, record.Doc)
+	}
+
+	// Record 3 may or may not have reached the disk
+	if len(docs) < 2 || docs[0] != 1 || docs[1] != 3 {
+		t.Errorf("Open() after failed appends replayed docs %v, want 1, 3", docs)
+	}
+}
@@ -11,7 +11,7 @@ type BitSet struct {
 }
 
 func New(capacity uint) *BitSet {
-	return &BitSet{make([]uint, capacity / 32), 0}
+	return &BitSet{make([]uint, (capacity + 31) / 32), 0}
 }
 
 func position(doc match.DocId) (block, bit uint) {
@@ -27,7 +27,7 @@ func docId(block, bit uint) (doc match.DocId) {
 func (b *BitSet) Add(doc match.DocId) os.Error {
 	block, bit := position(doc)
 
-	if uint(cap(b.backing)) < block {
+	if uint(len(b.backing)) <= block {
 		return os.NewError(fmt.Sprintf("DocId is too large for this BitSet (required capacity %d, have %d)", block, cap(b.backing)))
 	}
 
@@ -40,11 +40,26 @@ func (b *BitSet) Add(doc match.DocId) os.Error {
 	return nil
 }
 
+func (b *BitSet) Contains(doc match.DocId) bool {
+	block, bit := position(doc)
+
+	if block >= uint(len(b.backing)) {
+		return false
+	}
+
+	return b.backing[block]&(1<<bit) != 0
+}
+
+// The approximate memory used, in bytes
+func (b *BitSet) Size() uint64 {
+	return uint64(len(b.backing)) * 4
+}
+
 // Find the first non-empty block starting with backing[start]
 func (b *BitSet) firstBlock(start uint) (uint, bool) {
 	pos := start
 
-	for pos := start; pos < uint(len(b.backing)) && b.backing[pos] == 0; pos++ {
+	for ; pos < uint(len(b.backing)) && b.backing[pos] == 0; pos++ {
 		// Scan until a non-empty block or we reach the end
 	}
 
@@ -98,29 +113,31 @@ func (b *BitSet) firstBit(block, start uint) (uint, bool) {
 		return 0, true
 	}
 
-	return deBruijn[(((val & -val) * deBruijnMask)) >> 27], false
+	// Only the low 32 bits of the product index the table
+	return deBruijn[(((val & -val) * deBruijnMask) & 0xFFFFFFFF) >> 27], false
 }
 
 // Return the first set bit starting with block, bit
 func (b *BitSet) nextBit(block, bit uint) (nextBlock, nextBit uint, finished bool) {
 	// Allow the caller to increment the bit
-	if bit > 32 {
-		block += bit / 32
-		bit = bit % 32
+	block += bit / 32
+	bit = bit % 32
+
+	if block >= uint(len(b.backing)) {
+		return 0, 0, true
+	}
+
+	if nBit, empty := b.firstBit(block, bit); !empty {
+		return block, nBit, false
 	}
 
-	nBlock, finished := b.firstBlock(block)
+	nBlock, finished := b.firstBlock(block + 1)
 
 	if finished {
 		return 0, 0, finished
 	}
 
-	nBit := uint(0)
-	if nBlock == block {
-		nBit = bit
-	}
-
-	nBit, _ = b.firstBit(nBlock, nBit)
+	nBit, _ := b.firstBit(nBlock, 0)
 
 	return nBlock, nBit, false
 }
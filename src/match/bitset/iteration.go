@@ -10,15 +10,10 @@ type BitSetIterator struct {
 }
 
 func NewIter(b *BitSet) *BitSetIterator {
-	firstBlock, finished := b.firstBlock(0)
+	i := &BitSetIterator{b, 0, false}
+	i.moveTo(0, 0)
 
-	if finished {
-		return &BitSetIterator{b, 0, true}
-	}
-
-	firstBit, _ := b.firstBit(firstBlock, 0)
-	doc := docId(firstBlock, firstBit)
-	return &BitSetIterator{b, doc, false}
+	return i
 }
 
 func (b *BitSetIterator) Current() match.DocId {
@@ -29,6 +24,16 @@ func (b *BitSetIterator) Finished() bool {
 	return b.finished
 }
 
+// Move to the first set bit at or after block, bit
+func (b *BitSetIterator) moveTo(block, bit uint) {
+	nextBlock, nextBit, finished := b.b.nextBit(block, bit)
+
+	b.finished = finished
+	if !finished {
+		b.doc = docId(nextBlock, nextBit)
+	}
+}
+
 func (b *BitSetIterator) Next() (match.DocId, bool) {
 	if b.finished {
 		panic("Next called on finished iterator")
@@ -36,25 +41,18 @@ func (b *BitSetIterator) Next() (match.DocId, bool) {
 
 	block, bit := position(b.doc)
 	// start one past the current position
-	nextBlock, nextBit, _ := b.b.nextBit(block, bit+1)
-
-	b.doc = docId(nextBlock, nextBit)
-	b.finished = (b.doc == b.b.MaxId)
+	b.moveTo(block, bit+1)
 
 	return b.doc, b.finished
 }
 
-// TODO: what happens when you seek past then end?
+// Seeking past the last set bit finishes the iterator
 func (b *BitSetIterator) Seek(target match.DocId) (match.DocId, bool) {
 	if b.finished {
 		panic("Seek called on finished iterator")
 	}
 
-	block, bit := position(target)
-	nextBlock, nextBit, _ := b.b.nextBit(block, bit)
-
-	b.doc = docId(nextBlock, nextBit)
-	b.finished = (b.doc == b.b.MaxId)
+	b.moveTo(position(target))
 
 	return b.doc, b.finished
 }
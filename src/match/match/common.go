@@ -47,27 +47,35 @@ func (d *docIdHeap) Pop() interface{} {
 }
 
 func Merge(iters []MatchIterator, result MatchList) {
-	if len(iters) == 0 {
+	h := &docIdHeap{[]MatchIterator{}}
+	for _, it := range iters {
+		if !it.Finished() {
+			h.iters = append(h.iters, it)
+		}
+	}
+
+	if len(h.iters) == 0 {
 		return
 	}
 
-	h := &docIdHeap{iters}
 	heap.Init(h)
 
+	started := false
 	last := DocId(0)
-	for {
+	for h.Len() > 0 {
 		i := heap.Pop(h).(MatchIterator)
 		next := i.Current()
 
-		if ! i.Finished() {
+		if i.Next(); !i.Finished() {
 			heap.Push(h, i)
 		}
 
-		if next == last {
+		if started && next == last {
 			continue
 		} else {
 			result.Add(next)
 			last = next
+			started = true
 		}
 	}
 }
@@ -0,0 +1,75 @@
+package match
+
+import "fmt"
+import "os"
+import "testing"
+
+// Iterates over docs, which are in ascending order
+type sliceIter struct {
+	docs []DocId
+	pos  int
+}
+
+func newSliceIter(docs ...DocId) *sliceIter {
+	return &sliceIter{docs, 0}
+}
+
+func (s *sliceIter) Current() DocId {
+	return s.docs[s.pos]
+}
+
+func (s *sliceIter) Finished() bool {
+	return s.pos >= len(s.docs)
+}
+
+func (s *sliceIter) Next() (DocId, bool) {
+	s.pos++
+	if s.Finished() {
+		return 0, true
+	}
+
+	return s.Current(), false
+}
+
+func (s *sliceIter) Seek(target DocId) (DocId, bool) {
+	for !s.Finished() && s.Current() < target {
+		s.pos++
+	}
+
+	if s.Finished() {
+		return 0, true
+	}
+
+	return s.Current(), false
+}
+
+type docList []DocId
+
+func (d *docList) Add(doc DocId) os.Error {
+	*d = append(*d, doc)
+	return nil
+}
+
+// Merge used to never advance its iterators, so it didn't return, and
+// it skipped doc 0
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		iters []MatchIterator
+		want  string
+	}{
+		{[]MatchIterator{newSliceIter(0, 2, 4), newSliceIter(1, 2, 5)}, "[0 1 2 4 5]"},
+		{[]MatchIterator{newSliceIter(0), newSliceIter(0)}, "[0]"},
+		{[]MatchIterator{newSliceIter(), newSliceIter(3, 7)}, "[3 7]"},
+		{[]MatchIterator{newSliceIter()}, "[]"},
+		{[]MatchIterator{}, "[]"},
+	}
+
+	for _, test := range tests {
+		result := &docList{}
+		Merge(test.iters, result)
+
+		if got := fmt.Sprint([]DocId(*result)); got != test.want {
+			t.Errorf("Merge() = %s, want %s", got, test.want)
+		}
+	}
+}
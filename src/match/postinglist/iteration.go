@@ -1,29 +1,60 @@
 package postinglist
 
+import "os"
 import match "basis/match"
 
+// Iterators stop at a block that can't be read, and report it from Err
 type PostingListIterator struct {
 	pl       *PostingList
 	b        Block
 	finished bool
+	err      os.Error
 
+	// offset of the block following b
 	last uint
 	size uint
 }
 
 func NewIter(pl *PostingList) *PostingListIterator {
-	read, first := pl.readBlock(0, 0)
-	size := uint(len(pl.Raw))
-	finished := read > size
+	i := &PostingListIterator{pl, Block{}, false, nil, 0, uint(len(pl.Raw))}
 
-	return &PostingListIterator{pl, first, finished, read, size}
+	if i.size == 0 {
+		i.finished = true
+		return i
+	}
+
+	i.read(0, 0)
+	i.skipBlocks()
+
+	return i
 }
 
-func (i *PostingListIterator) advance() {
-	read, b := i.pl.readBlock(i.last, i.b.doc)
+func (i *PostingListIterator) read(idx uint, lastDoc match.DocId) {
+	read, b, err := i.pl.readBlock(idx, lastDoc)
+	if err != nil {
+		i.err = err
+		i.finished = true
+		return
+	}
+
 	i.b = b
-	i.last += read
-	i.finished = (i.last > i.size)
+	i.last = idx + read
+}
+
+func (i *PostingListIterator) advance() {
+	if i.last >= i.size {
+		i.finished = true
+		return
+	}
+
+	i.read(i.last, i.b.doc)
+}
+
+// Step over any skip blocks so b is a doc (or we're finished)
+func (i *PostingListIterator) skipBlocks() {
+	for i.b.isSkip && !i.finished {
+		i.advance()
+	}
 }
 
 func (i *PostingListIterator) Current() match.DocId {
@@ -34,15 +65,18 @@ func (i *PostingListIterator) Finished() bool {
 	return i.finished
 }
 
+// Why the iterator finished early, if the list is corrupt
+func (i *PostingListIterator) Err() os.Error {
+	return i.err
+}
+
 func (i *PostingListIterator) Next() (match.DocId, bool) {
 	if i.finished {
 		panic("Called Next on a finished iterator")
 	}
 
 	i.advance()
-	for i.b.isSkip && !i.finished {
-		i.advance()
-	}
+	i.skipBlocks()
 
 	return i.b.doc, i.finished
 }
@@ -56,29 +90,37 @@ func (i *PostingListIterator) Seek(target match.DocId) (match.DocId, bool) {
 		return i.b.doc, false
 	}
 
+	if i.pl.SkipTable {
+		i.seekTable(target)
+	}
+
 	for !i.finished && i.b.doc < target {
-		if i.b.isSkip {
-			if i.b.nextDoc <= target {
-				// take the skip
-				start := i.last + i.b.nextBlockOffset
-				read, b := i.pl.readBlock(start, i.b.nextDoc)
-				i.b = b
-
-				i.last = i.b.start + read
-				i.finished = (i.last > i.size)
-			} else {
-				// ignore it
-				i.advance()
-			}
+		// Only take a skip if every doc it passes over is smaller
+		// than the target
+		if i.b.isSkip && i.b.initialized() && i.b.nextDoc < target {
+			i.read(i.b.start+i.b.nextBlockOffset, i.b.nextDoc)
 		} else {
 			i.advance()
 		}
 	}
 
 	// We might have ended on a skip. Advance past that.
-	for i.b.isSkip && !i.finished {
-		i.advance()
-	}
+	i.skipBlocks()
 
 	return i.b.doc, i.finished
 }
+
+func (i *PostingListIterator) seekTable(target match.DocId) {
+	idx := i.pl.findTableSkip(target)
+	if idx < 0 {
+		return
+	}
+
+	// Only jump forwards
+	skip := i.pl.tableSkip(idx)
+	if skip.Offset < i.last || skip.Offset >= i.size {
+		return
+	}
+
+	i.read(skip.Offset, skip.Doc)
+}
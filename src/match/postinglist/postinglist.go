@@ -8,21 +8,128 @@ import match "basis/match"
 type PostingList struct {
 	Raw        []byte
 	MaxId      match.DocId
+
+	// Insert a skip block every SkipInterval postings, or once
+	// SkipBytes bytes have been written since the last skip. Zero
+	// disables the corresponding trigger.
+	SkipInterval uint
+	SkipBytes    uint
+
+	// If set, skips go into Table rather than inline in Raw (see
+	// skiptable.go)
+	SkipTable bool
+	Table     []byte
+
+	// postings and end offset since the last skip block
+	sinceSkip uint
+	lastSkip  uint
+}
+
+func New(capacity, skipInterval uint) *PostingList {
+	return &PostingList{Raw: make([]byte, 0, capacity), SkipInterval: skipInterval}
 }
 
-func FromBytes(raw []byte) *PostingList {
+func NewWithSkipTable(capacity, skipInterval uint) *PostingList {
+	pl := New(capacity, skipInterval)
+	pl.SkipTable = true
+
+	return pl
+}
+
+// Build a list from docs in ascending order, sized to fit exactly
+func Build(docs []match.DocId, skipInterval uint, layoutOption int) (*PostingList, os.Error) {
+	// Add needs strictly more capacity than it uses
+	capacity := uint(1)
+	last := match.DocId(0)
+
+	for _, doc := range docs {
+		capacity += varint.VarInt(doc - last).Size()
+		last = doc
+	}
+
+	if skipInterval > 0 {
+		capacity += uint(len(docs)) / skipInterval * (1 + SKIP_PAYLOAD)
+	}
+
+	pl := New(capacity, skipInterval)
+	for _, doc := range docs {
+		if err := pl.Add(doc); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := pl.BuildSkips(layoutOption); err != nil {
+		return nil, err
+	}
+
+	return pl, nil
+}
+
+// Serialized layout: max doc (8 bytes), skip table length, skip
+// table, data length, data. Lengths are varints.
+//
+// Only the framing is checked; the blocks are checked as they're read
+// (or all at once by Verify).
+func FromBytes(raw []byte) (*PostingList, os.Error) {
+	if len(raw) < 8 {
+		return nil, os.NewError("posting list is shorter than its header")
+	}
+
 	maxId := readUInt64(raw)
 	raw = raw[8:]
 
-	n, rawLen := varint.Read(raw)
+	n, tableLen, err := varint.ReadChecked(raw)
+	if err != nil {
+		return nil, err
+	}
+
 	raw = raw[n:]
+	if uint64(tableLen) > uint64(len(raw)) || tableLen%SKIP_ENTRY_SIZE != 0 {
+		return nil, os.NewError(fmt.Sprintf("bad skip table length %d", tableLen))
+	}
+
+	table := raw[:tableLen]
+	raw = raw[tableLen:]
+
+	n, rawLen, err := varint.ReadChecked(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	raw = raw[n:]
+	if uint64(rawLen) > uint64(len(raw)) {
+		return nil, os.NewError(fmt.Sprintf("data length %d runs past the end of the list", rawLen))
+	}
+
 	raw = raw[:rawLen]
 
-	return &PostingList{raw, match.DocId(maxId)}
+	return &PostingList{Raw: raw, MaxId: match.DocId(maxId), SkipTable: tableLen > 0, Table: table}, nil
+}
+
+// For lists whose framing has already been checked: like FromBytes,
+// but panics
+func MustFromBytes(raw []byte) *PostingList {
+	pl, err := FromBytes(raw)
+	if err != nil {
+		panic("postinglist: " + err.String())
+	}
+
+	return pl
 }
 
 func (pl *PostingList) Size() int {
-	return len(pl.Raw) + int(varint.VarInt(len(pl.Raw)).Size()) + 8
+	tableSize := len(pl.Table) + int(varint.VarInt(len(pl.Table)).Size())
+	return len(pl.Raw) + int(varint.VarInt(len(pl.Raw)).Size()) + tableSize + 8
+}
+
+func writeSection(dst, section []byte) []byte {
+	// Write ORs into the first byte
+	dst[0] = 0
+	written := varint.VarInt(len(section)).Write(dst)
+	dst = dst[written:]
+
+	copy(dst, section)
+	return dst[len(section):]
 }
 
 func (pl *PostingList) ToBytes(dst []byte) {
@@ -30,13 +137,12 @@ func (pl *PostingList) ToBytes(dst []byte) {
 		panic("dst is too small")
 	}
 
+	dst = dst[:pl.Size()]
 	writeUInt64(dst, uint64(pl.MaxId))
 	dst = dst[8:]
 
-	written := varint.VarInt(len(pl.Raw)).Write(dst[8:])
-	dst = dst[written:]
-
-	copy(dst, pl.Raw)
+	dst = writeSection(dst, pl.Table)
+	writeSection(dst, pl.Raw)
 }
 
 // Encoding scheme:
@@ -45,11 +151,19 @@ func (pl *PostingList) ToBytes(dst []byte) {
 // least-significant bits first)
 
 func (pl *PostingList) Add(doc match.DocId) (err os.Error) {
-	numBlocks := uint(len(pl.Raw))
-	if numBlocks > 0 && doc < pl.MaxId {
+	if len(pl.Raw) > 0 && doc < pl.MaxId {
 		return os.NewError("doc isn't larger than current max doc")
 	}
 
+	if pl.SkipTable && (len(pl.Raw) == 0 || pl.needsSkip()) {
+		pl.addTableSkip()
+	} else if pl.needsSkip() {
+		if err := pl.addSkip(); err != nil {
+			return err
+		}
+	}
+
+	numBlocks := uint(len(pl.Raw))
 	diff := varint.VarInt(doc - pl.MaxId)
 
 	size := diff.Size()
@@ -59,11 +173,15 @@ func (pl *PostingList) Add(doc match.DocId) (err os.Error) {
 	}
 
 	pl.Raw = pl.Raw[0:numBlocks+size]
+	// Write ORs into the first byte, which may be left over from a
+	// previous user of the buffer
+	pl.Raw[numBlocks] = 0
 	diff.Write(pl.Raw[numBlocks:])
 
 	// Set the high bit
 	pl.Raw[numBlocks] = blockTypeDoc | pl.Raw[numBlocks]
 	pl.MaxId = doc
+	pl.sinceSkip++
 
 	return nil
 }
@@ -74,42 +192,66 @@ type Block struct {
 
 	isSkip bool
 
-	// always 1 for non-skips
+	// always 1 for non-skips. For skips, the distance from the start
+	// of this block to the skip it links to (0 if it isn't linked)
 	nextBlockOffset uint
 	// the doc id for this block (same as the last for skip blocks)
 	doc match.DocId
 
-	// for skip blocks
+	// for skip blocks, the last doc before the linked skip
 	nextDoc match.DocId
 }
 
-func (pl PostingList) readBlock(idx uint, lastDoc match.DocId) (uint, Block) {
+func (pl PostingList) readBlock(idx uint, lastDoc match.DocId) (uint, Block, os.Error) {
+	if idx >= uint(len(pl.Raw)) {
+		return 0, Block{}, os.NewError(fmt.Sprintf("block %d is past the end of the list", idx))
+	}
+
 	bytes := pl.Raw[idx:]
 
 	if bytes[0]&blockTypeDoc == blockTypeDoc {
-		docSize, docOffset := varint.Read(bytes)
+		docSize, docOffset, err := varint.ReadChecked(bytes)
+		if err != nil {
+			return 0, Block{}, err
+		}
 
 		doc := match.DocId(docOffset) + lastDoc
+		if doc < lastDoc {
+			return 0, Block{}, os.NewError(fmt.Sprintf("doc overflows at block %d", idx))
+		}
+
 		data := Block{idx, false, 1, doc, 0}
 
-		return docSize, data
+		return docSize, data, nil
+	}
+
+	if bytes[0] != SKIP_UNINITIALIZED && bytes[0] != SKIP_INITIALIZED {
+		return 0, Block{}, os.NewError(fmt.Sprintf("bad block type %#x at block %d", bytes[0], idx))
+	}
+
+	if len(bytes) < 1+SKIP_PAYLOAD {
+		return 0, Block{}, os.NewError(fmt.Sprintf("skip at block %d runs past the end of the list", idx))
 	}
 
 	nextBlockOffset := readUInt(bytes[1:])
 	nextDocOffset := readUInt64(bytes[5:])
 
 	data := Block{idx, true, nextBlockOffset, lastDoc, match.DocId(uint64(lastDoc) + nextDocOffset)}
-	return 1 + SKIP_PAYLOAD, data
+	return 1 + SKIP_PAYLOAD, data, nil
 }
 
-func (pl PostingList) blocks(visit func(Block)) {
+// Visit blocks in order, stopping at the first that can't be read
+func (pl PostingList) blocks(visit func(Block)) os.Error {
 	i := uint(0)
 	lastDoc := match.DocId(0)
 
 	// walk through the blocks
 	numBlocks := uint(len(pl.Raw))
 	for i < numBlocks {
-		r, block := pl.readBlock(i, lastDoc)
+		r, block, err := pl.readBlock(i, lastDoc)
+		if err != nil {
+			return err
+		}
 
 		lastDoc = block.doc
 
@@ -117,8 +259,11 @@ func (pl PostingList) blocks(visit func(Block)) {
 
 		i += r
 	}
+
+	return nil
 }
 
+// Only used while building a list, which can't be corrupt
 func (pl PostingList) skips() []Block {
 	skips := []Block{}
 
@@ -131,14 +276,17 @@ func (pl PostingList) skips() []Block {
 	return skips
 }
 
-func (pl PostingList) Docs(visit func(match.DocId)) {
-	pl.blocks(func(b Block) {
+// Visit every doc, returning an error (after visiting the docs before
+// it) if the list is corrupt
+func (pl PostingList) Docs(visit func(match.DocId)) os.Error {
+	return pl.blocks(func(b Block) {
 		if !b.isSkip {
 			visit(b.doc)
 		}
 	})
 }
 
+// The stats of a corrupt list only count the docs before the damage
 func (pl PostingList) Stats() Stats {
 	docCount := 0
 
@@ -147,6 +295,36 @@ func (pl PostingList) Stats() Stats {
 	return Stats{docCount, uint64(pl.MaxId)}
 }
 
+// How a list is encoded
+type Layout struct {
+	Docs int
+	// Inline skip blocks, and how many of them link to a later skip
+	Skips       int
+	LinkedSkips int
+	TableSkips  int
+
+	RawBytes   int
+	TableBytes int
+}
+
+func (pl PostingList) Layout() (Layout, os.Error) {
+	l := Layout{0, 0, 0, len(pl.Table) / SKIP_ENTRY_SIZE, len(pl.Raw), len(pl.Table)}
+
+	err := pl.blocks(func(b Block) {
+		switch {
+		case !b.isSkip:
+			l.Docs++
+		case b.initialized():
+			l.Skips++
+			l.LinkedSkips++
+		default:
+			l.Skips++
+		}
+	})
+
+	return l, err
+}
+
 func (b Block) initialized() bool {
 	return b.nextBlockOffset != 0
 }
@@ -155,6 +333,10 @@ func (pl *PostingList) String() string {
 	numBlocks := len(pl.Raw)
 	s := fmt.Sprintf("PostingList: %d of %d blocks used, max doc %d\n", numBlocks, cap(pl.Raw), pl.MaxId)
 
+	for idx := 0; idx < pl.numTableSkips(); idx++ {
+		s += pl.tableSkip(idx).String() + "\n"
+	}
+
 	pl.blocks(func(b Block) {
 		s += b.String() + "\n"
 	})
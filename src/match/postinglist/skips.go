@@ -10,9 +10,22 @@ const SKIP_INITIALIZED = 1
 const (
 	SkipLayoutRandom = iota
 	SkipLayoutNext
+	SkipLayoutLevels
 )
 
-func (pl *PostingList) addSkip(doc int) (err os.Error) {
+func (pl *PostingList) needsSkip() bool {
+	if len(pl.Raw) == 0 || pl.sinceSkip == 0 {
+		return false
+	}
+
+	if pl.SkipInterval > 0 && pl.sinceSkip >= pl.SkipInterval {
+		return true
+	}
+
+	return pl.SkipBytes > 0 && uint(len(pl.Raw))-pl.lastSkip >= pl.SkipBytes
+}
+
+func (pl *PostingList) addSkip() (err os.Error) {
 	numBlocks := len(pl.Raw)
 	if numBlocks+1+SKIP_PAYLOAD >= cap(pl.Raw) {
 		return os.NewError("Out of space")
@@ -22,6 +35,12 @@ func (pl *PostingList) addSkip(doc int) (err os.Error) {
 
 	// Mark the block as uninitialized
 	pl.Raw[numBlocks] = SKIP_UNINITIALIZED
+	for idx := numBlocks + 1; idx < len(pl.Raw); idx++ {
+		pl.Raw[idx] = 0
+	}
+
+	pl.sinceSkip = 0
+	pl.lastSkip = uint(len(pl.Raw))
 
 	return nil
 }
@@ -29,8 +48,8 @@ func (pl *PostingList) addSkip(doc int) (err os.Error) {
 func (pl *PostingList) updateSkip(src, target Block) {
 	pl.Raw[src.start] = SKIP_INITIALIZED
 
-	writeUInt(pl.Raw[1:], target.nextBlockOffset)
-	writeUInt64(pl.Raw[5:], uint64(target.nextDoc))
+	writeUInt(pl.Raw[src.start+1:], target.start-src.start)
+	writeUInt64(pl.Raw[src.start+5:], uint64(target.doc-src.doc))
 }
 
 func (pl *PostingList) setupSkipsRandom() {
@@ -68,12 +87,35 @@ func (pl *PostingList) setupSkipsNext() {
 	}
 }
 
+// Skip n (counting from 1) links to skip n + lowbit(n), so every
+// other skip covers 2 skips, every 4th covers 4 and so on. A seek
+// doubles its stride until it overshoots, which gives a logarithmic
+// number of skips to reach any target.
+func (pl *PostingList) setupSkipsLevels() {
+	skips := pl.skips()
+
+	for idx, skip := range skips {
+		n := idx + 1
+		goal := n + (n & -n) - 1
+
+		if goal >= len(skips) {
+			goal = len(skips) - 1
+		}
+
+		if goal > idx {
+			pl.updateSkip(skip, skips[goal])
+		}
+	}
+}
+
 func (pl *PostingList) BuildSkips(layoutOption int) (err os.Error) {
 	switch layoutOption {
 	case SkipLayoutRandom:
 		pl.setupSkipsRandom()
 	case SkipLayoutNext:
 		pl.setupSkipsNext()
+	case SkipLayoutLevels:
+		pl.setupSkipsLevels()
 	default:
 		return os.NewError("Invalid layout option")
 	}
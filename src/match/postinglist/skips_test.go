@@ -0,0 +1,137 @@
+package postinglist
+
+import match "basis/match"
+import "testing"
+
+func buildList(t *testing.T, layout int) (*PostingList, []match.DocId) {
+	pl := New(100000, 4)
+	docs := []match.DocId{}
+
+	for doc := match.DocId(3); doc < 5000; doc += 7 {
+		if err := pl.Add(doc); err != nil {
+			t.Fatalf("Add(%d) = %s", doc, err)
+		}
+
+		docs = append(docs, doc)
+	}
+
+	if err := pl.BuildSkips(layout); err != nil {
+		t.Fatalf("BuildSkips(%d) = %s", layout, err)
+	}
+
+	return pl, docs
+}
+
+var layouts = []int{SkipLayoutRandom, SkipLayoutNext, SkipLayoutLevels}
+
+func TestSkipsInserted(t *testing.T) {
+	pl, docs := buildList(t, SkipLayoutNext)
+
+	if skips := len(pl.skips()); skips != (len(docs)-1)/4 {
+		t.Errorf("len(skips) = %d, want %d", skips, (len(docs)-1)/4)
+	}
+}
+
+func TestIterateWithSkips(t *testing.T) {
+	for _, layout := range layouts {
+		pl, docs := buildList(t, layout)
+
+		it := NewIter(pl)
+		idx := 0
+		for ; !it.Finished(); idx++ {
+			if it.Current() != docs[idx] {
+				t.Errorf("layout %d: doc %d = %d, want %d", layout, idx, it.Current(), docs[idx])
+			}
+
+			it.Next()
+		}
+
+		if idx != len(docs) {
+			t.Errorf("layout %d: iterated %d docs, want %d", layout, idx, len(docs))
+		}
+	}
+}
+
+func TestSeekWithSkips(t *testing.T) {
+	targets := []match.DocId{4, 100, 101, 2000, 4990, 4999}
+
+	for _, layout := range layouts {
+		pl, docs := buildList(t, layout)
+
+		for _, target := range targets {
+			it := NewIter(pl)
+			got, finished := it.Seek(target)
+
+			want := match.DocId(0)
+			for _, doc := range docs {
+				if doc >= target {
+					want = doc
+					break
+				}
+			}
+
+			if want == 0 {
+				if !finished {
+					t.Errorf("layout %d: Seek(%d) should have finished", layout, target)
+				}
+			} else if got != want || finished {
+				t.Errorf("layout %d: Seek(%d) = %d, want %d", layout, target, got, want)
+			}
+		}
+	}
+}
+
+func TestSkipTable(t *testing.T) {
+	pl := NewWithSkipTable(100000, 4)
+	docs := []match.DocId{}
+
+	for doc := match.DocId(3); doc < 5000; doc += 7 {
+		if err := pl.AddScored(doc, float32(doc%13)); err != nil {
+			t.Fatalf("AddScored(%d) = %s", doc, err)
+		}
+
+		docs = append(docs, doc)
+	}
+
+	if len(pl.skips()) != 0 {
+		t.Errorf("inline skips written with a skip table")
+	}
+
+	raw := make([]byte, pl.Size())
+	pl.ToBytes(raw)
+	read, err := FromBytes(raw)
+	if err != nil {
+		t.Fatalf("FromBytes() = %s", err)
+	}
+
+	if read.numTableSkips() != (len(docs)+3)/4 {
+		t.Errorf("numTableSkips() = %d, want %d", read.numTableSkips(), (len(docs)+3)/4)
+	}
+
+	if score := read.tableSkip(1).MaxScore; score != 12 {
+		t.Errorf("tableSkip(1).MaxScore = %f, want 12", score)
+	}
+
+	for _, target := range []match.DocId{4, 100, 101, 2000, 4990} {
+		it := NewIter(read)
+		got, _ := it.Seek(target)
+
+		if want := ((target+3)/7)*7 + 3; got != want {
+			t.Errorf("Seek(%d) = %d, want %d", target, got, want)
+		}
+	}
+}
+
+func TestLayout(t *testing.T) {
+	pl, docs := buildList(t, SkipLayoutNext)
+
+	layout, err := pl.Layout()
+	if err != nil {
+		t.Fatalf("Layout() = %s", err)
+	}
+
+	skips := (len(docs) - 1) / 4
+	if layout.Docs != len(docs) || layout.Skips != skips || layout.LinkedSkips != skips-1 || layout.RawBytes != len(pl.Raw) {
+		t.Errorf("Layout() = %+v, want %d docs and %d skips, all but the last linked", layout, len(docs), skips)
+	}
+}
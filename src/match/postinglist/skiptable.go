@@ -0,0 +1,98 @@
+package postinglist
+
+import "fmt"
+import "math"
+import "os"
+import match "basis/match"
+
+// An alternative to inline skip blocks: the skips live in a table of
+// fixed size entries ahead of the data, so Raw holds nothing but
+// gaps. Each entry records where a block of postings starts, the
+// last doc before it (the base for decoding the block's first gap)
+// and the largest score added to the block.
+//
+// Entry layout: doc (8 bytes), offset into Raw (4 bytes), max score
+// (4 bytes, IEEE 754 bits)
+const SKIP_ENTRY_SIZE = 16
+
+type SkipEntry struct {
+	Doc      match.DocId
+	Offset   uint
+	MaxScore float32
+}
+
+func (pl *PostingList) addTableSkip() {
+	entry := make([]byte, SKIP_ENTRY_SIZE)
+	writeUInt64(entry, uint64(pl.MaxId))
+	writeUInt(entry[8:], uint(len(pl.Raw)))
+	writeUInt(entry[12:], 0)
+
+	pl.Table = append(pl.Table, entry...)
+	pl.sinceSkip = 0
+	pl.lastSkip = uint(len(pl.Raw))
+}
+
+func (pl *PostingList) numTableSkips() int {
+	return len(pl.Table) / SKIP_ENTRY_SIZE
+}
+
+func (pl *PostingList) tableSkip(idx int) SkipEntry {
+	entry := pl.Table[idx*SKIP_ENTRY_SIZE:]
+
+	doc := match.DocId(readUInt64(entry))
+	offset := readUInt(entry[8:])
+	score := math.Float32frombits(uint32(readUInt(entry[12:])))
+
+	return SkipEntry{doc, offset, score}
+}
+
+// Find the last skip that only passes over docs smaller than target,
+// or -1 if there isn't one
+func (pl *PostingList) findTableSkip(target match.DocId) int {
+	lo, hi := 0, pl.numTableSkips()
+
+	for lo < hi {
+		mid := (lo + hi) / 2
+
+		if pl.tableSkip(mid).Doc < target {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	return lo - 1
+}
+
+// Add a doc with a score, tracking the maximum score of the current
+// block in the skip table
+func (pl *PostingList) AddScored(doc match.DocId, score float32) (err os.Error) {
+	if !pl.SkipTable {
+		return os.NewError("scores are only kept in the skip table")
+	}
+
+	if err = pl.Add(doc); err != nil {
+		return err
+	}
+
+	last := pl.numTableSkips() - 1
+	if score > pl.tableSkip(last).MaxScore {
+		writeUInt(pl.Table[last*SKIP_ENTRY_SIZE+12:], uint(math.Float32bits(score)))
+	}
+
+	return nil
+}
+
+func (pl *PostingList) SkipEntries() []SkipEntry {
+	entries := make([]SkipEntry, pl.numTableSkips())
+
+	for idx := range entries {
+		entries[idx] = pl.tableSkip(idx)
+	}
+
+	return entries
+}
+
+func (e SkipEntry) String() string {
+	return fmt.Sprintf("Skip - doc %d @ idx %d, max score %f", e.Doc, e.Offset, e.MaxScore)
+}
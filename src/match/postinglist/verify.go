@@ -0,0 +1,76 @@
+package postinglist
+
+import "fmt"
+import "os"
+import match "basis/match"
+
+// Check the whole list: every block decodes inside Raw, the docs
+// ascend to MaxId, and every skip (inline or in the table) lands on a
+// block and records the right doc for it.
+func (pl *PostingList) Verify() os.Error {
+	// The doc before each block, and which blocks are skips
+	before := make(map[uint]match.DocId)
+	isSkip := make(map[uint]bool)
+	skips := []Block{}
+	last := match.DocId(0)
+	docs := 0
+
+	err := pl.blocks(func(b Block) {
+		if b.isSkip {
+			before[b.start] = b.doc
+			isSkip[b.start] = true
+			skips = append(skips, b)
+			return
+		}
+
+		before[b.start] = last
+		last = b.doc
+		docs++
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if docs > 0 && last != pl.MaxId {
+		return os.NewError(fmt.Sprintf("last doc is %d but the max is %d", last, pl.MaxId))
+	}
+
+	for _, skip := range skips {
+		if !skip.initialized() {
+			continue
+		}
+
+		target := skip.start + skip.nextBlockOffset
+		if !isSkip[target] {
+			return os.NewError(fmt.Sprintf("skip at %d links to %d, which isn't a skip", skip.start, target))
+		}
+
+		if skip.nextDoc != before[target] {
+			return os.NewError(fmt.Sprintf("skip at %d says doc %d precedes %d, but it's %d", skip.start, skip.nextDoc, target, before[target]))
+		}
+	}
+
+	if len(pl.Table)%SKIP_ENTRY_SIZE != 0 {
+		return os.NewError(fmt.Sprintf("skip table length %d isn't a whole number of entries", len(pl.Table)))
+	}
+
+	for idx := 0; idx < pl.numTableSkips(); idx++ {
+		entry := pl.tableSkip(idx)
+
+		doc, found := before[entry.Offset]
+		if !found || isSkip[entry.Offset] {
+			return os.NewError(fmt.Sprintf("skip table entry %d points at %d, which isn't a doc", idx, entry.Offset))
+		}
+
+		if idx > 0 && entry.Offset <= pl.tableSkip(idx-1).Offset {
+			return os.NewError(fmt.Sprintf("skip table entry %d doesn't move forwards", idx))
+		}
+
+		if entry.Doc != doc {
+			return os.NewError(fmt.Sprintf("skip table entry %d says doc %d precedes %d, but it's %d", idx, entry.Doc, entry.Offset, doc))
+		}
+	}
+
+	return nil
+}
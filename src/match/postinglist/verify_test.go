@@ -0,0 +1,104 @@
+package postinglist
+
+import match "basis/match"
+import "testing"
+
+func serialize(pl *PostingList) []byte {
+	raw := make([]byte, pl.Size())
+	pl.ToBytes(raw)
+
+	return raw
+}
+
+func TestVerify(t *testing.T) {
+	for _, layout := range layouts {
+		pl, _ := buildList(t, layout)
+
+		if err := pl.Verify(); err != nil {
+			t.Errorf("layout %d: Verify() = %s", layout, err)
+		}
+	}
+
+	table := NewWithSkipTable(1000, 4)
+	for doc := match.DocId(1); doc < 100; doc += 3 {
+		table.Add(doc)
+	}
+
+	if err := table.Verify(); err != nil {
+		t.Errorf("skip table: Verify() = %s", err)
+	}
+
+	// Point the first skip somewhere else
+	pl, _ := buildList(t, SkipLayoutNext)
+	skip := pl.skips()[0]
+	writeUInt(pl.Raw[skip.start+1:], skip.nextBlockOffset+1)
+
+	if err := pl.Verify(); err == nil {
+		t.Errorf("Verify() of a misdirected skip = nil, want an error")
+	}
+
+	pl, _ = buildList(t, SkipLayoutNext)
+	pl.MaxId++
+
+	if err := pl.Verify(); err == nil {
+		t.Errorf("Verify() with the wrong MaxId = nil, want an error")
+	}
+}
+
+// Read the whole list every way there is. Corrupt lists must fail
+// with errors, not panics.
+func readAll(raw []byte) {
+	pl, err := FromBytes(raw)
+	if err != nil {
+		return
+	}
+
+	pl.Verify()
+	pl.Stats()
+
+	for it := NewIter(pl); !it.Finished(); it.Next() {
+	}
+
+	it := NewIter(pl)
+	for target := match.DocId(0); !it.Finished() && target < 6000; target += 500 {
+		if it.Current() < target {
+			it.Seek(target)
+		}
+	}
+}
+
+func TestCorruptLists(t *testing.T) {
+	pl, _ := buildList(t, SkipLayoutLevels)
+	table := NewWithSkipTable(1000, 4)
+	for doc := match.DocId(1); doc < 100; doc += 3 {
+		table.Add(doc)
+	}
+
+	for _, list := range []*PostingList{pl, table} {
+		raw := serialize(list)
+
+		for n := 0; n < len(raw); n++ {
+			readAll(raw[:n])
+		}
+
+		for idx := range raw {
+			for _, flip := range []byte{0x01, 0x40, 0x80, 0xFF} {
+				corrupt := make([]byte, len(raw))
+				copy(corrupt, raw)
+				corrupt[idx] ^= flip
+
+				readAll(corrupt)
+			}
+		}
+	}
+
+	truncated := serialize(pl)
+	truncated = truncated[:len(truncated)-1]
+	if _, err := FromBytes(truncated); err == nil {
+		t.Errorf("FromBytes() of a truncated list = nil error")
+	}
+
+	if _, err := FromBytes([]byte{1, 2, 3}); err == nil {
+		t.Errorf("FromBytes() of 3 bytes = nil error")
+	}
+}
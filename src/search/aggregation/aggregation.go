@@ -0,0 +1,175 @@
+package aggregation
+
+import "math"
+import "os"
+import "sort"
+import match "basis/match"
+import store "basis/index/store"
+
+// Aggregations consume matching docs like any other match.MatchList.
+// Bucket aggregations take a Factory so each bucket can run its own
+// sub-aggregation (e.g. the average price per category).
+type Aggregation interface {
+	match.MatchList
+
+	// Something encodable as JSON
+	Result() interface{}
+}
+
+type Factory func() Aggregation
+
+// Where aggregations read values. store.NumericColumn is one.
+type Values interface {
+	Get(match.DocId) (int64, bool)
+}
+
+// Sorted-string doc values, by ordinal
+type Ordinals struct {
+	Column *store.SortedColumn
+}
+
+func (o Ordinals) Get(doc match.DocId) (int64, bool) {
+	ord, found := o.Column.Ord(doc)
+	return int64(ord), found
+}
+
+// Min, max, sum and average of a numeric field
+type Stats struct {
+	values Values
+
+	Count    int
+	Min, Max int64
+	Sum      int64
+}
+
+type StatsResult struct {
+	Count         int
+	Min, Max, Sum int64
+	Avg           float64
+}
+
+func NewStats(values Values) *Stats {
+	return &Stats{values, 0, math.MaxInt64, math.MinInt64, 0}
+}
+
+func (s *Stats) Add(doc match.DocId) os.Error {
+	value, found := s.values.Get(doc)
+	if !found {
+		return nil
+	}
+
+	s.Count++
+	s.Sum += value
+
+	if value < s.Min {
+		s.Min = value
+	}
+
+	if value > s.Max {
+		s.Max = value
+	}
+
+	return nil
+}
+
+func (s *Stats) Avg() float64 {
+	if s.Count == 0 {
+		return math.NaN()
+	}
+
+	return float64(s.Sum) / float64(s.Count)
+}
+
+func (s *Stats) Result() interface{} {
+	if s.Count == 0 {
+		return StatsResult{}
+	}
+
+	return StatsResult{s.Count, s.Min, s.Max, s.Sum, s.Avg()}
+}
+
+type Bucket struct {
+	Key   string
+	Count int
+	Sub   interface{}
+}
+
+type buckets []Bucket
+
+func (b buckets) Len() int { return len(b) }
+func (b buckets) Less(i, j int) bool {
+	if b[i].Count != b[j].Count {
+		return b[i].Count > b[j].Count
+	}
+
+	return b[i].Key < b[j].Key
+}
+func (b buckets) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+
+type bucket struct {
+	count int
+	sub   Aggregation
+}
+
+func (b *bucket) add(doc match.DocId, sub Factory) os.Error {
+	b.count++
+
+	if sub == nil {
+		return nil
+	}
+
+	if b.sub == nil {
+		b.sub = sub()
+	}
+
+	return b.sub.Add(doc)
+}
+
+func (b *bucket) result(key string) Bucket {
+	if b.sub == nil {
+		return Bucket{key, b.count, nil}
+	}
+
+	return Bucket{key, b.count, b.sub.Result()}
+}
+
+// A bucket per value of a sorted-string field, largest first
+type Terms struct {
+	column  *store.SortedColumn
+	sub     Factory
+	size    int
+	buckets []*bucket
+}
+
+func NewTerms(column *store.SortedColumn, size int, sub Factory) *Terms {
+	return &Terms{column, sub, size, make([]*bucket, column.Cardinality())}
+}
+
+func (t *Terms) Add(doc match.DocId) os.Error {
+	ord, found := t.column.Ord(doc)
+	if !found {
+		return nil
+	}
+
+	if t.buckets[ord] == nil {
+		t.buckets[ord] = &bucket{}
+	}
+
+	return t.buckets[ord].add(doc, t.sub)
+}
+
+func (t *Terms) Result() interface{} {
+	results := buckets{}
+	for ord, b := range t.buckets {
+		if b != nil {
+			results = append(results, b.result(t.column.Term(ord)))
+		}
+	}
+
+	sort.Sort(results)
+	if t.size < len(results) {
+		results = results[:t.size]
+	}
+
+	return []Bucket(results)
+}
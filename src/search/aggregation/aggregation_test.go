@@ -0,0 +1,82 @@
+package aggregation
+
+import "math"
+import "testing"
+import match "basis/match"
+import store "basis/index/store"
+
+func numeric(values func(int) int64, docs int) *store.NumericColumn {
+	column := store.NewNumericColumn()
+
+	for doc := 0; doc < docs; doc++ {
+		column.Add(match.DocId(doc), values(doc))
+	}
+
+	return column
+}
+
+func addAll(a Aggregation, docs int) {
+	for doc := 0; doc < docs; doc++ {
+		a.Add(match.DocId(doc))
+	}
+}
+
+func TestNested(t *testing.T) {
+	prices := numeric(func(doc int) int64 { return int64(doc) }, 100)
+
+	categories := make([]string, 100)
+	docs := make([]match.DocId, 100)
+	for doc := range docs {
+		docs[doc] = match.DocId(doc)
+		categories[doc] = []string{"a", "b"}[doc/50]
+	}
+
+	terms := NewTerms(store.NewSortedColumn(docs, categories), 10, func() Aggregation {
+		return NewStats(prices)
+	})
+	addAll(terms, 100)
+
+	results := terms.Result().([]Bucket)
+	if len(results) != 2 {
+		t.Fatalf("len(buckets) = %d, want 2", len(results))
+	}
+
+	if avg := results[1].Sub.(StatsResult).Avg; results[1].Key != "b" || avg != 74.5 {
+		t.Errorf("bucket %s has avg %f, want b with 74.5", results[1].Key, avg)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h, _ := NewHistogram(numeric(func(doc int) int64 { return int64(doc - 50) }, 100), 30, nil)
+	addAll(h, 100)
+
+	results := h.Result().([]Bucket)
+	keys := []string{"-60", "-30", "0", "30"}
+	counts := []int{20, 30, 30, 20}
+
+	for idx, b := range results {
+		if b.Key != keys[idx] || b.Count != counts[idx] {
+			t.Errorf("bucket %d = %s: %d, want %s: %d", idx, b.Key, b.Count, keys[idx], counts[idx])
+		}
+	}
+}
+
+func TestCardinality(t *testing.T) {
+	c, _ := NewCardinality(numeric(func(doc int) int64 { return int64(doc % 20000) }, 100000), DefaultPrecision)
+	addAll(c, 100000)
+
+	if estimate := c.Estimate(); math.Fabs(float64(estimate)-20000) > 600 {
+		t.Errorf("Estimate() = %d, want about 20000", estimate)
+	}
+}
+
+func TestPercentiles(t *testing.T) {
+	p, _ := NewPercentiles(numeric(func(doc int) int64 { return int64(doc * 7919 % 10000) }, 10000), []float64{1, 50, 99}, DefaultCompression)
+	addAll(p, 10000)
+
+	for _, result := range p.Result().([]PercentileResult) {
+		if want := result.Percent * 100; math.Fabs(result.Value-want) > 50 {
+			t.Errorf("percentile %f = %f, want about %f", result.Percent, result.Value, want)
+		}
+	}
+}
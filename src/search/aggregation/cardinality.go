@@ -0,0 +1,86 @@
+package aggregation
+
+import "math"
+import "os"
+import match "basis/match"
+
+// Approximate distinct values with a HyperLogLog sketch. 2^precision
+// one byte registers give a standard error of about
+// 1.04 / sqrt(2^precision), or 0.8% at the default precision.
+const DefaultPrecision = 14
+
+type Cardinality struct {
+	values    Values
+	precision uint
+	registers []uint8
+}
+
+func NewCardinality(values Values, precision uint) (*Cardinality, os.Error) {
+	if precision < 4 || precision > 18 {
+		return nil, os.NewError("precision must be between 4 and 18")
+	}
+
+	return &Cardinality{values, precision, make([]uint8, 1<<precision)}, nil
+}
+
+// The murmur3 finalizer, which spreads nearby values over all 64 bits
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+
+	return h
+}
+
+func (c *Cardinality) Add(doc match.DocId) os.Error {
+	value, found := c.values.Get(doc)
+	if !found {
+		return nil
+	}
+
+	h := mix(uint64(value))
+	register := h >> (64 - c.precision)
+
+	// The position of the first set bit in what's left
+	rest := h<<c.precision | 1<<(c.precision-1)
+	rank := uint8(1)
+	for rest&(1<<63) == 0 {
+		rank++
+		rest <<= 1
+	}
+
+	if rank > c.registers[register] {
+		c.registers[register] = rank
+	}
+
+	return nil
+}
+
+func (c *Cardinality) Estimate() uint64 {
+	m := float64(len(c.registers))
+
+	sum := 0.0
+	zeros := 0
+	for _, r := range c.registers {
+		sum += math.Pow(2, -float64(r))
+
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+
+	// Linear counting is more accurate for small cardinalities
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return uint64(estimate + 0.5)
+}
+
+func (c *Cardinality) Result() interface{} {
+	return c.Estimate()
+}
@@ -0,0 +1,80 @@
+package aggregation
+
+import "os"
+import "sort"
+import "strconv"
+import match "basis/match"
+
+// Intervals for histograms over timestamps (in seconds)
+const (
+	Second = 1
+	Minute = 60 * Second
+	Hour   = 60 * Minute
+	Day    = 24 * Hour
+	Week   = 7 * Day
+)
+
+// Fixed width buckets of a numeric field. Each bucket is keyed by the
+// start of its interval, and buckets come back in key order.
+type Histogram struct {
+	values   Values
+	interval int64
+	sub      Factory
+	buckets  map[int64]*bucket
+}
+
+func NewHistogram(values Values, interval int64, sub Factory) (*Histogram, os.Error) {
+	if interval <= 0 {
+		return nil, os.NewError("histogram interval must be positive")
+	}
+
+	return &Histogram{values, interval, sub, make(map[int64]*bucket)}, nil
+}
+
+// Round down, including for negative values
+func (h *Histogram) key(value int64) int64 {
+	key := value / h.interval * h.interval
+	if key > value {
+		key -= h.interval
+	}
+
+	return key
+}
+
+func (h *Histogram) Add(doc match.DocId) os.Error {
+	value, found := h.values.Get(doc)
+	if !found {
+		return nil
+	}
+
+	key := h.key(value)
+	b, found := h.buckets[key]
+	if !found {
+		b = &bucket{}
+		h.buckets[key] = b
+	}
+
+	return b.add(doc, h.sub)
+}
+
+type int64s []int64
+
+func (k int64s) Len() int           { return len(k) }
+func (k int64s) Less(i, j int) bool { return k[i] < k[j] }
+func (k int64s) Swap(i, j int)      { k[i], k[j] = k[j], k[i] }
+
+func (h *Histogram) Result() interface{} {
+	keys := make(int64s, 0, len(h.buckets))
+	for key := range h.buckets {
+		keys = append(keys, key)
+	}
+
+	sort.Sort(keys)
+
+	results := make([]Bucket, len(keys))
+	for idx, key := range keys {
+		results[idx] = h.buckets[key].result(strconv.Itoa64(key))
+	}
+
+	return results
+}
@@ -0,0 +1,155 @@
+package aggregation
+
+import "math"
+import "os"
+import "sort"
+import match "basis/match"
+
+// Approximate percentiles with a t-digest: values are clustered into
+// centroids that are small near the tails and large in the middle, so
+// extreme percentiles stay accurate in bounded memory.
+const DefaultCompression = 100
+
+// Values are buffered and merged into the centroids in batches
+const digestBuffer = 512
+
+type centroid struct {
+	mean  float64
+	count float64
+}
+
+type centroids []centroid
+
+func (c centroids) Len() int           { return len(c) }
+func (c centroids) Less(i, j int) bool { return c[i].mean < c[j].mean }
+func (c centroids) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+type Percentiles struct {
+	values      Values
+	percents    []float64
+	compression float64
+
+	centroids centroids
+	buffer    centroids
+	total     float64
+	min, max  float64
+}
+
+type PercentileResult struct {
+	Percent float64
+	Value   float64
+}
+
+// percents are in [0, 100]
+func NewPercentiles(values Values, percents []float64, compression float64) (*Percentiles, os.Error) {
+	for _, p := range percents {
+		if p < 0 || p > 100 {
+			return nil, os.NewError("percentiles must be between 0 and 100")
+		}
+	}
+
+	return &Percentiles{values, percents, compression, centroids{}, centroids{}, 0, math.Inf(1), math.Inf(-1)}, nil
+}
+
+func (p *Percentiles) Add(doc match.DocId) os.Error {
+	value, found := p.values.Get(doc)
+	if !found {
+		return nil
+	}
+
+	p.add(float64(value))
+	return nil
+}
+
+func (p *Percentiles) add(value float64) {
+	p.buffer = append(p.buffer, centroid{value, 1})
+	p.total++
+
+	if value < p.min {
+		p.min = value
+	}
+
+	if value > p.max {
+		p.max = value
+	}
+
+	if len(p.buffer) >= digestBuffer {
+		p.compress()
+	}
+}
+
+// Merge neighbouring centroids while they stay under the size limit
+// for their quantile, 4 * total * q * (1 - q) / compression
+func (p *Percentiles) compress() {
+	if len(p.buffer) == 0 {
+		return
+	}
+
+	all := append(p.centroids, p.buffer...)
+	sort.Sort(all)
+
+	merged := centroids{all[0]}
+	before := 0.0
+
+	for _, next := range all[1:] {
+		current := &merged[len(merged)-1]
+		proposed := current.count + next.count
+		q := (before + proposed/2) / p.total
+
+		if proposed <= 4*p.total*q*(1-q)/p.compression {
+			current.mean += (next.mean - current.mean) * next.count / proposed
+			current.count = proposed
+		} else {
+			before += current.count
+			merged = append(merged, next)
+		}
+	}
+
+	p.centroids = merged
+	p.buffer = centroids{}
+}
+
+// Interpolate between the midpoints of the centroids either side of
+// the target rank
+func (p *Percentiles) Quantile(q float64) float64 {
+	p.compress()
+
+	if len(p.centroids) == 0 {
+		return math.NaN()
+	}
+
+	target := q * p.total
+	before := 0.0
+	lastMid, lastMean := 0.0, p.min
+
+	for _, c := range p.centroids {
+		mid := before + c.count/2
+
+		if target < mid {
+			if mid == lastMid {
+				return c.mean
+			}
+
+			return lastMean + (c.mean-lastMean)*(target-lastMid)/(mid-lastMid)
+		}
+
+		before += c.count
+		lastMid, lastMean = mid, c.mean
+	}
+
+	if p.total == lastMid {
+		return p.max
+	}
+
+	return lastMean + (p.max-lastMean)*(target-lastMid)/(p.total-lastMid)
+}
+
+func (p *Percentiles) Result() interface{} {
+	results := make([]PercentileResult, len(p.percents))
+
+	for idx, percent := range p.percents {
+		results[idx] = PercentileResult{percent, p.Quantile(percent / 100)}
+	}
+
+	return results
+}
@@ -0,0 +1,187 @@
+package cache
+
+import "container/list"
+import "os"
+import "sort"
+import "strings"
+import "sync"
+import match "basis/match"
+import bitset "basis/match/bitset"
+
+// Rough cost of an entry on top of its bits
+const entryOverhead = 128
+
+// Canonical key for a filter: the same kind and parameters give the
+// same key whatever order the parameters were given in.
+func FilterKey(kind string, params map[string]string) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+
+	sort.SortStrings(names)
+
+	parts := []string{kind}
+	for _, name := range names {
+		parts = append(parts, name+"="+params[name])
+	}
+
+	return strings.Join(parts, "\x00")
+}
+
+type FilterStats struct {
+	Hits, Misses, Evictions uint64
+
+	Entries int
+	Bytes   uint64
+}
+
+type filterEntry struct {
+	segment, key string
+	bits         *bitset.BitSet
+	size         uint64
+}
+
+// Caches filters (attribute ranges, geo boxes...) as bitsets per
+// segment, evicting the least recently used once the cached bitsets
+// pass a memory budget. Segments are immutable, so entries only need
+// dropping when a segment goes away.
+type FilterCache struct {
+	lock sync.Mutex
+
+	budget uint64
+	lru    *list.List
+	// segment -> key -> element in lru
+	entries map[string]map[string]*list.Element
+	// segment -> how many times it's been invalidated, so a bitset
+	// built across an Invalidate isn't cached
+	invalidations map[string]uint64
+
+	stats FilterStats
+}
+
+func NewFilterCache(budget uint64) *FilterCache {
+	return &FilterCache{sync.Mutex{}, budget, list.New(), make(map[string]map[string]*list.Element), make(map[string]uint64), FilterStats{}}
+}
+
+// Iterators that can stop early, at corrupt data, say why with Err
+// (as postinglist iterators do)
+type errIterator interface {
+	Err() os.Error
+}
+
+func materialize(maxId match.DocId, iters []match.MatchIterator) (*bitset.BitSet, os.Error) {
+	bits := bitset.New(uint(maxId) + 1)
+	match.Merge(iters, bits)
+
+	for _, it := range iters {
+		if it, ok := it.(errIterator); ok && it.Err() != nil {
+			return nil, it.Err()
+		}
+	}
+
+	return bits, nil
+}
+
+// The bitset for a filter on a segment. On a miss, the iterators from
+// iters are unioned into a new bitset (big enough for docs up to
+// maxId) and cached. If an iterator fails, so does Get, and nothing is
+// cached.
+func (c *FilterCache) Get(segment, key string, maxId match.DocId, iters func() []match.MatchIterator) (*bitset.BitSet, os.Error) {
+	c.lock.Lock()
+
+	if elem, found := c.entries[segment][key]; found {
+		c.lru.MoveToFront(elem)
+		c.stats.Hits++
+		c.lock.Unlock()
+
+		return elem.Value.(*filterEntry).bits, nil
+	}
+
+	c.stats.Misses++
+	invalidations := c.invalidations[segment]
+	c.lock.Unlock()
+
+	// Build the bitset without holding the lock. Two queries might
+	// both miss and build the same filter, which is harmless.
+	bits, err := materialize(maxId, iters())
+	if err != nil {
+		return nil, err
+	}
+
+	c.put(&filterEntry{segment, key, bits, bits.Size() + entryOverhead}, invalidations)
+
+	return bits, nil
+}
+
+// Cache entry, unless its segment has been invalidated since the miss
+// that built it, when the count was invalidations
+func (c *FilterCache) put(entry *filterEntry, invalidations uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if entry.size > c.budget || c.invalidations[entry.segment] != invalidations {
+		return
+	}
+
+	keys, found := c.entries[entry.segment]
+	if !found {
+		keys = make(map[string]*list.Element)
+		c.entries[entry.segment] = keys
+	}
+
+	if elem, found := keys[entry.key]; found {
+		c.remove(elem)
+	}
+
+	keys[entry.key] = c.lru.PushFront(entry)
+	c.stats.Entries++
+	c.stats.Bytes += entry.size
+
+	for c.stats.Bytes > c.budget {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// Must hold the lock
+func (c *FilterCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*filterEntry)
+
+	keys := c.entries[entry.segment]
+	keys[entry.key] = nil, false
+	if len(keys) == 0 {
+		c.entries[entry.segment] = nil, false
+	}
+
+	c.stats.Entries--
+	c.stats.Bytes -= entry.size
+}
+
+// Drop everything cached for a segment, once it's been merged away or
+// replaced (see query.Executor.Replace)
+func (c *FilterCache) Invalidate(segment string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.invalidations[segment]++
+	for _, elem := range c.entries[segment] {
+		c.remove(elem)
+	}
+}
+
+func (c *FilterCache) Clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *FilterCache) Stats() FilterStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.stats
+}
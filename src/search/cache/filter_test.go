@@ -0,0 +1,117 @@
+package cache
+
+import "os"
+import "strconv"
+import "testing"
+import match "basis/match"
+import bitset "basis/match/bitset"
+import postinglist "basis/match/postinglist"
+
+// Every step'th doc below 1250
+func every(step int) func() []match.MatchIterator {
+	return func() []match.MatchIterator {
+		docs := []match.DocId{}
+		for doc := 0; doc < 1250; doc += step {
+			docs = append(docs, match.DocId(doc))
+		}
+
+		pl, _ := postinglist.Build(docs, 4, postinglist.SkipLayoutLevels)
+		return []match.MatchIterator{postinglist.NewIter(pl)}
+	}
+}
+
+func count(bits *bitset.BitSet) int {
+	n := 0
+	for it := bitset.NewIter(bits); !it.Finished(); it.Next() {
+		n++
+	}
+
+	return n
+}
+
+// Stops after its first doc, as a list does at a corrupt block
+type truncated struct {
+	match.MatchIterator
+}
+
+func (truncated) Err() os.Error {
+	return os.NewError("corrupt block")
+}
+
+func TestFilterKey(t *testing.T) {
+	a := FilterKey("range", map[string]string{"field": "price", "lo": "1", "hi": "5"})
+	b := FilterKey("range", map[string]string{"hi": "5", "lo": "1", "field": "price"})
+
+	if a != b {
+		t.Errorf("FilterKey depends on parameter order: %q != %q", a, b)
+	}
+}
+
+func TestFilterCache(t *testing.T) {
+	// Room for two 1250 bit sets
+	c := NewFilterCache(2 * (entryOverhead + 160))
+
+	for _, step := range []int{1, 2, 1, 3} {
+		key := FilterKey("every", map[string]string{"step": strconv.Itoa(step)})
+
+		bits, err := c.Get("segment", key, 1249, every(step))
+		if err != nil {
+			t.Fatalf("Get() = %s", err)
+		}
+
+		if n := count(bits); n != 1249/step+1 {
+			t.Errorf("filter every %d has %d docs, want %d", step, n, 1249/step+1)
+		}
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 1 || stats.Misses != 3 || stats.Evictions != 1 || stats.Entries != 2 {
+		t.Errorf("Stats() = %+v, want 1 hit, 3 misses, 1 eviction and 2 entries", stats)
+	}
+
+	c.Invalidate("segment")
+	if stats = c.Stats(); stats.Entries != 0 || stats.Bytes != 0 {
+		t.Errorf("Stats() = %+v after Invalidate, want it empty", stats)
+	}
+}
+
+func TestFilterError(t *testing.T) {
+	c := NewFilterCache(1 << 20)
+	iters := func() []match.MatchIterator {
+		return []match.MatchIterator{truncated{every(2)()[0]}}
+	}
+
+	if bits, err := c.Get("segment", "truncated", 1249, iters); err == nil || bits != nil {
+		t.Errorf("Get() of a corrupt list = %v, %v, want an error", bits, err)
+	}
+
+	if stats := c.Stats(); stats.Entries != 0 {
+		t.Errorf("Stats() = %+v, want nothing cached", stats)
+	}
+}
+
+func TestInvalidateWhileBuilding(t *testing.T) {
+	c := NewFilterCache(1 << 20)
+
+	// The segment is replaced while the filter is built from it
+	iters := func() []match.MatchIterator {
+		c.Invalidate("segment")
+		return every(2)()
+	}
+
+	if _, err := c.Get("segment", "every", 1249, iters); err != nil {
+		t.Fatalf("Get() = %s", err)
+	}
+
+	if stats := c.Stats(); stats.Entries != 0 {
+		t.Errorf("Stats() = %+v, want the stale filter left out", stats)
+	}
+
+	if _, err := c.Get("segment", "every", 1249, every(2)); err != nil {
+		t.Fatalf("Get() = %s", err)
+	}
+
+	if stats := c.Stats(); stats.Entries != 1 || stats.Misses != 2 {
+		t.Errorf("Stats() = %+v, want 2 misses and the new filter cached", stats)
+	}
+}
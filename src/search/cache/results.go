@@ -0,0 +1,136 @@
+package cache
+
+import "container/list"
+import "sync"
+import "time"
+
+type ResultStats struct {
+	Hits, Misses, Evictions, Expirations uint64
+
+	Entries int
+	Bytes   uint64
+}
+
+type resultEntry struct {
+	key        string
+	value      interface{}
+	size       uint64
+	generation uint64
+	expires    int64
+}
+
+// Caches whole query results, bounded by bytes with LRU eviction.
+// Results are only valid for the index generation they were computed
+// on, so the first lookup or insert for a newer generation empties
+// the cache. A ttl (in nanoseconds, 0 for none) also bounds how stale
+// a result can get.
+type ResultCache struct {
+	lock sync.Mutex
+
+	budget uint64
+	ttl    int64
+
+	lru        *list.List
+	entries    map[string]*list.Element
+	generation uint64
+
+	stats ResultStats
+}
+
+func NewResultCache(budget uint64, ttl int64) *ResultCache {
+	return &ResultCache{sync.Mutex{}, budget, ttl, list.New(), make(map[string]*list.Element), 0, ResultStats{}}
+}
+
+// Must hold the lock
+func (c *ResultCache) advance(generation uint64) {
+	if generation <= c.generation {
+		return
+	}
+
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+
+	c.generation = generation
+}
+
+// Must hold the lock
+func (c *ResultCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*resultEntry)
+	c.entries[entry.key] = nil, false
+
+	c.stats.Entries--
+	c.stats.Bytes -= entry.size
+}
+
+func (c *ResultCache) Get(generation uint64, key string) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.advance(generation)
+
+	elem, found := c.entries[key]
+	if !found {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	entry := elem.Value.(*resultEntry)
+
+	if entry.generation != generation {
+		// Computed on an older index (a lookup from a searcher that
+		// hasn't switched generations yet)
+		c.stats.Misses++
+		return nil, false
+	}
+
+	if entry.expires > 0 && entry.expires < time.Nanoseconds() {
+		c.remove(elem)
+		c.stats.Expirations++
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+	c.stats.Hits++
+
+	return entry.value, true
+}
+
+// Cache a value of roughly size bytes computed on generation
+func (c *ResultCache) Put(generation uint64, key string, value interface{}, size uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.advance(generation)
+
+	if generation < c.generation || size > c.budget {
+		return
+	}
+
+	if elem, found := c.entries[key]; found {
+		c.remove(elem)
+	}
+
+	expires := int64(0)
+	if c.ttl > 0 {
+		expires = time.Nanoseconds() + c.ttl
+	}
+
+	entry := &resultEntry{key, value, size, generation, expires}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.stats.Entries++
+	c.stats.Bytes += size
+
+	for c.stats.Bytes > c.budget {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *ResultCache) Stats() ResultStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.stats
+}
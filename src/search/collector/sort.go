@@ -0,0 +1,379 @@
+package collector
+
+import "container/heap"
+import "os"
+import match "basis/match"
+import store "basis/index/store"
+
+// Where docs without a value for a sort field go, whichever the
+// direction
+const (
+	MissingLast = iota
+	MissingFirst
+)
+
+type SortField struct {
+	Field      string
+	Descending bool
+	Missing    int
+}
+
+// A doc and its values for each sort field. Sorted-string fields sort
+// by ordinal, so keys are only comparable within a segment; a Cursor
+// is what compares across segments.
+type SortKey struct {
+	Doc     match.DocId
+	Values  []int64
+	Present []bool
+}
+
+// A place in a sorted search over several segments: a hit's value for
+// each sort field, with sorted strings as their terms, then its
+// segment and doc, which break ties. The cursor of the last hit of a
+// page gives the next page. Segments that change between pages (a
+// name reused for other docs) can make pages skip or repeat docs.
+type Cursor struct {
+	// Per sort field: the numeric value, or the term of a sorted-string
+	// field, and whether the hit has one
+	Values  []int64
+	Terms   []string
+	Present []bool
+
+	Segment string
+	Doc     match.DocId
+}
+
+type column interface {
+	get(match.DocId) (int64, bool)
+}
+
+type numericColumn struct {
+	c *store.NumericColumn
+}
+
+func (n numericColumn) get(doc match.DocId) (int64, bool) {
+	return n.c.Get(doc)
+}
+
+type sortedColumn struct {
+	c *store.SortedColumn
+}
+
+func (s sortedColumn) get(doc match.DocId) (int64, bool) {
+	ord, found := s.c.Ord(doc)
+	return int64(ord), found
+}
+
+// For a field the segment has no values for
+type missingColumn struct{}
+
+func (missingColumn) get(doc match.DocId) (int64, bool) {
+	return 0, false
+}
+
+// Collects the first page of a segment's matches ordered by doc values
+// rather than score. Pass the cursor of the last hit of the previous
+// page as after to get the next page, so deep pages cost no more than
+// the first.
+type SortCollector struct {
+	fields  []SortField
+	columns []column
+	size    int
+	segment string
+	after   *Cursor
+
+	// The best keys so far, worst on top
+	keys []*SortKey
+
+	Total int
+}
+
+// Collects from the segment with the given name and doc values. Docs
+// are missing values for fields the segment has no values for.
+func NewSortCollector(values *store.DocValues, fields []SortField, size int, segment string, after *Cursor) (*SortCollector, os.Error) {
+	if len(fields) == 0 {
+		return nil, os.NewError("need at least one sort field")
+	}
+
+	columns := make([]column, len(fields))
+	for idx, field := range fields {
+		if c, found := values.Numeric[field.Field]; found {
+			columns[idx] = numericColumn{c}
+		} else if c, found := values.Sorted[field.Field]; found {
+			columns[idx] = sortedColumn{c}
+		} else {
+			// Perhaps other segments have some
+			columns[idx] = missingColumn{}
+		}
+	}
+
+	if after != nil && (len(after.Values) != len(fields) || len(after.Terms) != len(fields) || len(after.Present) != len(fields)) {
+		return nil, os.NewError("cursor doesn't match the sort fields")
+	}
+
+	return &SortCollector{fields, columns, size, segment, after, []*SortKey{}, 0}, nil
+}
+
+func (c *SortCollector) key(doc match.DocId) *SortKey {
+	key := &SortKey{doc, make([]int64, len(c.columns)), make([]bool, len(c.columns))}
+
+	for idx, column := range c.columns {
+		key.Values[idx], key.Present[idx] = column.get(doc)
+	}
+
+	return key
+}
+
+// Orders a's and b's values for a field, given whether each has one
+// and how the values compare when they both do (negative if a's is
+// smaller). Negative if a sorts first.
+func compareField(field SortField, aPresent, bPresent bool, cmp int) int {
+	if aPresent != bPresent {
+		if aPresent == (field.Missing == MissingLast) {
+			return -1
+		}
+
+		return 1
+	}
+
+	if !aPresent || cmp == 0 {
+		return 0
+	}
+
+	if (cmp < 0) != field.Descending {
+		return -1
+	}
+
+	return 1
+}
+
+func compareInts(a, b int64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+
+	return 0
+}
+
+func compareStrings(a, b string) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+
+	return 0
+}
+
+// Ties between segments go by segment name, then by doc
+func compareDocs(aSegment string, aDoc match.DocId, bSegment string, bDoc match.DocId) int {
+	if cmp := compareStrings(aSegment, bSegment); cmp != 0 {
+		return cmp
+	}
+
+	if aDoc < bDoc {
+		return -1
+	} else if aDoc > bDoc {
+		return 1
+	}
+
+	return 0
+}
+
+// Negative if a sorts before b
+func (c *SortCollector) compare(a, b *SortKey) int {
+	for idx, field := range c.fields {
+		cmp := compareField(field, a.Present[idx], b.Present[idx], compareInts(a.Values[idx], b.Values[idx]))
+		if cmp != 0 {
+			return cmp
+		}
+	}
+
+	return compareDocs(c.segment, a.Doc, c.segment, b.Doc)
+}
+
+// Negative if key sorts before the cursor
+func (c *SortCollector) compareCursor(key *SortKey, cursor *Cursor) int {
+	for idx, field := range c.fields {
+		cmp := 0
+		if sorted, ok := c.columns[idx].(sortedColumn); ok {
+			if key.Present[idx] {
+				cmp = compareStrings(sorted.c.Term(int(key.Values[idx])), cursor.Terms[idx])
+			}
+		} else {
+			cmp = compareInts(key.Values[idx], cursor.Values[idx])
+		}
+
+		if cmp = compareField(field, key.Present[idx], cursor.Present[idx], cmp); cmp != 0 {
+			return cmp
+		}
+	}
+
+	return compareDocs(c.segment, key.Doc, cursor.Segment, cursor.Doc)
+}
+
+func (c *SortCollector) Len() int {
+	return len(c.keys)
+}
+
+// The heap keeps the worst key on top
+func (c *SortCollector) Less(i, j int) bool {
+	return c.compare(c.keys[i], c.keys[j]) > 0
+}
+
+func (c *SortCollector) Swap(i, j int) {
+	c.keys[i], c.keys[j] = c.keys[j], c.keys[i]
+}
+
+func (c *SortCollector) Push(x interface{}) {
+	c.keys = append(c.keys, x.(*SortKey))
+}
+
+func (c *SortCollector) Pop() interface{} {
+	last := len(c.keys) - 1
+	key := c.keys[last]
+	c.keys = c.keys[:last]
+
+	return key
+}
+
+func (c *SortCollector) Add(doc match.DocId) os.Error {
+	c.Total++
+
+	key := c.key(doc)
+	if c.after != nil && c.compareCursor(key, c.after) <= 0 {
+		return nil
+	}
+
+	if len(c.keys) < c.size {
+		heap.Push(c, key)
+	} else if c.size > 0 && c.compare(key, c.keys[0]) < 0 {
+		heap.Pop(c)
+		heap.Push(c, key)
+	}
+
+	return nil
+}
+
+// The page, in sort order. This empties the collector.
+func (c *SortCollector) Results() []*SortKey {
+	results := make([]*SortKey, len(c.keys))
+
+	for idx := len(results) - 1; idx >= 0; idx-- {
+		results[idx] = heap.Pop(c).(*SortKey)
+	}
+
+	return results
+}
+
+// A page of one segment's keys, with the strings their sorted-string
+// ordinals stand for, so it can be merged with other segments' pages
+type Page struct {
+	Segment string
+	Keys    []*SortKey
+
+	fields []SortField
+	// Per key, the term of each sorted-string field
+	terms [][]string
+	sorted []bool
+}
+
+// Results as a Page. This empties the collector.
+func (c *SortCollector) Page() *Page {
+	keys := c.Results()
+	p := &Page{c.segment, keys, c.fields, make([][]string, len(keys)), make([]bool, len(c.columns))}
+
+	for idx, column := range c.columns {
+		_, p.sorted[idx] = column.(sortedColumn)
+	}
+
+	for n, key := range keys {
+		p.terms[n] = make([]string, len(c.columns))
+
+		for idx, column := range c.columns {
+			if sorted, ok := column.(sortedColumn); ok && key.Present[idx] {
+				p.terms[n][idx] = sorted.c.Term(int(key.Values[idx]))
+			}
+		}
+	}
+
+	return p
+}
+
+// Negative if key a of page p sorts before key b of page q. Sorted
+// strings compare by term, as ordinals differ between segments.
+func comparePages(p *Page, a int, q *Page, b int) int {
+	ka, kb := p.Keys[a], q.Keys[b]
+
+	for idx, field := range p.fields {
+		cmp := 0
+		if p.sorted[idx] {
+			cmp = compareStrings(p.terms[a][idx], q.terms[b][idx])
+		} else {
+			cmp = compareInts(ka.Values[idx], kb.Values[idx])
+		}
+
+		if cmp = compareField(field, ka.Present[idx], kb.Present[idx], cmp); cmp != 0 {
+			return cmp
+		}
+	}
+
+	return compareDocs(p.Segment, ka.Doc, q.Segment, kb.Doc)
+}
+
+// The cursor of key n of the page
+func (p *Page) Cursor(n int) *Cursor {
+	key := p.Keys[n]
+	cursor := &Cursor{make([]int64, len(key.Values)), make([]string, len(key.Values)), make([]bool, len(key.Values)), p.Segment, key.Doc}
+
+	for idx := range key.Values {
+		if p.sorted[idx] {
+			cursor.Terms[idx] = p.terms[n][idx]
+		} else {
+			cursor.Values[idx] = key.Values[idx]
+		}
+
+		cursor.Present[idx] = key.Present[idx]
+	}
+
+	return cursor
+}
+
+// A key of a merged page, the index of the page it came from, and its
+// cursor
+type Merged struct {
+	Page   int
+	Key    *SortKey
+	Cursor *Cursor
+}
+
+// The first size keys of pages (which must sort on the same fields),
+// in order. Keys that tie go in order of segment name, then doc.
+func Merge(pages []*Page, size int) []Merged {
+	merged := []Merged{}
+	next := make([]int, len(pages))
+
+	for len(merged) < size {
+		best := -1
+		for idx, p := range pages {
+			if next[idx] == len(p.Keys) {
+				continue
+			}
+
+			if best < 0 || comparePages(p, next[idx], pages[best], next[best]) < 0 {
+				best = idx
+			}
+		}
+
+		if best < 0 {
+			break
+		}
+
+		merged = append(merged, Merged{best, pages[best].Keys[next[best]], pages[best].Cursor(next[best])})
+		next[best]++
+	}
+
+	return merged
+}
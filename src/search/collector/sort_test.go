@@ -0,0 +1,139 @@
+package collector
+
+import "fmt"
+import "testing"
+import match "basis/match"
+import store "basis/index/store"
+
+// Docs 0 to 5: prices 30, 10, 30, missing, 20, missing and brands b,
+// a, a, c, missing, a
+func testValues() *store.DocValues {
+	values := store.NewDocValues()
+
+	price := store.NewNumericColumn()
+	for _, pair := range [][2]int64{{0, 30}, {1, 10}, {2, 30}, {4, 20}} {
+		price.Add(match.DocId(pair[0]), pair[1])
+	}
+
+	values.Numeric["price"] = price
+	values.Sorted["brand"] = store.NewSortedColumn([]match.DocId{0, 1, 2, 3, 5}, []string{"b", "a", "a", "c", "a"})
+
+	return values
+}
+
+func collect(t *testing.T, values *store.DocValues, fields []SortField, size int, after *Cursor) *Page {
+	c, err := NewSortCollector(values, fields, size, "a", after)
+	if err != nil {
+		t.Fatalf("NewSortCollector() = %s", err)
+	}
+
+	for doc := match.DocId(0); doc < 6; doc++ {
+		c.Add(doc)
+	}
+
+	return c.Page()
+}
+
+func docs(keys []*SortKey) string {
+	ids := []match.DocId{}
+	for _, key := range keys {
+		ids = append(ids, key.Doc)
+	}
+
+	return fmt.Sprint(ids)
+}
+
+func TestSort(t *testing.T) {
+	price := SortField{"price", false, MissingLast}
+	brand := SortField{"brand", false, MissingLast}
+
+	tests := []struct {
+		fields []SortField
+		size   int
+		want   string
+	}{
+		{[]SortField{price}, 6, "[1 4 0 2 3 5]"},
+		{[]SortField{SortField{"price", true, MissingLast}}, 6, "[0 2 4 1 3 5]"},
+		{[]SortField{SortField{"price", false, MissingFirst}}, 6, "[3 5 1 4 0 2]"},
+		{[]SortField{SortField{"price", true, MissingFirst}}, 6, "[3 5 0 2 4 1]"},
+		{[]SortField{brand, price}, 6, "[1 2 5 0 3 4]"},
+		{[]SortField{brand, SortField{"price", true, MissingFirst}}, 6, "[5 2 1 0 3 4]"},
+		{[]SortField{SortField{"price", true, MissingLast}, brand}, 6, "[2 0 4 1 5 3]"},
+		{[]SortField{brand, price}, 3, "[1 2 5]"},
+		{[]SortField{SortField{"unknown", false, MissingLast}}, 6, "[0 1 2 3 4 5]"},
+	}
+
+	for _, test := range tests {
+		if got := docs(collect(t, testValues(), test.fields, test.size, nil).Keys); got != test.want {
+			t.Errorf("sort by %v = %s, want %s", test.fields, got, test.want)
+		}
+	}
+}
+
+func TestSortAfter(t *testing.T) {
+	fields := []SortField{SortField{"brand", false, MissingLast}, SortField{"price", false, MissingLast}}
+
+	first := collect(t, testValues(), fields, 2, nil)
+	rest := collect(t, testValues(), fields, 6, first.Cursor(1))
+
+	if got := docs(first.Keys) + docs(rest.Keys); got != "[1 2][5 0 3 4]" {
+		t.Errorf("pages = %s, want [1 2][5 0 3 4]", got)
+	}
+
+	// A cursor from another segment, whose ordinals differ: after
+	// brand "aa", then after brand "b" price 30 in segment "b"
+	cursors := []struct {
+		cursor *Cursor
+		want   string
+	}{
+		{&Cursor{[]int64{0, 0}, []string{"aa", ""}, []bool{true, false}, "b", 0}, "[0 3 4]"},
+		{&Cursor{[]int64{0, 30}, []string{"b", ""}, []bool{true, true}, "b", 7}, "[3 4]"},
+		{&Cursor{[]int64{0, 30}, []string{"b", ""}, []bool{true, true}, "", 7}, "[0 3 4]"},
+	}
+
+	for _, test := range cursors {
+		if got := docs(collect(t, testValues(), fields, 6, test.cursor).Keys); got != test.want {
+			t.Errorf("page after %v = %s, want %s", test.cursor, got, test.want)
+		}
+	}
+
+	if _, err := NewSortCollector(testValues(), fields, 6, "a", &Cursor{[]int64{0}, []string{""}, []bool{false}, "", 0}); err == nil {
+		t.Errorf("NewSortCollector() with a cursor for one field succeeded")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	fields := []SortField{SortField{"brand", false, MissingLast}, SortField{"price", true, MissingLast}}
+
+	// Ordinals differ between the segments: "b" is 0 in the second
+	other := store.NewDocValues()
+	price := store.NewNumericColumn()
+	price.Add(0, 50)
+	price.Add(1, 5)
+	other.Numeric["price"] = price
+	other.Sorted["brand"] = store.NewSortedColumn([]match.DocId{0, 1}, []string{"b", "d"})
+
+	pages := []*Page{}
+	for idx, values := range []*store.DocValues{testValues(), other} {
+		c, err := NewSortCollector(values, fields, 4, fmt.Sprint(idx), nil)
+		if err != nil {
+			t.Fatalf("NewSortCollector() = %s", err)
+		}
+
+		for doc := match.DocId(0); doc < 6; doc++ {
+			c.Add(doc)
+		}
+
+		pages = append(pages, c.Page())
+	}
+
+	got := ""
+	for _, m := range Merge(pages, 5) {
+		got += fmt.Sprintf("%d/%d ", m.Page, m.Key.Doc)
+	}
+
+	// Brand b ties across the segments, so the higher price goes first
+	if want := "0/2 0/1 0/5 1/0 0/0 "; got != want {
+		t.Errorf("Merge() = %s, want %s", got, want)
+	}
+}
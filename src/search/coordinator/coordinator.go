@@ -0,0 +1,223 @@
+package coordinator
+
+import "os"
+import "sort"
+import "time"
+import segment "basis/index/segment"
+import query "basis/search/query"
+
+// Part of a collection that can be searched on its own. Scores must
+// come from the stats passed to Search, so that they're comparable
+// across shards, and hits must give the ids docs were added with (see
+// segment.OriginalId), since segment-local ids mean nothing outside
+// the shard.
+type Shard interface {
+	Stats(q *query.Query) (*query.Stats, os.Error)
+	Search(q *query.Query, global *query.Stats) (*query.Results, os.Error)
+}
+
+// A shard in this process
+type Local struct {
+	Executor *query.Executor
+}
+
+func (l Local) Stats(q *query.Query) (*query.Stats, os.Error) {
+	return l.Executor.Stats(q), nil
+}
+
+func (l Local) Search(q *query.Query, global *query.Stats) (*query.Results, os.Error) {
+	results, err := l.Executor.Search(q, global)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make(map[string]*segment.Segment)
+	for _, src := range l.Executor.Sources() {
+		segments[src.Name] = src.Segment
+	}
+
+	// A copy, as results may be cached
+	original := &query.Results{make([]query.Hit, len(results.Hits)), results.Total}
+	for idx, hit := range results.Hits {
+		original.Hits[idx] = query.Hit{hit.Segment, segments[hit.Segment].OriginalId(hit.Doc), hit.Score}
+	}
+
+	return original, nil
+}
+
+// A hit, with Doc the id it was added with
+type Hit struct {
+	Shard string
+	query.Hit
+
+	// Where the shard was added, which breaks ties
+	order int
+}
+
+type Results struct {
+	Hits  []Hit
+	Total int
+
+	// Shards that answered both phases, and the ones that failed or
+	// timed out (with why). Results are partial if any failed.
+	Responded []string
+	Failed    map[string]os.Error
+}
+
+func (r *Results) Partial() bool {
+	return len(r.Failed) > 0
+}
+
+var ErrTimeout = os.NewError("shard timed out")
+var ErrNoShards = os.NewError("no shard responded")
+
+// Fans queries out to shards and merges their hits. Each query takes
+// two rounds: the shards' stats are summed into global stats, then
+// every shard searches with them. A shard that fails or misses the
+// deadline in either round is left out of the results.
+type Coordinator struct {
+	names  []string
+	shards []Shard
+
+	// Per round, in nanoseconds (0 waits forever)
+	Timeout int64
+}
+
+func New(timeout int64) *Coordinator {
+	return &Coordinator{[]string{}, []Shard{}, timeout}
+}
+
+func (c *Coordinator) Add(name string, shard Shard) {
+	c.names = append(c.names, name)
+	c.shards = append(c.shards, shard)
+}
+
+type response struct {
+	shard int
+	value interface{}
+	err   os.Error
+}
+
+// Calls call on each of the live shards, returning what came back by
+// the deadline. Late shards are marked failed; their goroutines finish
+// into a buffered channel that nobody reads.
+func (c *Coordinator) round(live []int, failed map[string]os.Error, call func(Shard) (interface{}, os.Error)) map[int]interface{} {
+	responses := make(chan response, len(live))
+
+	for _, shard := range live {
+		go func(shard int) {
+			value, err := call(c.shards[shard])
+			responses <- response{shard, value, err}
+		}(shard)
+	}
+
+	// Never closes if there's no timeout
+	deadline := make(chan bool)
+	if c.Timeout > 0 {
+		go func() {
+			time.Sleep(c.Timeout)
+			close(deadline)
+		}()
+	}
+
+	values := make(map[int]interface{})
+	for pending := len(live); pending > 0; pending-- {
+		select {
+		case r := <-responses:
+			if r.err != nil {
+				failed[c.names[r.shard]] = r.err
+			} else {
+				values[r.shard] = r.value
+			}
+		case <-deadline:
+			for _, shard := range live {
+				_, answered := values[shard]
+				if _, failedAlready := failed[c.names[shard]]; !answered && !failedAlready {
+					failed[c.names[shard]] = ErrTimeout
+				}
+			}
+
+			return values
+		}
+	}
+
+	return values
+}
+
+func answered(values map[int]interface{}) []int {
+	shards := []int{}
+	for shard := range values {
+		shards = append(shards, shard)
+	}
+
+	sort.SortInts(shards)
+	return shards
+}
+
+// The best hits first; ties go to the shard added first, then the
+// lower doc
+type byScore []Hit
+
+func (h byScore) Len() int      { return len(h) }
+func (h byScore) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h byScore) Less(i, j int) bool {
+	if h[i].Score != h[j].Score {
+		return h[i].Score > h[j].Score
+	}
+
+	if h[i].order != h[j].order {
+		return h[i].order < h[j].order
+	}
+
+	return h[i].Doc < h[j].Doc
+}
+
+func (c *Coordinator) Search(q *query.Query) (*Results, os.Error) {
+	if len(c.shards) == 0 {
+		return nil, ErrNoShards
+	}
+
+	results := &Results{[]Hit{}, 0, []string{}, make(map[string]os.Error)}
+
+	live := make([]int, len(c.shards))
+	for shard := range live {
+		live[shard] = shard
+	}
+
+	stats := c.round(live, results.Failed, func(s Shard) (interface{}, os.Error) {
+		return s.Stats(q)
+	})
+
+	global := query.NewStats()
+	for _, value := range stats {
+		global.Add(value.(*query.Stats))
+	}
+
+	live = answered(stats)
+	found := c.round(live, results.Failed, func(s Shard) (interface{}, os.Error) {
+		return s.Search(q, global)
+	})
+
+	if len(found) == 0 {
+		return nil, ErrNoShards
+	}
+
+	for _, shard := range answered(found) {
+		name := c.names[shard]
+		shardResults := found[shard].(*query.Results)
+
+		results.Responded = append(results.Responded, name)
+		results.Total += shardResults.Total
+
+		for _, hit := range shardResults.Hits {
+			results.Hits = append(results.Hits, Hit{name, hit, shard})
+		}
+	}
+
+	sort.Sort(byScore(results.Hits))
+	if len(results.Hits) > q.K {
+		results.Hits = results.Hits[:q.K]
+	}
+
+	return results, nil
+}
@@ -0,0 +1,204 @@
+package coordinator
+
+import "net"
+import "os"
+import "rpc"
+import "testing"
+import "time"
+import match "basis/match"
+import builder "basis/index/builder"
+import segment "basis/index/segment"
+import cache "basis/search/cache"
+import query "basis/search/query"
+
+// Docs [from, to), with "rare" much more common in the second half
+func testSegment(t *testing.T, from, to int) *segment.Segment {
+	b := builder.New(builder.DefaultOptions)
+
+	for i := from; i < to; i++ {
+		tokens := []string{"all"}
+		if (i < 50 && i%25 == 0) || (i >= 50 && i%2 == 0) {
+			tokens = append(tokens, "rare")
+		}
+
+		doc := &builder.Document{Id: match.DocId(i), Fields: map[string][]string{"body": tokens}}
+		if err := b.Add(doc); err != nil {
+			t.Fatalf("Add(%d) = %s", i, err)
+		}
+	}
+
+	seg, err := b.Finish()
+	if err != nil {
+		t.Fatalf("Finish() = %s", err)
+	}
+
+	return seg
+}
+
+func executor(sources ...query.Source) *query.Executor {
+	return query.NewExecutor(sources, 1, cache.NewFilterCache(1<<20))
+}
+
+type slow struct {
+	Shard
+	delay int64
+}
+
+func (s slow) Search(q *query.Query, global *query.Stats) (*query.Results, os.Error) {
+	time.Sleep(s.delay)
+	return s.Shard.Search(q, global)
+}
+
+type broken struct{}
+
+func (broken) Stats(q *query.Query) (*query.Stats, os.Error) {
+	return nil, os.NewError("broken")
+}
+
+func (broken) Search(q *query.Query, global *query.Stats) (*query.Results, os.Error) {
+	return nil, os.NewError("broken")
+}
+
+func TestGlobalScores(t *testing.T) {
+	a := query.Source{"a", testSegment(t, 0, 50)}
+	b := query.Source{"b", testSegment(t, 50, 100)}
+
+	c := New(0)
+	c.Add("a", Local{executor(a)})
+	c.Add("b", Local{executor(b)})
+
+	q := &query.Query{[]string{"body:all", "body:rare"}, query.MatchAny, nil, nil, nil, query.SumFields, nil, nil, nil, 100}
+	results, err := c.Search(q)
+	if err != nil {
+		t.Fatalf("Search() = %s", err)
+	}
+
+	// Scores must match searching both segments together
+	whole, _ := executor(a, b).Search(q, nil)
+	if results.Total != whole.Total || len(results.Hits) != len(whole.Hits) {
+		t.Fatalf("Search() found %d, want %d", results.Total, whole.Total)
+	}
+
+	for idx, hit := range results.Hits {
+		if hit.Score != whole.Hits[idx].Score {
+			t.Errorf("hit %d scored %f, want %f", idx, hit.Score, whole.Hits[idx].Score)
+		}
+	}
+
+	if len(results.Responded) != 2 || results.Partial() {
+		t.Errorf("Search() heard from %v, want a and b", results.Responded)
+	}
+}
+
+func TestPartialResults(t *testing.T) {
+	c := New(50e6)
+	c.Add("a", Local{executor(query.Source{"a", testSegment(t, 0, 50)})})
+	c.Add("slow", slow{Local{executor(query.Source{"b", testSegment(t, 50, 100)})}, 1e9})
+	c.Add("broken", broken{})
+
+	q := &query.Query{[]string{"body:all"}, query.MatchAll, nil, nil, nil, query.SumFields, nil, nil, nil, 10}
+	results, err := c.Search(q)
+	if err != nil {
+		t.Fatalf("Search() = %s", err)
+	}
+
+	if results.Total != 50 || len(results.Responded) != 1 || results.Responded[0] != "a" {
+		t.Errorf("Search() found %d from %v, want 50 from a", results.Total, results.Responded)
+	}
+
+	if results.Failed["slow"] != ErrTimeout || results.Failed["broken"] == nil {
+		t.Errorf("Search() failures = %v, want slow timed out and broken", results.Failed)
+	}
+}
+
+func TestRemote(t *testing.T) {
+	server := rpc.NewServer()
+	if err := server.Register(NewShardService(Local{executor(query.Source{"a", testSegment(t, 0, 50)})})); err != nil {
+		t.Fatalf("Register() = %s", err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+
+	client := rpc.NewClient(clientConn)
+	defer client.Close()
+
+	c := New(0)
+	c.Add("remote", Remote{client})
+	c.Add("local", Local{executor(query.Source{"b", testSegment(t, 50, 100)})})
+
+	q := &query.Query{[]string{"body:rare"}, query.MatchAll, nil, nil, nil, query.SumFields, nil, nil, nil, 5}
+	results, err := c.Search(q)
+	if err != nil {
+		t.Fatalf("Search() = %s", err)
+	}
+
+	if results.Total != 27 || len(results.Hits) != 5 || len(results.Responded) != 2 {
+		t.Errorf("Search() = %d hits of %d from %v, want 5 of 27 from 2 shards", len(results.Hits), results.Total, results.Responded)
+	}
+}
+
+func TestTies(t *testing.T) {
+	// The same docs, so every doc ties with its copy
+	c := New(0)
+	c.Add("b", Local{executor(query.Source{"s", testSegment(t, 0, 50)})})
+	c.Add("a", Local{executor(query.Source{"s", testSegment(t, 0, 50)})})
+
+	q := &query.Query{[]string{"body:all"}, query.MatchAll, nil, nil, nil, query.SumFields, nil, nil, nil, 100}
+	results, err := c.Search(q)
+	if err != nil {
+		t.Fatalf("Search() = %s", err)
+	}
+
+	// The 48 docs without "rare" score best, b's first
+	first, second := results.Hits[0], results.Hits[48]
+	if first.Shard != "b" || second.Shard != "a" || first.Doc != second.Doc || first.Score != second.Score {
+		t.Errorf("hits 0 and 48 = %s/%d and %s/%d, want the same doc from b then a", first.Shard, first.Doc, second.Shard, second.Doc)
+	}
+}
+
+func TestOriginalIds(t *testing.T) {
+	// Reverse the docs, so 0 and 25 become 49 and 24
+	ranks := make(map[match.DocId]float64)
+	for i := 0; i < 50; i++ {
+		ranks[match.DocId(i)] = float64(i)
+	}
+
+	options := builder.DefaultOptions
+	options.Ranks = ranks
+	b := builder.New(options)
+
+	for i := 0; i < 50; i++ {
+		tokens := []string{"all"}
+		if i%25 == 0 {
+			tokens = append(tokens, "rare")
+		}
+
+		if err := b.Add(&builder.Document{Id: match.DocId(i), Fields: map[string][]string{"body": tokens}}); err != nil {
+			t.Fatalf("Add(%d) = %s", i, err)
+		}
+	}
+
+	seg, err := b.Finish()
+	if err != nil {
+		t.Fatalf("Finish() = %s", err)
+	}
+
+	c := New(0)
+	c.Add("ranked", Local{executor(query.Source{"s", seg})})
+
+	q := &query.Query{[]string{"body:rare"}, query.MatchAll, nil, nil, nil, query.SumFields, nil, nil, nil, 10}
+	results, err := c.Search(q)
+	if err != nil {
+		t.Fatalf("Search() = %s", err)
+	}
+
+	docs := make(map[match.DocId]bool)
+	for _, hit := range results.Hits {
+		docs[hit.Doc] = true
+	}
+
+	if len(docs) != 2 || !docs[0] || !docs[25] {
+		t.Errorf("Search() found docs %v, want 0 and 25", docs)
+	}
+}
@@ -0,0 +1,62 @@
+package coordinator
+
+import "os"
+import "rpc"
+import query "basis/search/query"
+
+// Serves a shard over rpc, as "ShardService"
+type ShardService struct {
+	shard Shard
+}
+
+func NewShardService(shard Shard) *ShardService {
+	return &ShardService{shard}
+}
+
+type SearchArgs struct {
+	Query  *query.Query
+	Global *query.Stats
+}
+
+func (s *ShardService) Stats(q *query.Query, reply *query.Stats) os.Error {
+	stats, err := s.shard.Stats(q)
+	if err != nil {
+		return err
+	}
+
+	*reply = *stats
+	return nil
+}
+
+func (s *ShardService) Search(args *SearchArgs, reply *query.Results) os.Error {
+	results, err := s.shard.Search(args.Query, args.Global)
+	if err != nil {
+		return err
+	}
+
+	*reply = *results
+	return nil
+}
+
+// A shard served by a ShardService elsewhere
+type Remote struct {
+	Client *rpc.Client
+}
+
+func (r Remote) Stats(q *query.Query) (*query.Stats, os.Error) {
+	stats := query.NewStats()
+	if err := r.Client.Call("ShardService.Stats", q, stats); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+func (r Remote) Search(q *query.Query, global *query.Stats) (*query.Results, os.Error) {
+	results := &query.Results{}
+	if err := r.Client.Call("ShardService.Search", &SearchArgs{q, global}, results); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
@@ -0,0 +1,195 @@
+package facet
+
+import "os"
+import "sort"
+import "strconv"
+import match "basis/match"
+import store "basis/index/store"
+
+// A facet counts matches as they're added, so it can be handed to
+// match.Intersection or match.Merge directly, or chained in front of
+// another collector with Chain.
+type Facet interface {
+	match.MatchList
+
+	// The n values with the most matches
+	Top(n int) []Count
+}
+
+type Count struct {
+	Value string
+	Count int
+}
+
+type counts []Count
+
+func (c counts) Len() int { return len(c) }
+func (c counts) Less(i, j int) bool {
+	if c[i].Count != c[j].Count {
+		return c[i].Count > c[j].Count
+	}
+
+	return c[i].Value < c[j].Value
+}
+func (c counts) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+
+func top(c counts, n int) []Count {
+	sort.Sort(c)
+
+	if n < len(c) {
+		c = c[:n]
+	}
+
+	return c
+}
+
+// Adds up the counts of each value in lists (from the same facet over
+// different segments, say), returning the n values with the most
+func Sum(lists [][]Count, n int) []Count {
+	totals := make(map[string]int)
+	for _, list := range lists {
+		for _, count := range list {
+			totals[count.Value] += count.Count
+		}
+	}
+
+	c := counts{}
+	for value, count := range totals {
+		c = append(c, Count{value, count})
+	}
+
+	return top(c, n)
+}
+
+// Counts per value of a sorted-string doc value
+type TermsFacet struct {
+	column *store.SortedColumn
+	counts []int
+}
+
+func NewTermsFacet(column *store.SortedColumn) *TermsFacet {
+	return &TermsFacet{column, make([]int, column.Cardinality())}
+}
+
+func (f *TermsFacet) Add(doc match.DocId) os.Error {
+	if ord, found := f.column.Ord(doc); found {
+		f.counts[ord]++
+	}
+
+	return nil
+}
+
+func (f *TermsFacet) Top(n int) []Count {
+	c := counts{}
+	for ord, count := range f.counts {
+		if count > 0 {
+			c = append(c, Count{f.column.Term(ord), count})
+		}
+	}
+
+	return top(c, n)
+}
+
+// Counts per distinct value of a numeric doc value
+type ValuesFacet struct {
+	column *store.NumericColumn
+	counts map[int64]int
+}
+
+func NewValuesFacet(column *store.NumericColumn) *ValuesFacet {
+	return &ValuesFacet{column, make(map[int64]int)}
+}
+
+func (f *ValuesFacet) Add(doc match.DocId) os.Error {
+	if value, found := f.column.Get(doc); found {
+		f.counts[value]++
+	}
+
+	return nil
+}
+
+func (f *ValuesFacet) Top(n int) []Count {
+	c := counts{}
+	for value, count := range f.counts {
+		c = append(c, Count{strconv.Itoa64(value), count})
+	}
+
+	return top(c, n)
+}
+
+// A bucket of numeric values, [Min, Max)
+type Range struct {
+	Name     string
+	Min, Max int64
+}
+
+// Counts per range of a numeric doc value. Ranges may overlap.
+type RangeFacet struct {
+	column *store.NumericColumn
+	ranges []Range
+	counts []int
+}
+
+func NewRangeFacet(column *store.NumericColumn, ranges []Range) *RangeFacet {
+	return &RangeFacet{column, ranges, make([]int, len(ranges))}
+}
+
+func (f *RangeFacet) Add(doc match.DocId) os.Error {
+	value, found := f.column.Get(doc)
+	if !found {
+		return nil
+	}
+
+	for idx, r := range f.ranges {
+		if r.Min <= value && value < r.Max {
+			f.counts[idx]++
+		}
+	}
+
+	return nil
+}
+
+// Every range, in the order they were given
+func (f *RangeFacet) Counts() []Count {
+	c := make([]Count, len(f.ranges))
+	for idx, r := range f.ranges {
+		c[idx] = Count{r.Name, f.counts[idx]}
+	}
+
+	return c
+}
+
+func (f *RangeFacet) Top(n int) []Count {
+	return top(f.Counts(), n)
+}
+
+// Adds up lists of the counts of ranges (see RangeFacet.Counts), over
+// different segments, say. Every range is returned, in order.
+func SumRanges(ranges []Range, lists [][]Count) []Count {
+	c := make([]Count, len(ranges))
+	for idx, r := range ranges {
+		c[idx] = Count{r.Name, 0}
+	}
+
+	for _, list := range lists {
+		for idx := range c {
+			c[idx].Count += list[idx].Count
+		}
+	}
+
+	return c
+}
+
+// Passes each match to every list in turn, so facets can be counted
+// while another collector gathers the results
+type Chain []match.MatchList
+
+func (c Chain) Add(doc match.DocId) os.Error {
+	for _, list := range c {
+		if err := list.Add(doc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package facet
+
+import "fmt"
+import "testing"
+import match "basis/match"
+import bitset "basis/match/bitset"
+import store "basis/index/store"
+
+// Docs 0 to 7: colors red, blue, red, green, red, blue, missing,
+// green; sizes 1, 2, 2, 3, 1, 1, 2, missing
+func testValues() *store.DocValues {
+	values := store.NewDocValues()
+	values.Sorted["color"] = store.NewSortedColumn(
+		[]match.DocId{0, 1, 2, 3, 4, 5, 7},
+		[]string{"red", "blue", "red", "green", "red", "blue", "green"},
+	)
+
+	size := store.NewNumericColumn()
+	for doc, value := range []int64{1, 2, 2, 3, 1, 1, 2} {
+		size.Add(match.DocId(doc), value)
+	}
+
+	values.Numeric["size"] = size
+	return values
+}
+
+func iter(docs ...match.DocId) match.MatchIterator {
+	bits := bitset.New(8)
+	for _, doc := range docs {
+		bits.Add(doc)
+	}
+
+	return bitset.NewIter(bits)
+}
+
+func count(f match.MatchList, docs ...match.DocId) {
+	for _, doc := range docs {
+		f.Add(doc)
+	}
+}
+
+func TestFacets(t *testing.T) {
+	values := testValues()
+	all := []match.DocId{0, 1, 2, 3, 4, 5, 6, 7}
+
+	terms := NewTermsFacet(values.Sorted["color"])
+	numbers := NewValuesFacet(values.Numeric["size"])
+	ranges := NewRangeFacet(values.Numeric["size"], []Range{Range{"small", 0, 2}, Range{"large", 2, 10}, Range{"any", 0, 10}})
+	count(Chain{terms, numbers, ranges}, all...)
+
+	tests := []struct {
+		facet Facet
+		n     int
+		want  string
+	}{
+		{terms, 10, "[{red 3} {blue 2} {green 2}]"},
+		{terms, 2, "[{red 3} {blue 2}]"},
+		{terms, 0, "[]"},
+		{numbers, 10, "[{1 3} {2 3} {3 1}]"},
+		{numbers, 1, "[{1 3}]"},
+		{ranges, 10, "[{any 7} {large 4} {small 3}]"},
+	}
+
+	for _, test := range tests {
+		if got := fmt.Sprint(test.facet.Top(test.n)); got != test.want {
+			t.Errorf("Top(%d) = %s, want %s", test.n, got, test.want)
+		}
+	}
+
+	if got := fmt.Sprint(ranges.Counts()); got != "[{small 3} {large 4} {any 7}]" {
+		t.Errorf("Counts() = %s, want ranges in order", got)
+	}
+
+	sum := Sum([][]Count{terms.Top(10), []Count{Count{"green", 2}, Count{"pink", 1}}}, 3)
+	if got := fmt.Sprint(sum); got != "[{green 4} {red 3} {blue 2}]" {
+		t.Errorf("Sum() = %s, want [{green 4} {red 3} {blue 2}]", got)
+	}
+}
+
+func TestMultiSelect(t *testing.T) {
+	values := testValues()
+
+	// Red or blue docs of size 1
+	query := func() []match.MatchIterator { return []match.MatchIterator{iter(0, 1, 2, 3, 4, 5, 6, 7)} }
+	filters := []Filter{
+		Filter{"color", func() match.MatchIterator { return iter(0, 1, 2, 4, 5) }},
+		Filter{"size", func() match.MatchIterator { return iter(0, 4, 5) }},
+	}
+
+	colors := NewTermsFacet(values.Sorted["color"])
+	sizes := NewValuesFacet(values.Numeric["size"])
+	facets := map[string]Facet{"color": colors, "size": sizes}
+
+	result := bitset.New(8)
+	MultiSelect(query, filters, facets, result)
+
+	docs := []match.DocId{}
+	for it := bitset.NewIter(result); !it.Finished(); it.Next() {
+		docs = append(docs, it.Current())
+	}
+
+	if got := fmt.Sprint(docs); got != "[0 4 5]" {
+		t.Errorf("results = %s, want [0 4 5]", got)
+	}
+
+	// Each facet leaves its own filter out: colors of size 1 docs, and
+	// sizes of red or blue docs
+	if got := fmt.Sprint(colors.Top(10)); got != "[{red 2} {blue 1}]" {
+		t.Errorf("colors = %s, want [{red 2} {blue 1}]", got)
+	}
+
+	if got := fmt.Sprint(sizes.Top(10)); got != "[{1 3} {2 2}]" {
+		t.Errorf("sizes = %s, want [{1 3} {2 2}]", got)
+	}
+}
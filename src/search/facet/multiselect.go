@@ -0,0 +1,48 @@
+package facet
+
+import match "basis/match"
+
+// A filter on the field a facet counts. Iter is called each time the
+// filter is needed, since iterators can only be consumed once.
+type Filter struct {
+	Field string
+	Iter  func() match.MatchIterator
+}
+
+// Run a query with every filter applied, sending matches to result.
+// Facets on a filtered field are counted over the query with that
+// field's filters left out, so the unselected values of a facet still
+// show how many results picking them would add.
+func MultiSelect(query func() []match.MatchIterator, filters []Filter, facets map[string]Facet, result match.MatchList) {
+	intersect := func(exclude string, to match.MatchList) {
+		iters := query()
+		for _, filter := range filters {
+			if filter.Field != exclude {
+				iters = append(iters, filter.Iter())
+			}
+		}
+
+		match.Intersection(iters, to)
+	}
+
+	filtered := make(map[string]bool)
+	for _, filter := range filters {
+		filtered[filter.Field] = true
+	}
+
+	// Unfiltered facets count the main results
+	main := Chain{result}
+	for field, facet := range facets {
+		if !filtered[field] {
+			main = append(main, facet)
+		}
+	}
+
+	intersect("", main)
+
+	for field, facet := range facets {
+		if filtered[field] {
+			intersect(field, facet)
+		}
+	}
+}
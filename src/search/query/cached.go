@@ -0,0 +1,55 @@
+package query
+
+import "os"
+import "sync"
+import cache "basis/search/cache"
+
+// Sits in front of an executor, answering repeated queries from a
+// result cache. Swapping in an executor for a new generation
+// invalidates everything cached for the old one.
+type Cached struct {
+	lock     sync.RWMutex
+	executor *Executor
+	results  *cache.ResultCache
+}
+
+func NewCached(executor *Executor, results *cache.ResultCache) *Cached {
+	return &Cached{sync.RWMutex{}, executor, results}
+}
+
+func (c *Cached) Executor() *Executor {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.executor
+}
+
+func (c *Cached) SetExecutor(executor *Executor) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.executor = executor
+}
+
+// Queries scored with global stats aren't cached, since the stats
+// can change without the local generation changing.
+func (c *Cached) Search(q *Query, global *Stats) (*Results, os.Error) {
+	executor := c.Executor()
+
+	if global != nil {
+		return executor.Search(q, global)
+	}
+
+	key := q.Key()
+	if results, found := c.results.Get(executor.Generation(), key); found {
+		return results.(*Results), nil
+	}
+
+	results, err := executor.Search(q, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c.results.Put(executor.Generation(), key, results, results.Size())
+	return results, nil
+}
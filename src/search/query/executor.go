@@ -0,0 +1,635 @@
+package query
+
+import "container/heap"
+import "fmt"
+import "math"
+import "os"
+import match "basis/match"
+import bitset "basis/match/bitset"
+import postinglist "basis/match/postinglist"
+import numeric "basis/index/numeric"
+import segment "basis/index/segment"
+import store "basis/index/store"
+import text "basis/index/text"
+import cache "basis/search/cache"
+import collector "basis/search/collector"
+import facet "basis/search/facet"
+
+type Hit struct {
+	Segment string
+	Doc     match.DocId
+	Score   float64
+}
+
+type Results struct {
+	Hits  []Hit
+	Total int
+}
+
+// Rough size of a hit, for bounding caches
+func (r *Results) Size() uint64 {
+	size := uint64(64)
+	for _, hit := range r.Hits {
+		size += uint64(len(hit.Segment)) + 32
+	}
+
+	return size
+}
+
+// The collection-wide numbers that go into scores. A searcher over
+// part of a collection (a shard) should be given the global stats so
+// its scores are comparable with the other parts.
+type Stats struct {
+	DocCount int
+	DocFreqs map[string]int
+}
+
+func NewStats() *Stats {
+	return &Stats{0, make(map[string]int)}
+}
+
+func (s *Stats) Add(o *Stats) {
+	s.DocCount += o.DocCount
+	for term, freq := range o.DocFreqs {
+		s.DocFreqs[term] += freq
+	}
+}
+
+func (s *Stats) idf(term string) float64 {
+	return 1 + math.Log(float64(s.DocCount+1)/float64(s.DocFreqs[term]+1))
+}
+
+type Source struct {
+	Name    string
+	Segment *segment.Segment
+}
+
+// Runs queries over a fixed set of segments. When the segments change
+// the generation must too, since caches key on it.
+type Executor struct {
+	sources    []Source
+	generation uint64
+	filters    *cache.FilterCache
+}
+
+func NewExecutor(sources []Source, generation uint64, filters *cache.FilterCache) *Executor {
+	return &Executor{sources, generation, filters}
+}
+
+// An executor over a new set of segments, sharing this one's filter
+// cache. Filters cached for segments that were dropped, or replaced by
+// a different segment with the same name, are invalidated. Deletions
+// don't invalidate anything: the scorer checks them after the filters.
+func (e *Executor) Replace(sources []Source, generation uint64) *Executor {
+	current := make(map[string]*segment.Segment)
+	for _, src := range sources {
+		current[src.Name] = src.Segment
+	}
+
+	for _, src := range e.sources {
+		if current[src.Name] != src.Segment {
+			e.filters.Invalidate(src.Name)
+		}
+	}
+
+	return NewExecutor(sources, generation, e.filters)
+}
+
+func (e *Executor) Generation() uint64 {
+	return e.generation
+}
+
+func (e *Executor) Sources() []Source {
+	return e.sources
+}
+
+// The local stats for a query's terms
+func (e *Executor) Stats(q *Query) *Stats {
+	stats := NewStats()
+
+	for _, src := range e.sources {
+		stats.DocCount += src.Segment.DocCount
+
+		for _, group := range q.groups() {
+			for _, term := range group {
+				if pl, found := src.Segment.Terms.Lookup(term); found {
+					stats.DocFreqs[term] += pl.Stats().DocCount
+				}
+			}
+		}
+	}
+
+	return stats
+}
+
+// The best hits so far, with the worst on top
+type hits []Hit
+
+func (h *hits) Len() int { return len(*h) }
+func (h *hits) Less(i, j int) bool {
+	return worse((*h)[i], (*h)[j])
+}
+func (h *hits) Swap(i, j int)      { (*h)[i], (*h)[j] = (*h)[j], (*h)[i] }
+func (h *hits) Push(x interface{}) { *h = append(*h, x.(Hit)) }
+func (h *hits) Pop() (popped interface{}) {
+	last := len(*h) - 1
+	popped = (*h)[last]
+	*h = (*h)[:last]
+
+	return
+}
+
+// Lower scores are worse, then later docs (lower static rank)
+func worse(a, b Hit) bool {
+	if a.Score != b.Score {
+		return a.Score < b.Score
+	}
+
+	if a.Segment != b.Segment {
+		return a.Segment > b.Segment
+	}
+
+	return a.Doc > b.Doc
+}
+
+// An iterator used to check whether each candidate has a term. The
+// weight is the term's idf times its field's boost; group is the query
+// term or word (see groups) it came from, and field indexes the
+// scorer's per-field slices.
+type probe struct {
+	it     match.MatchIterator
+	weight float64
+	group  int
+	field  int
+}
+
+// Scores candidate docs (which arrive in ascending order) and keeps
+// the best K, or passes the docs that match on to sink if it's set
+type scorer struct {
+	segment string
+	probes  []probe
+	filters []*bitset.BitSet
+	deleted *bitset.BitSet
+
+	// Whether every group has to match, and how field scores combine
+	matchAll bool
+	combine  int
+
+	// Per group and per field, reset for each doc. Norms are only
+	// looked up once a field matches, and are -1 until then.
+	matched     []bool
+	fieldScores []float64
+	norms       []float64
+	lengths     []*store.NumericColumn
+
+	k     int
+	best  *hits
+	sink  match.MatchList
+	total int
+}
+
+// Longer fields count for less, as a match in them says less about
+// what the doc is about. Docs with no length recorded aren't scaled.
+func (s *scorer) norm(field int, doc match.DocId) float64 {
+	if s.norms[field] < 0 {
+		s.norms[field] = 1
+		if column := s.lengths[field]; column != nil {
+			if length, found := column.Get(doc); found && length > 0 {
+				s.norms[field] = 1 / math.Sqrt(float64(length))
+			}
+		}
+	}
+
+	return s.norms[field]
+}
+
+func (s *scorer) Add(doc match.DocId) os.Error {
+	for _, filter := range s.filters {
+		if !filter.Contains(doc) {
+			return nil
+		}
+	}
+
+	if s.deleted != nil && s.deleted.Contains(doc) {
+		return nil
+	}
+
+	for idx := range s.matched {
+		s.matched[idx] = false
+	}
+
+	for idx := range s.fieldScores {
+		s.fieldScores[idx] = 0
+		s.norms[idx] = -1
+	}
+
+	for _, p := range s.probes {
+		if !p.it.Finished() && p.it.Current() < doc {
+			p.it.Seek(doc)
+		}
+
+		if !p.it.Finished() && p.it.Current() == doc {
+			s.matched[p.group] = true
+			s.fieldScores[p.field] += p.weight * s.norm(p.field, doc)
+		}
+	}
+
+	if s.matchAll {
+		for _, matched := range s.matched {
+			if !matched {
+				return nil
+			}
+		}
+	}
+
+	if s.sink != nil {
+		s.total++
+		return s.sink.Add(doc)
+	}
+
+	score := 0.0
+	for _, fieldScore := range s.fieldScores {
+		if s.combine != BestField {
+			score += fieldScore
+		} else if fieldScore > score {
+			score = fieldScore
+		}
+	}
+
+	s.total++
+	hit := Hit{s.segment, doc, score}
+
+	if s.best.Len() < s.k {
+		heap.Push(s.best, hit)
+	} else if s.k > 0 && worse((*s.best)[0], hit) {
+		heap.Pop(s.best)
+		heap.Push(s.best, hit)
+	}
+
+	return nil
+}
+
+// The bitset of each of q's filters on a segment, or an error if a
+// filter's lists are corrupt
+func (e *Executor) filterBits(src Source, q *Query) ([]*bitset.BitSet, os.Error) {
+	seg := src.Segment
+	filters := []*bitset.BitSet{}
+
+	for _, r := range q.Ranges {
+		tree, found := seg.Attribute(r.Attribute)
+		if !found {
+			// Nothing can match
+			filters = append(filters, bitset.New(0))
+			continue
+		}
+
+		key := cache.FilterKey("range", map[string]string{
+			"attribute": r.Attribute,
+			"min":       fmt.Sprint(r.Min),
+			"max":       fmt.Sprint(r.Max),
+		})
+
+		lo, hi := r.Min, r.Max
+		bits, err := e.filters.Get(src.Name, key, seg.MaxId, func() []match.MatchIterator {
+			return tree.Range(lo, hi)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		filters = append(filters, bits)
+	}
+
+	for _, r := range q.Numeric {
+		key := cache.FilterKey("numeric", map[string]string{
+			"field": r.Field,
+			"min":   fmt.Sprint(r.Min),
+			"max":   fmt.Sprint(r.Max),
+		})
+
+		field, lo, hi := r.Field, r.Min, r.Max
+		bits, err := e.filters.Get(src.Name, key, seg.MaxId, func() []match.MatchIterator {
+			// The precisions a range expands to, unioned
+			iters := []match.MatchIterator{}
+			for _, token := range numeric.RangeTokens(lo, hi) {
+				if pl, found := seg.Terms.Lookup(text.FieldTerm(field, token)); found {
+					iters = append(iters, postinglist.NewIter(pl))
+				}
+			}
+
+			return iters
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		filters = append(filters, bits)
+	}
+
+	if b := q.Box; b != nil {
+		key := cache.FilterKey("box", map[string]string{
+			"box": fmt.Sprint(b.MinLat, b.MinLon, b.MaxLat, b.MaxLon),
+		})
+
+		bits, err := e.filters.Get(src.Name, key, seg.MaxId, func() []match.MatchIterator {
+			return seg.Geo.Within(b.MinLat, b.MinLon, b.MaxLat, b.MaxLon, seg.Values.Point)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		filters = append(filters, bits)
+	}
+
+	return filters, nil
+}
+
+func (e *Executor) searchSegment(src Source, q *Query, stats *Stats, best *hits, sink match.MatchList) (int, os.Error) {
+	seg := src.Segment
+	groups := q.groups()
+
+	filters, err := e.filterBits(src, q)
+	if err != nil {
+		return 0, os.NewError(fmt.Sprintf("segment %s: %s", src.Name, err))
+	}
+
+	s := &scorer{
+		src.Name, []probe{}, filters, seg.Deleted, q.Mode == MatchAll, q.Combine,
+		make([]bool, len(groups)), []float64{}, []float64{}, []*store.NumericColumn{},
+		q.K, best, sink, 0,
+	}
+
+	// Any of these that stopped at a corrupt block fails the search
+	iters := []*postinglist.PostingListIterator{}
+	candidates := []match.MatchIterator{}
+	fields := make(map[string]int)
+
+	// A group with one list can be intersected with the others;
+	// otherwise the scorer checks that every group matched
+	intersect := q.Mode == MatchAll
+
+	for idx, group := range groups {
+		found := 0
+
+		for _, term := range group {
+			pl, ok := seg.Terms.Lookup(term)
+			if !ok {
+				continue
+			}
+
+			name, _ := text.SplitFieldTerm(term)
+			field, ok := fields[name]
+			if !ok {
+				field = len(s.fieldScores)
+				fields[name] = field
+
+				s.fieldScores = append(s.fieldScores, 0)
+				s.norms = append(s.norms, -1)
+				s.lengths = append(s.lengths, seg.Values.Lengths[name])
+			}
+
+			candidate, prober := postinglist.NewIter(pl), postinglist.NewIter(pl)
+			iters = append(iters, candidate, prober)
+
+			candidates = append(candidates, candidate)
+			s.probes = append(s.probes, probe{prober, stats.idf(term) * q.boost(name), idx, field})
+			found++
+		}
+
+		if found == 0 && q.Mode == MatchAll {
+			return 0, nil
+		}
+
+		intersect = intersect && found == 1
+	}
+
+	switch {
+	case len(candidates) > 0 && intersect:
+		match.Intersection(candidates, s)
+	case len(candidates) > 0:
+		match.Merge(candidates, s)
+	case len(groups) == 0 && len(s.filters) > 0:
+		// A pure filter query
+		match.Merge([]match.MatchIterator{bitset.NewIter(s.filters[0])}, s)
+	}
+
+	for _, it := range iters {
+		if err := it.Err(); err != nil {
+			return 0, os.NewError(fmt.Sprintf("segment %s: %s", src.Name, err))
+		}
+	}
+
+	return s.total, nil
+}
+
+// Run a query over every segment. Scores use global if it's given,
+// otherwise the stats of these segments.
+func (e *Executor) Search(q *Query, global *Stats) (*Results, os.Error) {
+	if q.K < 0 {
+		return nil, os.NewError("K must not be negative")
+	}
+
+	stats := global
+	if stats == nil {
+		stats = e.Stats(q)
+	}
+
+	best := &hits{}
+	total := 0
+
+	for _, src := range e.sources {
+		n, err := e.searchSegment(src, q, stats, best, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		total += n
+	}
+
+	results := &Results{make([]Hit, best.Len()), total}
+	for idx := len(results.Hits) - 1; idx >= 0; idx-- {
+		results.Hits[idx] = heap.Pop(best).(Hit)
+	}
+
+	return results, nil
+}
+
+// Passes every match of q in the idx'th source to sink, unscored and
+// in DocId order, returning how many there were. q.K is ignored.
+func (e *Executor) Each(q *Query, idx int, sink match.MatchList) (int, os.Error) {
+	return e.searchSegment(e.sources[idx], q, NewStats(), &hits{}, sink)
+}
+
+// A hit of a sorted search, with its cursor for the page after it
+type SortedHit struct {
+	Segment string
+	Doc     match.DocId
+	Cursor  *collector.Cursor
+}
+
+type SortedResults struct {
+	Hits  []SortedHit
+	Total int
+}
+
+// The first size matches of q in the order of their doc values (see
+// collector) rather than by score, after the cursor if it's given.
+// Total counts every match, including those before the cursor. q.K is
+// ignored.
+func (e *Executor) Sorted(q *Query, fields []collector.SortField, size int, after *collector.Cursor) (*SortedResults, os.Error) {
+	if size < 0 {
+		return nil, os.NewError("size must not be negative")
+	}
+
+	pages := make([]*collector.Page, len(e.sources))
+	total := 0
+
+	for idx, src := range e.sources {
+		c, err := collector.NewSortCollector(src.Segment.Values, fields, size, src.Name, after)
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := e.searchSegment(src, q, NewStats(), &hits{}, c)
+		if err != nil {
+			return nil, err
+		}
+
+		pages[idx] = c.Page()
+		total += n
+	}
+
+	results := &SortedResults{[]SortedHit{}, total}
+	for _, m := range collector.Merge(pages, size) {
+		results.Hits = append(results.Hits, SortedHit{e.sources[m.Page].Name, m.Key.Doc, m.Cursor})
+	}
+
+	return results, nil
+}
+
+// A facet to count over a query's matches. Without Ranges it counts
+// each value of Field's doc values (sorted-string or numeric); with
+// them, how many of Field's numeric values fall in each range. With
+// MultiSelect, the query's own filters on Field are left out while it's
+// counted (see facet.MultiSelect), so the values they exclude still
+// show how many results picking them would add.
+type FacetRequest struct {
+	Field       string
+	Ranges      []facet.Range
+	MultiSelect bool
+}
+
+// The facet counting r over values, or nil if there are no values
+// for it
+func newFacet(values *store.DocValues, r FacetRequest) facet.Facet {
+	if len(r.Ranges) > 0 {
+		if c, found := values.Numeric[r.Field]; found {
+			return facet.NewRangeFacet(c, r.Ranges)
+		}
+	} else if c, found := values.Sorted[r.Field]; found {
+		return facet.NewTermsFacet(c)
+	} else if c, found := values.Numeric[r.Field]; found {
+		return facet.NewValuesFacet(c)
+	}
+
+	return nil
+}
+
+// The counts of each requested facet among q's matches, by field: the
+// n most common values, or every range in order. q.K is ignored.
+func (e *Executor) Facets(q *Query, requests []FacetRequest, n int) (map[string][]facet.Count, os.Error) {
+	// Facets counted over the same query are counted together
+	queries := []*Query{q}
+	grouped := [][]FacetRequest{[]FacetRequest{}}
+	faceted := make(map[string]bool)
+
+	for _, r := range requests {
+		if faceted[r.Field] {
+			return nil, os.NewError(fmt.Sprintf("%s is faceted twice", r.Field))
+		}
+		faceted[r.Field] = true
+
+		idx := 0
+		if r.MultiSelect {
+			if unfiltered, dropped := q.without(r.Field); dropped {
+				queries = append(queries, unfiltered)
+				grouped = append(grouped, []FacetRequest{})
+				idx = len(queries) - 1
+			}
+		}
+
+		grouped[idx] = append(grouped[idx], r)
+	}
+
+	counts := make(map[string][][]facet.Count)
+	for _, src := range e.sources {
+		for idx, fq := range queries {
+			if err := e.countFacets(src, fq, grouped[idx], counts); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	results := make(map[string][]facet.Count)
+	for _, r := range requests {
+		if len(r.Ranges) > 0 {
+			results[r.Field] = facet.SumRanges(r.Ranges, counts[r.Field])
+		} else {
+			results[r.Field] = facet.Sum(counts[r.Field], n)
+		}
+	}
+
+	return results, nil
+}
+
+// Count requests over a segment's matches of q, adding to counts
+func (e *Executor) countFacets(src Source, q *Query, requests []FacetRequest, counts map[string][][]facet.Count) os.Error {
+	facets := make(map[string]facet.Facet)
+	chain := facet.Chain{}
+
+	for _, r := range requests {
+		if f := newFacet(src.Segment.Values, r); f != nil {
+			facets[r.Field] = f
+			chain = append(chain, f)
+		}
+	}
+
+	if len(chain) == 0 {
+		return nil
+	}
+
+	if len(q.groups()) == 0 && len(q.Ranges) == 0 && len(q.Numeric) == 0 && q.Box == nil {
+		// Nothing left to match on, as when a filter query's only
+		// filters are left out, so every doc counts
+		seg := src.Segment
+		for doc := match.DocId(0); seg.DocCount > 0 && doc <= seg.MaxId; doc++ {
+			if !seg.IsDeleted(doc) {
+				chain.Add(doc)
+			}
+		}
+	} else if _, err := e.searchSegment(src, q, NewStats(), &hits{}, chain); err != nil {
+		return err
+	}
+
+	// All of them, since a value's total is over every segment
+	for field, f := range facets {
+		if ranges, ok := f.(*facet.RangeFacet); ok {
+			counts[field] = append(counts[field], ranges.Counts())
+		} else {
+			counts[field] = append(counts[field], f.Top(math.MaxInt32))
+		}
+	}
+
+	return nil
+}
+
+// The stored fields of a hit
+func (e *Executor) Document(hit Hit) (map[string]string, os.Error) {
+	for _, src := range e.sources {
+		if src.Name == hit.Segment {
+			return src.Segment.Document(hit.Doc)
+		}
+	}
+
+	return nil, os.NewError("no segment named " + hit.Segment)
+}
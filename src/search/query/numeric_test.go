@@ -0,0 +1,138 @@
+package query
+
+import "os"
+import "rand"
+import "testing"
+import match "basis/match"
+import bitset "basis/match/bitset"
+import postinglist "basis/match/postinglist"
+import builder "basis/index/builder"
+import numeric "basis/index/numeric"
+import segment "basis/index/segment"
+import text "basis/index/text"
+import cache "basis/search/cache"
+
+// Every doc has a price (an int, also kept as a doc value to scan) and
+// a weight (a float)
+func numericSegment(count int, prices func(int) int64) (*segment.Segment, os.Error) {
+	b := builder.New(builder.DefaultOptions)
+
+	for i := 0; i < count; i++ {
+		price := prices(i)
+		doc := &builder.Document{
+			Id:         match.DocId(i),
+			Attributes: map[string]int64{"price": price},
+			Numbers:    map[string]uint64{"price": numeric.Int(price), "weight": numeric.Float(float64(price) / 8)},
+		}
+
+		if err := b.Add(doc); err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Finish()
+}
+
+func spread(i int) int64 {
+	return int64(i*7919%2001 - 1000)
+}
+
+func TestNumeric(t *testing.T) {
+	seg, err := numericSegment(2000, spread)
+	if err != nil {
+		t.Fatalf("numericSegment() = %s", err)
+	}
+
+	e := NewExecutor([]Source{Source{"a", seg}}, 1, cache.NewFilterCache(1<<20))
+
+	bounds := [][2]int64{{-1000, 1000}, {-5, 5}, {0, 0}, {17, 255}, {-300, -200}, {999, 5000}, {3, 2}}
+	for _, b := range bounds {
+		want := 0
+		for i := 0; i < 2000; i++ {
+			if price := spread(i); price >= b[0] && price <= b[1] {
+				want++
+			}
+		}
+
+		ints := []NumericRange{NumericRange{"price", numeric.Int(b[0]), numeric.Int(b[1])}}
+		floats := []NumericRange{NumericRange{"weight", numeric.Float(float64(b[0]) / 8), numeric.Float(float64(b[1]) / 8)}}
+
+		for _, filter := range [][]NumericRange{ints, floats} {
+			q := &Query{nil, MatchAll, nil, nil, nil, SumFields, nil, filter, nil, 0}
+
+			results, err := e.Search(q, nil)
+			if err != nil {
+				t.Fatalf("Search() = %s", err)
+			}
+
+			if results.Total != want {
+				t.Errorf("%s in [%d, %d] matched %d docs, want %d", filter[0].Field, b[0], b[1], results.Total, want)
+			}
+		}
+	}
+}
+
+var benchSegment *segment.Segment
+
+const benchDocs = 100000
+
+func benchRanges(b *testing.B) (*segment.Segment, [][2]int64) {
+	if benchSegment == nil {
+		seg, err := numericSegment(benchDocs, func(int) int64 {
+			return rand.Int63n(2000000) - 1000000
+		})
+		if err != nil {
+			b.Fatalf("numericSegment() = %s", err)
+		}
+
+		benchSegment = seg
+	}
+
+	// A tenth of the values each
+	ranges := make([][2]int64, 100)
+	for idx := range ranges {
+		min := rand.Int63n(1800000) - 1000000
+		ranges[idx] = [2]int64{min, min + 200000}
+	}
+
+	return benchSegment, ranges
+}
+
+// Union the posting lists a range expands to
+func BenchmarkNumericRange(b *testing.B) {
+	b.StopTimer()
+	seg, ranges := benchRanges(b)
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		r := ranges[i%len(ranges)]
+		iters := []match.MatchIterator{}
+
+		for _, token := range numeric.RangeTokens(numeric.Int(r[0]), numeric.Int(r[1])) {
+			if pl, found := seg.Terms.Lookup(text.FieldTerm("price", token)); found {
+				iters = append(iters, postinglist.NewIter(pl))
+			}
+		}
+
+		match.Merge(iters, bitset.New(benchDocs))
+	}
+}
+
+// Check every doc's value
+func BenchmarkNumericScan(b *testing.B) {
+	b.StopTimer()
+	seg, ranges := benchRanges(b)
+	column := seg.Values.Numeric["price"]
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		r := ranges[i%len(ranges)]
+		bits := bitset.New(benchDocs)
+
+		for idx, value := range column.Values {
+			if value >= r[0] && value <= r[1] {
+				bits.Add(column.Docs[idx])
+			}
+		}
+	}
+}
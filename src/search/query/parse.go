@@ -0,0 +1,67 @@
+package query
+
+import "os"
+import "strings"
+import analysis "basis/index/analysis"
+import text "basis/index/text"
+
+// Splits a query string into words, each of which is either field:text
+// or bare text. The text is split into tokens by a, which should be
+// the analyzer the fields were indexed with. Calls visit with each
+// token, and its field ("" for bare text).
+func split(q string, a analysis.Analyzer, visit func(field, token string)) os.Error {
+	for _, word := range strings.Fields(q) {
+		field := ""
+		if idx := strings.Index(word, ":"); idx > 0 {
+			field, word = word[:idx], word[idx+1:]
+		}
+
+		tokens, err := analysis.Terms(a, word)
+		if err != nil {
+			return err
+		}
+
+		for _, token := range tokens {
+			visit(field, token)
+		}
+	}
+
+	return nil
+}
+
+// Turns a query string into field qualified terms. Words are separated
+// by spaces, and each is either field:text or bare text, which searches
+// defaultField.
+func Parse(q, defaultField string, a analysis.Analyzer) ([]string, os.Error) {
+	terms := []string{}
+
+	err := split(q, a, func(field, token string) {
+		if field == "" {
+			field = defaultField
+		}
+
+		terms = append(terms, text.FieldTerm(field, token))
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return terms, nil
+}
+
+// Like Parse, but the tokens of bare text are returned as words, for a
+// query over several fields (see Query.Words)
+func ParseWords(q string, a analysis.Analyzer) (terms, words []string, err os.Error) {
+	terms, words = []string{}, []string{}
+
+	err = split(q, a, func(field, token string) {
+		if field == "" {
+			words = append(words, token)
+		} else {
+			terms = append(terms, text.FieldTerm(field, token))
+		}
+	})
+
+	return
+}
@@ -0,0 +1,180 @@
+package query
+
+import "fmt"
+import "sort"
+import "strings"
+import text "basis/index/text"
+
+// How the terms of a query combine
+const (
+	MatchAll = iota
+	MatchAny
+)
+
+// How a doc's scores in each field combine
+const (
+	SumFields = iota
+	BestField
+)
+
+// Docs with an attribute in [Min, Max]
+type Range struct {
+	Attribute string
+	Min, Max  int64
+}
+
+// Docs with a numeric field (see numeric) in [Min, Max], which are
+// encoded values
+type NumericRange struct {
+	Field    string
+	Min, Max uint64
+}
+
+type Box struct {
+	MinLat, MinLon, MaxLat, MaxLon float64
+}
+
+type Query struct {
+	// Field qualified terms (see text.FieldTerm)
+	Terms []string
+	Mode  int
+
+	// Words to look for in every one of Fields. A word counts as one
+	// term for Mode, which a doc matches if any of the fields has it.
+	Words  []string
+	Fields []string
+
+	// Scales the scores of terms in a field (1 if it's missing)
+	Boosts map[string]float64
+	// SumFields adds up a doc's scores in each field, BestField takes
+	// the highest
+	Combine int
+
+	// Filters every result must pass. They don't affect scores.
+	Ranges  []Range
+	Numeric []NumericRange
+	Box     *Box
+
+	// How many hits to return
+	K int
+}
+
+type ranges []Range
+
+func (r ranges) Len() int { return len(r) }
+func (r ranges) Less(i, j int) bool {
+	if r[i].Attribute != r[j].Attribute {
+		return r[i].Attribute < r[j].Attribute
+	}
+
+	if r[i].Min != r[j].Min {
+		return r[i].Min < r[j].Min
+	}
+
+	return r[i].Max < r[j].Max
+}
+func (r ranges) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+
+// A copy of q without its filters on field (Ranges on the attribute
+// and Numeric ranges on the field), and whether it had any
+func (q *Query) without(field string) (*Query, bool) {
+	copied := *q
+	copied.Ranges, copied.Numeric = []Range{}, []NumericRange{}
+
+	for _, r := range q.Ranges {
+		if r.Attribute != field {
+			copied.Ranges = append(copied.Ranges, r)
+		}
+	}
+
+	for _, r := range q.Numeric {
+		if r.Field != field {
+			copied.Numeric = append(copied.Numeric, r)
+		}
+	}
+
+	return &copied, len(copied.Ranges) != len(q.Ranges) || len(copied.Numeric) != len(q.Numeric)
+}
+
+func sorted(strs []string) []string {
+	copied := make([]string, len(strs))
+	copy(copied, strs)
+	sort.SortStrings(copied)
+
+	return copied
+}
+
+// The terms that can match each of the query's words and terms
+func (q *Query) groups() [][]string {
+	groups := [][]string{}
+	for _, term := range q.Terms {
+		groups = append(groups, []string{term})
+	}
+
+	for _, word := range q.Words {
+		group := []string{}
+		for _, field := range q.Fields {
+			group = append(group, text.FieldTerm(field, word))
+		}
+
+		groups = append(groups, group)
+	}
+
+	return groups
+}
+
+func (q *Query) boost(field string) float64 {
+	if boost, found := q.Boosts[field]; found {
+		return boost
+	}
+
+	return 1
+}
+
+// A normalized form of the query, the same for queries that only
+// differ in the order of their terms or filters
+func (q *Query) Key() string {
+	terms := sorted(q.Terms)
+
+	filters := make(ranges, len(q.Ranges))
+	copy(filters, q.Ranges)
+	sort.Sort(filters)
+
+	parts := []string{fmt.Sprintf("mode=%d combine=%d k=%d", q.Mode, q.Combine, q.K)}
+	for _, term := range terms {
+		parts = append(parts, fmt.Sprintf("term=%q", term))
+	}
+
+	for _, word := range sorted(q.Words) {
+		parts = append(parts, fmt.Sprintf("word=%q", word))
+	}
+
+	for _, field := range sorted(q.Fields) {
+		parts = append(parts, fmt.Sprintf("field=%q", field))
+	}
+
+	boosted := []string{}
+	for field := range q.Boosts {
+		boosted = append(boosted, field)
+	}
+
+	for _, field := range sorted(boosted) {
+		parts = append(parts, fmt.Sprintf("boost=%q:%g", field, q.Boosts[field]))
+	}
+
+	for _, r := range filters {
+		parts = append(parts, fmt.Sprintf("range=%q:%d:%d", r.Attribute, r.Min, r.Max))
+	}
+
+	numeric := []string{}
+	for _, r := range q.Numeric {
+		numeric = append(numeric, fmt.Sprintf("numeric=%q:%d:%d", r.Field, r.Min, r.Max))
+	}
+	parts = append(parts, sorted(numeric)...)
+
+	if q.Box != nil {
+		parts = append(parts, fmt.Sprintf("box=%g:%g:%g:%g", q.Box.MinLat, q.Box.MinLon, q.Box.MaxLat, q.Box.MaxLon))
+	}
+
+	return strings.Join(parts, " ")
+}
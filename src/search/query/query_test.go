@@ -0,0 +1,401 @@
+package query
+
+import "fmt"
+import "strings"
+import "testing"
+import match "basis/match"
+import analysis "basis/index/analysis"
+import builder "basis/index/builder"
+import segment "basis/index/segment"
+import cache "basis/search/cache"
+import collector "basis/search/collector"
+import facet "basis/search/facet"
+
+func testSegment(t *testing.T) *segment.Segment {
+	b := builder.New(builder.DefaultOptions)
+
+	for i := 0; i < 100; i++ {
+		tokens := []string{"all"}
+		if i%2 == 0 {
+			tokens = append(tokens, "even")
+		}
+
+		if i%10 == 0 {
+			tokens = append(tokens, "tens")
+		}
+
+		doc := &builder.Document{
+			Id:         match.DocId(i),
+			Fields:     map[string][]string{"body": tokens},
+			Attributes: map[string]int64{"price": int64(i)},
+		}
+
+		if err := b.Add(doc); err != nil {
+			t.Fatalf("Add(%d) = %s", i, err)
+		}
+	}
+
+	seg, err := b.Finish()
+	if err != nil {
+		t.Fatalf("Finish() = %s", err)
+	}
+
+	return seg
+}
+
+func testExecutor(t *testing.T, generation uint64) *Executor {
+	sources := []Source{Source{"a", testSegment(t)}}
+	return NewExecutor(sources, generation, cache.NewFilterCache(1<<20))
+}
+
+func TestSearch(t *testing.T) {
+	e := testExecutor(t, 1)
+
+	q := &Query{[]string{"body:even", "body:tens"}, MatchAny, nil, nil, nil, SumFields, []Range{Range{"price", 0, 49}}, nil, nil, 3}
+	results, err := e.Search(q, nil)
+	if err != nil {
+		t.Fatalf("Search() = %s", err)
+	}
+
+	// Docs matching both terms score highest
+	if results.Total != 25 || len(results.Hits) != 3 {
+		t.Fatalf("Search() found %d (%d hits), want 25 (3 hits)", results.Total, len(results.Hits))
+	}
+
+	for idx, doc := range []match.DocId{0, 10, 20} {
+		if results.Hits[idx].Doc != doc {
+			t.Errorf("hit %d = %d, want %d", idx, results.Hits[idx].Doc, doc)
+		}
+	}
+
+	q = &Query{[]string{"body:even", "body:tens"}, MatchAll, nil, nil, nil, SumFields, nil, nil, nil, 100}
+	if results, _ = e.Search(q, nil); results.Total != 10 {
+		t.Errorf("Search(all) found %d, want 10", results.Total)
+	}
+}
+
+func TestKey(t *testing.T) {
+	a := &Query{[]string{"b", "a"}, MatchAll, nil, nil, nil, SumFields, []Range{Range{"y", 0, 1}, Range{"x", 0, 1}}, nil, nil, 10}
+	b := &Query{[]string{"a", "b"}, MatchAll, nil, nil, nil, SumFields, []Range{Range{"x", 0, 1}, Range{"y", 0, 1}}, nil, nil, 10}
+
+	if a.Key() != b.Key() {
+		t.Errorf("Key() depends on order: %q != %q", a.Key(), b.Key())
+	}
+}
+
+func TestCached(t *testing.T) {
+	results := cache.NewResultCache(1<<20, 0)
+	c := NewCached(testExecutor(t, 1), results)
+	q := &Query{[]string{"body:tens"}, MatchAll, nil, nil, nil, SumFields, nil, nil, nil, 10}
+
+	c.Search(q, nil)
+	c.Search(q, nil)
+
+	if stats := results.Stats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("Stats() = %+v, want 1 hit and 1 miss", stats)
+	}
+
+	c.SetExecutor(testExecutor(t, 2))
+	c.Search(q, nil)
+
+	if stats := results.Stats(); stats.Misses != 2 || stats.Entries != 1 {
+		t.Errorf("Stats() = %+v, want a miss after the generation changed", stats)
+	}
+}
+
+func TestParse(t *testing.T) {
+	terms, err := Parse("Red-Shoes title:Sale! tag:", "body", analysis.Default)
+	if err != nil {
+		t.Fatalf("Parse() = %s", err)
+	}
+
+	if got := strings.Join(terms, " "); got != "body:red body:shoes title:sale" {
+		t.Errorf("Parse() = %s", got)
+	}
+}
+
+func multiFieldExecutor(t *testing.T) *Executor {
+	b := builder.New(builder.DefaultOptions)
+
+	docs := []map[string]string{
+		{"title": "red shoes", "body": "comfortable running shoes"},
+		{"title": "blue hat", "body": "a red hat with a blue band, to go with red shoes"},
+		{"title": "red", "body": "shoes"},
+		{"title": "green scarf", "body": "warm"},
+	}
+
+	for idx, text := range docs {
+		if err := b.Add(&builder.Document{Id: match.DocId(idx), Text: text}); err != nil {
+			t.Fatalf("Add(%d) = %s", idx, err)
+		}
+	}
+
+	seg, err := b.Finish()
+	if err != nil {
+		t.Fatalf("Finish() = %s", err)
+	}
+
+	return NewExecutor([]Source{Source{"a", seg}}, 1, cache.NewFilterCache(1<<20))
+}
+
+func docs(results *Results) []match.DocId {
+	found := []match.DocId{}
+	for _, hit := range results.Hits {
+		found = append(found, hit.Doc)
+	}
+
+	return found
+}
+
+func TestMultiField(t *testing.T) {
+	e := multiFieldExecutor(t)
+
+	// Every word has to be in one of the fields, not all in the same
+	// one. Doc 2 has red only in its title and shoes only in its body.
+	q := &Query{nil, MatchAll, []string{"red", "shoes"}, []string{"title", "body"}, nil, SumFields, nil, nil, nil, 10}
+	results, err := e.Search(q, nil)
+	if err != nil {
+		t.Fatalf("Search() = %s", err)
+	}
+
+	if results.Total != 3 {
+		t.Fatalf("Search() found %v, want docs 0, 1 and 2", docs(results))
+	}
+
+	// Doc 1 mentions both words, but in a long body, so the short
+	// fields of doc 2 win
+	if found := docs(results); found[2] != 1 {
+		t.Errorf("Search() = %v, want doc 1 last", found)
+	}
+
+	sum := results.Hits[0].Score
+	q.Combine = BestField
+	if results, err = e.Search(q, nil); err != nil {
+		t.Fatalf("Search() = %s", err)
+	}
+
+	if best := results.Hits[0].Score; best >= sum {
+		t.Errorf("the best field scored %g, want less than the sum of fields (%g)", best, sum)
+	}
+
+	// Boosting the body puts doc 1's body above the others' titles
+	q = &Query{nil, MatchAny, []string{"blue"}, []string{"title", "body"}, map[string]float64{"body": 10}, BestField, nil, nil, nil, 10}
+	if results, err = e.Search(q, nil); err != nil {
+		t.Fatalf("Search() = %s", err)
+	}
+
+	if found := docs(results); len(found) != 1 || found[0] != 1 {
+		t.Errorf("Search() = %v, want doc 1", found)
+	}
+
+	plain := &Query{[]string{"title:red"}, MatchAll, nil, nil, nil, SumFields, nil, nil, nil, 10}
+	boosted := &Query{[]string{"title:red"}, MatchAll, nil, nil, map[string]float64{"title": 2}, SumFields, nil, nil, nil, 10}
+
+	a, _ := e.Search(plain, nil)
+	b, _ := e.Search(boosted, nil)
+	if a.Total != 2 || b.Total != 2 || b.Hits[0].Score != 2*a.Hits[0].Score {
+		t.Errorf("boosting doubled %g to %g", a.Hits[0].Score, b.Hits[0].Score)
+	}
+
+	if plain.Key() == boosted.Key() {
+		t.Errorf("Key() ignores boosts")
+	}
+}
+
+func TestReplace(t *testing.T) {
+	e := testExecutor(t, 1)
+	q := &Query{nil, MatchAll, nil, nil, nil, SumFields, []Range{Range{"price", 0, 9}}, nil, nil, 100}
+
+	search := func(want int) {
+		results, err := e.Search(q, nil)
+		if err != nil {
+			t.Fatalf("Search() = %s", err)
+		}
+
+		if results.Total != want {
+			t.Errorf("generation %d: Total = %d, want %d", e.Generation(), results.Total, want)
+		}
+	}
+
+	search(10)
+
+	// The same segment keeps its filters
+	e = e.Replace(e.Sources(), 2)
+	if stats := e.filters.Stats(); stats.Entries != 1 {
+		t.Errorf("Stats() = %+v, want the filter kept", stats)
+	}
+
+	search(10)
+
+	// A new segment under the same name doesn't get them
+	seg, err := numericSegment(5, func(i int) int64 { return int64(i) })
+	if err != nil {
+		t.Fatalf("numericSegment() = %s", err)
+	}
+
+	e = e.Replace([]Source{Source{"a", seg}}, 3)
+	if stats := e.filters.Stats(); stats.Entries != 0 {
+		t.Errorf("Stats() = %+v, want the filter invalidated", stats)
+	}
+
+	search(5)
+}
+
+func TestSorted(t *testing.T) {
+	seg, err := numericSegment(5, func(i int) int64 { return int64(i * 100) })
+	if err != nil {
+		t.Fatalf("numericSegment() = %s", err)
+	}
+
+	e := NewExecutor([]Source{Source{"a", testSegment(t)}, Source{"b", seg}}, 1, cache.NewFilterCache(1<<20))
+	fields := []collector.SortField{collector.SortField{"price", true, collector.MissingLast}}
+
+	tests := []struct {
+		q     *Query
+		total int
+		want  string
+	}{
+		{&Query{nil, MatchAll, nil, nil, nil, SumFields, []Range{Range{"price", 0, 1000}}, nil, nil, 0}, 105, "b/4 b/3 b/2 b/1 a/99 "},
+		{&Query{[]string{"body:tens"}, MatchAll, nil, nil, nil, SumFields, nil, nil, nil, 0}, 10, "a/90 a/80 a/70 a/60 a/50 "},
+	}
+
+	for _, test := range tests {
+		results, err := e.Sorted(test.q, fields, 5, nil)
+		if err != nil {
+			t.Fatalf("Sorted() = %s", err)
+		}
+
+		got := ""
+		for _, hit := range results.Hits {
+			got += fmt.Sprintf("%s/%d ", hit.Segment, hit.Doc)
+		}
+
+		if got != test.want || results.Total != test.total {
+			t.Errorf("Sorted(%v) = %s of %d, want %s of %d", test.q.Terms, got, results.Total, test.want, test.total)
+		}
+	}
+}
+
+func TestSortedPages(t *testing.T) {
+	seg, err := numericSegment(5, func(i int) int64 { return int64(i * 10) })
+	if err != nil {
+		t.Fatalf("numericSegment() = %s", err)
+	}
+
+	e := NewExecutor([]Source{Source{"a", testSegment(t)}, Source{"b", seg}}, 1, cache.NewFilterCache(1<<20))
+	fields := []collector.SortField{collector.SortField{"price", false, collector.MissingLast}}
+	q := &Query{nil, MatchAll, nil, nil, nil, SumFields, []Range{Range{"price", 0, 1000}}, nil, nil, 0}
+
+	all, err := e.Sorted(q, fields, 200, nil)
+	if err != nil {
+		t.Fatalf("Sorted() = %s", err)
+	}
+
+	want := ""
+	for _, hit := range all.Hits {
+		want += fmt.Sprintf("%s/%d ", hit.Segment, hit.Doc)
+	}
+
+	// Pages of 7 across both segments, with prices 0 to 40 in each
+	got := ""
+	var after *collector.Cursor
+	for pages := 0; pages < 20; pages++ {
+		results, err := e.Sorted(q, fields, 7, after)
+		if err != nil {
+			t.Fatalf("Sorted() = %s", err)
+		}
+
+		if len(results.Hits) == 0 {
+			break
+		}
+
+		for _, hit := range results.Hits {
+			got += fmt.Sprintf("%s/%d ", hit.Segment, hit.Doc)
+		}
+
+		after = results.Hits[len(results.Hits)-1].Cursor
+	}
+
+	if len(all.Hits) != 105 || got != want {
+		t.Errorf("paged Sorted() = %s, want %s", got, want)
+	}
+}
+
+func TestFacets(t *testing.T) {
+	seg, err := numericSegment(5, func(i int) int64 { return int64(i * 10) })
+	if err != nil {
+		t.Fatalf("numericSegment() = %s", err)
+	}
+
+	e := NewExecutor([]Source{Source{"a", testSegment(t)}, Source{"b", seg}}, 1, cache.NewFilterCache(1<<20))
+	q := &Query{nil, MatchAll, nil, nil, nil, SumFields, []Range{Range{"price", 0, 20}}, nil, nil, 0}
+
+	facets, err := e.Facets(q, []FacetRequest{FacetRequest{"price", nil, false}, FacetRequest{"unknown", nil, false}}, 4)
+	if err != nil {
+		t.Fatalf("Facets() = %s", err)
+	}
+
+	// Prices 0, 10 and 20 are in both segments
+	if got := fmt.Sprint(facets["price"]); got != "[{0 2} {10 2} {20 2} {1 1}]" {
+		t.Errorf("price facet = %s, want [{0 2} {10 2} {20 2} {1 1}]", got)
+	}
+
+	if got := facets["unknown"]; len(got) != 0 {
+		t.Errorf("unknown facet = %v, want no counts", got)
+	}
+
+	if _, err = e.Facets(q, []FacetRequest{FacetRequest{"price", nil, false}, FacetRequest{"price", nil, true}}, 4); err == nil {
+		t.Errorf("Facets() of price twice = nil, want an error")
+	}
+}
+
+func TestRangeFacets(t *testing.T) {
+	seg, err := numericSegment(5, func(i int) int64 { return int64(i * 10) })
+	if err != nil {
+		t.Fatalf("numericSegment() = %s", err)
+	}
+
+	// Prices 0-99 and 0-40 by tens
+	e := NewExecutor([]Source{Source{"a", testSegment(t)}, Source{"b", seg}}, 1, cache.NewFilterCache(1<<20))
+	ranges := []facet.Range{facet.Range{"high", 10, 1000}, facet.Range{"low", 0, 10}, facet.Range{"none", 1000, 2000}}
+
+	q := &Query{[]string{"body:even"}, MatchAll, nil, nil, nil, SumFields, []Range{Range{"price", 0, 20}}, nil, nil, 0}
+
+	tests := []struct {
+		multiSelect bool
+		want        string
+	}{
+		// Even prices in [0, 20] in a, and none in b, which has no body
+		{false, "[{high 6} {low 5} {none 0}]"},
+		// With the price filter left out, every even price in a
+		{true, "[{high 45} {low 5} {none 0}]"},
+	}
+
+	for _, test := range tests {
+		facets, err := e.Facets(q, []FacetRequest{FacetRequest{"price", ranges, test.multiSelect}}, 1)
+		if err != nil {
+			t.Fatalf("Facets() = %s", err)
+		}
+
+		if got := fmt.Sprint(facets["price"]); got != test.want {
+			t.Errorf("multi-select %v: price facet = %s, want %s", test.multiSelect, got, test.want)
+		}
+	}
+
+	// A filter query counts every doc once its only filter is left out
+	q = &Query{nil, MatchAll, nil, nil, nil, SumFields, []Range{Range{"price", 0, 20}}, nil, nil, 0}
+	requests := []FacetRequest{FacetRequest{"price", ranges, true}, FacetRequest{"unknown", ranges, true}}
+
+	facets, err := e.Facets(q, requests, 1)
+	if err != nil {
+		t.Fatalf("Facets() = %s", err)
+	}
+
+	if got := fmt.Sprint(facets["price"]); got != "[{high 94} {low 11} {none 0}]" {
+		t.Errorf("price facet of every doc = %s, want [{high 94} {low 11} {none 0}]", got)
+	}
+
+	if got := fmt.Sprint(facets["unknown"]); got != "[{high 0} {low 0} {none 0}]" {
+		t.Errorf("unknown facet = %s, want every range empty", got)
+	}
+}
@@ -93,3 +93,37 @@ func Read(src []byte) (bytesRead uint, value VarInt) {
 
 	panic("Can't get here")
 }
+
+var ErrTruncated = os.NewError("varint runs past the end of its input")
+var ErrOverflow = os.NewError("varint is too long for 64 bits")
+
+// Like Read, but returns an error for input that isn't a whole varint
+// instead of panicking
+func ReadChecked(src []byte) (bytesRead uint, value VarInt, err os.Error) {
+	if len(src) == 0 {
+		return 0, 0, ErrTruncated
+	}
+
+	value = VarInt(src[0] & 0x3F)
+
+	if src[0]&0x40 == 0x40 {
+		return 1, value, nil
+	}
+
+	shift := uint(6)
+	for position := 1; position < len(src); position++ {
+		if shift >= 64 {
+			return 0, 0, ErrOverflow
+		}
+
+		value += (VarInt(src[position]&0x7F) << shift)
+
+		if src[position]&0x80 == 0x80 {
+			return uint(position + 1), value, nil
+		}
+
+		shift += 7
+	}
+
+	return 0, 0, ErrTruncated
+}
@@ -144,3 +144,29 @@ func BenchmarkEnd(b *testing.B) {
 		Read(buffers[idx % 10000])
 	}
 }
+
+func TestReadChecked(t *testing.T) {
+	for _, dt := range encodeTests {
+		n, v, err := ReadChecked(dt.out)
+		if err != nil || n != uint(len(dt.out)) || v != dt.in {
+			t.Errorf("ReadChecked(%v) = %d, %d, %v, want %d, %d", dt.out, n, v, err, len(dt.out), dt.in)
+		}
+
+		if len(dt.out) == 1 {
+			continue
+		}
+
+		if _, _, err = ReadChecked(dt.out[:len(dt.out)-1]); err != ErrTruncated {
+			t.Errorf("ReadChecked(%v) = %v, want ErrTruncated", dt.out[:len(dt.out)-1], err)
+		}
+	}
+
+	if _, _, err := ReadChecked([]byte{}); err != ErrTruncated {
+		t.Errorf("ReadChecked([]) = %v, want ErrTruncated", err)
+	}
+
+	long := make([]byte, 12)
+	if _, _, err := ReadChecked(append(long, 0x80)); err != ErrOverflow {
+		t.Errorf("ReadChecked(13 bytes) = %v, want ErrOverflow", err)
+	}
+}